@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/soulgarden/logfowd/conf"
+)
+
+const defaultAdminAddr = "http://127.0.0.1:8080"
+
+// adminAddr returns base url of the admin server of the local agent, taken from config when not set explicitly.
+func adminAddr(addr string) string {
+	if addr != "" {
+		return strings.TrimRight(addr, "/")
+	}
+
+	cfg, err := conf.New()
+	if err != nil || cfg.Admin.Listen == "" {
+		return defaultAdminAddr
+	}
+
+	if strings.HasPrefix(cfg.Admin.Listen, ":") {
+		return "http://127.0.0.1" + cfg.Admin.Listen
+	}
+
+	return "http://" + cfg.Admin.Listen
+}
+
+// adminToken returns the bearer token of the admin server, taken from config when not set explicitly.
+func adminToken(token string) string {
+	if token != "" {
+		return token
+	}
+
+	cfg, err := conf.New()
+	if err != nil {
+		return ""
+	}
+
+	return cfg.Admin.Token
+}
@@ -16,6 +16,10 @@ var rootCmd = &cobra.Command{
 
 func Execute() {
 	rootCmd.AddCommand(newWorker())
+	rootCmd.AddCommand(newStatus())
+	rootCmd.AddCommand(newTap())
+	rootCmd.AddCommand(newValidate())
+	rootCmd.AddCommand(newTest())
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Err(err).Msg("Command execution failed")
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"github.com/spf13/cobra"
+	"github.com/valyala/fasthttp"
+)
+
+func newStatus() *cobra.Command {
+	var addr, token, namespace, pod string
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "List files tracked by the running agent",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			query := url.Values{}
+			query.Set("namespace", namespace)
+			query.Set("pod", pod)
+
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseResponse(resp)
+
+			req.SetRequestURI(adminAddr(addr) + "/files?" + query.Encode())
+
+			if token := adminToken(token); token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			if err := fasthttp.DoTimeout(req, resp, dictionary.RequestTimeout); err != nil {
+				return err
+			}
+
+			body := resp.Body()
+
+			if resp.StatusCode() != fasthttp.StatusOK {
+				return fmt.Errorf("%w: %d %s", dictionary.ErrBadStatusCode, resp.StatusCode(), body)
+			}
+
+			statuses := entity.FileStatuses{}
+
+			if err := easyjson.Unmarshal(body, &statuses); err != nil {
+				return err
+			}
+
+			return printStatuses(statuses)
+		},
+	}
+
+	cmd.Flags().StringVar(&addr, "addr", "", "admin server url, taken from config by default")
+	cmd.Flags().StringVar(&token, "token", "", "admin token, taken from config by default")
+	cmd.Flags().StringVarP(&namespace, "namespace", "n", "", "filter by namespace")
+	cmd.Flags().StringVarP(&pod, "pod", "p", "", "filter by pod name")
+
+	return cmd
+}
+
+func printStatuses(statuses entity.FileStatuses) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "PATH\tINODE\tNAMESPACE\tPOD\tCONTAINER\tOFFSET\tSIZE\tBEHIND\tLAST READ")
+
+	for _, s := range statuses {
+		readAt := "-"
+		if !s.ReadAt.IsZero() {
+			readAt = s.ReadAt.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(
+			w,
+			"%s\t%d\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n",
+			s.Path,
+			s.Inode,
+			s.Namespace,
+			s.PodName,
+			s.ContainerName,
+			s.Offset,
+			s.Size,
+			s.BytesBehind,
+			readAt,
+		)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/spf13/cobra"
+)
+
+func newTap() *cobra.Command {
+	var addr, token, namespace, pod, container string
+
+	cmd := &cobra.Command{
+		Use:   "tap",
+		Short: "Stream processed documents from the running agent",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			query := url.Values{}
+			query.Set("namespace", namespace)
+			query.Set("pod", pod)
+			query.Set("container", container)
+
+			req, err := http.NewRequestWithContext(
+				cmd.Context(),
+				http.MethodGet,
+				adminAddr(addr)+"/tap?"+query.Encode(),
+				nil,
+			)
+			if err != nil {
+				return err
+			}
+
+			if token := adminToken(token); token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+
+				return fmt.Errorf("%w: %d %s", dictionary.ErrBadStatusCode, resp.StatusCode, body)
+			}
+
+			reader := bufio.NewReader(resp.Body)
+
+			for {
+				line, err := reader.ReadBytes('\n')
+				if len(line) > 0 {
+					if _, err := os.Stdout.Write(line); err != nil {
+						return err
+					}
+				}
+
+				if err != nil {
+					if err == io.EOF {
+						return nil
+					}
+
+					return err
+				}
+			}
+		},
+	}
+
+	cmd.Flags().StringVar(&addr, "addr", "", "admin server url, taken from config by default")
+	cmd.Flags().StringVar(&token, "token", "", "admin token, taken from config by default")
+	cmd.Flags().StringVarP(&namespace, "namespace", "n", "", "filter by namespace")
+	cmd.Flags().StringVarP(&pod, "pod", "p", "", "filter by pod name")
+	cmd.Flags().StringVarP(&container, "container", "c", "", "filter by container name")
+
+	return cmd
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/mailru/easyjson"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/entity"
+	"github.com/soulgarden/logfowd/service"
+	"github.com/spf13/cobra"
+)
+
+func newTest() *cobra.Command {
+	var path string
+
+	cmd := &cobra.Command{
+		Use:   "test CASES...",
+		Short: "Run pipeline test cases and exit non-zero on failures",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if path == "" {
+				path = conf.Path()
+			}
+
+			cfg, err := conf.Load(path)
+			if err != nil {
+				fmt.Printf("%s: %s\n", path, err)
+
+				os.Exit(1)
+			}
+
+			pipeline := service.NewPipeline(cfg)
+
+			var passed, failed int
+
+			for _, casesPath := range args {
+				p, f, err := runCases(pipeline, casesPath)
+				if err != nil {
+					fmt.Printf("%s: %s\n", casesPath, err)
+
+					os.Exit(1)
+				}
+
+				passed += p
+				failed += f
+			}
+
+			fmt.Printf("%d passed, %d failed\n", passed, failed)
+
+			if failed > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().StringVar(&path, "config", "", "config path, CFG_PATH env by default")
+
+	return cmd
+}
+
+// runCases prints result of every case of the file with differences of failed ones, returns numbers of passed
+// and failed cases.
+func runCases(pipeline *service.Pipeline, path string) (int, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cases := entity.PipelineCases{}
+
+	if err := easyjson.Unmarshal(data, &cases); err != nil {
+		return 0, 0, err
+	}
+
+	var passed, failed int
+
+	for i, c := range cases {
+		name := c.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i)
+		}
+
+		diffs := pipeline.Test(c)
+
+		if len(diffs) == 0 {
+			passed++
+
+			fmt.Printf("PASS %s: %s\n", path, name)
+
+			continue
+		}
+
+		failed++
+
+		fmt.Printf("FAIL %s: %s\n", path, name)
+
+		for _, diff := range diffs {
+			fmt.Printf("    %s\n", diff)
+		}
+	}
+
+	return passed, failed, nil
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/service"
+	"github.com/spf13/cobra"
+)
+
+func newValidate() *cobra.Command {
+	var (
+		path    string
+		connect bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Check config and exit non-zero on problems",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if path == "" {
+				path = conf.Path()
+			}
+
+			if problems := validateConfig(path, connect); problems > 0 {
+				fmt.Printf("%s: %d problems found\n", path, problems)
+
+				os.Exit(1)
+			}
+
+			fmt.Printf("%s: ok\n", path)
+		},
+	}
+
+	cmd.Flags().StringVar(&path, "config", "", "config path, CFG_PATH env by default")
+	cmd.Flags().BoolVar(&connect, "connect", false, "probe every output: connect to its destination or check its dir is writable")
+
+	return cmd
+}
+
+// validateConfig prints every problem of the config located by file line and field, returns number of problems.
+func validateConfig(path string, connect bool) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("%s: %s\n", path, err)
+
+		return 1
+	}
+
+	cfg, err := conf.Load(path)
+	if err != nil {
+		fmt.Printf("%s: %s\n", path, err)
+
+		return 1
+	}
+
+	// yaml and toml configs are validated without line numbers
+	lines, _ := conf.LocateLines(data)
+
+	problems := cfg.Problems()
+
+	if connect && len(problems) == 0 {
+		problems = append(problems, connectProblems(cfg)...)
+	}
+
+	for _, problem := range problems {
+		location := path
+
+		if line := lines.Line(problem.Field); line > 0 {
+			location = fmt.Sprintf("%s:%d", path, line)
+		}
+
+		fmt.Printf("%s: %s\n", location, problem)
+	}
+
+	return len(problems)
+}
+
+// connectProblems probes every output implementing service.Prober, es outputs are probed without bootstrapping
+// the cluster.
+func connectProblems(cfg conf.Config) []conf.Problem {
+	logger := zerolog.Nop()
+	metrics := service.NewMetrics()
+
+	problems := make([]conf.Problem, 0)
+
+	for i, outputCfg := range cfg.OutputConfigs() {
+		prefix := ""
+		if len(cfg.Outputs) > 0 {
+			prefix = fmt.Sprintf("outputs[%d].", i)
+		}
+
+		field := prefix + probeField(outputCfg)
+
+		output, err := service.NewOutput(cfg, outputCfg, metrics, &logger)
+		if err != nil {
+			problems = append(problems, conf.Problem{Field: field, Message: "connect: " + err.Error()})
+
+			continue
+		}
+
+		if prober, ok := output.(service.Prober); ok {
+			if err := prober.Probe(); err != nil {
+				problems = append(problems, conf.Problem{Field: field, Message: "connect: " + err.Error()})
+			}
+		}
+
+		_ = output.Close()
+	}
+
+	return problems
+}
+
+// probeField returns the field of the output config holding the address its probe connects to.
+func probeField(output conf.Output) string {
+	switch output.Type {
+	case dictionary.OutputES:
+		if len(output.Storage.Hosts) > 0 {
+			return "storage.hosts"
+		}
+
+		return "storage.host"
+	case dictionary.OutputForward, dictionary.OutputSyslog:
+		return output.Type + ".address"
+	case dictionary.OutputGELF:
+		if output.GELF.Transport == dictionary.GELFTransportHTTP {
+			return "gelf.url"
+		}
+
+		return "gelf.address"
+	case dictionary.OutputKafka:
+		return "kafka.brokers"
+	case dictionary.OutputS3:
+		return "s3.endpoint"
+	case dictionary.OutputFile, dictionary.OutputParquet:
+		return output.Type + ".dir"
+	default:
+		return output.Type + ".url"
+	}
+}
@@ -5,12 +5,15 @@ import (
 
 	"github.com/rs/zerolog"
 	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
 	"github.com/soulgarden/logfowd/service"
 	"github.com/spf13/cobra"
 )
 
 func newWorker() *cobra.Command {
-	return &cobra.Command{
+	var dryRun bool
+
+	cmd := &cobra.Command{
 		Use:   "worker",
 		Short: "Main process",
 		Args:  cobra.NoArgs,
@@ -24,6 +27,27 @@ func newWorker() *cobra.Command {
 				os.Exit(1)
 			}
 
+			if dryRun {
+				cfg.Output = dictionary.OutputStdout
+
+				for i := range cfg.Outputs {
+					cfg.Outputs[i].Type = dictionary.OutputStdout
+				}
+			}
+
+			// documents are printed to stdout, so logs are moved out of their way
+			for _, outputCfg := range cfg.OutputConfigs() {
+				if outputCfg.Type == dictionary.OutputStdout {
+					logger = logger.Output(os.Stderr)
+				}
+			}
+
+			if err := cfg.Validate(); err != nil {
+				logger.Err(err).Msg("validate config")
+
+				os.Exit(1)
+			}
+
 			if cfg.DebugMode {
 				zerolog.SetGlobalLevel(zerolog.DebugLevel)
 			}
@@ -32,11 +56,45 @@ func newWorker() *cobra.Command {
 
 			ctx, _ := cmdManager.ListenSignal()
 
-			service.NewWatcher(
+			metrics := service.NewMetrics()
+			health := service.NewHealth(cfg)
+			tap := service.NewTap(metrics, &logger)
+
+			outputs, err := service.NewOutputs(cfg, metrics, &logger)
+			if err != nil {
+				logger.Err(err).Msg("new outputs")
+
+				os.Exit(1)
+			}
+
+			for name, output := range outputs {
+				health.AddReadinessCheck(name, output.Health)
+			}
+
+			watcher := service.NewWatcher(
 				cfg,
-				service.NewESCli(cfg, &logger),
+				outputs,
+				metrics,
+				health,
+				tap,
 				&logger,
-			).Start(ctx)
+			)
+
+			if cfg.Admin.Enabled {
+				go func() {
+					_ = service.NewServer(cfg, metrics, health, watcher, tap, &logger).Start(ctx)
+				}()
+			}
+
+			go func() {
+				_ = service.NewReloader(conf.Path(), cfg, outputs, watcher, metrics, health, &logger).Start(ctx)
+			}()
+
+			watcher.Start(ctx)
 		},
 	}
+
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "print documents to stdout instead of sending them to es")
+
+	return cmd
 }
@@ -1,41 +1,477 @@
 package conf
 
 import (
+	"fmt"
 	"os"
+	"reflect"
+	"strconv"
 
 	"github.com/jinzhu/configor"
+	"github.com/soulgarden/logfowd/dictionary"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	Env       string   `json:"env" default:"prod"`
 	DebugMode bool     `json:"debug_mode"  default:"false"`
+	Output    string   `json:"output" default:"es"`
 	Storage   Storage  `json:"storage"`
-	LogsPath  []string `json:"logs_path" default:"/var/log/pods"`
+	Stdout    Stdout   `json:"stdout"`
+	Outputs   []Output `json:"outputs"`
+	LogsPath  []string `json:"logs_path" default:"[/var/log/pods]"`
+	Admin     Admin    `json:"admin"`
+	Reload    Reload   `json:"reload"`
+}
+
+type Admin struct {
+	Enabled       bool   `json:"enabled" default:"true"`
+	Listen        string `json:"listen" default:"127.0.0.1:8080"`
+	HealthTimeout int    `json:"health_timeout" default:"120000"`
+	// Tap serves /tap, it streams log lines of every container and is off unless enabled explicitly.
+	Tap bool `json:"tap" default:"false"`
+	// Token is required as a bearer token by /files and /tap when set.
+	Token string `json:"token"`
+}
+
+// Reload applies config changes on SIGHUP and, when watch is enabled, on changes of the config file.
+type Reload struct {
+	Watch    bool `json:"watch" default:"true"`
+	Debounce int  `json:"debounce" default:"1000"`
+}
+
+// Output is a named destination with its own queue and workers. Events matching any route are sent to it,
+// all events when routes are empty. Only the section named after the output type is used.
+type Output struct {
+	Name          string      `json:"name"`
+	Type          string      `json:"type" default:"es"`
+	Workers       int         `json:"workers" default:"10"`
+	FlushInterval int         `json:"flush_interval" default:"1000"`
+	Overflow      string      `json:"overflow" default:"drop"`
+	Routes        []Route     `json:"routes"`
+	Storage       Storage     `json:"storage"`
+	Stdout        Stdout      `json:"stdout"`
+	Loki          Loki        `json:"loki"`
+	OTLP          OTLP        `json:"otlp"`
+	Forward       Forward     `json:"forward"`
+	Kafka         Kafka       `json:"kafka"`
+	Splunk        Splunk      `json:"splunk"`
+	ClickHouse    ClickHouse  `json:"clickhouse"`
+	GELF          GELF        `json:"gelf"`
+	Syslog        Syslog      `json:"syslog"`
+	File          FileArchive `json:"file"`
+	S3            S3          `json:"s3"`
+	Parquet       Parquet     `json:"parquet"`
+}
+
+// Loki pushes events to streams labeled by meta fields, label sets over max_streams seen within an hour are
+// pushed to a single overflow stream. Pushes failed with 429, 5xx or network errors are retried with the exponential
+// backoff starting at retry_delay.
+type Loki struct {
+	URL          string            `json:"url" default:"http://loki:3100"`
+	Encoding     string            `json:"encoding" default:"protobuf"`
+	Labels       []string          `json:"labels" default:"[namespace,pod,container]"`
+	StaticLabels map[string]string `json:"static_labels"`
+	MaxStreams   int               `json:"max_streams" default:"1000"`
+	TenantID     string            `json:"tenant_id" default:""`
+	Username     string            `json:"username" default:""`
+	Password     string            `json:"password" default:""`
+	MaxRetries   int               `json:"max_retries" default:"5"`
+	RetryDelay   int               `json:"retry_delay" default:"1000"`
+}
+
+// OTLP exports events as OpenTelemetry logs to url/v1/logs, requests failed with 429, 5xx or a network error are
+// retried after Retry-After or the exponential backoff starting at retry_delay.
+type OTLP struct {
+	URL         string            `json:"url" default:"http://otel-collector:4318"`
+	Encoding    string            `json:"encoding" default:"protobuf"`
+	Compression string            `json:"compression" default:"gzip"`
+	Headers     map[string]string `json:"headers"`
+	MaxRetries  int               `json:"max_retries" default:"5"`
+	RetryDelay  int               `json:"retry_delay" default:"1000"`
+}
+
+// Forward sends events to a fluentd or fluent bit aggregator in PackedForward mode, tag placeholders
+// {namespace}, {pod}, {pod_id}, {container} and {path} are replaced by meta of the event.
+type Forward struct {
+	Address     string `json:"address" default:"fluentd:24224"`
+	Tag         string `json:"tag" default:"kube.{namespace}.{pod}.{container}"`
+	Compression string `json:"compression" default:"none"`
+	RequireAck  bool   `json:"require_ack"`
+	SharedKey   string `json:"shared_key" default:""`
+	Hostname    string `json:"hostname" default:""`
+	Username    string `json:"username" default:""`
+	Password    string `json:"password" default:""`
+	Timeout     int    `json:"timeout" default:"5000"`
+}
+
+// Kafka produces events as json documents to the templated topic, events with the same partition key go
+// to the same partition, events with an empty key are spread over partitions.
+type Kafka struct {
+	Brokers      []string `json:"brokers" default:"[kafka:9092]"`
+	Topic        string   `json:"topic" default:"logs"`
+	PartitionKey string   `json:"partition_key" default:"'{pod_id}'"`
+	Acks         string   `json:"acks" default:"all"`
+	Compression  string   `json:"compression" default:"none"`
+	Idempotent   bool     `json:"idempotent"`
+	ClientID     string   `json:"client_id" default:"logfowd"`
+	Timeout      int      `json:"timeout" default:"10000"`
+}
+
+// Splunk sends events to the http event collector, host, source, sourcetype and index take the same placeholders
+// as forward tags, empty ones are left to defaults of the token. With ack every batch is resent until
+// the indexers acknowledge it. ca_file verifies the collector against pem certificates instead of system roots,
+// cert_file and key_file present a client certificate.
+type Splunk struct {
+	URL                string `json:"url" default:"https://splunk:8088"`
+	Token              string `json:"token" default:""`
+	Host               string `json:"host" default:""`
+	Source             string `json:"source" default:"'{path}'"`
+	Sourcetype         string `json:"sourcetype" default:"kube:container:{container}"`
+	Index              string `json:"index" default:""`
+	Ack                bool   `json:"ack"`
+	AckPollInterval    int    `json:"ack_poll_interval" default:"1000"`
+	AckTimeout         int    `json:"ack_timeout" default:"60000"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+}
+
+// ClickHouse inserts events as JSONEachRow rows over the http interface, columns map table columns to event fields
+// and default to a column per field. Retried inserts carry the dedup token of the batch, rows are not duplicated
+// by Replicated* tables and MergeTree ones with non_replicated_deduplication_window, which create_table sets.
+type ClickHouse struct {
+	URL               string             `json:"url" default:"http://clickhouse:8123"`
+	Database          string             `json:"database" default:"default"`
+	Table             string             `json:"table" default:"logs"`
+	Username          string             `json:"username" default:"default"`
+	Password          string             `json:"password" default:""`
+	Columns           []ClickHouseColumn `json:"columns"`
+	AsyncInsert       bool               `json:"async_insert"`
+	AsyncInsertNoWait bool               `json:"async_insert_no_wait"`
+	CreateTable       bool               `json:"create_table"`
+	Engine            string             `json:"engine" default:"MergeTree ORDER BY (namespace, pod_name, timestamp)"`
+	MaxRetries        int                `json:"max_retries" default:"3"`
+	RetryDelay        int                `json:"retry_delay" default:"1000"`
+}
+
+// ClickHouseColumn fills the column with the event field, one of message, @timestamp, namespace, pod_name, pod_id,
+// container_name or path.
+type ClickHouseColumn struct {
+	Name  string `json:"name"`
+	Field string `json:"field"`
+}
+
+// TableColumns returns configured columns or a column per event field named after it.
+func (c ClickHouse) TableColumns() []ClickHouseColumn {
+	if len(c.Columns) > 0 {
+		return c.Columns
+	}
+
+	return []ClickHouseColumn{
+		{Name: "timestamp", Field: dictionary.FieldTimestamp},
+		{Name: "message", Field: dictionary.FieldMessage},
+		{Name: "namespace", Field: dictionary.FieldNamespace},
+		{Name: "pod_name", Field: dictionary.FieldPodName},
+		{Name: "pod_id", Field: dictionary.FieldPodID},
+		{Name: "container_name", Field: dictionary.FieldContainerName},
+		{Name: "path", Field: dictionary.FieldPath},
+	}
+}
+
+// GELF sends events to graylog over udp with chunking, null-delimited tcp or http. Compression applies to udp and
+// http, gelf over tcp is always uncompressed, tls is used by tcp only. ca_file, cert_file and key_file apply to tls
+// and https like those of splunk.
+type GELF struct {
+	Transport          string `json:"transport" default:"udp"`
+	Address            string `json:"address" default:"graylog:12201"`
+	URL                string `json:"url" default:"http://graylog:12201/gelf"`
+	Host               string `json:"host" default:""`
+	Compression        string `json:"compression" default:"gzip"`
+	ChunkSize          int    `json:"chunk_size" default:"1420"`
+	TLS                bool   `json:"tls"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	Timeout            int    `json:"timeout" default:"5000"`
+}
+
+// Syslog sends events as rfc5424 messages with meta in the sd_id structured data element or as rfc3164 messages
+// without it. app_name and hostname take the forward tag placeholders, an empty hostname is the node hostname.
+// Over tcp messages are framed by octet counting or newlines. ca_file, cert_file and key_file apply to tls like those
+// of splunk.
+type Syslog struct {
+	Transport          string `json:"transport" default:"tcp"`
+	Address            string `json:"address" default:"syslog:514"`
+	Format             string `json:"format" default:"rfc5424"`
+	Framing            string `json:"framing" default:"octet_counting"`
+	Facility           int    `json:"facility" default:"1"`
+	Severity           int    `json:"severity" default:"6"`
+	AppName            string `json:"app_name" default:"'{container}'"`
+	Hostname           string `json:"hostname" default:""`
+	SDID               string `json:"sd_id" default:"kubernetes@32473"`
+	TLS                bool   `json:"tls"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	Timeout            int    `json:"timeout" default:"5000"`
+}
+
+// FileArchive writes events as ndjson documents to dir/namespace/day segments. A segment is closed when it reaches
+// max_size bytes or max_age milliseconds and compressed, the oldest closed segments are deleted while the archive
+// is over max_total_size bytes, zero disables the limit.
+type FileArchive struct {
+	Dir          string `json:"dir" default:"/var/lib/logfowd/archive"`
+	MaxSize      int64  `json:"max_size" default:"104857600"`
+	MaxAge       int    `json:"max_age" default:"3600000"`
+	Compression  string `json:"compression" default:"gzip"`
+	MaxTotalSize int64  `json:"max_total_size" default:"10737418240"`
+}
+
+// S3 buffers events per object key as compressed ndjson and uploads an object when the buffer reaches
+// buffer_size bytes or buffer_interval milliseconds. Buffers over part_size bytes are uploaded in parts.
+// Buffers failed to be uploaded are kept and retried, the oldest are dropped over max_pending_size bytes.
+// The key takes the forward tag placeholders, {date} of the read time and {node}, a unique name is appended.
+// Empty keys are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+type S3 struct {
+	Endpoint       string `json:"endpoint" default:"https://s3.amazonaws.com"`
+	Region         string `json:"region" default:"us-east-1"`
+	Bucket         string `json:"bucket" default:""`
+	AccessKey      string `json:"access_key" default:""`
+	SecretKey      string `json:"secret_key" default:""`
+	PathStyle      bool   `json:"path_style" default:"true"`
+	Key            string `json:"key" default:"'{namespace}/{date}/{node}'"`
+	Node           string `json:"node" default:""`
+	Compression    string `json:"compression" default:"gzip"`
+	BufferSize     int64  `json:"buffer_size" default:"67108864"`
+	BufferInterval int    `json:"buffer_interval" default:"60000"`
+	PartSize       int64  `json:"part_size" default:"8388608"`
+	MaxPendingSize int64  `json:"max_pending_size" default:"268435456"`
+	MaxRetries     int    `json:"max_retries" default:"3"`
+	RetryDelay     int    `json:"retry_delay" default:"1000"`
+}
+
+// Parquet writes events as rows of zstd compressed parquet files to dir/key, the key takes the forward tag
+// placeholders, {date} of the read time and {node}. Columns are the fields of es documents followed by fields.
+// Rows are written as a row group when they reach row_group_size bytes, a file is closed at max_size bytes or
+// max_age milliseconds. Closed files are uploaded to s3 and removed when s3.bucket is set, only settings of
+// requests to the bucket are used.
+type Parquet struct {
+	Dir          string   `json:"dir" default:"/var/lib/logfowd/parquet"`
+	Key          string   `json:"key" default:"'{namespace}/{date}'"`
+	Fields       []string `json:"fields"`
+	Compression  string   `json:"compression" default:"zstd"`
+	RowGroupSize int64    `json:"row_group_size" default:"8388608"`
+	MaxSize      int64    `json:"max_size" default:"134217728"`
+	MaxAge       int      `json:"max_age" default:"3600000"`
+	S3           S3       `json:"s3"`
+}
+
+// Route matches events by meta, fields are shell patterns like kube-*, empty fields match anything.
+type Route struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+}
+
+// Stdout prints documents instead of sending them to es, every sample-th document is printed.
+type Stdout struct {
+	Format string `json:"format" default:"bulk"`
+	Sample int    `json:"sample" default:"1"`
 }
 
 type Storage struct {
-	Host          string `json:"host" default:"elasticsearch"`
-	Port          string `json:"port" default:"9200"`
-	IndexName     string `json:"index_name" default:"logfowd"`
-	FlushInterval int    `json:"flush_interval" default:"1000"`
-	Workers       int    `json:"workers" default:"10"`
-	APIPrefix     string `json:"api_prefix" default:""`
-	UseAuth       bool   `json:"use_auth" default:"false"`
-	Username      string `json:"username" default:""`
-	Password      string `json:"password" default:""`
+	Host                string     `json:"host" default:"elasticsearch"`
+	Port                string     `json:"port" default:"9200"`
+	Hosts               []string   `json:"hosts"`
+	Balancer            string     `json:"balancer" default:"round_robin"`
+	HealthCheckInterval int        `json:"health_check_interval" default:"5000"`
+	Sniff               bool       `json:"sniff" default:"false"`
+	SniffInterval       int        `json:"sniff_interval" default:"60000"`
+	IndexName           string     `json:"index_name" default:"logfowd"`
+	DataStream          DataStream `json:"data_stream"`
+	Template            Template   `json:"template"`
+	Retention           Retention  `json:"retention"`
+	FlushInterval       int        `json:"flush_interval" default:"1000"`
+	Workers             int        `json:"workers" default:"10"`
+	APIPrefix           string     `json:"api_prefix" default:""`
+	UseAuth             bool       `json:"use_auth" default:"false"`
+	Username            string     `json:"username" default:""`
+	Password            string     `json:"password" default:""`
+}
+
+// Endpoints returns base urls of all configured nodes, falls back to host and port for single node setups.
+func (s Storage) Endpoints() []string {
+	if len(s.Hosts) > 0 {
+		return s.Hosts
+	}
+
+	return []string{s.Host + ":" + s.Port}
+}
+
+// DataStream enables writing to the data stream instead of daily indices when name is set.
+type DataStream struct {
+	Name            string `json:"name" default:""`
+	Bootstrap       bool   `json:"bootstrap" default:"false"`
+	Policy          string `json:"policy" default:""`
+	RolloverMaxAge  string `json:"rollover_max_age" default:"1d"`
+	RolloverMaxSize string `json:"rollover_max_size" default:"50gb"`
+	DeleteAfter     string `json:"delete_after" default:"30d"`
+}
+
+func (s DataStream) Enabled() bool {
+	return s.Name != ""
+}
+
+// PolicyName returns lifecycle policy name, defaults to the data stream name.
+func (s DataStream) PolicyName() string {
+	if s.Policy != "" {
+		return s.Policy
+	}
+
+	return s.Name
+}
+
+// Template describes the index template installed on startup, it is only updated when the version is newer.
+type Template struct {
+	Enabled  bool                   `json:"enabled" default:"false"`
+	Name     string                 `json:"name" default:""`
+	Version  int                    `json:"version" default:"1"`
+	File     string                 `json:"file" default:""`
+	Settings map[string]interface{} `json:"settings"`
+	Mappings map[string]interface{} `json:"mappings"`
+}
+
+// Retention deletes or closes daily indices older than the policy age, only indices named
+// <pattern>-YYYY.MM.DD are touched.
+type Retention struct {
+	Enabled        bool              `json:"enabled" default:"false"`
+	Interval       int               `json:"interval" default:"3600000"`
+	DryRun         bool              `json:"dry_run" default:"false"`
+	LeaderElection bool              `json:"leader_election" default:"true"`
+	LockIndex      string            `json:"lock_index" default:"logfowd-lock"`
+	Policies       []RetentionPolicy `json:"policies"`
+}
+
+type RetentionPolicy struct {
+	Pattern    string `json:"pattern"`
+	MaxAgeDays int    `json:"max_age_days"`
+	Action     string `json:"action"`
+}
+
+// GetAction returns policy action, configor does not fill defaults of slice items, so delete is used when empty.
+func (p RetentionPolicy) GetAction() string {
+	if p.Action == "" {
+		return dictionary.RetentionActionDelete
+	}
+
+	return p.Action
+}
+
+// OutputConfigs returns the outputs list or, when it is empty, a single output built from the output, storage
+// and stdout sections. The single output blocks readers on overflow like before outputs were added.
+func (c Config) OutputConfigs() []Output {
+	if len(c.Outputs) > 0 {
+		return c.Outputs
+	}
+
+	return []Output{{
+		Name:          c.Output,
+		Type:          c.Output,
+		Workers:       c.Storage.Workers,
+		FlushInterval: c.Storage.FlushInterval,
+		Overflow:      dictionary.OverflowBlock,
+		Storage:       c.Storage,
+		Stdout:        c.Stdout,
+	}}
+}
+
+// ForOutput returns the config with storage and stdout sections of the output, clients of outputs only read these.
+func (c Config) ForOutput(output Output) Config {
+	c.Storage, c.Stdout = output.Storage, output.Stdout
+
+	return c
 }
 
 func New() (Config, error) {
+	return Load(Path())
+}
+
+// Path returns the config file path taken from CFG_PATH env.
+func Path() string {
+	if path := os.Getenv("CFG_PATH"); path != "" {
+		return path
+	}
+
+	return "./conf/config.json"
+}
+
+func Load(path string) (Config, error) {
 	c := Config{}
-	path := os.Getenv("CFG_PATH")
 
-	if path == "" {
-		path = "./conf/config.json"
+	// configor ignores defaults failed to be parsed and leaves the rest of the struct without defaults,
+	// so they are filled before configor finds nothing blank
+	if err := setDefaults(&c); err != nil {
+		return c, err
 	}
 
 	if err := configor.New(&configor.Config{ErrorOnUnmatchedKeys: true}).Load(&c, path); err != nil {
 		return c, err
 	}
 
+	// defaults are filled before the file is read, so items of the outputs list are filled separately
+	for i := range c.Outputs {
+		if err := setDefaults(&c.Outputs[i]); err != nil {
+			return c, err
+		}
+
+		prefix := "Configor_Outputs_" + strconv.Itoa(i)
+
+		if err := configor.New(&configor.Config{ENVPrefix: prefix}).Load(&c.Outputs[i]); err != nil {
+			return c, err
+		}
+	}
+
 	return c, nil
 }
+
+// setDefaults fills blank fields of the struct and of nested structs with default tags parsed as yaml,
+// like configor does. Templated defaults starting with { are quoted, otherwise yaml reads them as maps.
+func setDefaults(v any) error {
+	value := reflect.Indirect(reflect.ValueOf(v))
+
+	for i := 0; i < value.NumField(); i++ {
+		field, fieldType := value.Field(i), value.Type().Field(i)
+
+		if !fieldType.IsExported() {
+			continue
+		}
+
+		if tag := fieldType.Tag.Get("default"); tag != "" && field.IsZero() {
+			if err := yaml.Unmarshal([]byte(tag), field.Addr().Interface()); err != nil {
+				return fmt.Errorf("default of %s.%s: %w", value.Type().Name(), fieldType.Name, err)
+			}
+		}
+
+		switch field.Kind() {
+		case reflect.Struct:
+			if err := setDefaults(field.Addr().Interface()); err != nil {
+				return err
+			}
+		case reflect.Slice:
+			for j := 0; j < field.Len(); j++ {
+				if field.Index(j).Kind() != reflect.Struct {
+					break
+				}
+
+				if err := setDefaults(field.Index(j).Addr().Interface()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+func TestLoad_Outputs(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	data := `{"outputs":[{"name":"all","storage":{"index_name":"all"}},{"name":"debug","type":"stdout","workers":1}]}`
+
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if problems := c.Problems(); len(problems) > 0 {
+		t.Errorf("Problems() = %v, want none", problems)
+	}
+
+	outputs := c.OutputConfigs()
+
+	if len(outputs) != 2 {
+		t.Fatalf("OutputConfigs() returned %d outputs, want 2", len(outputs))
+	}
+
+	all, debug := outputs[0], outputs[1]
+
+	if all.Type != dictionary.OutputES || all.Workers != 10 || all.Overflow != dictionary.OverflowDrop {
+		t.Errorf("defaults of all output = %s, %d, %s", all.Type, all.Workers, all.Overflow)
+	}
+
+	if all.Storage.IndexName != "all" || all.Storage.Host != "elasticsearch" || all.Storage.FlushInterval != 1000 {
+		t.Errorf("storage of all output = %+v", all.Storage)
+	}
+
+	if debug.Workers != 1 || debug.Stdout.Format != dictionary.StdoutFormatBulk || debug.Stdout.Sample != 1 {
+		t.Errorf("debug output = %+v", debug)
+	}
+}
+
+func TestLoad_OutputDefaults(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	data := `{"outputs":[{"name":"es"},{"name":"stdout","type":"stdout"},{"name":"loki","type":"loki"},` +
+		`{"name":"otlp","type":"otlp"},{"name":"forward","type":"forward"},{"name":"kafka","type":"kafka"},` +
+		`{"name":"splunk","type":"splunk"},{"name":"clickhouse","type":"clickhouse"},{"name":"gelf","type":"gelf"},` +
+		`{"name":"syslog","type":"syslog"},{"name":"file","type":"file"},{"name":"s3","type":"s3"},` +
+		`{"name":"parquet","type":"parquet"}]}`
+
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	outputs := make(map[string]Output, len(c.Outputs))
+
+	for _, output := range c.Outputs {
+		outputs[output.Name] = output
+	}
+
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{name: "es", got: outputs["es"].Storage.Host, want: "elasticsearch"},
+		{name: "stdout", got: outputs["stdout"].Stdout.Format, want: dictionary.StdoutFormatBulk},
+		{name: "loki", got: outputs["loki"].Loki.Labels, want: []string{"namespace", "pod", "container"}},
+		{name: "otlp", got: outputs["otlp"].OTLP.Compression, want: dictionary.CompressionGzip},
+		{name: "forward", got: outputs["forward"].Forward.Tag, want: "kube.{namespace}.{pod}.{container}"},
+		{name: "kafka partition key", got: outputs["kafka"].Kafka.PartitionKey, want: "{pod_id}"},
+		{name: "kafka acks", got: outputs["kafka"].Kafka.Acks, want: dictionary.KafkaAcksAll},
+		{name: "kafka brokers", got: outputs["kafka"].Kafka.Brokers, want: []string{"kafka:9092"}},
+		{name: "splunk source", got: outputs["splunk"].Splunk.Source, want: "{path}"},
+		{name: "splunk sourcetype", got: outputs["splunk"].Splunk.Sourcetype, want: "kube:container:{container}"},
+		{name: "splunk ack timeout", got: outputs["splunk"].Splunk.AckTimeout, want: 60000},
+		{name: "clickhouse", got: outputs["clickhouse"].ClickHouse.Table, want: "logs"},
+		{name: "gelf", got: outputs["gelf"].GELF.Transport, want: dictionary.GELFTransportUDP},
+		{name: "syslog app name", got: outputs["syslog"].Syslog.AppName, want: "{container}"},
+		{name: "syslog sd id", got: outputs["syslog"].Syslog.SDID, want: "kubernetes@32473"},
+		{name: "file", got: outputs["file"].File.Dir, want: "/var/lib/logfowd/archive"},
+		{name: "s3 key", got: outputs["s3"].S3.Key, want: "{namespace}/{date}/{node}"},
+		{name: "s3 max pending size", got: outputs["s3"].S3.MaxPendingSize, want: int64(268435456)},
+		{name: "parquet key", got: outputs["parquet"].Parquet.Key, want: "{namespace}/{date}"},
+		{name: "parquet row group size", got: outputs["parquet"].Parquet.RowGroupSize, want: int64(8388608)},
+		{name: "parquet s3 region", got: outputs["parquet"].Parquet.S3.Region, want: "us-east-1"},
+	}
+
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s default = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestSetDefaults_Invalid(t *testing.T) {
+	t.Parallel()
+
+	var invalid struct {
+		Key string `default:"{namespace}/{date}"`
+	}
+
+	if err := setDefaults(&invalid); err == nil {
+		t.Error("setDefaults() of unquoted template error = nil")
+	}
+}
+
+func TestLoad_LogsPathDefault(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	if err := os.WriteFile(path, []byte(`{}`), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if want := []string{"/var/log/pods"}; !reflect.DeepEqual(c.LogsPath, want) {
+		t.Errorf("LogsPath = %q, want %q", c.LogsPath, want)
+	}
+}
+
+func TestConfig_OutputConfigs(t *testing.T) {
+	t.Parallel()
+
+	c := validConfig()
+
+	want := []Output{{
+		Name:          dictionary.OutputES,
+		Type:          dictionary.OutputES,
+		Workers:       c.Storage.Workers,
+		FlushInterval: c.Storage.FlushInterval,
+		Overflow:      dictionary.OverflowBlock,
+		Storage:       c.Storage,
+		Stdout:        c.Stdout,
+	}}
+
+	if got := c.OutputConfigs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("OutputConfigs() = %+v, want %+v", got, want)
+	}
+}
+
+func TestConfig_RestartRequired(t *testing.T) {
+	t.Parallel()
+
+	c := validConfig()
+	c.Outputs = []Output{{Name: "es", Type: dictionary.OutputES, Workers: 2, Overflow: dictionary.OverflowDrop}}
+
+	next := validConfig()
+	next.Outputs = []Output{{
+		Name:     "es",
+		Type:     dictionary.OutputES,
+		Workers:  2,
+		Overflow: dictionary.OverflowDrop,
+		Routes:   []Route{{Namespace: "default"}},
+	}}
+
+	if fields := c.RestartRequired(next); len(fields) != 0 {
+		t.Errorf("RestartRequired() with changed routes = %v, want none", fields)
+	}
+
+	next.Outputs[0].Workers = 4
+	next.Output = dictionary.OutputStdout
+
+	if fields := c.RestartRequired(next); !reflect.DeepEqual(fields, []string{"output", "outputs"}) {
+		t.Errorf("RestartRequired() = %v, want [output outputs]", fields)
+	}
+}
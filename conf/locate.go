@@ -0,0 +1,115 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Lines maps json paths of fields in the same format as Problem.Field to line numbers of a json config,
+// parents of missing fields are used to locate problems of fields taken from defaults.
+type Lines map[string]int
+
+// LocateLines parses a json config and returns line numbers of all fields.
+func LocateLines(data []byte) (Lines, error) {
+	lines := Lines{}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	if err := locateValue(dec, data, "", lines); err != nil && !errors.Is(err, io.EOF) {
+		return lines, err
+	}
+
+	return lines, nil
+}
+
+// Line returns the line of the field or of its closest parent, 0 when nothing is found.
+func (l Lines) Line(field string) int {
+	for field != "" {
+		if line, ok := l[field]; ok {
+			return line
+		}
+
+		i := strings.LastIndexAny(field, ".[")
+		if i < 0 {
+			break
+		}
+
+		field = field[:i]
+	}
+
+	return 0
+}
+
+func locateValue(dec *json.Decoder, data []byte, path string, lines Lines) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	delim, ok := token.(json.Delim)
+	if !ok {
+		return nil
+	}
+
+	switch delim {
+	case '{':
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+
+			field, _ := key.(string)
+			if path != "" {
+				field = path + "." + field
+			}
+
+			lines[field] = lineAt(data, dec.InputOffset())
+
+			if err := locateValue(dec, data, field, lines); err != nil {
+				return err
+			}
+		}
+	case '[':
+		for i := 0; dec.More(); i++ {
+			field := path + "[" + strconv.Itoa(i) + "]"
+
+			// the offset points to the end of the previous token, skip whitespace to get the item line
+			lines[field] = lineAt(data, nextTokenOffset(data, dec.InputOffset()))
+
+			if err := locateValue(dec, data, field, lines); err != nil {
+				return err
+			}
+		}
+	}
+
+	// closing delimiter
+	_, err = dec.Token()
+
+	return err
+}
+
+func nextTokenOffset(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',':
+			offset++
+		default:
+			return offset
+		}
+	}
+
+	return offset
+}
+
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
@@ -0,0 +1,817 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+var (
+	esTimeUnitRegexp = regexp.MustCompile(`^\d+(d|h|m|s|ms|micros|nanos)$`)
+	esSizeUnitRegexp = regexp.MustCompile(`^\d+(b|kb|mb|gb|tb|pb)$`)
+	lokiLabelRegexp  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	templatePlaceholderRegexp  = regexp.MustCompile(`\{[^{}]*\}`)
+	clickHouseIdentifierRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	syslogSDIDRegexp           = regexp.MustCompile(`^[!#-<>-\\^-~]{1,32}$`)
+	s3BucketRegexp             = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+)
+
+// Problem is a config error located by the json path of the field, like storage.retention.policies[0].pattern.
+type Problem struct {
+	Field   string
+	Message string
+}
+
+func (p Problem) Error() string {
+	return p.Field + ": " + p.Message
+}
+
+// Validate checks config values that configor can't check, all problems are joined into one error.
+func (c Config) Validate() error {
+	errs := make([]error, 0)
+
+	for _, problem := range c.Problems() {
+		errs = append(errs, fmt.Errorf("%w: %s", dictionary.ErrInvalidConfig, problem))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Problems returns every semantic problem of the config in the order of fields.
+// nolint: funlen, gocognit, cyclop
+func (c Config) Problems() []Problem {
+	problems := make([]Problem, 0)
+
+	add := func(field, format string, args ...interface{}) {
+		problems = append(problems, Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(c.LogsPath) == 0 {
+		add("logs_path", "is empty")
+	}
+
+	for i, path := range c.LogsPath {
+		if !strings.HasPrefix(path, "/") {
+			add(fmt.Sprintf("logs_path[%d]", i), "must be an absolute path, got %q", path)
+		}
+	}
+
+	if len(c.Outputs) == 0 {
+		if c.Output != dictionary.OutputES && c.Output != dictionary.OutputStdout {
+			add("output", "unknown value %q", c.Output)
+		}
+
+		if c.Output == dictionary.OutputStdout {
+			stdoutProblems("stdout", c.Stdout, add)
+		}
+	}
+
+	storageProblems("storage", c.Storage, add)
+
+	names := make(map[string]bool, len(c.Outputs))
+
+	for i, output := range c.Outputs {
+		field := fmt.Sprintf("outputs[%d]", i)
+
+		switch {
+		case output.Name == "":
+			add(field+".name", "is empty")
+		case names[output.Name]:
+			add(field+".name", "duplicate name %q", output.Name)
+		}
+
+		names[output.Name] = true
+
+		outputProblems(field, output, add)
+	}
+
+	if c.Admin.Enabled {
+		if _, _, err := net.SplitHostPort(c.Admin.Listen); err != nil {
+			add("admin.listen", "invalid address %q: %s", c.Admin.Listen, err)
+		}
+
+		if c.Admin.HealthTimeout < 1 {
+			add("admin.health_timeout", "must be positive, got %d", c.Admin.HealthTimeout)
+		}
+
+		if c.Admin.Tap && c.Admin.Token == "" && !loopback(c.Admin.Listen) {
+			add("admin.token", "required to serve tap on non-loopback address %q", c.Admin.Listen)
+		}
+	}
+
+	if c.Reload.Watch && c.Reload.Debounce < 1 {
+		add("reload.debounce", "must be positive, got %d", c.Reload.Debounce)
+	}
+
+	return problems
+}
+
+type addProblem func(field, format string, args ...interface{})
+
+// outputProblems checks an item of the outputs list and the section of its type.
+func outputProblems(prefix string, output Output, add addProblem) {
+	switch output.Type {
+	case dictionary.OutputES:
+		storageProblems(prefix+".storage", output.Storage, add)
+	case dictionary.OutputStdout:
+		stdoutProblems(prefix+".stdout", output.Stdout, add)
+	case dictionary.OutputLoki:
+		lokiProblems(prefix+".loki", output.Loki, add)
+	case dictionary.OutputOTLP:
+		otlpProblems(prefix+".otlp", output.OTLP, add)
+	case dictionary.OutputForward:
+		forwardProblems(prefix+".forward", output.Forward, add)
+	case dictionary.OutputKafka:
+		kafkaProblems(prefix+".kafka", output.Kafka, add)
+	case dictionary.OutputSplunk:
+		splunkProblems(prefix+".splunk", output.Splunk, add)
+	case dictionary.OutputClickHouse:
+		clickHouseProblems(prefix+".clickhouse", output.ClickHouse, add)
+	case dictionary.OutputGELF:
+		gelfProblems(prefix+".gelf", output.GELF, add)
+	case dictionary.OutputSyslog:
+		syslogProblems(prefix+".syslog", output.Syslog, add)
+	case dictionary.OutputFile:
+		fileArchiveProblems(prefix+".file", output.File, add)
+	case dictionary.OutputS3:
+		s3Problems(prefix+".s3", output.S3, add)
+	case dictionary.OutputParquet:
+		parquetProblems(prefix+".parquet", output.Parquet, add)
+	default:
+		add(prefix+".type", "unknown value %q", output.Type)
+	}
+
+	if output.Workers < 1 {
+		add(prefix+".workers", "must be positive, got %d", output.Workers)
+	}
+
+	if output.FlushInterval < 1 {
+		add(prefix+".flush_interval", "must be positive, got %d", output.FlushInterval)
+	}
+
+	if output.Overflow != dictionary.OverflowBlock && output.Overflow != dictionary.OverflowDrop {
+		add(prefix+".overflow", "unknown value %q", output.Overflow)
+	}
+
+	for i, route := range output.Routes {
+		field := fmt.Sprintf("%s.routes[%d]", prefix, i)
+
+		for _, pattern := range [][2]string{
+			{"namespace", route.Namespace},
+			{"pod", route.Pod},
+			{"container", route.Container},
+		} {
+			if _, err := path.Match(pattern[1], ""); err != nil {
+				add(field+"."+pattern[0], "invalid pattern %q", pattern[1])
+			}
+		}
+	}
+}
+
+func stdoutProblems(prefix string, stdout Stdout, add addProblem) {
+	if stdout.Format != dictionary.StdoutFormatBulk && stdout.Format != dictionary.StdoutFormatPretty {
+		add(prefix+".format", "unknown value %q", stdout.Format)
+	}
+
+	if stdout.Sample < 1 {
+		add(prefix+".sample", "must be positive, got %d", stdout.Sample)
+	}
+}
+
+func lokiProblems(prefix string, loki Loki, add addProblem) {
+	if u, err := url.Parse(loki.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		add(prefix+".url", "must be an http or https url, got %q", loki.URL)
+	}
+
+	if loki.Encoding != dictionary.LokiEncodingProtobuf && loki.Encoding != dictionary.LokiEncodingJSON {
+		add(prefix+".encoding", "unknown value %q", loki.Encoding)
+	}
+
+	if loki.MaxRetries < 0 {
+		add(prefix+".max_retries", "must not be negative, got %d", loki.MaxRetries)
+	}
+
+	if loki.RetryDelay < 1 {
+		add(prefix+".retry_delay", "must be positive, got %d", loki.RetryDelay)
+	}
+
+	if len(loki.Labels) == 0 && len(loki.StaticLabels) == 0 {
+		add(prefix+".labels", "is empty while static_labels are empty, loki requires at least one label")
+	}
+
+	for i, label := range loki.Labels {
+		switch label {
+		case dictionary.LokiLabelNamespace, dictionary.LokiLabelPod, dictionary.LokiLabelPodID, dictionary.LokiLabelContainer:
+		default:
+			add(fmt.Sprintf("%s.labels[%d]", prefix, i), "unknown label %q", label)
+		}
+	}
+
+	names := make([]string, 0, len(loki.StaticLabels))
+
+	for name := range loki.StaticLabels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !lokiLabelRegexp.MatchString(name) {
+			add(prefix+".static_labels."+name, "invalid label name")
+		}
+	}
+
+	if loki.MaxStreams < 1 {
+		add(prefix+".max_streams", "must be positive, got %d", loki.MaxStreams)
+	}
+}
+
+func otlpProblems(prefix string, otlp OTLP, add addProblem) {
+	if u, err := url.Parse(otlp.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		add(prefix+".url", "must be an http or https url, got %q", otlp.URL)
+	}
+
+	if otlp.Encoding != dictionary.OTLPEncodingProtobuf && otlp.Encoding != dictionary.OTLPEncodingJSON {
+		add(prefix+".encoding", "unknown value %q", otlp.Encoding)
+	}
+
+	if otlp.Compression != dictionary.CompressionGzip && otlp.Compression != dictionary.CompressionNone {
+		add(prefix+".compression", "unknown value %q", otlp.Compression)
+	}
+
+	if otlp.MaxRetries < 0 {
+		add(prefix+".max_retries", "must not be negative, got %d", otlp.MaxRetries)
+	}
+
+	if otlp.RetryDelay < 1 {
+		add(prefix+".retry_delay", "must be positive, got %d", otlp.RetryDelay)
+	}
+}
+
+func forwardProblems(prefix string, forward Forward, add addProblem) {
+	if _, _, err := net.SplitHostPort(forward.Address); err != nil {
+		add(prefix+".address", "must be host:port, got %q", forward.Address)
+	}
+
+	if forward.Tag == "" {
+		add(prefix+".tag", "is empty")
+	}
+
+	templateProblems(prefix+".tag", forward.Tag, add)
+
+	if forward.Compression != dictionary.CompressionGzip && forward.Compression != dictionary.CompressionNone {
+		add(prefix+".compression", "unknown value %q", forward.Compression)
+	}
+
+	if forward.Password != "" && forward.Username == "" {
+		add(prefix+".username", "is empty while password is set")
+	}
+
+	if forward.Timeout < 1 {
+		add(prefix+".timeout", "must be positive, got %d", forward.Timeout)
+	}
+}
+
+func kafkaProblems(prefix string, kafka Kafka, add addProblem) {
+	if len(kafka.Brokers) == 0 {
+		add(prefix+".brokers", "is empty")
+	}
+
+	for i, broker := range kafka.Brokers {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			add(fmt.Sprintf("%s.brokers[%d]", prefix, i), "must be host:port, got %q", broker)
+		}
+	}
+
+	if kafka.Topic == "" {
+		add(prefix+".topic", "is empty")
+	}
+
+	templateProblems(prefix+".topic", kafka.Topic, add)
+	templateProblems(prefix+".partition_key", kafka.PartitionKey, add)
+
+	if kafka.Acks != dictionary.KafkaAcksAll && kafka.Acks != dictionary.KafkaAcksLeader && kafka.Acks != dictionary.KafkaAcksNone {
+		add(prefix+".acks", "unknown value %q", kafka.Acks)
+	} else if kafka.Idempotent && kafka.Acks != dictionary.KafkaAcksAll {
+		add(prefix+".acks", "must be %s for the idempotent producer, got %q", dictionary.KafkaAcksAll, kafka.Acks)
+	}
+
+	if kafka.Compression != dictionary.CompressionNone && kafka.Compression != dictionary.CompressionGzip &&
+		kafka.Compression != dictionary.CompressionZstd {
+		add(prefix+".compression", "unknown value %q", kafka.Compression)
+	}
+
+	if kafka.Timeout < 1 {
+		add(prefix+".timeout", "must be positive, got %d", kafka.Timeout)
+	}
+}
+
+func splunkProblems(prefix string, splunk Splunk, add addProblem) {
+	if u, err := url.Parse(splunk.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		add(prefix+".url", "must be an http or https url, got %q", splunk.URL)
+	}
+
+	if splunk.Token == "" {
+		add(prefix+".token", "is empty")
+	}
+
+	templateProblems(prefix+".host", splunk.Host, add)
+	templateProblems(prefix+".source", splunk.Source, add)
+	templateProblems(prefix+".sourcetype", splunk.Sourcetype, add)
+	templateProblems(prefix+".index", splunk.Index, add)
+
+	if splunk.Ack && splunk.AckPollInterval < 1 {
+		add(prefix+".ack_poll_interval", "must be positive, got %d", splunk.AckPollInterval)
+	}
+
+	if splunk.Ack && splunk.AckTimeout < splunk.AckPollInterval {
+		add(prefix+".ack_timeout", "must not be less than ack_poll_interval, got %d", splunk.AckTimeout)
+	}
+
+	tlsProblems(prefix, splunk.CAFile, splunk.CertFile, splunk.KeyFile, add)
+}
+
+func clickHouseProblems(prefix string, clickHouse ClickHouse, add addProblem) {
+	if u, err := url.Parse(clickHouse.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		add(prefix+".url", "must be an http or https url, got %q", clickHouse.URL)
+	}
+
+	if !clickHouseIdentifierRegexp.MatchString(clickHouse.Database) {
+		add(prefix+".database", "must be an identifier, got %q", clickHouse.Database)
+	}
+
+	if !clickHouseIdentifierRegexp.MatchString(clickHouse.Table) {
+		add(prefix+".table", "must be an identifier, got %q", clickHouse.Table)
+	}
+
+	names := make(map[string]bool, len(clickHouse.Columns))
+
+	for i, column := range clickHouse.Columns {
+		field := fmt.Sprintf("%s.columns[%d]", prefix, i)
+
+		if !clickHouseIdentifierRegexp.MatchString(column.Name) {
+			add(field+".name", "must be an identifier, got %q", column.Name)
+		} else if names[column.Name] {
+			add(field+".name", "duplicate name %q", column.Name)
+		}
+
+		names[column.Name] = true
+
+		if !slices.Contains(dictionary.Fields, column.Field) {
+			add(field+".field", "unknown field %q", column.Field)
+		}
+	}
+
+	if clickHouse.CreateTable && clickHouse.Engine == "" {
+		add(prefix+".engine", "is empty while create_table is set")
+	}
+
+	if clickHouse.MaxRetries < 0 {
+		add(prefix+".max_retries", "must not be negative, got %d", clickHouse.MaxRetries)
+	}
+
+	if clickHouse.RetryDelay < 1 {
+		add(prefix+".retry_delay", "must be positive, got %d", clickHouse.RetryDelay)
+	}
+}
+
+func gelfProblems(prefix string, gelf GELF, add addProblem) {
+	switch gelf.Transport {
+	case dictionary.GELFTransportUDP, dictionary.GELFTransportTCP:
+		if _, _, err := net.SplitHostPort(gelf.Address); err != nil {
+			add(prefix+".address", "must be host:port, got %q", gelf.Address)
+		}
+	case dictionary.GELFTransportHTTP:
+		if u, err := url.Parse(gelf.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			add(prefix+".url", "must be an http or https url, got %q", gelf.URL)
+		}
+	default:
+		add(prefix+".transport", "unknown value %q", gelf.Transport)
+	}
+
+	switch gelf.Compression {
+	case dictionary.CompressionGzip, dictionary.CompressionZlib, dictionary.CompressionNone:
+	default:
+		add(prefix+".compression", "unknown value %q", gelf.Compression)
+	}
+
+	if gelf.ChunkSize <= dictionary.GELFChunkHeaderSize || gelf.ChunkSize > dictionary.GELFMaxChunkSize {
+		add(prefix+".chunk_size", "must be between %d and %d, got %d",
+			dictionary.GELFChunkHeaderSize+1, dictionary.GELFMaxChunkSize, gelf.ChunkSize)
+	}
+
+	if gelf.Timeout < 1 {
+		add(prefix+".timeout", "must be positive, got %d", gelf.Timeout)
+	}
+
+	tlsProblems(prefix, gelf.CAFile, gelf.CertFile, gelf.KeyFile, add)
+}
+
+func syslogProblems(prefix string, syslog Syslog, add addProblem) {
+	if syslog.Transport != dictionary.SyslogTransportUDP && syslog.Transport != dictionary.SyslogTransportTCP {
+		add(prefix+".transport", "unknown value %q", syslog.Transport)
+	}
+
+	if _, _, err := net.SplitHostPort(syslog.Address); err != nil {
+		add(prefix+".address", "must be host:port, got %q", syslog.Address)
+	}
+
+	if syslog.Format != dictionary.SyslogFormatRFC5424 && syslog.Format != dictionary.SyslogFormatRFC3164 {
+		add(prefix+".format", "unknown value %q", syslog.Format)
+	}
+
+	if syslog.Framing != dictionary.SyslogFramingOctetCounting && syslog.Framing != dictionary.SyslogFramingNewline {
+		add(prefix+".framing", "unknown value %q", syslog.Framing)
+	}
+
+	if syslog.Facility < 0 || syslog.Facility > dictionary.SyslogMaxFacility {
+		add(prefix+".facility", "must be between 0 and %d, got %d", dictionary.SyslogMaxFacility, syslog.Facility)
+	}
+
+	if syslog.Severity < 0 || syslog.Severity > dictionary.SyslogMaxSeverity {
+		add(prefix+".severity", "must be between 0 and %d, got %d", dictionary.SyslogMaxSeverity, syslog.Severity)
+	}
+
+	templateProblems(prefix+".app_name", syslog.AppName, add)
+	templateProblems(prefix+".hostname", syslog.Hostname, add)
+
+	if !syslogSDIDRegexp.MatchString(syslog.SDID) {
+		add(prefix+".sd_id", "must be up to 32 printable ascii characters except =, ] and \", got %q", syslog.SDID)
+	}
+
+	if syslog.Timeout < 1 {
+		add(prefix+".timeout", "must be positive, got %d", syslog.Timeout)
+	}
+
+	tlsProblems(prefix, syslog.CAFile, syslog.CertFile, syslog.KeyFile, add)
+}
+
+// tlsProblems checks that configured tls files are readable, a client certificate needs both cert_file and key_file.
+func tlsProblems(prefix, caFile, certFile, keyFile string, add addProblem) {
+	for _, file := range []struct{ field, path string }{
+		{field: ".ca_file", path: caFile},
+		{field: ".cert_file", path: certFile},
+		{field: ".key_file", path: keyFile},
+	} {
+		if file.path == "" {
+			continue
+		}
+
+		if f, err := os.Open(file.path); err != nil {
+			add(prefix+file.field, "is not readable: %s", err)
+		} else {
+			_ = f.Close()
+		}
+	}
+
+	if certFile != "" && keyFile == "" {
+		add(prefix+".key_file", "is empty while cert_file is set")
+	}
+
+	if keyFile != "" && certFile == "" {
+		add(prefix+".cert_file", "is empty while key_file is set")
+	}
+}
+
+func fileArchiveProblems(prefix string, archive FileArchive, add addProblem) {
+	if archive.Dir == "" {
+		add(prefix+".dir", "is empty")
+	}
+
+	if archive.MaxSize < 1 {
+		add(prefix+".max_size", "must be positive, got %d", archive.MaxSize)
+	}
+
+	if archive.MaxAge < 1 {
+		add(prefix+".max_age", "must be positive, got %d", archive.MaxAge)
+	}
+
+	switch archive.Compression {
+	case dictionary.CompressionGzip, dictionary.CompressionZstd, dictionary.CompressionNone:
+	default:
+		add(prefix+".compression", "unknown value %q", archive.Compression)
+	}
+
+	if archive.MaxTotalSize < 0 || (archive.MaxTotalSize > 0 && archive.MaxTotalSize < archive.MaxSize) {
+		add(prefix+".max_total_size", "must be zero or at least max_size, got %d", archive.MaxTotalSize)
+	}
+}
+
+func s3Problems(prefix string, s3 S3, add addProblem) {
+	s3ConnectionProblems(prefix, s3, add)
+
+	if strings.HasPrefix(s3.Key, "/") {
+		add(prefix+".key", "must not start with /")
+	}
+
+	templateProblems(prefix+".key", s3.Key, add, dictionary.TemplateDate, dictionary.TemplateNode)
+
+	switch s3.Compression {
+	case dictionary.CompressionGzip, dictionary.CompressionZstd, dictionary.CompressionNone:
+	default:
+		add(prefix+".compression", "unknown value %q", s3.Compression)
+	}
+
+	if s3.PartSize < dictionary.S3MinPartSize {
+		add(prefix+".part_size", "must be at least %d, got %d", dictionary.S3MinPartSize, s3.PartSize)
+	}
+
+	if s3.BufferSize < 1 {
+		add(prefix+".buffer_size", "must be positive, got %d", s3.BufferSize)
+	}
+
+	if s3.BufferInterval < 1 {
+		add(prefix+".buffer_interval", "must be positive, got %d", s3.BufferInterval)
+	}
+
+	if s3.MaxPendingSize < 1 {
+		add(prefix+".max_pending_size", "must be positive, got %d", s3.MaxPendingSize)
+	}
+}
+
+// s3ConnectionProblems checks settings of requests to the bucket.
+func s3ConnectionProblems(prefix string, s3 S3, add addProblem) {
+	if u, err := url.Parse(s3.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		add(prefix+".endpoint", "must be an http or https url, got %q", s3.Endpoint)
+	}
+
+	if s3.Region == "" {
+		add(prefix+".region", "is empty")
+	}
+
+	if !s3BucketRegexp.MatchString(s3.Bucket) {
+		add(prefix+".bucket", "must be a bucket name, got %q", s3.Bucket)
+	}
+
+	if (s3.AccessKey == "") != (s3.SecretKey == "") {
+		add(prefix+".secret_key", "must be set together with access_key")
+	}
+
+	if s3.MaxRetries < 0 {
+		add(prefix+".max_retries", "must not be negative, got %d", s3.MaxRetries)
+	}
+
+	if s3.RetryDelay < 1 {
+		add(prefix+".retry_delay", "must be positive, got %d", s3.RetryDelay)
+	}
+}
+
+func parquetProblems(prefix string, parquet Parquet, add addProblem) {
+	if parquet.Dir == "" {
+		add(prefix+".dir", "is empty")
+	}
+
+	if strings.HasPrefix(parquet.Key, "/") {
+		add(prefix+".key", "must not start with /")
+	}
+
+	templateProblems(prefix+".key", parquet.Key, add, dictionary.TemplateDate, dictionary.TemplateNode)
+
+	names := make(map[string]bool, len(parquet.Fields))
+
+	for i, field := range parquet.Fields {
+		switch {
+		case !slices.Contains(dictionary.Fields, field):
+			add(fmt.Sprintf("%s.fields[%d]", prefix, i), "unknown field %q", field)
+		case names[field] || slices.Contains(dictionary.ParquetColumns, field):
+			add(fmt.Sprintf("%s.fields[%d]", prefix, i), "duplicate column %q", field)
+		}
+
+		names[field] = true
+	}
+
+	switch parquet.Compression {
+	case dictionary.CompressionZstd, dictionary.CompressionGzip, dictionary.CompressionNone:
+	default:
+		add(prefix+".compression", "unknown value %q", parquet.Compression)
+	}
+
+	if parquet.RowGroupSize < 1 {
+		add(prefix+".row_group_size", "must be positive, got %d", parquet.RowGroupSize)
+	}
+
+	if parquet.MaxSize < parquet.RowGroupSize {
+		add(prefix+".max_size", "must be at least row_group_size, got %d", parquet.MaxSize)
+	}
+
+	if parquet.MaxAge < 1 {
+		add(prefix+".max_age", "must be positive, got %d", parquet.MaxAge)
+	}
+
+	if parquet.S3.Bucket != "" {
+		s3ConnectionProblems(prefix+".s3", parquet.S3, add)
+	}
+}
+
+// templateProblems reports placeholders of the template that are not meta fields or extra placeholders.
+func templateProblems(field, template string, add addProblem, extra ...string) {
+	for _, placeholder := range templatePlaceholderRegexp.FindAllString(template, -1) {
+		if !slices.Contains(dictionary.TemplatePlaceholders, placeholder) && !slices.Contains(extra, placeholder) {
+			add(field, "unknown placeholder %s", placeholder)
+		}
+	}
+}
+
+// storageProblems checks es settings of the storage section or of an es output.
+// nolint: funlen, gocognit, cyclop
+func storageProblems(prefix string, storage Storage, add addProblem) {
+	for i, host := range storage.Endpoints() {
+		field := fmt.Sprintf("%s.hosts[%d]", prefix, i)
+		if len(storage.Hosts) == 0 {
+			field = prefix + ".host"
+		}
+
+		raw := host
+
+		// the scheme is optional, fasthttp falls back to http
+		if !strings.Contains(raw, "://") {
+			raw = "http://" + raw
+		}
+
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			add(field, "must be an http or https url, got %q", host)
+		}
+	}
+
+	if storage.Balancer != dictionary.BalancerRoundRobin && storage.Balancer != dictionary.BalancerLeastInflight {
+		add(prefix+".balancer", "unknown value %q", storage.Balancer)
+	}
+
+	if storage.HealthCheckInterval < 1 {
+		add(prefix+".health_check_interval", "must be positive, got %d", storage.HealthCheckInterval)
+	}
+
+	if storage.Sniff && storage.SniffInterval < 1 {
+		add(prefix+".sniff_interval", "must be positive, got %d", storage.SniffInterval)
+	}
+
+	if !storage.DataStream.Enabled() {
+		if problem := indexNameProblem(storage.IndexName); problem != "" {
+			add(prefix+".index_name", "%s", problem)
+		}
+	}
+
+	if ds := storage.DataStream; ds.Enabled() {
+		if problem := indexNameProblem(ds.Name); problem != "" {
+			add(prefix+".data_stream.name", "%s", problem)
+		}
+
+		if ds.Bootstrap {
+			if !esTimeUnitRegexp.MatchString(ds.RolloverMaxAge) {
+				add(prefix+".data_stream.rollover_max_age", "invalid time value %q", ds.RolloverMaxAge)
+			}
+
+			if !esSizeUnitRegexp.MatchString(ds.RolloverMaxSize) {
+				add(prefix+".data_stream.rollover_max_size", "invalid size value %q", ds.RolloverMaxSize)
+			}
+
+			if ds.DeleteAfter != "" && !esTimeUnitRegexp.MatchString(ds.DeleteAfter) {
+				add(prefix+".data_stream.delete_after", "invalid time value %q", ds.DeleteAfter)
+			}
+		}
+	}
+
+	if storage.Template.Enabled && storage.Template.File != "" {
+		if f, err := os.Open(storage.Template.File); err != nil {
+			add(prefix+".template.file", "is not readable: %s", err)
+		} else {
+			_ = f.Close()
+		}
+	}
+
+	if storage.Retention.Enabled {
+		if storage.Retention.Interval < 1 {
+			add(prefix+".retention.interval", "must be positive, got %d", storage.Retention.Interval)
+		}
+
+		if storage.Retention.LeaderElection && storage.Retention.LockIndex == "" {
+			add(prefix+".retention.lock_index", "is empty")
+		}
+
+		if len(storage.Retention.Policies) == 0 {
+			add(prefix+".retention.policies", "is empty")
+		}
+
+		for i, policy := range storage.Retention.Policies {
+			field := fmt.Sprintf("%s.retention.policies[%d]", prefix, i)
+
+			if policy.Pattern == "" {
+				add(field+".pattern", "is empty")
+			}
+
+			if policy.MaxAgeDays < 1 {
+				add(field+".max_age_days", "must be positive, got %d", policy.MaxAgeDays)
+			}
+
+			if policy.GetAction() != dictionary.RetentionActionDelete &&
+				policy.GetAction() != dictionary.RetentionActionClose {
+				add(field+".action", "unknown value %q", policy.Action)
+			}
+		}
+	}
+
+	if storage.FlushInterval < 1 {
+		add(prefix+".flush_interval", "must be positive, got %d", storage.FlushInterval)
+	}
+
+	if storage.Workers < 1 {
+		add(prefix+".workers", "must be positive, got %d", storage.Workers)
+	}
+
+	if storage.UseAuth && storage.Username == "" {
+		add(prefix+".username", "is empty while use_auth is enabled")
+	}
+}
+
+// indexNameProblem checks es index naming restrictions, the date suffix is appended by logfowd.
+func indexNameProblem(name string) string {
+	switch {
+	case name == "":
+		return "is empty"
+	case strings.ToLower(name) != name:
+		return fmt.Sprintf("must be lowercase, got %q", name)
+	case strings.HasPrefix(name, "-") || strings.HasPrefix(name, "_") || strings.HasPrefix(name, "+"):
+		return fmt.Sprintf("must not start with -, _ or +, got %q", name)
+	case strings.ContainsAny(name, `\/*?"<>| ,#:`):
+		return fmt.Sprintf(`must not contain \ / * ? " < > | space , # :, got %q`, name)
+	}
+
+	return ""
+}
+
+// loopback reports whether the address is reachable from the host only, an empty host listens on every interface.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// RestartRequired returns fields changed in next config that can't be applied without a restart.
+func (c Config) RestartRequired(next Config) []string {
+	fields := make([]string, 0)
+
+	if !reflect.DeepEqual(c.LogsPath, next.LogsPath) {
+		fields = append(fields, "logs_path")
+	}
+
+	if c.Output != next.Output {
+		fields = append(fields, "output")
+	}
+
+	if (len(c.Outputs) > 0 || len(next.Outputs) > 0) && !sameQueues(c.Outputs, next.Outputs) {
+		fields = append(fields, "outputs")
+	}
+
+	if c.Storage.Workers != next.Storage.Workers {
+		fields = append(fields, "storage.workers")
+	}
+
+	if c.Admin != next.Admin {
+		fields = append(fields, "admin")
+	}
+
+	if c.Reload != next.Reload {
+		fields = append(fields, "reload")
+	}
+
+	return fields
+}
+
+// sameQueues reports whether outputs have the same names, types and queue settings, routes and output
+// sections can be changed at runtime.
+func sameQueues(outputs, next []Output) bool {
+	if len(outputs) != len(next) {
+		return false
+	}
+
+	for i := range outputs {
+		if outputs[i].Name != next[i].Name ||
+			outputs[i].Type != next[i].Type ||
+			outputs[i].Workers != next[i].Workers ||
+			outputs[i].Overflow != next[i].Overflow {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,564 @@
+package conf
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+func validConfig() Config {
+	return Config{
+		LogsPath: []string{"/var/log/pods"},
+		Output:   dictionary.OutputES,
+		Storage: Storage{
+			Host:                "http://elasticsearch",
+			Port:                "9200",
+			Balancer:            dictionary.BalancerRoundRobin,
+			HealthCheckInterval: 5000,
+			IndexName:           "logfowd",
+			FlushInterval:       1000,
+			Workers:             10,
+		},
+		Stdout: Stdout{Format: dictionary.StdoutFormatBulk, Sample: 1},
+		Admin:  Admin{Enabled: true, Listen: ":8080", HealthTimeout: 120000},
+		Reload: Reload{Watch: true, Debounce: 1000},
+	}
+}
+
+func TestConfig_Problems(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		fields []string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *Config) {},
+		},
+		{
+			name:   "host without scheme",
+			modify: func(c *Config) { c.Storage.Host = "elasticsearch" },
+		},
+		{
+			name: "bad hosts and balancer",
+			modify: func(c *Config) {
+				c.Storage.Hosts = []string{"http://es-1:9200", "ftp://es-2"}
+				c.Storage.Balancer = "random"
+			},
+			fields: []string{"storage.hosts[1]", "storage.balancer"},
+		},
+		{
+			name: "stdout output",
+			modify: func(c *Config) {
+				c.Output = dictionary.OutputStdout
+				c.Stdout = Stdout{Format: "yaml", Sample: 0}
+			},
+			fields: []string{"stdout.format", "stdout.sample"},
+		},
+		{
+			name:   "unknown output",
+			modify: func(c *Config) { c.Output = "kafka" },
+			fields: []string{"output"},
+		},
+		{
+			name: "outputs",
+			modify: func(c *Config) {
+				es := Output{Name: "es", Type: dictionary.OutputES, Workers: 1, FlushInterval: 1000, Overflow: dictionary.OverflowDrop}
+				es.Storage = validConfig().Storage
+
+				c.Outputs = []Output{
+					es,
+					{
+						Name:          "es",
+						Type:          dictionary.OutputStdout,
+						Workers:       0,
+						FlushInterval: 1000,
+						Overflow:      dictionary.OverflowBlock,
+						Routes:        []Route{{Namespace: "kube-*", Pod: "[api"}},
+						Stdout:        Stdout{Format: dictionary.StdoutFormatPretty, Sample: 1},
+					},
+					{Type: "nats", Workers: 1, FlushInterval: 1000, Overflow: "wait"},
+				}
+			},
+			fields: []string{
+				"outputs[1].name",
+				"outputs[1].workers",
+				"outputs[1].routes[0].pod",
+				"outputs[2].name",
+				"outputs[2].type",
+				"outputs[2].overflow",
+			},
+		},
+		{
+			name: "loki output",
+			modify: func(c *Config) {
+				c.Outputs = []Output{{
+					Name:          "loki",
+					Type:          dictionary.OutputLoki,
+					Workers:       1,
+					FlushInterval: 1000,
+					Overflow:      dictionary.OverflowDrop,
+					Loki: Loki{
+						URL:          "loki:3100",
+						Encoding:     dictionary.LokiEncodingProtobuf,
+						Labels:       []string{"namespace", "node"},
+						StaticLabels: map[string]string{"cluster": "dev", "bad-name": "x"},
+						MaxStreams:   0,
+						MaxRetries:   -1,
+						RetryDelay:   1000,
+					},
+				}}
+			},
+			fields: []string{
+				"outputs[0].loki.url",
+				"outputs[0].loki.max_retries",
+				"outputs[0].loki.labels[1]",
+				"outputs[0].loki.static_labels.bad-name",
+				"outputs[0].loki.max_streams",
+			},
+		},
+		{
+			name: "otlp output",
+			modify: func(c *Config) {
+				c.Outputs = []Output{{
+					Name:          "otlp",
+					Type:          dictionary.OutputOTLP,
+					Workers:       1,
+					FlushInterval: 1000,
+					Overflow:      dictionary.OverflowDrop,
+					OTLP: OTLP{
+						URL:         "http://collector:4318",
+						Encoding:    "grpc",
+						Compression: dictionary.CompressionGzip,
+						MaxRetries:  -1,
+						RetryDelay:  100,
+					},
+				}}
+			},
+			fields: []string{"outputs[0].otlp.encoding", "outputs[0].otlp.max_retries"},
+		},
+		{
+			name: "forward output",
+			modify: func(c *Config) {
+				c.Outputs = []Output{{
+					Name:          "fluentd",
+					Type:          dictionary.OutputForward,
+					Workers:       1,
+					FlushInterval: 1000,
+					Overflow:      dictionary.OverflowDrop,
+					Forward: Forward{
+						Address:     "fluentd",
+						Tag:         "kube.{namespace}.{node}",
+						Compression: dictionary.CompressionGzip,
+						Password:    "secret",
+						Timeout:     5000,
+					},
+				}}
+			},
+			fields: []string{"outputs[0].forward.address", "outputs[0].forward.tag", "outputs[0].forward.username"},
+		},
+		{
+			name: "kafka output",
+			modify: func(c *Config) {
+				c.Outputs = []Output{{
+					Name:          "kafka",
+					Type:          dictionary.OutputKafka,
+					Workers:       1,
+					FlushInterval: 1000,
+					Overflow:      dictionary.OverflowDrop,
+					Kafka: Kafka{
+						Brokers:      []string{"kafka:9092", "kafka"},
+						Topic:        "logs-{namespace}",
+						PartitionKey: "{pod_uid}",
+						Acks:         dictionary.KafkaAcksLeader,
+						Compression:  "lz4",
+						Idempotent:   true,
+						Timeout:      1000,
+					},
+				}}
+			},
+			fields: []string{
+				"outputs[0].kafka.brokers[1]",
+				"outputs[0].kafka.partition_key",
+				"outputs[0].kafka.acks",
+				"outputs[0].kafka.compression",
+			},
+		},
+		{
+			name: "splunk output",
+			modify: func(c *Config) {
+				c.Outputs = []Output{{
+					Name:          "splunk",
+					Type:          dictionary.OutputSplunk,
+					Workers:       1,
+					FlushInterval: 1000,
+					Overflow:      dictionary.OverflowDrop,
+					Splunk: Splunk{
+						URL:             "https://splunk:8088",
+						Source:          "{path}",
+						Sourcetype:      "kube:{image}",
+						Ack:             true,
+						AckPollInterval: 1000,
+						AckTimeout:      500,
+					},
+				}}
+			},
+			fields: []string{"outputs[0].splunk.token", "outputs[0].splunk.sourcetype", "outputs[0].splunk.ack_timeout"},
+		},
+		{
+			name: "clickhouse output",
+			modify: func(c *Config) {
+				c.Outputs = []Output{{
+					Name:          "clickhouse",
+					Type:          dictionary.OutputClickHouse,
+					Workers:       1,
+					FlushInterval: 1000,
+					Overflow:      dictionary.OverflowDrop,
+					ClickHouse: ClickHouse{
+						URL:      "http://clickhouse:8123",
+						Database: "default",
+						Table:    "access-logs",
+						Columns: []ClickHouseColumn{
+							{Name: "ts", Field: dictionary.FieldTimestamp},
+							{Name: "ts", Field: "node"},
+						},
+						CreateTable: true,
+						MaxRetries:  3,
+						RetryDelay:  1000,
+					},
+				}}
+			},
+			fields: []string{
+				"outputs[0].clickhouse.table",
+				"outputs[0].clickhouse.columns[1].name",
+				"outputs[0].clickhouse.columns[1].field",
+				"outputs[0].clickhouse.engine",
+			},
+		},
+		{
+			name: "gelf output",
+			modify: func(c *Config) {
+				c.Outputs = []Output{
+					{
+						Name:          "graylog-udp",
+						Type:          dictionary.OutputGELF,
+						Workers:       1,
+						FlushInterval: 1000,
+						Overflow:      dictionary.OverflowDrop,
+						GELF: GELF{
+							Transport:   dictionary.GELFTransportUDP,
+							Address:     "graylog",
+							Compression: "snappy",
+							ChunkSize:   12,
+							Timeout:     5000,
+						},
+					},
+					{
+						Name:          "graylog-http",
+						Type:          dictionary.OutputGELF,
+						Workers:       1,
+						FlushInterval: 1000,
+						Overflow:      dictionary.OverflowDrop,
+						GELF: GELF{
+							Transport:   dictionary.GELFTransportHTTP,
+							URL:         "graylog:12201/gelf",
+							Compression: dictionary.CompressionZlib,
+							ChunkSize:   1420,
+							Timeout:     0,
+						},
+					},
+				}
+			},
+			fields: []string{
+				"outputs[0].gelf.address",
+				"outputs[0].gelf.compression",
+				"outputs[0].gelf.chunk_size",
+				"outputs[1].gelf.url",
+				"outputs[1].gelf.timeout",
+			},
+		},
+		{
+			name: "syslog output",
+			modify: func(c *Config) {
+				c.Outputs = []Output{{
+					Name:          "siem",
+					Type:          dictionary.OutputSyslog,
+					Workers:       1,
+					FlushInterval: 1000,
+					Overflow:      dictionary.OverflowBlock,
+					Syslog: Syslog{
+						Transport: "tls",
+						Address:   "siem:6514",
+						Format:    dictionary.SyslogFormatRFC5424,
+						Framing:   dictionary.SyslogFramingOctetCounting,
+						Facility:  24,
+						Severity:  6,
+						AppName:   "{app}",
+						SDID:      "k8s meta",
+						Timeout:   5000,
+					},
+				}}
+			},
+			fields: []string{
+				"outputs[0].syslog.transport",
+				"outputs[0].syslog.facility",
+				"outputs[0].syslog.app_name",
+				"outputs[0].syslog.sd_id",
+			},
+		},
+		{
+			name: "tls files",
+			modify: func(c *Config) {
+				c.Outputs = []Output{{
+					Name:          "siem",
+					Type:          dictionary.OutputSyslog,
+					Workers:       1,
+					FlushInterval: 1000,
+					Overflow:      dictionary.OverflowBlock,
+					Syslog: Syslog{
+						Transport: dictionary.SyslogTransportTCP,
+						Address:   "siem:6514",
+						Format:    dictionary.SyslogFormatRFC5424,
+						Framing:   dictionary.SyslogFramingOctetCounting,
+						Facility:  1,
+						Severity:  6,
+						SDID:      "meta@32473",
+						TLS:       true,
+						CAFile:    "/not/exists/ca.pem",
+						CertFile:  "/not/exists/cert.pem",
+						Timeout:   5000,
+					},
+				}}
+			},
+			fields: []string{
+				"outputs[0].syslog.ca_file",
+				"outputs[0].syslog.cert_file",
+				"outputs[0].syslog.key_file",
+			},
+		},
+		{
+			name: "file output",
+			modify: func(c *Config) {
+				c.Outputs = []Output{{
+					Name:          "archive",
+					Type:          dictionary.OutputFile,
+					Workers:       1,
+					FlushInterval: 1000,
+					Overflow:      dictionary.OverflowBlock,
+					File: FileArchive{
+						Dir:          "/var/lib/logfowd/archive",
+						MaxSize:      100 << 20,
+						MaxAge:       0,
+						Compression:  "xz",
+						MaxTotalSize: 1 << 20,
+					},
+				}}
+			},
+			fields: []string{"outputs[0].file.max_age", "outputs[0].file.compression", "outputs[0].file.max_total_size"},
+		},
+		{
+			name: "s3 output",
+			modify: func(c *Config) {
+				c.Outputs = []Output{{
+					Name:          "archive",
+					Type:          dictionary.OutputS3,
+					Workers:       1,
+					FlushInterval: 1000,
+					Overflow:      dictionary.OverflowBlock,
+					S3: S3{
+						Endpoint:       "s3.amazonaws.com",
+						Region:         "us-east-1",
+						Bucket:         "Logs",
+						AccessKey:      "access",
+						PathStyle:      true,
+						Key:            "{namespace}/{day}",
+						Compression:    dictionary.CompressionGzip,
+						BufferSize:     64 << 20,
+						BufferInterval: 60000,
+						PartSize:       1 << 20,
+						MaxRetries:     3,
+						RetryDelay:     1000,
+					},
+				}}
+			},
+			fields: []string{
+				"outputs[0].s3.endpoint",
+				"outputs[0].s3.bucket",
+				"outputs[0].s3.secret_key",
+				"outputs[0].s3.key",
+				"outputs[0].s3.part_size",
+				"outputs[0].s3.max_pending_size",
+			},
+		},
+		{
+			name: "parquet output",
+			modify: func(c *Config) {
+				c.Outputs = []Output{{
+					Name:          "analytics",
+					Type:          dictionary.OutputParquet,
+					Workers:       1,
+					FlushInterval: 1000,
+					Overflow:      dictionary.OverflowBlock,
+					Parquet: Parquet{
+						Dir:          "/var/lib/logfowd/parquet",
+						Key:          "{namespace}/{date}",
+						Fields:       []string{"path", "level", "message"},
+						Compression:  "snappy",
+						RowGroupSize: 8 << 20,
+						MaxSize:      1 << 20,
+						MaxAge:       3600000,
+						S3: S3{
+							Endpoint:   "minio:9000",
+							Region:     "us-east-1",
+							Bucket:     "logs",
+							MaxRetries: 3,
+							RetryDelay: 1000,
+						},
+					},
+				}}
+			},
+			fields: []string{
+				"outputs[0].parquet.fields[1]",
+				"outputs[0].parquet.fields[2]",
+				"outputs[0].parquet.compression",
+				"outputs[0].parquet.max_size",
+				"outputs[0].parquet.s3.endpoint",
+			},
+		},
+		{
+			name: "index name",
+			modify: func(c *Config) {
+				c.Storage.IndexName = "Logs"
+			},
+			fields: []string{"storage.index_name"},
+		},
+		{
+			name: "data stream",
+			modify: func(c *Config) {
+				c.Storage.IndexName = ""
+				c.Storage.DataStream = DataStream{
+					Name:            "logs-k8s",
+					Bootstrap:       true,
+					RolloverMaxAge:  "1 day",
+					RolloverMaxSize: "50gb",
+				}
+			},
+			fields: []string{"storage.data_stream.rollover_max_age"},
+		},
+		{
+			name: "retention policies",
+			modify: func(c *Config) {
+				c.Storage.Retention = Retention{
+					Enabled:  true,
+					Interval: 1000,
+					Policies: []RetentionPolicy{
+						{Pattern: "logfowd", MaxAgeDays: 7},
+						{MaxAgeDays: 0, Action: "drop"},
+					},
+				}
+			},
+			fields: []string{
+				"storage.retention.policies[1].pattern",
+				"storage.retention.policies[1].max_age_days",
+				"storage.retention.policies[1].action",
+			},
+		},
+		{
+			name: "template file",
+			modify: func(c *Config) {
+				c.Storage.Template = Template{Enabled: true, File: "/not/exists.json"}
+			},
+			fields: []string{"storage.template.file"},
+		},
+		{
+			name: "tap without token",
+			modify: func(c *Config) {
+				c.Admin.Tap = true
+			},
+			fields: []string{"admin.token"},
+		},
+		{
+			name: "tap on loopback",
+			modify: func(c *Config) {
+				c.Admin.Listen = "127.0.0.1:8080"
+				c.Admin.Tap = true
+			},
+		},
+		{
+			name: "admin and workers",
+			modify: func(c *Config) {
+				c.Admin.Listen = "8080"
+				c.Storage.Workers = 0
+			},
+			fields: []string{"storage.workers", "admin.listen"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := validConfig()
+			tt.modify(&c)
+
+			problems := c.Problems()
+
+			if len(problems) != len(tt.fields) {
+				t.Fatalf("Problems() = %v, want fields %v", problems, tt.fields)
+			}
+
+			for i, problem := range problems {
+				if problem.Field != tt.fields[i] {
+					t.Errorf("Problems()[%d].Field = %s, want %s", i, problem.Field, tt.fields[i])
+				}
+			}
+
+			if err := c.Validate(); (err != nil) != (len(tt.fields) > 0) || (err != nil && !errors.Is(err, dictionary.ErrInvalidConfig)) {
+				t.Errorf("Validate() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestLocateLines(t *testing.T) {
+	t.Parallel()
+
+	data := []byte(`{
+  "storage": {
+    "hosts": [
+      "http://es-1:9200",
+      "http://es-2:9200"
+    ],
+    "retention": {
+      "policies": [
+        {"pattern": "logfowd"}
+      ]
+    }
+  }
+}`)
+
+	lines, err := LocateLines(data)
+	if err != nil {
+		t.Fatalf("LocateLines() error = %v", err)
+	}
+
+	tests := map[string]int{
+		"storage":                               2,
+		"storage.hosts[1]":                      5,
+		"storage.retention.policies[0].pattern": 9,
+		"storage.retention.policies[0].max_age": 9,
+		"storage.retention.lock_index":          7,
+		"admin.listen":                          0,
+	}
+
+	for field, want := range tests {
+		if got := lines.Line(field); got != want {
+			t.Errorf("Line(%s) = %d, want %d", field, got, want)
+		}
+	}
+}
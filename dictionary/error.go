@@ -9,3 +9,43 @@ var ErrBadStatusCode = errors.New("bas status code")
 var ErrChannelClosed = errors.New("channel closed")
 
 var ErrInterfaceAssertion = errors.New("invalid interface assertion")
+
+var ErrUnsupportedVersion = errors.New("unsupported es version")
+
+var ErrUnsupportedFeature = errors.New("feature is not supported by es distribution")
+
+var ErrInvalidRetentionPolicy = errors.New("invalid retention policy")
+
+var ErrComponentStuck = errors.New("components are stuck")
+
+var ErrNotSynced = errors.New("log files are not synced yet")
+
+var ErrNoAliveNodes = errors.New("no alive es nodes")
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+var ErrForwardHandshake = errors.New("forward handshake failed")
+
+var ErrForwardAck = errors.New("forward ack mismatch")
+
+var ErrMsgpack = errors.New("invalid msgpack")
+
+var ErrKafkaProduce = errors.New("kafka produce failed")
+
+var ErrKafkaMalformed = errors.New("malformed kafka response")
+
+var ErrKafkaRetriable = errors.New("kafka retriable error")
+
+var ErrSplunkAckTimeout = errors.New("splunk ack timeout")
+
+var ErrSplunkNoAckID = errors.New("splunk response has no ack id, indexer acknowledgement is disabled for the token")
+
+var ErrGELFTooManyChunks = errors.New("gelf message exceeds max chunks")
+
+var ErrS3Upload = errors.New("s3 upload failed")
+
+var ErrNotDir = errors.New("not a directory")
+
+var ErrOutputStopped = errors.New("output is stopped")
+
+var ErrNoCertificates = errors.New("no pem certificates")
@@ -8,3 +8,27 @@ const (
 	RequestTimeout = 30 * time.Second
 	SendBatchesNum = 2
 )
+
+const (
+	BalancerRoundRobin    = "round_robin"
+	BalancerLeastInflight = "least_inflight"
+)
+
+const (
+	DistributionElasticsearch = "elasticsearch"
+	DistributionOpenSearch    = "opensearch"
+	DistributionUnknown       = "unknown"
+)
+
+const TemplatePriority = 200
+
+const IndexDateLayout = "2006.01.02"
+
+const (
+	RetentionActionDelete = "delete"
+	RetentionActionClose  = "close"
+)
+
+const RetentionLeaseID = "retention"
+
+const TapBufferSize = 1024
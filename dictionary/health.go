@@ -0,0 +1,11 @@
+package dictionary
+
+import "time"
+
+const HeartbeatInterval = 5 * time.Second
+
+const (
+	ComponentWatcher    = "watcher"
+	ComponentDispatcher = "dispatcher"
+	ComponentSender     = "sender"
+)
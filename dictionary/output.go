@@ -0,0 +1,296 @@
+package dictionary
+
+import "time"
+
+const (
+	OutputES     = "es"
+	OutputStdout = "stdout"
+)
+
+const (
+	StdoutFormatBulk   = "bulk"
+	StdoutFormatPretty = "pretty"
+)
+
+const (
+	OverflowBlock = "block"
+	OverflowDrop  = "drop"
+)
+
+const OutputLoki = "loki"
+
+const (
+	LokiEncodingProtobuf = "protobuf"
+	LokiEncodingJSON     = "json"
+)
+
+const (
+	LokiLabelNamespace = "namespace"
+	LokiLabelPod       = "pod"
+	LokiLabelPodID     = "pod_id"
+	LokiLabelContainer = "container"
+)
+
+const (
+	LokiPushPath  = "/loki/api/v1/push"
+	LokiReadyPath = "/ready"
+)
+
+// LokiMaxRetryDelay caps the exponential backoff of retried pushes.
+const LokiMaxRetryDelay = time.Minute
+
+// LokiStreamTTL is how long a label set counts towards the max streams limit after its last event.
+const LokiStreamTTL = time.Hour
+
+const (
+	LokiJobLabel      = "job"
+	LokiJob           = "logfowd"
+	LokiOverflowLabel = "overflow"
+)
+
+const OutputOTLP = "otlp"
+
+const (
+	OTLPEncodingProtobuf = "protobuf"
+	OTLPEncodingJSON     = "json"
+)
+
+const OTLPLogsPath = "/v1/logs"
+
+const OTLPScopeName = "logfowd"
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionZlib = "zlib"
+	CompressionNone = "none"
+)
+
+const (
+	OTLPAttributeNamespace     = "k8s.namespace.name"
+	OTLPAttributePodName       = "k8s.pod.name"
+	OTLPAttributePodUID        = "k8s.pod.uid"
+	OTLPAttributeContainerName = "k8s.container.name"
+)
+
+const OTLPMaxRetryDelay = time.Minute
+
+const (
+	TemplateNamespace = "{namespace}"
+	TemplatePod       = "{pod}"
+	TemplatePodID     = "{pod_id}"
+	TemplateContainer = "{container}"
+	TemplatePath      = "{path}"
+	TemplateDate      = "{date}"
+	TemplateNode      = "{node}"
+)
+
+var TemplatePlaceholders = []string{TemplateNamespace, TemplatePod, TemplatePodID, TemplateContainer, TemplatePath}
+
+const OutputForward = "forward"
+
+// ForwardRetries is how many times a batch is resent over a new connection before the send fails.
+const ForwardRetries = 2
+
+const OutputKafka = "kafka"
+
+const (
+	KafkaAcksAll    = "all"
+	KafkaAcksLeader = "1"
+	KafkaAcksNone   = "0"
+)
+
+// KafkaRetries is how many times batches failed with retriable errors are resent after a metadata refresh.
+const KafkaRetries = 3
+
+// KafkaRetryBackoff is the delay before the first retry, it doubles with every next one.
+const KafkaRetryBackoff = 100 * time.Millisecond
+
+// KafkaMetadataTTL is how long partition leaders of a topic are used before they are requested again.
+const KafkaMetadataTTL = 5 * time.Minute
+
+const OutputSplunk = "splunk"
+
+const (
+	SplunkEventPath  = "/services/collector/event"
+	SplunkAckPath    = "/services/collector/ack"
+	SplunkHealthPath = "/services/collector/health"
+)
+
+// SplunkRetries is how many times a batch not acknowledged within the ack timeout is resent.
+const SplunkRetries = 2
+
+const OutputClickHouse = "clickhouse"
+
+const ClickHousePingPath = "/ping"
+
+// ClickHouseDeduplicationWindow is how many recent insert tokens tables created with a non replicated MergeTree
+// engine keep, replicated engines deduplicate by their replicated_deduplication_window.
+const ClickHouseDeduplicationWindow = 1000
+
+// Fields of events outputs map to their own columns, named like fields of es documents.
+const (
+	FieldMessage       = "message"
+	FieldTimestamp     = "@timestamp"
+	FieldNamespace     = "namespace"
+	FieldPodName       = "pod_name"
+	FieldPodID         = "pod_id"
+	FieldContainerName = "container_name"
+	FieldPath          = "path"
+)
+
+var Fields = []string{
+	FieldMessage,
+	FieldTimestamp,
+	FieldNamespace,
+	FieldPodName,
+	FieldPodID,
+	FieldContainerName,
+	FieldPath,
+}
+
+const OutputGELF = "gelf"
+
+const (
+	GELFTransportUDP  = "udp"
+	GELFTransportTCP  = "tcp"
+	GELFTransportHTTP = "http"
+)
+
+const GELFVersion = "1.1"
+
+// GELFLevelInfo is the syslog level of messages, container logs carry no level of their own.
+const GELFLevelInfo = 6
+
+// GELFChunkHeaderSize is the size of the magic bytes, message id, sequence number and count of a udp chunk,
+// messages are split into at most GELFMaxChunks chunks of at most GELFMaxChunkSize bytes.
+const (
+	GELFChunkHeaderSize = 12
+	GELFMaxChunks       = 128
+	GELFMaxChunkSize    = 65507
+)
+
+// GELFRetries is how many times a tcp batch is resent over a new connection before the send fails.
+const GELFRetries = 2
+
+const OutputSyslog = "syslog"
+
+const (
+	SyslogTransportUDP = "udp"
+	SyslogTransportTCP = "tcp"
+)
+
+const (
+	SyslogFormatRFC5424 = "rfc5424"
+	SyslogFormatRFC3164 = "rfc3164"
+)
+
+const (
+	SyslogFramingOctetCounting = "octet_counting"
+	SyslogFramingNewline       = "newline"
+)
+
+const (
+	SyslogMaxFacility = 23
+	SyslogMaxSeverity = 7
+)
+
+// SyslogNilValue replaces empty header fields of rfc5424 messages.
+const SyslogNilValue = "-"
+
+// Max lengths of rfc5424 header fields and rfc3164 tags, longer values are truncated.
+const (
+	SyslogMaxHostname = 255
+	SyslogMaxAppName  = 48
+	SyslogMaxTag      = 32
+)
+
+// SyslogRetries is how many times a tcp batch is resent over a new connection before the send fails.
+const SyslogRetries = 2
+
+const OutputFile = "file"
+
+// FileArchiveExt is the extension of segments, compressed ones also get the extension of the compression.
+const FileArchiveExt = ".ndjson"
+
+// FileArchiveNoNamespace is the directory of events without a namespace.
+const FileArchiveNoNamespace = "_"
+
+// FileArchiveCheckInterval is how often segments are checked for max age and the archive for max total size.
+const FileArchiveCheckInterval = 10 * time.Second
+
+const OutputS3 = "s3"
+
+// S3MinPartSize is the min size of every part of a multipart upload but the last one.
+const S3MinPartSize = 5 << 20
+
+// S3MaxRetryDelay caps the exponential backoff of retried requests.
+const S3MaxRetryDelay = time.Minute
+
+const (
+	S3Algorithm   = "AWS4-HMAC-SHA256"
+	S3Service     = "s3"
+	S3DateFormat  = "20060102T150405Z"
+	S3ScopeFormat = "20060102"
+)
+
+// S3CheckInterval is how often buffers are checked for the buffer interval.
+const S3CheckInterval = time.Second
+
+// S3NodeEnv is the env var with the node name, the helm chart sets it from spec.nodeName.
+const S3NodeEnv = "NODE_NAME"
+
+const OutputParquet = "parquet"
+
+// ParquetExt is the extension of parquet files, files being written also get ParquetTmpExt.
+const (
+	ParquetExt    = ".parquet"
+	ParquetTmpExt = ".tmp"
+)
+
+// ParquetNameFormat names files after their creation time, so they are listed in the order of writes.
+const ParquetNameFormat = "20060102T150405.000000000Z"
+
+// ParquetCheckInterval is how often files are checked for max age and closed files are uploaded.
+const ParquetCheckInterval = 10 * time.Second
+
+// ParquetColumns are the columns of every parquet file, the fields of es documents.
+var ParquetColumns = []string{
+	FieldMessage,
+	FieldTimestamp,
+	FieldPodName,
+	FieldNamespace,
+	FieldContainerName,
+	FieldPodID,
+}
+
+// Values of the parquet format and of the thrift compact protocol its metadata is encoded with.
+const (
+	ParquetMagic     = "PAR1"
+	ParquetCreatedBy = "logfowd"
+
+	ParquetTypeInt64     = 2
+	ParquetTypeByteArray = 6
+
+	ParquetRepetitionRequired = 0
+
+	ParquetConvertedUTF8            = 0
+	ParquetConvertedTimestampMicros = 10
+
+	ParquetEncodingPlain = 0
+	ParquetEncodingRLE   = 3
+	ParquetPageTypeData  = 0
+
+	ParquetCodecNone = 0
+	ParquetCodecGzip = 2
+	ParquetCodecZstd = 6
+
+	ThriftTypeStop   = 0
+	ThriftTypeTrue   = 1
+	ThriftTypeFalse  = 2
+	ThriftTypeI32    = 5
+	ThriftTypeI64    = 6
+	ThriftTypeBin    = 8
+	ThriftTypeList   = 9
+	ThriftTypeStruct = 12
+)
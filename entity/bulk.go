@@ -0,0 +1,17 @@
+package entity
+
+//go:generate easyjson -all
+type BulkResponse struct {
+	Errors bool                   `json:"errors"`
+	Items  []map[string]*BulkItem `json:"items"`
+}
+
+type BulkItem struct {
+	Status int            `json:"status"`
+	Error  *BulkItemError `json:"error"`
+}
+
+type BulkItemError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
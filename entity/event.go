@@ -15,6 +15,7 @@ func NewEvent(line *Line, meta *Meta) *Event {
 		Message: line.Str,
 		Time:    line.Time,
 		Meta: &Meta{
+			Path:          meta.Path,
 			PodName:       meta.PodName,
 			Namespace:     meta.Namespace,
 			ContainerName: meta.ContainerName,
@@ -1,8 +1,12 @@
 package entity
 
+import "time"
+
 type File struct {
 	Size   int64
 	Offset int64
 	Path   string
+	Inode  uint64
+	ReadAt time.Time
 	Meta   *Meta
 }
@@ -0,0 +1,17 @@
+package entity
+
+// GELFMessage is a gelf 1.1 message, meta fields are sent as additional fields prefixed with an underscore.
+//
+//go:generate easyjson -all
+type GELFMessage struct {
+	Version       string    `json:"version"`
+	Host          string    `json:"host"`
+	ShortMessage  string    `json:"short_message"`
+	Timestamp     EpochTime `json:"timestamp"`
+	Level         int       `json:"level"`
+	Namespace     string    `json:"_namespace,omitempty"`
+	PodName       string    `json:"_pod_name,omitempty"`
+	PodID         string    `json:"_pod_id,omitempty"`
+	ContainerName string    `json:"_container_name,omitempty"`
+	Path          string    `json:"_path,omitempty"`
+}
@@ -4,11 +4,22 @@ import "time"
 
 //go:generate easyjson -all
 type IndexRequest struct {
-	IndexRequestBody *IndexRequestBody `json:"index"`
+	IndexRequestBody  *IndexRequestBody `json:"index,omitempty"`
+	CreateRequestBody *IndexRequestBody `json:"create,omitempty"`
+}
+
+// Body returns body of the bulk action, create actions are used for data streams.
+func (r *IndexRequest) Body() *IndexRequestBody {
+	if r.CreateRequestBody != nil {
+		return r.CreateRequestBody
+	}
+
+	return r.IndexRequestBody
 }
 
 type IndexRequestBody struct {
 	Index string `json:"_index"`
+	Type  string `json:"_type,omitempty"`
 	ID    string `json:"_id"`
 }
 
@@ -20,3 +31,14 @@ type FieldsBody struct {
 	ContainerName string    `json:"container_name"`
 	PodID         string    `json:"pod_id"`
 }
+
+func NewFieldsBody(event *Event) *FieldsBody {
+	return &FieldsBody{
+		Message:       event.Message,
+		Timestamp:     event.Time,
+		PodName:       event.PodName,
+		Namespace:     event.Namespace,
+		ContainerName: event.ContainerName,
+		PodID:         event.PodID,
+	}
+}
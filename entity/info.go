@@ -0,0 +1,13 @@
+package entity
+
+//go:generate easyjson -all
+type InfoResponse struct {
+	Version *InfoVersion `json:"version"`
+	Tagline string       `json:"tagline"`
+}
+
+type InfoVersion struct {
+	Number       string `json:"number"`
+	Distribution string `json:"distribution"`
+	BuildFlavor  string `json:"build_flavor"`
+}
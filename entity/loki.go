@@ -0,0 +1,12 @@
+package entity
+
+//go:generate easyjson -all
+type LokiPushRequest struct {
+	Streams []*LokiStream `json:"streams"`
+}
+
+// LokiStream holds entries of one label set, values are pairs of unix nanoseconds and the line.
+type LokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
@@ -1,6 +1,8 @@
 package entity
 
+// Meta describes the log file of an event, path is the path of the file the event was read from.
 type Meta struct {
+	Path          string
 	Namespace     string
 	PodName       string
 	PodID         string
@@ -0,0 +1,14 @@
+package entity
+
+//go:generate easyjson -all
+type NodesHTTPResponse struct {
+	Nodes map[string]*NodeInfo `json:"nodes"`
+}
+
+type NodeInfo struct {
+	HTTP *NodeHTTP `json:"http"`
+}
+
+type NodeHTTP struct {
+	PublishAddress string `json:"publish_address"`
+}
@@ -0,0 +1,44 @@
+package entity
+
+// OTLPLogsRequest is the json form of ExportLogsServiceRequest, 64-bit integers are encoded as strings
+// as the otlp json mapping requires.
+//
+//go:generate easyjson -all
+type OTLPLogsRequest struct {
+	ResourceLogs []*OTLPResourceLogs `json:"resourceLogs"`
+}
+
+type OTLPResourceLogs struct {
+	Resource  *OTLPResource    `json:"resource"`
+	ScopeLogs []*OTLPScopeLogs `json:"scopeLogs"`
+}
+
+type OTLPResource struct {
+	Attributes []*OTLPKeyValue `json:"attributes"`
+}
+
+type OTLPScopeLogs struct {
+	Scope      *OTLPScope       `json:"scope"`
+	LogRecords []*OTLPLogRecord `json:"logRecords"`
+}
+
+type OTLPScope struct {
+	Name string `json:"name"`
+}
+
+type OTLPLogRecord struct {
+	TimeUnixNano         string        `json:"timeUnixNano"`
+	ObservedTimeUnixNano string        `json:"observedTimeUnixNano"`
+	SeverityNumber       int           `json:"severityNumber,omitempty"`
+	SeverityText         string        `json:"severityText,omitempty"`
+	Body                 *OTLPAnyValue `json:"body"`
+}
+
+type OTLPKeyValue struct {
+	Key   string        `json:"key"`
+	Value *OTLPAnyValue `json:"value"`
+}
+
+type OTLPAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
@@ -0,0 +1,26 @@
+package entity
+
+import "time"
+
+// PipelineCase describes lines of a log file and documents expected to be produced from them.
+//
+//go:generate easyjson -all
+type PipelineCase struct {
+	Name     string      `json:"name"`
+	Path     string      `json:"path"`
+	Meta     *CaseMeta   `json:"meta"`
+	Time     time.Time   `json:"time"`
+	Lines    []string    `json:"lines"`
+	Expected []*TapEvent `json:"expected"`
+}
+
+//easyjson:json
+type PipelineCases []*PipelineCase
+
+// CaseMeta overrides meta parsed from the case path, empty fields are kept.
+type CaseMeta struct {
+	Namespace     string `json:"namespace"`
+	PodName       string `json:"pod_name"`
+	PodID         string `json:"pod_id"`
+	ContainerName string `json:"container_name"`
+}
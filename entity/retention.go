@@ -0,0 +1,24 @@
+package entity
+
+import "time"
+
+//go:generate easyjson -all
+type CatIndex struct {
+	Index  string `json:"index"`
+	Status string `json:"status"`
+}
+
+//easyjson:json
+type CatIndices []*CatIndex
+
+type Lease struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type LeaseResponse struct {
+	Found       bool   `json:"found"`
+	SeqNo       int64  `json:"_seq_no"`
+	PrimaryTerm int64  `json:"_primary_term"`
+	Source      *Lease `json:"_source"`
+}
@@ -0,0 +1,28 @@
+package entity
+
+// SplunkEvent is an event of the hec event endpoint, time is epoch seconds with milliseconds.
+//
+//go:generate easyjson -all
+type SplunkEvent struct {
+	Time       EpochTime         `json:"time"`
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	Sourcetype string            `json:"sourcetype,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Event      string            `json:"event"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+type SplunkResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+type SplunkAckRequest struct {
+	Acks []int64 `json:"acks"`
+}
+
+type SplunkAckResponse struct {
+	Acks map[string]bool `json:"acks"`
+}
@@ -0,0 +1,20 @@
+package entity
+
+import "time"
+
+//go:generate easyjson -all
+type FileStatus struct {
+	Path          string    `json:"path"`
+	Inode         uint64    `json:"inode"`
+	Namespace     string    `json:"namespace"`
+	PodName       string    `json:"pod_name"`
+	PodID         string    `json:"pod_id"`
+	ContainerName string    `json:"container_name"`
+	Offset        int64     `json:"offset"`
+	Size          int64     `json:"size"`
+	BytesBehind   int64     `json:"bytes_behind"`
+	ReadAt        time.Time `json:"read_at"`
+}
+
+//easyjson:json
+type FileStatuses []*FileStatus
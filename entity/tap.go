@@ -0,0 +1,8 @@
+package entity
+
+//go:generate easyjson -all
+type TapEvent struct {
+	Output   string      `json:"output,omitempty"`
+	Index    string      `json:"_index"`
+	Document *FieldsBody `json:"document"`
+}
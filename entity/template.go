@@ -0,0 +1,15 @@
+package entity
+
+//go:generate easyjson -all
+type IndexTemplatesResponse struct {
+	IndexTemplates []*NamedIndexTemplate `json:"index_templates"`
+}
+
+type NamedIndexTemplate struct {
+	Name          string                `json:"name"`
+	IndexTemplate *IndexTemplateVersion `json:"index_template"`
+}
+
+type IndexTemplateVersion struct {
+	Version int `json:"version"`
+}
@@ -0,0 +1,27 @@
+package entity
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/mailru/easyjson/jlexer"
+	"github.com/mailru/easyjson/jwriter"
+)
+
+// EpochTime is encoded as a number of epoch seconds with milliseconds like 1704164645.123.
+type EpochTime time.Time
+
+func (t EpochTime) MarshalEasyJSON(w *jwriter.Writer) {
+	ms := time.Time(t).UnixMilli()
+
+	b := strconv.AppendInt(nil, ms/1000, 10)
+	b = append(b, '.')
+	b = append(b, byte('0'+ms%1000/100), byte('0'+ms%100/10), byte('0'+ms%10))
+
+	w.Raw(b, nil)
+}
+
+func (t *EpochTime) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	*t = EpochTime(time.UnixMilli(int64(math.Round(l.Float64() * 1000))).UTC())
+}
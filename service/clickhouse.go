@@ -0,0 +1,286 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailru/easyjson/jwriter"
+	"github.com/rs/zerolog"
+	uuid "github.com/satori/go.uuid"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"github.com/valyala/fasthttp"
+)
+
+// ClickHouse inserts batches with INSERT ... FORMAT JSONEachRow over the http interface. Failed inserts are retried
+// with the dedup token of the batch, so a batch inserted before the failure is not inserted twice by tables that
+// deduplicate inserts: Replicated* engines and MergeTree ones with non_replicated_deduplication_window.
+type ClickHouse struct {
+	cfg      conf.ClickHouse
+	columns  []conf.ClickHouseColumn
+	insert   string
+	createMx sync.Mutex
+	created  bool
+	httpCli  *fasthttp.Client
+	stop     *outputStop
+	metrics  *OutputMetrics
+	logger   *zerolog.Logger
+}
+
+func NewClickHouse(cfg conf.ClickHouse, metrics *OutputMetrics, logger *zerolog.Logger) *ClickHouse {
+	columns := cfg.TableColumns()
+
+	names := make([]string, 0, len(columns))
+
+	for _, column := range columns {
+		names = append(names, "`"+column.Name+"`")
+	}
+
+	return &ClickHouse{
+		cfg:     cfg,
+		columns: columns,
+		insert:  fmt.Sprintf("INSERT INTO `%s` (%s) FORMAT JSONEachRow", cfg.Table, strings.Join(names, ", ")),
+		httpCli: &fasthttp.Client{},
+		stop:    newOutputStop(),
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+// Start waits for ctx, the table is created by the first batch. Once ctx is done inserts are no longer retried.
+func (s *ClickHouse) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	s.stop.stop()
+
+	return nil
+}
+
+func (s *ClickHouse) Health() error {
+	return nil
+}
+
+// Probe pings the http interface of clickhouse.
+func (s *ClickHouse) Probe() error {
+	return probeRequest(s.httpCli, fasthttp.MethodGet, strings.TrimRight(s.cfg.URL, "/")+dictionary.ClickHousePingPath, nil, nil)
+}
+
+// Close closes idle connections to clickhouse.
+func (s *ClickHouse) Close() error {
+	s.httpCli.CloseIdleConnections()
+
+	return nil
+}
+
+func (s *ClickHouse) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// SendEvents inserts events as one batch, network errors and 5xx responses are retried up to max_retries times
+// with an exponential backoff from retry_delay.
+func (s *ClickHouse) SendEvents(events []*entity.Event) error {
+	err := s.createTable()
+
+	if err == nil {
+		err = s.insertRows(events)
+	}
+
+	if err != nil {
+		s.logger.Err(err).Int("num", len(events)).Msg("insert to clickhouse")
+
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
+		return err
+	}
+
+	s.metrics.BatchesSent.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+func (s *ClickHouse) insertRows(events []*entity.Event) error {
+	body := s.makeBody(events)
+	settings := s.settings(uuid.NewV4().String())
+
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+
+		var status int
+
+		status, err = s.request(settings, body)
+
+		s.metrics.BulkDuration.Observe(time.Since(start).Seconds())
+
+		if err == nil || (status != 0 && status < http.StatusInternalServerError) || attempt >= s.cfg.MaxRetries {
+			return err
+		}
+
+		s.metrics.Retries.Inc()
+
+		delay := time.Duration(s.cfg.RetryDelay) * time.Millisecond << attempt
+
+		s.logger.Warn().Err(err).Int("attempt", attempt+1).Dur("delay", delay).Msg("insert to clickhouse, retrying")
+
+		if !s.stop.wait(delay) {
+			return err
+		}
+	}
+}
+
+// settings returns query parameters of the insert, the dedup token makes clickhouse skip retried batches
+// that were already inserted.
+func (s *ClickHouse) settings(token string) url.Values {
+	settings := url.Values{}
+
+	settings.Set("database", s.cfg.Database)
+	settings.Set("query", s.insert)
+	settings.Set("date_time_input_format", "best_effort")
+	settings.Set("insert_deduplicate", "1")
+	settings.Set("insert_deduplication_token", token)
+
+	if s.cfg.AsyncInsert {
+		settings.Set("async_insert", "1")
+		settings.Set("async_insert_deduplicate", "1")
+
+		if s.cfg.AsyncInsertNoWait {
+			settings.Set("wait_for_async_insert", "0")
+		} else {
+			settings.Set("wait_for_async_insert", "1")
+		}
+	}
+
+	return settings
+}
+
+// makeBody writes a json object per event with configured columns.
+func (s *ClickHouse) makeBody(events []*entity.Event) []byte {
+	w := &jwriter.Writer{}
+
+	for _, event := range events {
+		w.RawByte('{')
+
+		for i, column := range s.columns {
+			if i > 0 {
+				w.RawByte(',')
+			}
+
+			w.String(column.Name)
+			w.RawByte(':')
+			w.String(eventField(event, column.Field))
+		}
+
+		w.RawString("}\n")
+	}
+
+	return w.Buffer.BuildBytes()
+}
+
+// createTable creates the table once when create_table is set.
+func (s *ClickHouse) createTable() error {
+	if !s.cfg.CreateTable {
+		return nil
+	}
+
+	s.createMx.Lock()
+	defer s.createMx.Unlock()
+
+	if s.created {
+		return nil
+	}
+
+	settings := url.Values{}
+
+	settings.Set("database", s.cfg.Database)
+
+	if _, err := s.request(settings, []byte(s.createQuery())); err != nil {
+		return err
+	}
+
+	s.created = true
+
+	s.logger.Info().Str("table", s.cfg.Table).Msg("clickhouse table created")
+
+	return nil
+}
+
+// createQuery returns the ddl of the table, columns get types of their fields. Non replicated MergeTree engines
+// don't deduplicate inserts by default, they get non_replicated_deduplication_window unless the engine sets it.
+func (s *ClickHouse) createQuery() string {
+	definitions := make([]string, 0, len(s.columns))
+
+	for _, column := range s.columns {
+		definitions = append(definitions, "`"+column.Name+"` "+clickHouseType(column.Field))
+	}
+
+	engine := s.cfg.Engine
+	name, _, _ := strings.Cut(strings.TrimSpace(engine), " ")
+	name, _, _ = strings.Cut(name, "(")
+
+	if strings.HasSuffix(name, "MergeTree") &&
+		!strings.HasPrefix(name, "Replicated") &&
+		!strings.Contains(engine, "non_replicated_deduplication_window") {
+		separator := " SETTINGS "
+
+		if strings.Contains(strings.ToUpper(engine), " SETTINGS ") {
+			separator = ", "
+		}
+
+		engine += fmt.Sprintf(
+			"%snon_replicated_deduplication_window = %d",
+			separator,
+			dictionary.ClickHouseDeduplicationWindow,
+		)
+	}
+
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS `%s` (%s) ENGINE = %s",
+		s.cfg.Table,
+		strings.Join(definitions, ", "),
+		engine,
+	)
+}
+
+// request posts the body with the settings, returns the status code, zero on network errors.
+func (s *ClickHouse) request(settings url.Values, body []byte) (int, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetBody(body)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.Set("X-ClickHouse-User", s.cfg.Username)
+	req.Header.Set("X-ClickHouse-Key", s.cfg.Password)
+	req.SetRequestURI(strings.TrimRight(s.cfg.URL, "/") + "/?" + settings.Encode())
+
+	if err := s.httpCli.DoTimeout(req, resp, dictionary.RequestTimeout); err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode() != http.StatusOK {
+		return resp.StatusCode(), fmt.Errorf("%w: %d %s", dictionary.ErrBadStatusCode, resp.StatusCode(), resp.Body())
+	}
+
+	return resp.StatusCode(), nil
+}
+
+func clickHouseType(field string) string {
+	switch field {
+	case dictionary.FieldTimestamp:
+		return "DateTime64(9)"
+	case dictionary.FieldNamespace, dictionary.FieldContainerName:
+		return "LowCardinality(String)"
+	default:
+		return "String"
+	}
+}
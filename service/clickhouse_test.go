@@ -0,0 +1,296 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// fakeClickHouse stores inserted rows once per dedup token, the first failures inserts are stored
+// but answered with 503 like a server failing after the insert.
+type fakeClickHouse struct {
+	*httptest.Server
+	mx       sync.Mutex
+	failures int
+	requests int
+	queries  []string
+	tokens   []string
+	rows     map[string][]string
+}
+
+func newFakeClickHouse(t *testing.T, failures int) *fakeClickHouse {
+	t.Helper()
+
+	server := &fakeClickHouse{failures: failures, rows: make(map[string][]string)}
+
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mx.Lock()
+		defer server.mx.Unlock()
+
+		server.requests++
+
+		if r.Header.Get("X-ClickHouse-User") != "writer" || r.Header.Get("X-ClickHouse-Key") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+
+		query := r.URL.Query()
+
+		if query.Get("database") != "logs" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		if query.Get("query") == "" {
+			server.queries = append(server.queries, string(body))
+
+			return
+		}
+
+		server.queries = append(server.queries, query.Get("query"))
+
+		token := query.Get("insert_deduplication_token")
+
+		server.tokens = append(server.tokens, token)
+
+		if _, ok := server.rows[token]; !ok {
+			server.rows[token] = strings.Split(string(bytes.TrimSpace(body)), "\n")
+		}
+
+		if server.failures > 0 {
+			server.failures--
+
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestClickHouse_SendEvents(t *testing.T) {
+	t.Parallel()
+
+	events := []*entity.Event{{
+		Message: `say "hi"`,
+		Time:    time.Date(2024, 1, 2, 3, 4, 5, 123000000, time.UTC),
+		Meta: &entity.Meta{
+			Path:          "/var/log/pods/default_api_abc/app/0.log",
+			Namespace:     "default",
+			PodName:       "api",
+			PodID:         "abc",
+			ContainerName: "app",
+		},
+	}}
+
+	tests := []struct {
+		name        string
+		columns     []conf.ClickHouseColumn
+		createTable bool
+		failures    int
+		queries     []string
+		row         string
+	}{
+		{
+			name:    "default columns",
+			queries: []string{"INSERT INTO `access` (`timestamp`, `message`, `namespace`, `pod_name`, `pod_id`, `container_name`, `path`) FORMAT JSONEachRow"},
+			row: `{"timestamp":"2024-01-02T03:04:05.123Z","message":"say \"hi\"","namespace":"default",` +
+				`"pod_name":"api","pod_id":"abc","container_name":"app","path":"/var/log/pods/default_api_abc/app/0.log"}`,
+		},
+		{
+			name:        "create table and retry",
+			columns:     []conf.ClickHouseColumn{{Name: "ts", Field: "@timestamp"}, {Name: "ns", Field: "namespace"}, {Name: "msg", Field: "message"}},
+			createTable: true,
+			failures:    2,
+			queries: []string{
+				"CREATE TABLE IF NOT EXISTS `access` (`ts` DateTime64(9), `ns` LowCardinality(String), `msg` String) " +
+					"ENGINE = MergeTree ORDER BY ts SETTINGS non_replicated_deduplication_window = 1000",
+				"INSERT INTO `access` (`ts`, `ns`, `msg`) FORMAT JSONEachRow",
+				"INSERT INTO `access` (`ts`, `ns`, `msg`) FORMAT JSONEachRow",
+				"INSERT INTO `access` (`ts`, `ns`, `msg`) FORMAT JSONEachRow",
+			},
+			row: `{"ts":"2024-01-02T03:04:05.123Z","ns":"default","msg":"say \"hi\""}`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			server := newFakeClickHouse(t, tt.failures)
+
+			clickHouse := NewClickHouse(conf.ClickHouse{
+				URL:         server.URL,
+				Database:    "logs",
+				Table:       "access",
+				Username:    "writer",
+				Password:    "secret",
+				Columns:     tt.columns,
+				CreateTable: tt.createTable,
+				Engine:      "MergeTree ORDER BY ts",
+				MaxRetries:  3,
+				RetryDelay:  1,
+			}, NewMetrics().ForOutput("test"), &logger)
+
+			if err := clickHouse.SendEvents(events); err != nil {
+				t.Fatalf("SendEvents() error = %v", err)
+			}
+
+			server.mx.Lock()
+			defer server.mx.Unlock()
+
+			if !reflect.DeepEqual(server.queries, tt.queries) {
+				t.Errorf("queries = %q, want %q", server.queries, tt.queries)
+			}
+
+			for _, token := range server.tokens {
+				if token != server.tokens[0] {
+					t.Errorf("retried with token %s, want %s", token, server.tokens[0])
+				}
+			}
+
+			if !reflect.DeepEqual(server.rows[server.tokens[0]], []string{tt.row}) {
+				t.Errorf("rows = %q, want %q", server.rows[server.tokens[0]], tt.row)
+			}
+		})
+	}
+}
+
+func TestClickHouse_SendEventsFailure(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	server := newFakeClickHouse(t, 0)
+
+	clickHouse := NewClickHouse(conf.ClickHouse{
+		URL:        server.URL,
+		Database:   "other",
+		Table:      "access",
+		Username:   "writer",
+		Password:   "secret",
+		MaxRetries: 3,
+		RetryDelay: 1,
+	}, NewMetrics().ForOutput("test"), &logger)
+
+	if err := clickHouse.SendEvents([]*entity.Event{{Message: "first", Meta: &entity.Meta{}}}); err == nil {
+		t.Fatal("SendEvents() error = nil, want bad status")
+	}
+
+	server.mx.Lock()
+	defer server.mx.Unlock()
+
+	if server.requests != 1 {
+		t.Errorf("sent %d requests, want 1 without retries of 4xx", server.requests)
+	}
+}
+
+func TestClickHouse_createQuery(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		engine string
+		query  string
+	}{
+		{
+			name:   "merge tree",
+			engine: "MergeTree ORDER BY ts",
+			query:  "MergeTree ORDER BY ts SETTINGS non_replicated_deduplication_window = 1000",
+		},
+		{
+			name:   "replacing merge tree",
+			engine: "ReplacingMergeTree(ts) ORDER BY ns",
+			query:  "ReplacingMergeTree(ts) ORDER BY ns SETTINGS non_replicated_deduplication_window = 1000",
+		},
+		{
+			name:   "merge tree with settings",
+			engine: "MergeTree ORDER BY ts SETTINGS index_granularity = 8192",
+			query:  "MergeTree ORDER BY ts SETTINGS index_granularity = 8192, non_replicated_deduplication_window = 1000",
+		},
+		{
+			name:   "merge tree with window",
+			engine: "MergeTree ORDER BY ts SETTINGS non_replicated_deduplication_window = 100",
+			query:  "MergeTree ORDER BY ts SETTINGS non_replicated_deduplication_window = 100",
+		},
+		{
+			name:   "replicated merge tree",
+			engine: "ReplicatedMergeTree('/clickhouse/tables/{shard}/access', '{replica}') ORDER BY ts",
+			query:  "ReplicatedMergeTree('/clickhouse/tables/{shard}/access', '{replica}') ORDER BY ts",
+		},
+		{name: "log", engine: "Log", query: "Log"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+
+			clickHouse := NewClickHouse(conf.ClickHouse{
+				Table:   "access",
+				Columns: []conf.ClickHouseColumn{{Name: "ts", Field: "@timestamp"}, {Name: "ns", Field: "namespace"}},
+				Engine:  tt.engine,
+			}, NewMetrics().ForOutput("test"), &logger)
+
+			want := "CREATE TABLE IF NOT EXISTS `access` (`ts` DateTime64(9), `ns` LowCardinality(String)) ENGINE = " + tt.query
+
+			if got := clickHouse.createQuery(); got != want {
+				t.Errorf("createQuery() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestClickHouse_SendEvents_Stopped(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	server := newFakeClickHouse(t, 10)
+
+	clickHouse := NewClickHouse(conf.ClickHouse{
+		URL:        server.URL,
+		Database:   "logs",
+		Table:      "access",
+		Username:   "writer",
+		Password:   "secret",
+		MaxRetries: 5,
+		RetryDelay: 60000,
+	}, NewMetrics().ForOutput("test"), &logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_ = clickHouse.Start(ctx)
+
+	if err := clickHouse.SendEvents([]*entity.Event{{Message: "first", Meta: &entity.Meta{}}}); err == nil {
+		t.Error("SendEvents() failing after stop error = nil")
+	}
+
+	server.mx.Lock()
+	defer server.mx.Unlock()
+
+	if server.requests != 1 {
+		t.Errorf("sent %d requests after stop, want 1", server.requests)
+	}
+}
@@ -2,10 +2,14 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mailru/easyjson"
@@ -21,16 +25,25 @@ import (
 type Cli struct {
 	cfg           conf.Config
 	httpCli       *fasthttp.Client
+	pool          *ESPool
+	version       ESVersion
+	setupMx       sync.Mutex
+	ready         atomic.Bool
 	buffers       sync.Pool
 	fieldsBodies  sync.Pool
 	indexRequests sync.Pool
+	metrics       *OutputMetrics
 	logger        *zerolog.Logger
 }
 
-func NewESCli(cfg conf.Config, logger *zerolog.Logger) *Cli {
+func NewESCli(cfg conf.Config, metrics *OutputMetrics, logger *zerolog.Logger) *Cli {
+	httpCli := &fasthttp.Client{}
+
 	return &Cli{
 		cfg:     cfg,
-		httpCli: &fasthttp.Client{},
+		httpCli: httpCli,
+		pool:    NewESPool(cfg, httpCli, logger),
+		version: ESVersion{Distribution: dictionary.DistributionUnknown},
 		buffers: sync.Pool{
 			New: func() interface{} { return &bytes.Buffer{} },
 		},
@@ -40,13 +53,29 @@ func NewESCli(cfg conf.Config, logger *zerolog.Logger) *Cli {
 			},
 		},
 		indexRequests: sync.Pool{
-			New: func() interface{} { return &entity.IndexRequest{IndexRequestBody: &entity.IndexRequestBody{}} },
+			New: func() interface{} {
+				if cfg.Storage.DataStream.Enabled() {
+					return &entity.IndexRequest{CreateRequestBody: &entity.IndexRequestBody{}}
+				}
+
+				return &entity.IndexRequest{IndexRequestBody: &entity.IndexRequestBody{}}
+			},
 		},
-		logger: logger,
+		metrics: metrics,
+		logger:  logger,
 	}
 }
 
 func (s *Cli) SendEvents(events []*entity.Event) error {
+	if err := s.setUp(); err != nil {
+		s.logger.Err(err).Msg("set up es")
+
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
+		return err
+	}
+
 	req := fasthttp.AcquireRequest()
 	resp := fasthttp.AcquireResponse()
 
@@ -57,6 +86,9 @@ func (s *Cli) SendEvents(events []*entity.Event) error {
 	if err != nil {
 		s.logger.Err(err).Msg("make body")
 
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
 		return err
 	}
 
@@ -67,28 +99,166 @@ func (s *Cli) SendEvents(events []*entity.Event) error {
 
 	req.Header.SetMethod(fasthttp.MethodPost)
 
-	req.Header.SetContentType("application/json")
+	s.setHeaders(req, true)
 
-	if s.cfg.Storage.UseAuth {
-		req.Header.Set(
-			"Authorization",
-			"Basic "+base64.StdEncoding.EncodeToString([]byte(s.cfg.Storage.Username+":"+s.cfg.Storage.Password)),
-		)
+	start := time.Now()
+
+	err = s.makeRequest(req, resp, s.getIndexName()+"/_bulk")
+
+	s.metrics.BulkDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
+		return err
+	}
+
+	s.metrics.BatchesSent.WithLabelValues("success").Inc()
+
+	s.countItemFailures(resp.Body())
+
+	return nil
+}
+
+// countItemFailures counts documents rejected by es, the batch itself is considered as sent.
+func (s *Cli) countItemFailures(body []byte) {
+	bulkResp := &entity.BulkResponse{}
+
+	if err := easyjson.Unmarshal(body, bulkResp); err != nil {
+		s.logger.Err(err).Msg("unmarshal bulk response")
+
+		return
+	}
+
+	if !bulkResp.Errors {
+		return
 	}
 
-	req.SetRequestURI(
-		s.cfg.Storage.Host + ":" + s.cfg.Storage.Port + s.cfg.Storage.APIPrefix + s.getIndexName() + "/_bulk",
-	)
+	for _, item := range bulkResp.Items {
+		for _, result := range item {
+			if result == nil || result.Status < http.StatusMultipleChoices {
+				continue
+			}
+
+			s.metrics.ItemFailures.WithLabelValues(strconv.Itoa(result.Status)).Inc()
+			s.metrics.DroppedEvents.Inc()
+
+			if result.Error != nil {
+				s.logger.Debug().
+					Int("status", result.Status).
+					Str("type", result.Error.Type).
+					Str("reason", result.Error.Reason).
+					Msg("document rejected")
+			}
+		}
+	}
+}
+
+// setUp detects the distribution and bootstraps the cluster once, a failed attempt is repeated on the next call,
+// so es being unreachable on startup doesn't stop the worker.
+func (s *Cli) setUp() error {
+	if s.ready.Load() {
+		return nil
+	}
+
+	s.setupMx.Lock()
+	defer s.setupMx.Unlock()
+
+	if s.ready.Load() {
+		return nil
+	}
 
-	if err := s.makeRequest(req, resp); err != nil {
+	if err := s.Detect(); err != nil {
 		return err
 	}
 
+	if err := s.Bootstrap(); err != nil {
+		return err
+	}
+
+	s.ready.Store(true)
+
 	return nil
 }
 
+// Detect requests cluster info and adjusts requests to the detected distribution and version.
+// Servers without es compatible info response, like zincsearch, are handled as unknown distribution.
+func (s *Cli) Detect() error {
+	status, body, err := s.request(fasthttp.MethodGet, "", nil)
+	if err != nil {
+		return err
+	}
+
+	if status != http.StatusOK {
+		return fmt.Errorf("%w: get cluster info: %d", dictionary.ErrBadStatusCode, status)
+	}
+
+	distribution, number := dictionary.DistributionUnknown, ""
+
+	info := &entity.InfoResponse{}
+
+	if easyjson.Unmarshal(body, info) == nil && info.Version != nil && info.Version.Number != "" {
+		distribution, number = dictionary.DistributionElasticsearch, info.Version.Number
+
+		if info.Version.Distribution == dictionary.DistributionOpenSearch {
+			distribution = dictionary.DistributionOpenSearch
+		}
+	}
+
+	version, err := newESVersion(distribution, number)
+	if err != nil {
+		return err
+	}
+
+	s.version = version
+
+	s.logger.Info().
+		Str("distribution", version.Distribution).
+		Str("version", version.Number).
+		Bool("data streams", version.DataStreams()).
+		Msg("es version detected")
+
+	return nil
+}
+
+// Health returns an error when all es nodes are marked as dead.
+func (s *Cli) Health() error {
+	if !s.pool.Alive() {
+		return dictionary.ErrNoAliveNodes
+	}
+
+	return nil
+}
+
+// Probe requests cluster info without bootstrapping the cluster.
+func (s *Cli) Probe() error {
+	return s.Detect()
+}
+
+// Start sets up the cluster and runs health checks of es nodes until ctx is done, a failed set up is retried by
+// the next batch.
+func (s *Cli) Start(ctx context.Context) error {
+	if err := s.setUp(); err != nil {
+		s.logger.Err(err).Msg("set up es")
+	}
+
+	return s.pool.Start(ctx)
+}
+
+// Close closes idle connections to es nodes.
+func (s *Cli) Close() error {
+	s.httpCli.CloseIdleConnections()
+
+	return nil
+}
+
+func (s *Cli) Capabilities() Capabilities {
+	return Capabilities{Indices: true}
+}
+
 func (s *Cli) getIndexName() string {
-	return s.cfg.Storage.IndexName + "-" + time.Now().Format("2006.01.02")
+	return indexName(s.cfg.Storage, time.Now())
 }
 
 func (s *Cli) makeBody(events []*entity.Event) (*bytes.Buffer, error) {
@@ -107,8 +277,10 @@ func (s *Cli) makeBody(events []*entity.Event) (*bytes.Buffer, error) {
 			return buf, dictionary.ErrInterfaceAssertion
 		}
 
-		indexRequest.IndexRequestBody.ID = uuid.NewV4().String()
-		indexRequest.IndexRequestBody.Index = s.getIndexName()
+		body := indexRequest.Body()
+		body.ID = uuid.NewV4().String()
+		body.Index = s.getIndexName()
+		body.Type = s.version.DocType()
 
 		marshalled, err := easyjson.Marshal(indexRequest)
 		if err != nil {
@@ -145,32 +317,87 @@ func (s *Cli) makeBody(events []*entity.Event) (*bytes.Buffer, error) {
 	return buf, nil
 }
 
-func (s *Cli) makeRequest(req *fasthttp.Request, resp *fasthttp.Response) error {
-	httpClient := &fasthttp.Client{}
+// request sends a management request, client errors are not treated as failures and their status is returned.
+func (s *Cli) request(method, path string, body []byte) (int, []byte, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
 
-	start := time.Now()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
 
-	if err := httpClient.DoTimeout(req, resp, dictionary.RequestTimeout); err != nil {
-		s.logRequest(req, resp, time.Since(start), err)
+	req.Header.SetMethod(method)
+	s.setHeaders(req, false)
+
+	if body != nil {
+		req.SetBody(body)
+	}
+
+	err := s.makeRequest(req, resp, path)
+	if err != nil && !(errors.Is(err, dictionary.ErrBadStatusCode) && resp.StatusCode() < http.StatusInternalServerError) {
+		return resp.StatusCode(), nil, err
+	}
+
+	return resp.StatusCode(), append([]byte(nil), resp.Body()...), nil
+}
 
-		if !errors.Is(err, fasthttp.ErrDialTimeout) {
-			return err
+// makeRequest sends request to the next node of the pool, on network errors and 5xx responses the node is marked
+// as dead and the request is retried on another one. A dial timeout is retried once on the same node first, so a
+// single node cluster still gets a retry.
+func (s *Cli) makeRequest(req *fasthttp.Request, resp *fasthttp.Response, path string) error {
+	var err error
+
+	for attempt := 0; attempt < s.pool.Len(); attempt++ {
+		if attempt > 0 {
+			s.metrics.Retries.Inc()
 		}
 
-		if err := httpClient.DoTimeout(req, resp, dictionary.RequestTimeout); err != nil {
-			return err
+		node := s.pool.Next()
+
+		req.SetRequestURI(node.url + s.cfg.Storage.APIPrefix + path)
+
+		start := time.Now()
+
+		err = s.do(node, req, resp)
+
+		if errors.Is(err, fasthttp.ErrDialTimeout) {
+			s.logRequest(req, resp, time.Since(start), err)
+			s.metrics.Retries.Inc()
+
+			start = time.Now()
+			err = s.do(node, req, resp)
+		}
+
+		if err == nil && resp.StatusCode() < http.StatusInternalServerError {
+			s.pool.MarkAlive(node)
+
+			if resp.StatusCode() != http.StatusOK {
+				s.logRequest(req, resp, time.Since(start), dictionary.ErrBadStatusCode)
+
+				return dictionary.ErrBadStatusCode
+			}
+
+			s.logRequest(req, resp, time.Since(start), nil)
+
+			return nil
+		}
+
+		if err == nil {
+			err = dictionary.ErrBadStatusCode
 		}
-	}
 
-	if resp.StatusCode() != http.StatusOK {
-		s.logRequest(req, resp, time.Since(start), dictionary.ErrBadStatusCode)
+		s.logRequest(req, resp, time.Since(start), err)
 
-		return dictionary.ErrBadStatusCode
+		s.pool.MarkDead(node, err)
 	}
 
-	s.logRequest(req, resp, time.Since(start), nil)
+	return err
+}
+
+func (s *Cli) do(node *esNode, req *fasthttp.Request, resp *fasthttp.Response) error {
+	node.inflight.Add(1)
+	defer node.inflight.Add(-1)
 
-	return nil
+	return s.httpCli.DoTimeout(req, resp, dictionary.RequestTimeout)
 }
 
 func (s *Cli) logRequest(
@@ -191,3 +418,22 @@ func (s *Cli) logRequest(
 
 	event.Msg("request")
 }
+
+func (s *Cli) setHeaders(req *fasthttp.Request, ndjson bool) {
+	req.Header.SetContentType(s.version.ContentType(ndjson))
+
+	if accept := s.version.Accept(); accept != "" {
+		req.Header.Set(fasthttp.HeaderAccept, accept)
+	}
+
+	setAuth(s.cfg, req)
+}
+
+func setAuth(cfg conf.Config, req *fasthttp.Request) {
+	if cfg.Storage.UseAuth {
+		req.Header.Set(
+			"Authorization",
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(cfg.Storage.Username+":"+cfg.Storage.Password)),
+		)
+	}
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/valyala/fasthttp"
+)
+
+// Bootstrap checks that the cluster supports configured features, creates missing data stream resources
+// and installs the index template. It must be called after Detect.
+func (s *Cli) Bootstrap() error {
+	ds := s.cfg.Storage.DataStream
+
+	if ds.Enabled() && !s.version.DataStreams() {
+		return fmt.Errorf(
+			"%w: data streams require elasticsearch 7.9+ or opensearch, detected %s %s",
+			dictionary.ErrUnsupportedVersion,
+			s.version.Distribution,
+			s.version.Number,
+		)
+	}
+
+	if s.cfg.Storage.Retention.Enabled && s.version.Distribution == dictionary.DistributionUnknown {
+		return fmt.Errorf("%w: index retention", dictionary.ErrUnsupportedFeature)
+	}
+
+	if ds.Enabled() && ds.Bootstrap {
+		if err := s.ensureLifecyclePolicy(); err != nil {
+			s.logger.Err(err).Str("policy", ds.PolicyName()).Msg("ensure lifecycle policy")
+
+			return err
+		}
+	}
+
+	if s.cfg.Storage.Template.Enabled {
+		if err := s.ensureIndexTemplate(); err != nil {
+			s.logger.Err(err).Str("template", s.templateName()).Msg("ensure index template")
+
+			return err
+		}
+
+		return nil
+	}
+
+	if ds.Enabled() && ds.Bootstrap {
+		if err := s.ensureDataStreamTemplate(); err != nil {
+			s.logger.Err(err).Str("data stream", ds.Name).Msg("ensure data stream template")
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Cli) ensureLifecyclePolicy() error {
+	ds := s.cfg.Storage.DataStream
+
+	path := "_ilm/policy/" + ds.PolicyName()
+	policy := s.ilmPolicy()
+
+	if s.version.Distribution == dictionary.DistributionOpenSearch {
+		path = "_plugins/_ism/policies/" + ds.PolicyName()
+		policy = s.ismPolicy()
+	}
+
+	return s.putIfMissing(path, policy)
+}
+
+func (s *Cli) ensureDataStreamTemplate() error {
+	template, err := s.indexTemplate()
+	if err != nil {
+		return err
+	}
+
+	return s.putIfMissing(s.templatePath(), template)
+}
+
+func (s *Cli) putIfMissing(path string, body interface{}) error {
+	status, _, err := s.request(fasthttp.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+
+	if status == http.StatusOK {
+		s.logger.Debug().Str("path", path).Msg("es resource already exists")
+
+		return nil
+	}
+
+	if status != http.StatusNotFound {
+		return fmt.Errorf("%w: get %s: %d", dictionary.ErrBadStatusCode, path, status)
+	}
+
+	if err := s.put(path, body); err != nil {
+		return err
+	}
+
+	s.logger.Info().Str("path", path).Msg("es resource created")
+
+	return nil
+}
+
+func (s *Cli) put(path string, body interface{}) error {
+	marshalled, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	status, respBody, err := s.request(fasthttp.MethodPut, path, marshalled)
+	if err != nil {
+		return err
+	}
+
+	if status != http.StatusOK && status != http.StatusCreated {
+		return fmt.Errorf("%w: put %s: %d %s", dictionary.ErrBadStatusCode, path, status, respBody)
+	}
+
+	return nil
+}
+
+func (s *Cli) ilmPolicy() map[string]interface{} {
+	ds := s.cfg.Storage.DataStream
+
+	sizeCondition := "max_primary_shard_size"
+
+	// max_primary_shard_size is available since 7.13
+	if s.version.Major == 7 && s.version.Minor < 13 {
+		sizeCondition = "max_size"
+	}
+
+	phases := map[string]interface{}{
+		"hot": map[string]interface{}{
+			"actions": map[string]interface{}{
+				"rollover": map[string]interface{}{
+					"max_age":     ds.RolloverMaxAge,
+					sizeCondition: ds.RolloverMaxSize,
+				},
+			},
+		},
+	}
+
+	if ds.DeleteAfter != "" {
+		phases["delete"] = map[string]interface{}{
+			"min_age": ds.DeleteAfter,
+			"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+		}
+	}
+
+	return map[string]interface{}{"policy": map[string]interface{}{"phases": phases}}
+}
+
+func (s *Cli) ismPolicy() map[string]interface{} {
+	ds := s.cfg.Storage.DataStream
+
+	hot := map[string]interface{}{
+		"name": "hot",
+		"actions": []interface{}{
+			map[string]interface{}{
+				"rollover": map[string]interface{}{
+					"min_index_age": ds.RolloverMaxAge,
+					"min_size":      ds.RolloverMaxSize,
+				},
+			},
+		},
+		"transitions": []interface{}{},
+	}
+
+	states := []interface{}{hot}
+
+	if ds.DeleteAfter != "" {
+		hot["transitions"] = []interface{}{
+			map[string]interface{}{
+				"state_name": "delete",
+				"conditions": map[string]interface{}{"min_index_age": ds.DeleteAfter},
+			},
+		}
+
+		states = append(states, map[string]interface{}{
+			"name":        "delete",
+			"actions":     []interface{}{map[string]interface{}{"delete": map[string]interface{}{}}},
+			"transitions": []interface{}{},
+		})
+	}
+
+	return map[string]interface{}{
+		"policy": map[string]interface{}{
+			"description":   "logfowd data stream " + ds.Name,
+			"default_state": "hot",
+			"states":        states,
+			"ism_template": []interface{}{
+				map[string]interface{}{
+					"index_patterns": []string{ds.Name + "*"},
+					"priority":       dictionary.TemplatePriority,
+				},
+			},
+		},
+	}
+}
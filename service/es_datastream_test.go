@@ -0,0 +1,213 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+// fakeESResources answers GET of existing resources with 200 and of others with 404, bodies of PUT requests
+// are stored by path.
+type fakeESResources struct {
+	*httptest.Server
+	mx       sync.Mutex
+	existing map[string]bool
+	puts     map[string]map[string]interface{}
+}
+
+func newFakeESResources(t *testing.T, existing ...string) *fakeESResources {
+	t.Helper()
+
+	es := &fakeESResources{existing: make(map[string]bool), puts: make(map[string]map[string]interface{})}
+
+	for _, path := range existing {
+		es.existing[path] = true
+	}
+
+	es.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		es.mx.Lock()
+		defer es.mx.Unlock()
+
+		switch r.Method {
+		case http.MethodGet:
+			if !es.existing[r.URL.Path] {
+				w.WriteHeader(http.StatusNotFound)
+
+				return
+			}
+
+			_, _ = w.Write([]byte(`{}`))
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+
+			put := make(map[string]interface{})
+			_ = json.Unmarshal(body, &put)
+
+			es.puts[r.URL.Path] = put
+
+			_, _ = w.Write([]byte(`{"acknowledged":true}`))
+		}
+	}))
+
+	t.Cleanup(es.Close)
+
+	return es
+}
+
+func newDataStreamTestCli(url string, version ESVersion) *Cli {
+	logger := zerolog.Nop()
+
+	cli := NewESCli(conf.Config{
+		Storage: conf.Storage{
+			Hosts:     []string{url},
+			IndexName: "logfowd",
+			APIPrefix: "/",
+			DataStream: conf.DataStream{
+				Name:            "logs-k8s",
+				Bootstrap:       true,
+				RolloverMaxAge:  "1d",
+				RolloverMaxSize: "50gb",
+				DeleteAfter:     "30d",
+			},
+		},
+	}, NewMetrics().ForOutput("test"), &logger)
+
+	cli.version = version
+	cli.ready.Store(true)
+
+	return cli
+}
+
+func TestCli_makeBody_DataStream(t *testing.T) {
+	t.Parallel()
+
+	cli := newDataStreamTestCli("http://127.0.0.1:9200", ESVersion{
+		Distribution: dictionary.DistributionElasticsearch, Number: "8.11.0", Major: 8, Minor: 11,
+	})
+
+	buf, err := cli.makeBody(testEvents())
+	if err != nil {
+		t.Fatalf("makeBody() error = %v", err)
+	}
+
+	action := make(map[string]map[string]interface{})
+
+	if err := json.Unmarshal(bytes.SplitN(buf.Bytes(), []byte("\n"), 2)[0], &action); err != nil {
+		t.Fatalf("unmarshal action: %v", err)
+	}
+
+	if _, ok := action["index"]; ok {
+		t.Errorf("action = %v, data streams accept create actions only", action)
+	}
+
+	if got := action["create"]["_index"]; got != "logs-k8s" {
+		t.Errorf("create _index = %v, want logs-k8s", got)
+	}
+}
+
+func TestCli_Bootstrap_DataStream(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		version      ESVersion
+		existing     []string
+		wantPolicy   string
+		wantTemplate string
+		wantSize     string
+		wantErr      error
+	}{
+		{
+			name:         "elasticsearch 8",
+			version:      ESVersion{Distribution: dictionary.DistributionElasticsearch, Number: "8.11.0", Major: 8, Minor: 11},
+			wantPolicy:   "/_ilm/policy/logs-k8s",
+			wantTemplate: "/_index_template/logs-k8s",
+			wantSize:     "max_primary_shard_size",
+		},
+		{
+			name:         "elasticsearch 7.10",
+			version:      ESVersion{Distribution: dictionary.DistributionElasticsearch, Number: "7.10.2", Major: 7, Minor: 10},
+			wantPolicy:   "/_ilm/policy/logs-k8s",
+			wantTemplate: "/_index_template/logs-k8s",
+			wantSize:     "max_size",
+		},
+		{
+			name:         "opensearch",
+			version:      ESVersion{Distribution: dictionary.DistributionOpenSearch, Number: "2.11.0", Major: 2, Minor: 11},
+			wantPolicy:   "/_plugins/_ism/policies/logs-k8s",
+			wantTemplate: "/_index_template/logs-k8s",
+		},
+		{
+			name:     "existing resources are kept",
+			version:  ESVersion{Distribution: dictionary.DistributionElasticsearch, Number: "8.11.0", Major: 8, Minor: 11},
+			existing: []string{"/_ilm/policy/logs-k8s", "/_index_template/logs-k8s"},
+		},
+		{
+			name:    "elasticsearch 7.8",
+			version: ESVersion{Distribution: dictionary.DistributionElasticsearch, Number: "7.8.0", Major: 7, Minor: 8},
+			wantErr: dictionary.ErrUnsupportedVersion,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			es := newFakeESResources(t, tt.existing...)
+
+			err := newDataStreamTestCli(es.URL, tt.version).Bootstrap()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Bootstrap() error = %v, want %v", err, tt.wantErr)
+			}
+
+			es.mx.Lock()
+			defer es.mx.Unlock()
+
+			if tt.wantPolicy == "" && tt.wantTemplate == "" {
+				if len(es.puts) != 0 {
+					t.Errorf("put %v, want nothing", es.puts)
+				}
+
+				return
+			}
+
+			policy, ok := es.puts[tt.wantPolicy]
+			if !ok {
+				t.Fatalf("policy %s is not put, got %v", tt.wantPolicy, es.puts)
+			}
+
+			encoded, _ := json.Marshal(policy)
+
+			for _, want := range []string{`"rollover"`, `"delete"`, `"30d"`, tt.wantSize} {
+				if !strings.Contains(string(encoded), want) {
+					t.Errorf("policy %s does not contain %s", encoded, want)
+				}
+			}
+
+			template, ok := es.puts[tt.wantTemplate]
+			if !ok {
+				t.Fatalf("template %s is not put, got %v", tt.wantTemplate, es.puts)
+			}
+
+			if _, ok := template["data_stream"]; !ok {
+				t.Errorf("template %v has no data_stream", template)
+			}
+
+			if patterns, _ := json.Marshal(template["index_patterns"]); string(patterns) != `["logs-k8s*"]` {
+				t.Errorf("index_patterns = %s, want [logs-k8s*]", patterns)
+			}
+		})
+	}
+}
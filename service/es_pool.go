@@ -0,0 +1,279 @@
+package service
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"github.com/valyala/fasthttp"
+)
+
+type esNode struct {
+	url      string
+	inflight atomic.Int64
+	dead     atomic.Bool
+}
+
+type ESPool struct {
+	cfg     conf.Config
+	httpCli *fasthttp.Client
+	mx      sync.RWMutex
+	nodes   []*esNode
+	next    atomic.Uint64
+	logger  *zerolog.Logger
+}
+
+func NewESPool(cfg conf.Config, httpCli *fasthttp.Client, logger *zerolog.Logger) *ESPool {
+	endpoints := cfg.Storage.Endpoints()
+	nodes := make([]*esNode, 0, len(endpoints))
+
+	for _, endpoint := range endpoints {
+		nodes = append(nodes, &esNode{url: strings.TrimRight(endpoint, "/")})
+	}
+
+	return &ESPool{
+		cfg:     cfg,
+		httpCli: httpCli,
+		nodes:   nodes,
+		logger:  logger,
+	}
+}
+
+func (s *ESPool) Len() int {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return len(s.nodes)
+}
+
+// Next selects a node using configured balancer, dead nodes are skipped unless all of them are dead.
+func (s *ESPool) Next() *esNode {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	alive := make([]*esNode, 0, len(s.nodes))
+
+	for _, node := range s.nodes {
+		if !node.dead.Load() {
+			alive = append(alive, node)
+		}
+	}
+
+	if len(alive) == 0 {
+		alive = s.nodes
+	}
+
+	if s.cfg.Storage.Balancer == dictionary.BalancerLeastInflight {
+		best := alive[int(s.next.Add(1)%uint64(len(alive)))]
+
+		for _, node := range alive {
+			if node.inflight.Load() < best.inflight.Load() {
+				best = node
+			}
+		}
+
+		return best
+	}
+
+	return alive[int((s.next.Add(1)-1)%uint64(len(alive)))]
+}
+
+// Alive reports whether at least one node is not marked as dead.
+func (s *ESPool) Alive() bool {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	for _, node := range s.nodes {
+		if !node.dead.Load() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *ESPool) MarkDead(node *esNode, err error) {
+	if !node.dead.Swap(true) {
+		s.logger.Err(err).Str("node", node.url).Msg("mark es node as dead")
+	}
+}
+
+func (s *ESPool) MarkAlive(node *esNode) {
+	if node.dead.Swap(false) {
+		s.logger.Info().Str("node", node.url).Msg("mark es node as alive")
+	}
+}
+
+func (s *ESPool) Start(ctx context.Context) error {
+	s.logger.Debug().Msg("start es pool health checker")
+
+	defer s.logger.Debug().Msg("stop es pool health checker")
+
+	healthCheck := time.NewTicker(time.Duration(s.cfg.Storage.HealthCheckInterval) * time.Millisecond)
+	defer healthCheck.Stop()
+
+	var sniff <-chan time.Time
+
+	if s.cfg.Storage.Sniff {
+		if err := s.Sniff(); err != nil {
+			s.logger.Err(err).Msg("sniff es nodes")
+		}
+
+		sniffTicker := time.NewTicker(time.Duration(s.cfg.Storage.SniffInterval) * time.Millisecond)
+		defer sniffTicker.Stop()
+
+		sniff = sniffTicker.C
+	}
+
+	for {
+		select {
+		case <-healthCheck.C:
+			s.probeDead()
+		case <-sniff:
+			if err := s.Sniff(); err != nil {
+				s.logger.Err(err).Msg("sniff es nodes")
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *ESPool) probeDead() {
+	s.mx.RLock()
+	nodes := make([]*esNode, len(s.nodes))
+	copy(nodes, s.nodes)
+	s.mx.RUnlock()
+
+	for _, node := range nodes {
+		if !node.dead.Load() {
+			continue
+		}
+
+		if err := s.ping(node); err != nil {
+			s.logger.Debug().Err(err).Str("node", node.url).Msg("es node is still dead")
+
+			continue
+		}
+
+		s.MarkAlive(node)
+	}
+}
+
+func (s *ESPool) ping(node *esNode) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.SetRequestURI(node.url + s.cfg.Storage.APIPrefix)
+	setAuth(s.cfg, req)
+
+	if err := s.httpCli.DoTimeout(req, resp, dictionary.RequestTimeout); err != nil {
+		return err
+	}
+
+	if resp.StatusCode() >= fasthttp.StatusInternalServerError {
+		return dictionary.ErrBadStatusCode
+	}
+
+	return nil
+}
+
+// Sniff replaces the node list with http publish addresses of cluster nodes, known nodes keep their state.
+func (s *ESPool) Sniff() error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	node := s.Next()
+
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.SetRequestURI(node.url + s.cfg.Storage.APIPrefix + "_nodes/http")
+	setAuth(s.cfg, req)
+
+	if err := s.httpCli.DoTimeout(req, resp, dictionary.RequestTimeout); err != nil {
+		s.MarkDead(node, err)
+
+		return err
+	}
+
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return dictionary.ErrBadStatusCode
+	}
+
+	nodesResp := &entity.NodesHTTPResponse{}
+
+	if err := easyjson.Unmarshal(resp.Body(), nodesResp); err != nil {
+		return err
+	}
+
+	scheme := "http"
+
+	if u, err := url.Parse(node.url); err == nil && u.Scheme != "" {
+		scheme = u.Scheme
+	}
+
+	urls := make([]string, 0, len(nodesResp.Nodes))
+
+	for _, info := range nodesResp.Nodes {
+		if info.HTTP == nil || info.HTTP.PublishAddress == "" {
+			continue
+		}
+
+		// publish address may look like "hostname/10.0.0.1:9200"
+		address := info.HTTP.PublishAddress
+		if i := strings.LastIndex(address, "/"); i >= 0 {
+			address = address[i+1:]
+		}
+
+		urls = append(urls, scheme+"://"+address)
+	}
+
+	if len(urls) == 0 {
+		return nil
+	}
+
+	s.setNodes(urls)
+
+	s.logger.Info().Strs("nodes", urls).Msg("es nodes sniffed")
+
+	return nil
+}
+
+func (s *ESPool) setNodes(urls []string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	known := make(map[string]*esNode, len(s.nodes))
+
+	for _, node := range s.nodes {
+		known[node.url] = node
+	}
+
+	nodes := make([]*esNode, 0, len(urls))
+
+	for _, u := range urls {
+		if node, ok := known[u]; ok {
+			nodes = append(nodes, node)
+
+			continue
+		}
+
+		nodes = append(nodes, &esNode{url: u})
+	}
+
+	s.nodes = nodes
+}
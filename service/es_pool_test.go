@@ -0,0 +1,316 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"github.com/valyala/fasthttp"
+)
+
+type fakeES struct {
+	*httptest.Server
+	fail       atomic.Bool
+	bulks      atomic.Int64
+	sniffTo    []string
+	info       string
+	infoStatus int
+	requests   atomic.Int64
+}
+
+func newFakeES(t *testing.T) *fakeES {
+	t.Helper()
+
+	es := &fakeES{}
+
+	es.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		es.requests.Add(1)
+
+		if es.fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_bulk"):
+			es.bulks.Add(1)
+
+			_, _ = w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+		case r.URL.Path == "/_nodes/http":
+			nodes := make([]string, 0, len(es.sniffTo))
+
+			for i, address := range es.sniffTo {
+				nodes = append(nodes, fmt.Sprintf(`"node%d":{"http":{"publish_address":"host%d/%s"}}`, i, i, address))
+			}
+
+			_, _ = w.Write([]byte(`{"nodes":{` + strings.Join(nodes, ",") + `}}`))
+		case r.URL.Path == "/" && es.infoStatus != 0:
+			w.WriteHeader(es.infoStatus)
+		case r.URL.Path == "/" && es.info != "":
+			_, _ = w.Write([]byte(es.info))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+
+	t.Cleanup(es.Close)
+
+	return es
+}
+
+func newPoolTestCli(balancer string, servers ...*fakeES) *Cli {
+	logger := zerolog.Nop()
+
+	hosts := make([]string, 0, len(servers))
+
+	for _, server := range servers {
+		hosts = append(hosts, server.URL)
+	}
+
+	return NewESCli(conf.Config{
+		Storage: conf.Storage{
+			Hosts:     hosts,
+			Balancer:  balancer,
+			IndexName: "logfowd",
+			APIPrefix: "/",
+		},
+	}, NewMetrics().ForOutput("test"), &logger)
+}
+
+func testEvents() []*entity.Event {
+	return []*entity.Event{
+		{
+			Message: "testlog1",
+			Time:    time.Now(),
+			Meta:    &entity.Meta{Namespace: "test", PodName: "test", PodID: "test", ContainerName: "test"},
+		},
+	}
+}
+
+func TestCli_SendEvents_RoundRobin(t *testing.T) {
+	t.Parallel()
+
+	servers := []*fakeES{newFakeES(t), newFakeES(t), newFakeES(t)}
+	cli := newPoolTestCli(dictionary.BalancerRoundRobin, servers...)
+
+	for i := 0; i < 6; i++ {
+		if err := cli.SendEvents(testEvents()); err != nil {
+			t.Fatalf("SendEvents() error = %v", err)
+		}
+	}
+
+	for i, server := range servers {
+		if got := server.bulks.Load(); got != 2 {
+			t.Errorf("server %d got %d bulks, want 2", i, got)
+		}
+	}
+}
+
+func TestCli_SendEvents_Failover(t *testing.T) {
+	t.Parallel()
+
+	servers := []*fakeES{newFakeES(t), newFakeES(t), newFakeES(t)}
+	cli := newPoolTestCli(dictionary.BalancerRoundRobin, servers...)
+
+	servers[1].fail.Store(true)
+
+	for i := 0; i < 6; i++ {
+		if err := cli.SendEvents(testEvents()); err != nil {
+			t.Fatalf("SendEvents() error = %v", err)
+		}
+	}
+
+	if got := servers[0].bulks.Load() + servers[2].bulks.Load(); got != 6 {
+		t.Errorf("healthy servers got %d bulks, want 6", got)
+	}
+
+	if got := servers[1].requests.Load(); got != 1 {
+		t.Errorf("failed server got %d requests, want 1", got)
+	}
+
+	if !cli.pool.nodes[1].dead.Load() {
+		t.Fatal("failed node is not marked as dead")
+	}
+
+	cli.pool.probeDead()
+
+	if !cli.pool.nodes[1].dead.Load() {
+		t.Fatal("failed node marked as alive while still failing")
+	}
+
+	servers[1].fail.Store(false)
+
+	cli.pool.probeDead()
+
+	if cli.pool.nodes[1].dead.Load() {
+		t.Fatal("recovered node is not marked as alive")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := cli.SendEvents(testEvents()); err != nil {
+			t.Fatalf("SendEvents() error = %v", err)
+		}
+	}
+
+	if got := servers[1].bulks.Load(); got != 1 {
+		t.Errorf("recovered server got %d bulks, want 1", got)
+	}
+}
+
+func TestCli_SendEvents_AllNodesFailed(t *testing.T) {
+	t.Parallel()
+
+	servers := []*fakeES{newFakeES(t), newFakeES(t)}
+	cli := newPoolTestCli(dictionary.BalancerRoundRobin, servers...)
+
+	for _, server := range servers {
+		server.fail.Store(true)
+	}
+
+	if err := cli.SendEvents(testEvents()); err == nil {
+		t.Fatal("SendEvents() expected error when all nodes failed")
+	}
+
+	servers[0].fail.Store(false)
+
+	// all nodes are dead, the pool still has to try them instead of giving up
+	if err := cli.SendEvents(testEvents()); err != nil {
+		t.Fatalf("SendEvents() error = %v", err)
+	}
+}
+
+func TestCli_SendEvents_Unreachable(t *testing.T) {
+	t.Parallel()
+
+	server := newFakeES(t)
+	server.fail.Store(true)
+
+	cli := newPoolTestCli(dictionary.BalancerRoundRobin, server)
+
+	if err := cli.SendEvents(testEvents()); err == nil {
+		t.Fatal("SendEvents() expected error while es is unreachable")
+	}
+
+	if got := testutil.ToFloat64(cli.metrics.DroppedEvents); got != 1 {
+		t.Errorf("dropped = %v, want 1", got)
+	}
+
+	server.fail.Store(false)
+	server.info = `{"version":{"number":"8.11.1"}}`
+
+	if err := cli.SendEvents(testEvents()); err != nil {
+		t.Fatalf("SendEvents() error = %v", err)
+	}
+
+	if cli.version.Major != 8 {
+		t.Errorf("version = %d, want 8 detected on the first batch es is reachable", cli.version.Major)
+	}
+
+	if got := server.bulks.Load(); got != 1 {
+		t.Errorf("server got %d bulks, want 1", got)
+	}
+}
+
+func TestCli_SendEvents_DialTimeout(t *testing.T) {
+	t.Parallel()
+
+	server := newFakeES(t)
+	cli := newPoolTestCli(dictionary.BalancerRoundRobin, server)
+
+	var dials atomic.Int64
+
+	cli.httpCli.Dial = func(addr string) (net.Conn, error) {
+		if dials.Add(1) == 1 {
+			return nil, fasthttp.ErrDialTimeout
+		}
+
+		return fasthttp.Dial(addr)
+	}
+
+	if err := cli.SendEvents(testEvents()); err != nil {
+		t.Fatalf("SendEvents() error = %v", err)
+	}
+
+	if got := server.bulks.Load(); got != 1 {
+		t.Errorf("server got %d bulks, want 1", got)
+	}
+
+	if cli.pool.nodes[0].dead.Load() {
+		t.Error("node is marked as dead after a retried dial timeout")
+	}
+
+	if got := testutil.ToFloat64(cli.metrics.Retries); got != 1 {
+		t.Errorf("retries = %v, want 1", got)
+	}
+}
+
+func TestESPool_Next_LeastInflight(t *testing.T) {
+	t.Parallel()
+
+	servers := []*fakeES{newFakeES(t), newFakeES(t), newFakeES(t)}
+	cli := newPoolTestCli(dictionary.BalancerLeastInflight, servers...)
+
+	cli.pool.nodes[0].inflight.Store(3)
+	cli.pool.nodes[1].inflight.Store(1)
+	cli.pool.nodes[2].inflight.Store(2)
+
+	for i := 0; i < 3; i++ {
+		if node := cli.pool.Next(); node != cli.pool.nodes[1] {
+			t.Fatalf("Next() = %s, want %s", node.url, cli.pool.nodes[1].url)
+		}
+	}
+
+	cli.pool.MarkDead(cli.pool.nodes[1], nil)
+
+	if node := cli.pool.Next(); node != cli.pool.nodes[2] {
+		t.Fatalf("Next() = %s, want %s", node.url, cli.pool.nodes[2].url)
+	}
+}
+
+func TestESPool_Sniff(t *testing.T) {
+	t.Parallel()
+
+	seed := newFakeES(t)
+	discovered := []*fakeES{newFakeES(t), newFakeES(t)}
+
+	for _, server := range discovered {
+		seed.sniffTo = append(seed.sniffTo, strings.TrimPrefix(server.URL, "http://"))
+	}
+
+	cli := newPoolTestCli(dictionary.BalancerRoundRobin, seed)
+
+	if err := cli.pool.Sniff(); err != nil {
+		t.Fatalf("Sniff() error = %v", err)
+	}
+
+	if got := cli.pool.Len(); got != len(discovered) {
+		t.Fatalf("Len() = %d, want %d", got, len(discovered))
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := cli.SendEvents(testEvents()); err != nil {
+			t.Fatalf("SendEvents() error = %v", err)
+		}
+	}
+
+	if got := seed.bulks.Load(); got != 0 {
+		t.Errorf("seed server got %d bulks, want 0", got)
+	}
+
+	for i, server := range discovered {
+		if got := server.bulks.Load(); got != 2 {
+			t.Errorf("discovered server %d got %d bulks, want 2", i, got)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"github.com/valyala/fasthttp"
+)
+
+func (s *Cli) templateName() string {
+	if s.cfg.Storage.Template.Name != "" {
+		return s.cfg.Storage.Template.Name
+	}
+
+	if s.cfg.Storage.DataStream.Enabled() {
+		return s.cfg.Storage.DataStream.Name
+	}
+
+	return s.cfg.Storage.IndexName
+}
+
+func (s *Cli) templateIndexPatterns() []string {
+	if s.cfg.Storage.DataStream.Enabled() {
+		return []string{s.cfg.Storage.DataStream.Name + "*"}
+	}
+
+	return []string{s.cfg.Storage.IndexName + "-*"}
+}
+
+// composableTemplates reports whether _index_template api is available, it was added in ES 7.8.
+func (s *Cli) composableTemplates() bool {
+	if s.version.Distribution == dictionary.DistributionOpenSearch {
+		return true
+	}
+
+	return s.version.Major > 7 || (s.version.Major == 7 && s.version.Minor >= 8)
+}
+
+func (s *Cli) templatePath() string {
+	if s.composableTemplates() {
+		return "_index_template/" + s.templateName()
+	}
+
+	return "_template/" + s.templateName()
+}
+
+// ensureIndexTemplate installs the index template or replaces the existing one when its version is older.
+func (s *Cli) ensureIndexTemplate() error {
+	if s.version.Distribution == dictionary.DistributionUnknown {
+		return fmt.Errorf("%w: index templates", dictionary.ErrUnsupportedFeature)
+	}
+
+	template, err := s.indexTemplate()
+	if err != nil {
+		return err
+	}
+
+	version, _ := template["version"].(int)
+
+	current, exists, err := s.installedTemplateVersion()
+	if err != nil {
+		return err
+	}
+
+	if exists && current >= version {
+		s.logger.Info().
+			Str("template", s.templateName()).
+			Int("installed version", current).
+			Int("version", version).
+			Msg("index template is up to date")
+
+		return nil
+	}
+
+	if err := s.put(s.templatePath(), template); err != nil {
+		return err
+	}
+
+	s.logger.Info().
+		Str("template", s.templateName()).
+		Int("previous version", current).
+		Int("version", version).
+		Msg("index template installed")
+
+	return nil
+}
+
+func (s *Cli) installedTemplateVersion() (int, bool, error) {
+	status, body, err := s.request(fasthttp.MethodGet, s.templatePath(), nil)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if status == http.StatusNotFound {
+		return 0, false, nil
+	}
+
+	if status != http.StatusOK {
+		return 0, false, fmt.Errorf("%w: get %s: %d", dictionary.ErrBadStatusCode, s.templatePath(), status)
+	}
+
+	if s.composableTemplates() {
+		resp := &entity.IndexTemplatesResponse{}
+
+		if err := easyjson.Unmarshal(body, resp); err != nil {
+			return 0, false, err
+		}
+
+		for _, t := range resp.IndexTemplates {
+			if t.Name == s.templateName() && t.IndexTemplate != nil {
+				return t.IndexTemplate.Version, true, nil
+			}
+		}
+
+		return 0, false, nil
+	}
+
+	resp := map[string]*entity.IndexTemplateVersion{}
+
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return 0, false, err
+	}
+
+	t, ok := resp[s.templateName()]
+	if !ok || t == nil {
+		return 0, false, nil
+	}
+
+	return t.Version, true, nil
+}
+
+// indexTemplate returns template loaded from the configured file or the built-in one with mapping overrides applied.
+func (s *Cli) indexTemplate() (map[string]interface{}, error) {
+	cfg := s.cfg.Storage.Template
+
+	var (
+		template map[string]interface{}
+		err      error
+	)
+
+	if cfg.File != "" {
+		template, err = loadTemplateFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		template = s.builtInTemplate()
+	}
+
+	if _, ok := template["version"]; !ok {
+		template["version"] = cfg.Version
+	} else if v, ok := template["version"].(float64); ok {
+		template["version"] = int(v)
+	}
+
+	body := template
+
+	if s.composableTemplates() {
+		body = nestedMap(template, "template")
+	}
+
+	mappings := nestedMap(body, "mappings")
+
+	if s.version.DocType() != "" {
+		mappings = nestedMap(mappings, s.version.DocType())
+	}
+
+	properties := nestedMap(mappings, "properties")
+
+	for field, mapping := range cfg.Mappings {
+		properties[field] = mapping
+	}
+
+	settings := nestedMap(body, "settings")
+
+	for key, value := range cfg.Settings {
+		settings[key] = value
+	}
+
+	return template, nil
+}
+
+func (s *Cli) builtInTemplate() map[string]interface{} {
+	mappings := map[string]interface{}{
+		"dynamic_templates": []interface{}{
+			map[string]interface{}{
+				"strings_as_keyword": map[string]interface{}{
+					"match_mapping_type": "string",
+					"mapping":            map[string]interface{}{"type": "keyword", "ignore_above": 1024},
+				},
+			},
+		},
+		"properties": fieldsBodyProperties(),
+	}
+
+	if s.version.DocType() != "" {
+		mappings = map[string]interface{}{s.version.DocType(): mappings}
+	}
+
+	settings := map[string]interface{}{}
+
+	if s.cfg.Storage.DataStream.Enabled() && s.version.Distribution == dictionary.DistributionElasticsearch {
+		settings["index.lifecycle.name"] = s.cfg.Storage.DataStream.PolicyName()
+	}
+
+	if !s.composableTemplates() {
+		return map[string]interface{}{
+			"index_patterns": s.templateIndexPatterns(),
+			"settings":       settings,
+			"mappings":       mappings,
+		}
+	}
+
+	template := map[string]interface{}{
+		"index_patterns": s.templateIndexPatterns(),
+		"priority":       dictionary.TemplatePriority,
+		"template": map[string]interface{}{
+			"settings": settings,
+			"mappings": mappings,
+		},
+		"_meta": map[string]interface{}{"managed_by": "logfowd"},
+	}
+
+	if s.cfg.Storage.DataStream.Enabled() {
+		template["data_stream"] = map[string]interface{}{}
+	}
+
+	return template
+}
+
+// fieldsBodyProperties maps every field of the document sent to es, message is full text searchable.
+func fieldsBodyProperties() map[string]interface{} {
+	properties := map[string]interface{}{}
+
+	t := reflect.TypeOf(entity.FieldsBody{})
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+
+		switch {
+		case field.Type == reflect.TypeOf(time.Time{}):
+			properties[name] = map[string]interface{}{"type": "date"}
+		case name == "message":
+			properties[name] = map[string]interface{}{"type": "text"}
+		default:
+			properties[name] = map[string]interface{}{"type": "keyword"}
+		}
+	}
+
+	return properties
+}
+
+func loadTemplateFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	template := map[string]interface{}{}
+
+	if err := json.Unmarshal(data, &template); err != nil {
+		return nil, fmt.Errorf("parse template %s: %w", path, err)
+	}
+
+	return template, nil
+}
+
+func nestedMap(m map[string]interface{}, key string) map[string]interface{} {
+	if nested, ok := m[key].(map[string]interface{}); ok {
+		return nested
+	}
+
+	nested := map[string]interface{}{}
+	m[key] = nested
+
+	return nested
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+func TestCli_ensureIndexTemplate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		installed   int
+		version     int
+		wantUpdated bool
+	}{
+		{name: "missing", installed: 0, version: 1, wantUpdated: true},
+		{name: "older", installed: 1, version: 2, wantUpdated: true},
+		{name: "same", installed: 2, version: 2, wantUpdated: false},
+		{name: "newer", installed: 3, version: 2, wantUpdated: false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var put map[string]interface{}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/_index_template/logfowd" {
+					w.WriteHeader(http.StatusNotFound)
+
+					return
+				}
+
+				switch r.Method {
+				case http.MethodGet:
+					if tt.installed == 0 {
+						w.WriteHeader(http.StatusNotFound)
+
+						return
+					}
+
+					_, _ = w.Write([]byte(`{"index_templates":[{"name":"logfowd","index_template":{"version":` +
+						strconv.Itoa(tt.installed) + `}}]}`))
+				case http.MethodPut:
+					body, _ := io.ReadAll(r.Body)
+					_ = json.Unmarshal(body, &put)
+
+					_, _ = w.Write([]byte(`{"acknowledged":true}`))
+				}
+			}))
+			defer server.Close()
+
+			logger := zerolog.Nop()
+
+			cli := NewESCli(conf.Config{
+				Storage: conf.Storage{
+					Hosts:     []string{server.URL},
+					IndexName: "logfowd",
+					APIPrefix: "/",
+					Template: conf.Template{
+						Enabled:  true,
+						Version:  tt.version,
+						Mappings: map[string]interface{}{"pod_name": map[string]interface{}{"type": "wildcard"}},
+					},
+				},
+			}, NewMetrics().ForOutput("test"), &logger)
+
+			cli.version = ESVersion{Distribution: dictionary.DistributionElasticsearch, Number: "8.11.0", Major: 8, Minor: 11}
+
+			if err := cli.ensureIndexTemplate(); err != nil {
+				t.Fatalf("ensureIndexTemplate() error = %v", err)
+			}
+
+			if (put != nil) != tt.wantUpdated {
+				t.Fatalf("template updated = %v, want %v", put != nil, tt.wantUpdated)
+			}
+
+			if put == nil {
+				return
+			}
+
+			if got := put["version"]; got != float64(tt.version) {
+				t.Errorf("version = %v, want %d", got, tt.version)
+			}
+
+			properties := put["template"].(map[string]interface{})["mappings"].(map[string]interface{})["properties"].(map[string]interface{})
+
+			for _, field := range []string{"message", "@timestamp", "pod_name", "namespace", "container_name", "pod_id"} {
+				if _, ok := properties[field]; !ok {
+					t.Errorf("mapping of %s is missing", field)
+				}
+			}
+
+			if got := properties["pod_name"].(map[string]interface{})["type"]; got != "wildcard" {
+				t.Errorf("pod_name type = %v, want wildcard override", got)
+			}
+		})
+	}
+}
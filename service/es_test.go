@@ -86,7 +86,7 @@ func TestCli_makeBody(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
-			s := NewESCli(tt.fields.cfg, tt.fields.logger)
+			s := NewESCli(tt.fields.cfg, NewMetrics().ForOutput("test"), tt.fields.logger)
 
 			_, err := s.makeBody(tt.args.events)
 			if (err != nil) != tt.wantErr {
@@ -99,7 +99,7 @@ func TestCli_makeBody(t *testing.T) {
 }
 
 func BenchmarkCli_makeBody(b *testing.B) {
-	s := NewESCli(conf.Config{}, nil)
+	s := NewESCli(conf.Config{}, NewMetrics().ForOutput("test"), nil)
 
 	const eventsNum = 100
 
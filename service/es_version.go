@@ -0,0 +1,104 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+// ESVersion describes the distribution and version of the cluster detected via GET /.
+type ESVersion struct {
+	Distribution string
+	Number       string
+	Major        int
+	Minor        int
+}
+
+func newESVersion(distribution, number string) (ESVersion, error) {
+	v := ESVersion{Distribution: distribution, Number: number}
+
+	if distribution == dictionary.DistributionUnknown {
+		return v, nil
+	}
+
+	parts := strings.SplitN(strings.SplitN(number, "-", 2)[0], ".", 3)
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return v, fmt.Errorf("%w: parse version %q", dictionary.ErrUnsupportedVersion, number)
+	}
+
+	v.Major = major
+
+	if len(parts) > 1 {
+		if v.Minor, err = strconv.Atoi(parts[1]); err != nil {
+			return v, fmt.Errorf("%w: parse version %q", dictionary.ErrUnsupportedVersion, number)
+		}
+	}
+
+	return v, v.validate()
+}
+
+func (v ESVersion) validate() error {
+	switch {
+	case v.Distribution == dictionary.DistributionElasticsearch && v.Major < 6:
+		return fmt.Errorf("%w: elasticsearch %s, 6.x or newer is required", dictionary.ErrUnsupportedVersion, v.Number)
+	case v.Distribution == dictionary.DistributionOpenSearch && v.Major < 1:
+		return fmt.Errorf("%w: opensearch %s, 1.x or newer is required", dictionary.ErrUnsupportedVersion, v.Number)
+	}
+
+	return nil
+}
+
+func (v ESVersion) isES() bool {
+	return v.Distribution == dictionary.DistributionElasticsearch
+}
+
+// DocType returns mapping type for bulk actions, only ES 6 still requires it.
+func (v ESVersion) DocType() string {
+	if v.isES() && v.Major == 6 {
+		return "_doc"
+	}
+
+	return ""
+}
+
+// DataStreams reports whether the cluster supports data streams.
+func (v ESVersion) DataStreams() bool {
+	switch v.Distribution {
+	case dictionary.DistributionElasticsearch:
+		return v.Major > 7 || (v.Major == 7 && v.Minor >= 9)
+	case dictionary.DistributionOpenSearch:
+		return true
+	}
+
+	return false
+}
+
+// ContentType returns content type of request bodies, ES 8 expects compatibility media types.
+func (v ESVersion) ContentType(ndjson bool) string {
+	if v.isES() && v.Major >= 8 {
+		if ndjson {
+			return "application/vnd.elasticsearch+x-ndjson; compatible-with=" + strconv.Itoa(v.Major)
+		}
+
+		return "application/vnd.elasticsearch+json; compatible-with=" + strconv.Itoa(v.Major)
+	}
+
+	if ndjson && v.Distribution != dictionary.DistributionUnknown {
+		return "application/x-ndjson"
+	}
+
+	return "application/json"
+}
+
+// Accept returns accept header value, empty when the default one should be used.
+func (v ESVersion) Accept() string {
+	if v.isES() && v.Major >= 8 {
+		return "application/vnd.elasticsearch+json; compatible-with=" + strconv.Itoa(v.Major)
+	}
+
+	return ""
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+func TestCli_Detect(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		info            string
+		infoStatus      int
+		wantDistr       string
+		wantMajor       int
+		wantDataStreams bool
+		wantDocType     string
+		wantContentType string
+		wantErr         error
+	}{
+		{
+			name:            "elasticsearch 8",
+			info:            `{"version":{"number":"8.11.1","build_flavor":"default"},"tagline":"You Know, for Search"}`,
+			wantDistr:       dictionary.DistributionElasticsearch,
+			wantMajor:       8,
+			wantDataStreams: true,
+			wantContentType: "application/vnd.elasticsearch+x-ndjson; compatible-with=8",
+		},
+		{
+			name:            "elasticsearch 7.8",
+			info:            `{"version":{"number":"7.8.0"},"tagline":"You Know, for Search"}`,
+			wantDistr:       dictionary.DistributionElasticsearch,
+			wantMajor:       7,
+			wantContentType: "application/x-ndjson",
+		},
+		{
+			name:            "elasticsearch 6",
+			info:            `{"version":{"number":"6.8.23"}}`,
+			wantDistr:       dictionary.DistributionElasticsearch,
+			wantMajor:       6,
+			wantDocType:     "_doc",
+			wantContentType: "application/x-ndjson",
+		},
+		{
+			name:            "opensearch 2",
+			info:            `{"version":{"distribution":"opensearch","number":"2.11.0"}}`,
+			wantDistr:       dictionary.DistributionOpenSearch,
+			wantMajor:       2,
+			wantDataStreams: true,
+			wantContentType: "application/x-ndjson",
+		},
+		{
+			name:            "unknown",
+			info:            `{}`,
+			wantDistr:       dictionary.DistributionUnknown,
+			wantContentType: "application/json",
+		},
+		{
+			name:    "elasticsearch 5",
+			info:    `{"version":{"number":"5.6.0"}}`,
+			wantErr: dictionary.ErrUnsupportedVersion,
+		},
+		{
+			name:       "unauthorized",
+			infoStatus: http.StatusUnauthorized,
+			wantErr:    dictionary.ErrBadStatusCode,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			es := newFakeES(t)
+			es.info = tt.info
+			es.infoStatus = tt.infoStatus
+
+			cli := newPoolTestCli(dictionary.BalancerRoundRobin, es)
+
+			err := cli.Detect()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Detect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			if cli.version.Distribution != tt.wantDistr || cli.version.Major != tt.wantMajor {
+				t.Errorf("Detect() = %s %d, want %s %d",
+					cli.version.Distribution, cli.version.Major, tt.wantDistr, tt.wantMajor)
+			}
+
+			if got := cli.version.DataStreams(); got != tt.wantDataStreams {
+				t.Errorf("DataStreams() = %v, want %v", got, tt.wantDataStreams)
+			}
+
+			if got := cli.version.DocType(); got != tt.wantDocType {
+				t.Errorf("DocType() = %q, want %q", got, tt.wantDocType)
+			}
+
+			if got := cli.version.ContentType(true); got != tt.wantContentType {
+				t.Errorf("ContentType() = %q, want %q", got, tt.wantContentType)
+			}
+		})
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/soulgarden/logfowd/entity"
@@ -18,6 +20,9 @@ type File struct {
 	EntityFile *entity.File
 	reader     *bufio.Reader
 	lines      chan *entity.Line
+	linesRead  atomic.Int64
+	// mx guards position fields of EntityFile, they are written by the reader and read by status and metrics
+	mx sync.RWMutex
 }
 
 func NewFile(path string) (*File, error) {
@@ -30,6 +35,7 @@ func NewFile(path string) (*File, error) {
 		Size:   0,
 		Offset: 0,
 		Path:   path,
+		Inode:  inode(f),
 		Meta:   &entity.Meta{},
 	}
 
@@ -52,8 +58,10 @@ func (s *File) SeekEnd() error {
 		return err
 	}
 
+	s.mx.Lock()
 	s.EntityFile.Size = info.Size()
 	s.EntityFile.Offset = offset
+	s.mx.Unlock()
 
 	s.reader.Reset(s.file)
 
@@ -78,7 +86,7 @@ func (s *File) Reset() error {
 		return err
 	}
 
-	f, err := os.Open(s.EntityFile.Path)
+	f, err := os.Open(s.Snapshot().Path)
 	if err != nil {
 		return err
 	}
@@ -87,7 +95,10 @@ func (s *File) Reset() error {
 
 	s.file = f
 
+	s.mx.Lock()
 	s.EntityFile.Offset = 0
+	s.EntityFile.Inode = inode(f)
+	s.mx.Unlock()
 
 	return nil
 }
@@ -100,7 +111,9 @@ func (s *File) IsTruncated() (bool, error) {
 		return false, err
 	}
 
+	s.mx.Lock()
 	s.EntityFile.Size = info.Size()
+	s.mx.Unlock()
 
 	return size > 0 && size > s.EntityFile.Size, nil
 }
@@ -116,17 +129,45 @@ func (s *File) readLine() error {
 		return err
 	}
 
-	s.EntityFile.Offset = offset - int64(s.reader.Buffered())
-
-	s.lines <- &entity.Line{
-		Pos:  s.EntityFile.Offset,
+	line := &entity.Line{
+		Pos:  offset - int64(s.reader.Buffered()),
 		Str:  strings.TrimRight(str, "\n"),
 		Time: time.Now(),
 	}
 
+	s.mx.Lock()
+	s.EntityFile.Offset = line.Pos
+	s.EntityFile.ReadAt = line.Time
+	s.mx.Unlock()
+
+	s.linesRead.Add(1)
+
+	s.lines <- line
+
 	return nil
 }
 
+// SetPath changes the path of the renamed file.
+func (s *File) SetPath(path string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.EntityFile.Path = path
+}
+
+// Snapshot returns a copy of EntityFile, it is safe to call while the file is read.
+func (s *File) Snapshot() entity.File {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return *s.EntityFile
+}
+
+// LinesRead returns the number of lines read from the file.
+func (s *File) LinesRead() int64 {
+	return s.linesRead.Load()
+}
+
 func (s *File) ListenLine() <-chan *entity.Line {
 	return s.lines
 }
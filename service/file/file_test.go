@@ -0,0 +1,71 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFile_Snapshot_WhileReading(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "0.log")
+
+	if err := os.WriteFile(path, []byte(strings.Repeat("line\n", 1000)), 0o644); err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatalf("NewFile() error = %v", err)
+	}
+
+	var wg sync.WaitGroup
+
+	done := make(chan struct{})
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		for range f.ListenLine() {
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if offset := f.Snapshot().Offset; offset < 0 || offset > 5000 {
+				t.Errorf("offset = %d out of file", offset)
+			}
+		}
+	}()
+
+	if err := f.Read(); err != nil {
+		t.Errorf("Read() error = %v", err)
+	}
+
+	if got := f.Snapshot().Offset; got != 5000 {
+		t.Errorf("offset = %d after read, want 5000", got)
+	}
+
+	f.SetPath(path + ".1")
+
+	if err := f.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+
+	close(done)
+
+	wg.Wait()
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package file
+
+import "os"
+
+func inode(_ *os.File) uint64 {
+	return 0
+}
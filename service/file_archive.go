@@ -0,0 +1,554 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/mailru/easyjson"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+const fileArchiveDay = "2006-01-02"
+
+// FileArchive appends events as ndjson documents to a segment per namespace and day of the read time. Closed
+// segments are compressed in the background and the oldest of them are deleted over the total size limit.
+type FileArchive struct {
+	cfg         conf.FileArchive
+	mx          sync.Mutex
+	segments    map[string]*fileSegment
+	wg          sync.WaitGroup
+	limitMx     sync.Mutex
+	compressMx  sync.Mutex
+	compressing map[string]bool
+	metrics     *OutputMetrics
+	logger      *zerolog.Logger
+}
+
+type fileSegment struct {
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64
+	created time.Time
+	failed  bool
+}
+
+func NewFileArchive(cfg conf.FileArchive, metrics *OutputMetrics, logger *zerolog.Logger) *FileArchive {
+	return &FileArchive{
+		cfg:         cfg,
+		segments:    make(map[string]*fileSegment),
+		compressing: make(map[string]bool),
+		metrics:     metrics,
+		logger:      logger,
+	}
+}
+
+// Start creates the dir, checks that files can be created in it and compresses segments left open by a previous
+// run, then closes segments over max age and enforces the total size limit every FileArchiveCheckInterval until
+// ctx is done.
+func (s *FileArchive) Start(ctx context.Context) error {
+	if err := os.MkdirAll(s.cfg.Dir, 0o755); err != nil {
+		s.logger.Err(err).Str("dir", s.cfg.Dir).Msg("create archive dir")
+	} else if err := writable(s.cfg.Dir); err != nil {
+		s.logger.Err(err).Str("dir", s.cfg.Dir).Msg("archive dir is not writable")
+	}
+
+	s.recover()
+
+	ticker := time.NewTicker(dictionary.FileArchiveCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			s.rotateExpired(time.Now())
+			s.enforceLimit()
+		}
+	}
+}
+
+// Health reports whether the archive dir exists, files are not created in it, that is checked once by Start.
+func (s *FileArchive) Health() error {
+	return isDir(s.cfg.Dir)
+}
+
+// Probe checks that files can be created in the dir.
+func (s *FileArchive) Probe() error {
+	return writableDir(s.cfg.Dir)
+}
+
+// Close closes open segments and waits until they are compressed.
+func (s *FileArchive) Close() error {
+	s.mx.Lock()
+
+	var errs []error
+
+	for key, segment := range s.segments {
+		errs = append(errs, s.closeSegment(segment))
+
+		delete(s.segments, key)
+	}
+
+	s.mx.Unlock()
+
+	s.wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (s *FileArchive) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// SendEvents appends documents to segments of the events and flushes them, segments reaching max size
+// are closed after the batch. Events of segments failed to be written are counted as dropped, other
+// events of the batch are still written.
+func (s *FileArchive) SendEvents(events []*entity.Event) error {
+	start := time.Now()
+
+	written, err := s.write(events)
+
+	s.metrics.BulkDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		s.logger.Err(err).Int("num", len(events)).Int("written", written).Msg("write to file archive")
+
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events) - written))
+
+		return err
+	}
+
+	s.metrics.BatchesSent.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+// write returns how many events were flushed to segments, with the first error when some were not.
+func (s *FileArchive) write(events []*entity.Event) (int, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := time.Now()
+	written := make(map[string]*fileSegment)
+	counts := make(map[string]int)
+
+	var errs []error
+
+	for _, event := range events {
+		key := s.segmentDir(event)
+
+		segment, err := s.writeEvent(key, event, now)
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		written[key] = segment
+		counts[key]++
+	}
+
+	var num int
+
+	for key, segment := range written {
+		if segment.failed {
+			continue
+		}
+
+		if err := segment.writer.Flush(); err != nil {
+			errs = append(errs, err)
+
+			s.discardSegment(key, segment)
+
+			continue
+		}
+
+		num += counts[key]
+
+		if segment.size >= s.cfg.MaxSize || now.Sub(segment.created) >= time.Duration(s.cfg.MaxAge)*time.Millisecond {
+			delete(s.segments, key)
+
+			if err := s.closeSegment(segment); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return num, errs[0]
+	}
+
+	return num, nil
+}
+
+// writeEvent appends the document to the segment of the key, a segment failed to be written is discarded,
+// so next events open a new one.
+func (s *FileArchive) writeEvent(key string, event *entity.Event, now time.Time) (*fileSegment, error) {
+	data, err := easyjson.Marshal(entity.NewFieldsBody(event))
+	if err != nil {
+		return nil, err
+	}
+
+	segment, err := s.segment(key, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = segment.writer.Write(append(data, '\n')); err != nil {
+		s.discardSegment(key, segment)
+
+		return nil, err
+	}
+
+	segment.size += int64(len(data)) + 1
+
+	return segment, nil
+}
+
+// segmentDir returns the dir of the event relative to the archive dir, namespace/day of the read time in utc.
+func (s *FileArchive) segmentDir(event *entity.Event) string {
+	namespace := event.Namespace
+	if namespace == "" {
+		namespace = dictionary.FileArchiveNoNamespace
+	}
+
+	return filepath.Join(namespace, event.Time.UTC().Format(fileArchiveDay))
+}
+
+// segment returns the open segment of the dir or creates one named after its creation time.
+func (s *FileArchive) segment(key string, now time.Time) (*fileSegment, error) {
+	if segment, ok := s.segments[key]; ok {
+		return segment, nil
+	}
+
+	dir := filepath.Join(s.cfg.Dir, key)
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, now.UTC().Format("150405.000000000")+dictionary.FileArchiveExt)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	segment := &fileSegment{path: path, file: file, writer: bufio.NewWriter(file), created: now}
+
+	s.segments[key] = segment
+
+	return segment, nil
+}
+
+// rotateExpired closes segments older than max age, events of past days stop going to their segments
+// at midnight, so those are closed by age too.
+func (s *FileArchive) rotateExpired(now time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for key, segment := range s.segments {
+		if now.Sub(segment.created) < time.Duration(s.cfg.MaxAge)*time.Millisecond {
+			continue
+		}
+
+		delete(s.segments, key)
+
+		if err := s.closeSegment(segment); err != nil {
+			s.logger.Err(err).Str("path", segment.path).Msg("close archive segment")
+		}
+	}
+}
+
+// closeSegment flushes and closes the segment and compresses it in the background.
+func (s *FileArchive) closeSegment(segment *fileSegment) error {
+	err := segment.writer.Flush()
+
+	if closeErr := segment.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.compressClosed(segment.path)
+
+	return nil
+}
+
+// discardSegment closes the segment after a failed write, documents written before the failure are kept
+// and compressed like those of closed segments.
+func (s *FileArchive) discardSegment(key string, segment *fileSegment) {
+	segment.failed = true
+
+	delete(s.segments, key)
+
+	if err := segment.file.Close(); err != nil {
+		s.logger.Err(err).Str("path", segment.path).Msg("close failed archive segment")
+	}
+
+	s.compressClosed(segment.path)
+}
+
+func (s *FileArchive) compressClosed(path string) {
+	s.setCompressing(path, true)
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		s.compress(path)
+		s.enforceLimit()
+	}()
+}
+
+// setCompressing marks the segment as being compressed, so enforceLimit doesn't delete it meanwhile.
+func (s *FileArchive) setCompressing(path string, compressing bool) {
+	s.compressMx.Lock()
+	defer s.compressMx.Unlock()
+
+	if compressing {
+		s.compressing[path] = true
+	} else {
+		delete(s.compressing, path)
+	}
+}
+
+// compress replaces the closed segment by its compressed copy, the segment is kept when compression fails.
+func (s *FileArchive) compress(path string) {
+	defer s.setCompressing(path, false)
+
+	if s.cfg.Compression == dictionary.CompressionNone {
+		return
+	}
+
+	target := path + "." + s.compressionExt()
+
+	if err := s.compressFile(path, target); err != nil {
+		s.logger.Err(err).Str("path", path).Msg("compress archive segment")
+
+		_ = os.Remove(target + ".tmp")
+
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		s.logger.Err(err).Str("path", path).Msg("remove compressed archive segment")
+	}
+}
+
+func (s *FileArchive) compressFile(path, target string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	dst, err := os.OpenFile(target+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	defer dst.Close()
+
+	var w io.WriteCloser
+
+	if s.cfg.Compression == dictionary.CompressionZstd {
+		if w, err = zstd.NewWriter(dst); err != nil {
+			return err
+		}
+	} else {
+		w = gzip.NewWriter(dst)
+	}
+
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(target+".tmp", target)
+}
+
+func (s *FileArchive) compressionExt() string {
+	if s.cfg.Compression == dictionary.CompressionZstd {
+		return "zst"
+	}
+
+	return "gz"
+}
+
+// recover removes partial compressed copies and compresses uncompressed segments that are not open.
+func (s *FileArchive) recover() {
+	busy := s.busyPaths()
+
+	err := filepath.WalkDir(s.cfg.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		switch {
+		case strings.HasSuffix(path, ".tmp") && fileArchiveSegment(strings.TrimSuffix(path, ".tmp")):
+			if err := os.Remove(path); err != nil {
+				s.logger.Err(err).Str("path", path).Msg("remove partial archive segment")
+			}
+		case strings.HasSuffix(path, dictionary.FileArchiveExt) && fileArchiveSegment(path) && !busy[path]:
+			s.setCompressing(path, true)
+			s.wg.Add(1)
+
+			go func() {
+				defer s.wg.Done()
+
+				s.compress(path)
+			}()
+		}
+
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		s.logger.Err(err).Str("dir", s.cfg.Dir).Msg("recover archive segments")
+	}
+}
+
+// enforceLimit deletes the oldest closed segments while the archive is over max total size, then removes
+// dirs left empty. Other files in the dir, partial compressed copies and segments being compressed are kept.
+func (s *FileArchive) enforceLimit() {
+	if s.cfg.MaxTotalSize == 0 {
+		return
+	}
+
+	s.limitMx.Lock()
+	defer s.limitMx.Unlock()
+
+	busy := s.busyPaths()
+
+	type segmentFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var (
+		total  int64
+		closed []segmentFile
+	)
+
+	err := filepath.WalkDir(s.cfg.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		if !fileArchiveSegment(strings.TrimSuffix(path, ".tmp")) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		total += info.Size()
+
+		if !busy[path] && !strings.HasSuffix(path, ".tmp") {
+			closed = append(closed, segmentFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		}
+
+		return nil
+	})
+	if err != nil {
+		s.logger.Err(err).Str("dir", s.cfg.Dir).Msg("measure archive")
+
+		return
+	}
+
+	sort.Slice(closed, func(i, j int) bool {
+		return closed[i].modTime.Before(closed[j].modTime)
+	})
+
+	for _, segment := range closed {
+		if total <= s.cfg.MaxTotalSize {
+			break
+		}
+
+		if err := os.Remove(segment.path); err != nil {
+			s.logger.Err(err).Str("path", segment.path).Msg("delete archive segment")
+
+			continue
+		}
+
+		total -= segment.size
+
+		s.logger.Info().Str("path", segment.path).Msg("archive over max total size, segment deleted")
+
+		for dir := filepath.Dir(segment.path); dir != filepath.Clean(s.cfg.Dir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+}
+
+// busyPaths returns paths of open segments and of segments being compressed.
+func (s *FileArchive) busyPaths() map[string]bool {
+	s.mx.Lock()
+
+	busy := make(map[string]bool, len(s.segments))
+
+	for _, segment := range s.segments {
+		busy[segment.path] = true
+	}
+
+	s.mx.Unlock()
+
+	s.compressMx.Lock()
+	defer s.compressMx.Unlock()
+
+	for path := range s.compressing {
+		busy[path] = true
+	}
+
+	return busy
+}
+
+// fileArchiveSegment reports whether the file is a segment, compressed or not.
+func fileArchiveSegment(path string) bool {
+	name := filepath.Base(path)
+
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+
+	for _, ext := range []string{"", ".gz", ".zst"} {
+		if strings.HasSuffix(name, dictionary.FileArchiveExt+ext) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,476 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// readArchive returns messages of every segment by its dir relative to the archive dir, segments are read
+// in the order of their names.
+func readArchive(t *testing.T, dir string) (map[string][]string, int) {
+	t.Helper()
+
+	var paths []string
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			paths = append(paths, path)
+		}
+
+		return err
+	})
+	if err != nil {
+		t.Fatalf("walk archive: %v", err)
+	}
+
+	sort.Strings(paths)
+
+	messages := make(map[string][]string)
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("open segment: %v", err)
+		}
+
+		var r io.Reader = file
+
+		switch filepath.Ext(path) {
+		case ".gz":
+			if r, err = gzip.NewReader(file); err != nil {
+				t.Fatalf("gzip reader: %v", err)
+			}
+		case ".zst":
+			decoder, err := zstd.NewReader(file)
+			if err != nil {
+				t.Fatalf("zstd reader: %v", err)
+			}
+
+			defer decoder.Close()
+
+			r = decoder
+		}
+
+		rel, _ := filepath.Rel(dir, filepath.Dir(path))
+		scanner := bufio.NewScanner(r)
+
+		for scanner.Scan() {
+			doc := &entity.FieldsBody{}
+			if err := doc.UnmarshalJSON(scanner.Bytes()); err != nil {
+				t.Errorf("unmarshal document: %v", err)
+			}
+
+			messages[rel] = append(messages[rel], doc.Message)
+		}
+
+		file.Close()
+	}
+
+	return messages, len(paths)
+}
+
+func fileArchiveEvents() []*entity.Event {
+	day := time.Date(2024, 1, 2, 23, 59, 59, 0, time.UTC)
+
+	return []*entity.Event{
+		{Message: "first", Time: day, Meta: &entity.Meta{Namespace: "default", PodName: "api"}},
+		{Message: "next day", Time: day.Add(time.Second), Meta: &entity.Meta{Namespace: "default", PodName: "api"}},
+		{Message: "no namespace", Time: day, Meta: &entity.Meta{}},
+		{Message: "second", Time: day, Meta: &entity.Meta{Namespace: "default", PodName: "api"}},
+	}
+}
+
+func TestFileArchive_SendEvents(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		compression string
+		maxSize     int64
+		ext         string
+		segments    int
+	}{
+		{name: "gzip", compression: dictionary.CompressionGzip, maxSize: 1 << 20, ext: ".gz", segments: 3},
+		{name: "zstd", compression: dictionary.CompressionZstd, maxSize: 1 << 20, ext: ".zst", segments: 3},
+		{name: "rotate by size", compression: dictionary.CompressionNone, maxSize: 1, ext: ".ndjson", segments: 4},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			dir := t.TempDir()
+
+			archive := NewFileArchive(conf.FileArchive{
+				Dir:         dir,
+				MaxSize:     tt.maxSize,
+				MaxAge:      3600000,
+				Compression: tt.compression,
+			}, NewMetrics().ForOutput("test"), &logger)
+
+			for _, events := range [][]*entity.Event{fileArchiveEvents()[:3], fileArchiveEvents()[3:]} {
+				if err := archive.SendEvents(events); err != nil {
+					t.Fatalf("SendEvents() error = %v", err)
+				}
+			}
+
+			if err := archive.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			messages, segments := readArchive(t, dir)
+
+			want := map[string][]string{
+				"default/2024-01-02": {"first", "second"},
+				"default/2024-01-03": {"next day"},
+				"_/2024-01-02":       {"no namespace"},
+			}
+
+			if !reflect.DeepEqual(messages, want) {
+				t.Errorf("archived %v, want %v", messages, want)
+			}
+
+			if segments != tt.segments {
+				t.Errorf("archived %d segments, want %d", segments, tt.segments)
+			}
+
+			matches, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*"+tt.ext))
+
+			if len(matches) != tt.segments {
+				t.Errorf("found %d segments with extension %s, want %d", len(matches), tt.ext, tt.segments)
+			}
+		})
+	}
+}
+
+func TestFileArchive_SendEvents_Failure(t *testing.T) {
+	t.Parallel()
+
+	long := strings.Repeat("x", 8192)
+
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, dir string, archive *FileArchive)
+		events  []*entity.Event
+		want    map[string][]string
+		dropped float64
+	}{
+		{
+			name: "segment dir not created",
+			setup: func(t *testing.T, dir string, _ *FileArchive) {
+				t.Helper()
+
+				if err := os.WriteFile(filepath.Join(dir, dictionary.FileArchiveNoNamespace), nil, 0o644); err != nil {
+					t.Fatalf("write file: %v", err)
+				}
+			},
+			events: fileArchiveEvents(),
+			want: map[string][]string{
+				"default/2024-01-02": {"first", "second"},
+				"default/2024-01-03": {"next day"},
+			},
+			dropped: 1,
+		},
+		{
+			name: "segment write failed",
+			setup: func(t *testing.T, _ string, archive *FileArchive) {
+				t.Helper()
+
+				if err := archive.SendEvents(fileArchiveEvents()[:1]); err != nil {
+					t.Fatalf("SendEvents() error = %v", err)
+				}
+
+				_ = archive.segments["default/2024-01-02"].file.Close()
+			},
+			events: []*entity.Event{
+				{Message: long, Time: fileArchiveEvents()[0].Time, Meta: &entity.Meta{Namespace: "default"}},
+				fileArchiveEvents()[1],
+			},
+			want: map[string][]string{
+				"default/2024-01-02": {"first"},
+				"default/2024-01-03": {"next day"},
+			},
+			dropped: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			dir := t.TempDir()
+			metrics := NewMetrics().ForOutput("test")
+
+			archive := NewFileArchive(conf.FileArchive{
+				Dir:         dir,
+				MaxSize:     1 << 20,
+				MaxAge:      3600000,
+				Compression: dictionary.CompressionNone,
+			}, metrics, &logger)
+
+			tt.setup(t, dir, archive)
+
+			if err := archive.SendEvents(tt.events); err == nil {
+				t.Error("SendEvents() error = nil, want write error")
+			}
+
+			if err := archive.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			if messages, _ := readArchive(t, dir); !reflect.DeepEqual(messages, tt.want) {
+				t.Errorf("archived %v, want %v", messages, tt.want)
+			}
+
+			if got := testutil.ToFloat64(metrics.DroppedEvents); got != tt.dropped {
+				t.Errorf("dropped events = %v, want %v", got, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestFileArchive_Health(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	dir := filepath.Join(t.TempDir(), "archive")
+
+	archive := NewFileArchive(conf.FileArchive{Dir: dir}, NewMetrics().ForOutput("test"), &logger)
+
+	if err := archive.Health(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Health() before start error = %v, want %v", err, fs.ErrNotExist)
+	}
+
+	if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat dir after health error = %v, want %v", err, fs.ErrNotExist)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_ = archive.Start(ctx)
+
+	if err := archive.Health(); err != nil {
+		t.Errorf("Health() after start error = %v", err)
+	}
+
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("dir after health = %v, %v, want no files", entries, err)
+	}
+}
+
+func TestFileArchive_RotateExpired(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	dir := t.TempDir()
+
+	archive := NewFileArchive(conf.FileArchive{
+		Dir:         dir,
+		MaxSize:     1 << 20,
+		MaxAge:      60000,
+		Compression: dictionary.CompressionGzip,
+	}, NewMetrics().ForOutput("test"), &logger)
+
+	if err := archive.SendEvents(fileArchiveEvents()[:1]); err != nil {
+		t.Fatalf("SendEvents() error = %v", err)
+	}
+
+	archive.rotateExpired(time.Now())
+
+	if len(archive.segments) != 1 {
+		t.Fatalf("open segments = %d before max age, want 1", len(archive.segments))
+	}
+
+	archive.rotateExpired(time.Now().Add(time.Minute))
+	archive.wg.Wait()
+
+	if len(archive.segments) != 0 {
+		t.Errorf("open segments = %d after max age, want 0", len(archive.segments))
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "default", "2024-01-02", "*.ndjson.gz"))
+
+	if len(matches) != 1 {
+		t.Errorf("found %d compressed segments, want 1", len(matches))
+	}
+}
+
+func TestFileArchive_EnforceLimit(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	dir := t.TempDir()
+
+	now := time.Now()
+
+	old := map[string]time.Duration{
+		"kube-system/2024-01-01/000000.000000000.ndjson.gz": 3 * time.Hour,
+		"default/2024-01-01/000000.000000000.ndjson.gz":     2 * time.Hour,
+		"default/2024-01-02/000000.000000000.ndjson.gz":     time.Hour,
+	}
+
+	for path, age := range old {
+		path = filepath.Join(dir, path)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", 100)), 0o644); err != nil {
+			t.Fatalf("write segment: %v", err)
+		}
+
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+
+	archive := NewFileArchive(conf.FileArchive{
+		Dir:          dir,
+		MaxSize:      1 << 20,
+		MaxAge:       3600000,
+		Compression:  dictionary.CompressionNone,
+		MaxTotalSize: 250,
+	}, NewMetrics().ForOutput("test"), &logger)
+
+	// the open segment is counted but never deleted
+	if err := archive.SendEvents(fileArchiveEvents()[:1]); err != nil {
+		t.Fatalf("SendEvents() error = %v", err)
+	}
+
+	archive.enforceLimit()
+
+	if _, err := os.Stat(filepath.Join(dir, "kube-system")); !os.IsNotExist(err) {
+		t.Errorf("stat emptied namespace dir error = %v, want not exists", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "default", "2024-01-01")); !os.IsNotExist(err) {
+		t.Errorf("stat emptied day dir error = %v, want not exists", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "default", "2024-01-02", "000000.000000000.ndjson.gz")); err != nil {
+		t.Errorf("stat newest closed segment error = %v", err)
+	}
+
+	if _, err := os.Stat(archive.segments["default/2024-01-02"].path); err != nil {
+		t.Errorf("stat open segment error = %v", err)
+	}
+}
+
+func TestFileArchive_EnforceLimit_Kept(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	dir := t.TempDir()
+
+	now := time.Now()
+
+	files := map[string]time.Duration{
+		".logfowd-probe-1": 5 * time.Hour,
+		"README":           5 * time.Hour,
+		"default/2024-01-01/000000.000000000.ndjson":        4 * time.Hour,
+		"default/2024-01-01/000001.000000000.ndjson.gz.tmp": 3 * time.Hour,
+		"default/2024-01-02/000000.000000000.ndjson.gz":     time.Hour,
+	}
+
+	for path, age := range files {
+		path = filepath.Join(dir, path)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", 100)), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+
+	archive := NewFileArchive(conf.FileArchive{
+		Dir:          dir,
+		MaxSize:      1 << 20,
+		MaxAge:       3600000,
+		Compression:  dictionary.CompressionGzip,
+		MaxTotalSize: 250,
+	}, NewMetrics().ForOutput("test"), &logger)
+
+	archive.setCompressing(filepath.Join(dir, "default/2024-01-01/000000.000000000.ndjson"), true)
+
+	archive.enforceLimit()
+
+	for path := range files {
+		_, err := os.Stat(filepath.Join(dir, path))
+
+		if deleted := errors.Is(err, fs.ErrNotExist); deleted != (path == "default/2024-01-02/000000.000000000.ndjson.gz") {
+			t.Errorf("stat %s error = %v", path, err)
+		}
+	}
+}
+
+func TestFileArchive_Recover(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	dir := t.TempDir()
+
+	segmentDir := filepath.Join(dir, "default", "2024-01-02")
+
+	if err := os.MkdirAll(segmentDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	files := map[string]string{
+		"000000.000000000.ndjson":        `{"message":"left open"}` + "\n",
+		"000000.000000000.ndjson.gz.tmp": "partial",
+	}
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(segmentDir, name), []byte(data), 0o644); err != nil {
+			t.Fatalf("write segment: %v", err)
+		}
+	}
+
+	archive := NewFileArchive(conf.FileArchive{
+		Dir:         dir,
+		MaxSize:     1 << 20,
+		MaxAge:      3600000,
+		Compression: dictionary.CompressionGzip,
+	}, NewMetrics().ForOutput("test"), &logger)
+
+	archive.recover()
+	archive.wg.Wait()
+
+	messages, segments := readArchive(t, dir)
+
+	if want := map[string][]string{"default/2024-01-02": {"left open"}}; !reflect.DeepEqual(messages, want) || segments != 1 {
+		t.Errorf("recovered %d segments with %v, want %v", segments, messages, want)
+	}
+}
@@ -0,0 +1,397 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// Forward sends events to a fluentd or fluent bit aggregator over the forward protocol, a PackedForward
+// message per tag. With require_ack a batch is resent over a new connection until every message is acked,
+// so events are delivered at least once.
+type Forward struct {
+	cfg      conf.Forward
+	hostname string
+	mx       sync.Mutex
+	conn     net.Conn
+	reader   *bufio.Reader
+	metrics  *OutputMetrics
+	logger   *zerolog.Logger
+}
+
+type forwardMessage struct {
+	tag   string
+	chunk string
+	body  []byte
+}
+
+func NewForward(cfg conf.Forward, metrics *OutputMetrics, logger *zerolog.Logger) *Forward {
+	hostname := cfg.Hostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+
+	return &Forward{
+		cfg:      cfg,
+		hostname: hostname,
+		metrics:  metrics,
+		logger:   logger,
+	}
+}
+
+// Start waits for ctx, the connection is opened by the first batch.
+func (s *Forward) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	return nil
+}
+
+func (s *Forward) Health() error {
+	return nil
+}
+
+// Probe connects to the aggregator, the handshake is done with the shared key set.
+func (s *Forward) Probe() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	return s.disconnect()
+}
+
+// Close closes the connection to the aggregator.
+func (s *Forward) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.disconnect()
+}
+
+func (s *Forward) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// SendEvents writes a message per tag, batches failed to be written or acked are resent over a new connection
+// up to ForwardRetries times.
+func (s *Forward) SendEvents(events []*entity.Event) error {
+	messages, err := s.messages(events)
+	if err != nil {
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+
+		err = s.send(messages)
+
+		s.metrics.BulkDuration.Observe(time.Since(start).Seconds())
+
+		if err == nil {
+			break
+		}
+
+		if closeErr := s.disconnect(); closeErr != nil {
+			s.logger.Err(closeErr).Msg("close forward connection")
+		}
+
+		if attempt >= dictionary.ForwardRetries {
+			s.logger.Err(err).Int("num", len(events)).Msg("forward events")
+
+			s.metrics.BatchesSent.WithLabelValues("error").Inc()
+			s.metrics.DroppedEvents.Add(float64(len(events)))
+
+			return err
+		}
+
+		s.metrics.Retries.Inc()
+
+		s.logger.Warn().Err(err).Int("attempt", attempt+1).Msg("forward events, resending over a new connection")
+	}
+
+	s.metrics.BatchesSent.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+func (s *Forward) send(messages []*forwardMessage) error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	if err := s.conn.SetDeadline(time.Now().Add(time.Duration(s.cfg.Timeout) * time.Millisecond)); err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		if _, err := s.conn.Write(message.body); err != nil {
+			return err
+		}
+	}
+
+	if !s.cfg.RequireAck {
+		return nil
+	}
+
+	for _, message := range messages {
+		resp, err := readMsgpack(s.reader)
+		if err != nil {
+			return err
+		}
+
+		values, _ := resp.(map[string]interface{})
+
+		if ack := string(msgpackBytes(values["ack"])); ack != message.chunk {
+			return fmt.Errorf("%w: expected %q, got %q", dictionary.ErrForwardAck, message.chunk, ack)
+		}
+	}
+
+	return nil
+}
+
+func (s *Forward) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	timeout := time.Duration(s.cfg.Timeout) * time.Millisecond
+
+	conn, err := net.DialTimeout("tcp", s.cfg.Address, timeout)
+	if err != nil {
+		return err
+	}
+
+	s.conn, s.reader = conn, bufio.NewReader(conn)
+
+	if s.cfg.SharedKey == "" {
+		return nil
+	}
+
+	if err := s.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	return s.handshake()
+}
+
+func (s *Forward) disconnect() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+
+	s.conn, s.reader = nil, nil
+
+	return err
+}
+
+// handshake answers HELO of the server with PING signed by the shared key and checks the PONG signature.
+func (s *Forward) handshake() error {
+	helo, err := readMsgpack(s.reader)
+	if err != nil {
+		return err
+	}
+
+	heloFields, _ := helo.([]interface{})
+	if len(heloFields) < 2 || heloFields[0] != "HELO" {
+		return fmt.Errorf("%w: expected HELO, got %v", dictionary.ErrForwardHandshake, helo)
+	}
+
+	options, _ := heloFields[1].(map[string]interface{})
+	nonce := msgpackBytes(options["nonce"])
+	authSalt := msgpackBytes(options["auth"])
+
+	salt, err := randomHex()
+	if err != nil {
+		return err
+	}
+
+	var password string
+
+	if s.cfg.Username != "" {
+		password = sha512Hex(string(authSalt), s.cfg.Username, s.cfg.Password)
+	}
+
+	var ping []byte
+
+	ping = appendMsgpackArray(ping, 6)
+	ping = appendMsgpackString(ping, "PING")
+	ping = appendMsgpackString(ping, s.hostname)
+	ping = appendMsgpackString(ping, salt)
+	ping = appendMsgpackString(ping, sha512Hex(salt, s.hostname, string(nonce), s.cfg.SharedKey))
+	ping = appendMsgpackString(ping, s.cfg.Username)
+	ping = appendMsgpackString(ping, password)
+
+	if _, err := s.conn.Write(ping); err != nil {
+		return err
+	}
+
+	pong, err := readMsgpack(s.reader)
+	if err != nil {
+		return err
+	}
+
+	pongFields, _ := pong.([]interface{})
+	if len(pongFields) < 5 || pongFields[0] != "PONG" {
+		return fmt.Errorf("%w: expected PONG, got %v", dictionary.ErrForwardHandshake, pong)
+	}
+
+	if ok, _ := pongFields[1].(bool); !ok {
+		return fmt.Errorf("%w: %s", dictionary.ErrForwardHandshake, msgpackBytes(pongFields[2]))
+	}
+
+	serverHostname := string(msgpackBytes(pongFields[3]))
+
+	if string(msgpackBytes(pongFields[4])) != sha512Hex(salt, serverHostname, string(nonce), s.cfg.SharedKey) {
+		return fmt.Errorf("%w: server %s signed pong with another shared key", dictionary.ErrForwardHandshake, serverHostname)
+	}
+
+	return nil
+}
+
+// messages encodes events into a PackedForward message per tag, tags are ordered by the first event.
+func (s *Forward) messages(events []*entity.Event) ([]*forwardMessage, error) {
+	byTag := make(map[string][]*entity.Event)
+	tags := make([]string, 0)
+
+	for _, event := range events {
+		tag := expandTemplate(s.cfg.Tag, event.Meta)
+
+		if _, ok := byTag[tag]; !ok {
+			tags = append(tags, tag)
+		}
+
+		byTag[tag] = append(byTag[tag], event)
+	}
+
+	messages := make([]*forwardMessage, 0, len(tags))
+
+	for _, tag := range tags {
+		message, err := s.message(tag, byTag[tag])
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+func (s *Forward) message(tag string, events []*entity.Event) (*forwardMessage, error) {
+	var entries []byte
+
+	for _, event := range events {
+		entries = appendMsgpackArray(entries, 2)
+		entries = appendMsgpackEventTime(entries, event.Time)
+		entries = appendMsgpackMap(entries, 5)
+		entries = appendMsgpackString(entries, "message")
+		entries = appendMsgpackString(entries, event.Message)
+		entries = appendMsgpackString(entries, "pod_name")
+		entries = appendMsgpackString(entries, event.Meta.PodName)
+		entries = appendMsgpackString(entries, "namespace")
+		entries = appendMsgpackString(entries, event.Meta.Namespace)
+		entries = appendMsgpackString(entries, "container_name")
+		entries = appendMsgpackString(entries, event.Meta.ContainerName)
+		entries = appendMsgpackString(entries, "pod_id")
+		entries = appendMsgpackString(entries, event.Meta.PodID)
+	}
+
+	message := &forwardMessage{tag: tag}
+
+	optionsNum := 1
+
+	if s.cfg.Compression == dictionary.CompressionGzip {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+
+		if _, err := w.Write(entries); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		entries = buf.Bytes()
+
+		optionsNum++
+	}
+
+	if s.cfg.RequireAck {
+		chunk := make([]byte, 16)
+
+		if _, err := rand.Read(chunk); err != nil {
+			return nil, err
+		}
+
+		message.chunk = base64.StdEncoding.EncodeToString(chunk)
+
+		optionsNum++
+	}
+
+	body := appendMsgpackArray(nil, 3)
+	body = appendMsgpackString(body, tag)
+	body = appendMsgpackBin(body, entries)
+	body = appendMsgpackMap(body, optionsNum)
+	body = appendMsgpackString(body, "size")
+	body = appendMsgpackUint(body, uint64(len(events)))
+
+	if s.cfg.Compression == dictionary.CompressionGzip {
+		body = appendMsgpackString(body, "compressed")
+		body = appendMsgpackString(body, dictionary.CompressionGzip)
+	}
+
+	if message.chunk != "" {
+		body = appendMsgpackString(body, "chunk")
+		body = appendMsgpackString(body, message.chunk)
+	}
+
+	message.body = body
+
+	return message, nil
+}
+
+func randomHex() (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func sha512Hex(parts ...string) string {
+	h := sha512.New()
+
+	for _, part := range parts {
+		h.Write([]byte(part))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
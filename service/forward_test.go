@@ -0,0 +1,289 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// fakeForward accepts PackedForward messages, records messages of every tag and acks chunks. The first
+// dropAcks messages are received without an ack and the connection is closed.
+type fakeForward struct {
+	listener  net.Listener
+	sharedKey string
+	mx        sync.Mutex
+	dropAcks  int
+	messages  map[string][]string
+}
+
+func newFakeForward(t *testing.T, sharedKey string) *fakeForward {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	server := &fakeForward{listener: listener, sharedKey: sharedKey, messages: make(map[string][]string)}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go server.serve(t, conn)
+		}
+	}()
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	return server
+}
+
+func (s *fakeForward) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	if s.sharedKey != "" && !s.handshake(t, conn, reader) {
+		return
+	}
+
+	for {
+		value, err := readMsgpack(reader)
+		if err != nil {
+			return
+		}
+
+		message, _ := value.([]interface{})
+		tag, _ := message[0].(string)
+		options, _ := message[2].(map[string]interface{})
+
+		entries := message[1].([]byte)
+
+		if options["compressed"] == dictionary.CompressionGzip {
+			gz, err := gzip.NewReader(bytes.NewReader(entries))
+			if err != nil {
+				t.Errorf("decode gzip: %v", err)
+
+				return
+			}
+
+			entries, _ = io.ReadAll(gz)
+		}
+
+		s.mx.Lock()
+
+		entriesReader := bufio.NewReader(bytes.NewReader(entries))
+
+		for {
+			entry, err := readMsgpack(entriesReader)
+			if err != nil {
+				break
+			}
+
+			fields := entry.([]interface{})
+
+			if ext, ok := fields[0].(msgpackExt); !ok || ext.typ != 0 || len(ext.data) != 8 {
+				t.Errorf("entry time = %v, want EventTime", fields[0])
+			}
+
+			record := fields[1].(map[string]interface{})
+
+			s.messages[tag] = append(s.messages[tag], record["message"].(string))
+		}
+
+		drop := s.dropAcks > 0
+		if drop {
+			s.dropAcks--
+		}
+
+		s.mx.Unlock()
+
+		if drop {
+			return
+		}
+
+		if chunk, ok := options["chunk"].(string); ok {
+			ack := appendMsgpackMap(nil, 1)
+			ack = appendMsgpackString(ack, "ack")
+			ack = appendMsgpackString(ack, chunk)
+
+			if _, err := conn.Write(ack); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *fakeForward) handshake(t *testing.T, conn net.Conn, reader *bufio.Reader) bool {
+	t.Helper()
+
+	helo := appendMsgpackArray(nil, 2)
+	helo = appendMsgpackString(helo, "HELO")
+	helo = appendMsgpackMap(helo, 3)
+	helo = appendMsgpackString(helo, "nonce")
+	helo = appendMsgpackBin(helo, []byte("nonce"))
+	helo = appendMsgpackString(helo, "auth")
+	helo = appendMsgpackBin(helo, []byte(""))
+	helo = appendMsgpackString(helo, "keepalive")
+	helo = append(helo, 0xc3)
+
+	if _, err := conn.Write(helo); err != nil {
+		return false
+	}
+
+	value, err := readMsgpack(reader)
+	if err != nil {
+		return false
+	}
+
+	ping := value.([]interface{})
+	hostname, salt := ping[1].(string), ping[2].(string)
+	ok := ping[3] == sha512Hex(salt, hostname, "nonce", s.sharedKey)
+
+	pong := appendMsgpackArray(nil, 5)
+	pong = appendMsgpackString(pong, "PONG")
+
+	if ok {
+		pong = append(pong, 0xc3)
+		pong = appendMsgpackString(pong, "")
+	} else {
+		pong = append(pong, 0xc2)
+		pong = appendMsgpackString(pong, "shared_key mismatch")
+	}
+
+	pong = appendMsgpackString(pong, "aggregator")
+	pong = appendMsgpackString(pong, sha512Hex(salt, "aggregator", "nonce", s.sharedKey))
+
+	_, _ = conn.Write(pong)
+
+	return ok
+}
+
+func forwardTestEvents() []*entity.Event {
+	now := time.Now()
+
+	return []*entity.Event{
+		{Message: "first", Time: now, Meta: &entity.Meta{Namespace: "default", PodName: "api", ContainerName: "app"}},
+		{Message: "other", Time: now, Meta: &entity.Meta{Namespace: "kube-system", PodName: "dns", ContainerName: "dns"}},
+		{Message: "second", Time: now, Meta: &entity.Meta{Namespace: "default", PodName: "api", ContainerName: "app"}},
+	}
+}
+
+func TestForward_SendEvents(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		compression string
+		requireAck  bool
+		sharedKey   string
+		dropAcks    int
+		want        map[string][]string
+	}{
+		{
+			name:        "plain",
+			compression: dictionary.CompressionNone,
+			want: map[string][]string{
+				"kube.default.api.app":     {"first", "second"},
+				"kube.kube-system.dns.dns": {"other"},
+			},
+		},
+		{
+			name:        "gzip with shared key",
+			compression: dictionary.CompressionGzip,
+			requireAck:  true,
+			sharedKey:   "secret",
+			want: map[string][]string{
+				"kube.default.api.app":     {"first", "second"},
+				"kube.kube-system.dns.dns": {"other"},
+			},
+		},
+		{
+			name:        "resend without ack",
+			compression: dictionary.CompressionNone,
+			requireAck:  true,
+			dropAcks:    1,
+			want: map[string][]string{
+				"kube.default.api.app":     {"first", "second", "first", "second"},
+				"kube.kube-system.dns.dns": {"other"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			server := newFakeForward(t, tt.sharedKey)
+
+			server.dropAcks = tt.dropAcks
+
+			forward := NewForward(conf.Forward{
+				Address:     server.listener.Addr().String(),
+				Tag:         "kube.{namespace}.{pod}.{container}",
+				Compression: tt.compression,
+				RequireAck:  tt.requireAck,
+				SharedKey:   tt.sharedKey,
+				Timeout:     5000,
+			}, NewMetrics().ForOutput("test"), &logger)
+
+			defer forward.Close()
+
+			if err := forward.SendEvents(forwardTestEvents()); err != nil {
+				t.Fatalf("SendEvents() error = %v", err)
+			}
+
+			if !tt.requireAck {
+				// without acks the messages may still be read by the server
+				forward.Close()
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			server.mx.Lock()
+			defer server.mx.Unlock()
+
+			if !reflect.DeepEqual(server.messages, tt.want) {
+				t.Errorf("forwarded messages = %v, want %v", server.messages, tt.want)
+			}
+		})
+	}
+}
+
+func TestForward_SendEvents_SharedKeyMismatch(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	server := newFakeForward(t, "secret")
+
+	forward := NewForward(conf.Forward{
+		Address:     server.listener.Addr().String(),
+		Tag:         "kube",
+		Compression: dictionary.CompressionNone,
+		SharedKey:   "other",
+		Timeout:     5000,
+	}, NewMetrics().ForOutput("test"), &logger)
+
+	defer forward.Close()
+
+	if err := forward.SendEvents(forwardTestEvents()); err == nil {
+		t.Error("SendEvents() with another shared key error = nil")
+	}
+}
@@ -0,0 +1,375 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/mailru/easyjson"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"github.com/valyala/fasthttp"
+)
+
+// GELF sends events to graylog. Over udp compressed messages larger than chunk_size are split into chunks,
+// over tcp messages are written uncompressed and null-delimited, over http every message is a request
+// as gelf http inputs take one message per request.
+type GELF struct {
+	cfg       conf.GELF
+	host      string
+	tlsConfig *tls.Config
+	mx        sync.Mutex
+	conn      net.Conn
+	httpCli   *fasthttp.Client
+	metrics   *OutputMetrics
+	logger    *zerolog.Logger
+}
+
+func NewGELF(cfg conf.GELF, metrics *OutputMetrics, logger *zerolog.Logger) (*GELF, error) {
+	host := cfg.Host
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+
+	tlsConfig, err := newTLSConfig(cfg.InsecureSkipVerify, cfg.CAFile, cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GELF{
+		cfg:       cfg,
+		host:      host,
+		tlsConfig: tlsConfig,
+		httpCli:   &fasthttp.Client{TLSConfig: tlsConfig},
+		metrics:   metrics,
+		logger:    logger,
+	}, nil
+}
+
+// Start waits for ctx, the connection is opened by the first batch.
+func (s *GELF) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	return nil
+}
+
+func (s *GELF) Health() error {
+	return nil
+}
+
+// Probe connects to graylog, udp addresses are only resolved and the http url is checked by a tcp connection.
+func (s *GELF) Probe() error {
+	if s.cfg.Transport == dictionary.GELFTransportHTTP {
+		return probeDial(s.cfg.URL)
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	return s.disconnect()
+}
+
+// Close closes the connection to graylog.
+func (s *GELF) Close() error {
+	s.httpCli.CloseIdleConnections()
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.disconnect()
+}
+
+func (s *GELF) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// SendEvents sends a message per event, tcp batches failed to be written are resent over a new connection
+// up to GELFRetries times. Over udp and http messages sent before a failure are not counted as dropped.
+func (s *GELF) SendEvents(events []*entity.Event) error {
+	messages, err := s.messages(events)
+	if err != nil {
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+
+		var sent int
+
+		switch s.cfg.Transport {
+		case dictionary.GELFTransportUDP:
+			sent, err = s.sendUDP(messages)
+		case dictionary.GELFTransportTCP:
+			err = s.sendTCP(messages)
+		default:
+			sent, err = s.sendHTTP(messages)
+		}
+
+		s.metrics.BulkDuration.Observe(time.Since(start).Seconds())
+
+		if err == nil {
+			break
+		}
+
+		if closeErr := s.disconnect(); closeErr != nil {
+			s.logger.Err(closeErr).Msg("close gelf connection")
+		}
+
+		if attempt >= dictionary.GELFRetries || s.cfg.Transport != dictionary.GELFTransportTCP {
+			s.logger.Err(err).Int("num", len(events)).Int("sent", sent).Msg("send to gelf")
+
+			s.metrics.BatchesSent.WithLabelValues("error").Inc()
+			s.metrics.DroppedEvents.Add(float64(len(events) - sent))
+
+			return err
+		}
+
+		s.metrics.Retries.Inc()
+
+		s.logger.Warn().Err(err).Int("attempt", attempt+1).Msg("send to gelf, resending over a new connection")
+	}
+
+	s.metrics.BatchesSent.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+// messages encodes events as gelf messages, compressed unless they are sent over tcp.
+func (s *GELF) messages(events []*entity.Event) ([][]byte, error) {
+	messages := make([][]byte, 0, len(events))
+
+	for _, event := range events {
+		data, err := easyjson.Marshal(&entity.GELFMessage{
+			Version:       dictionary.GELFVersion,
+			Host:          s.host,
+			ShortMessage:  event.Message,
+			Timestamp:     entity.EpochTime(event.Time),
+			Level:         dictionary.GELFLevelInfo,
+			Namespace:     event.Namespace,
+			PodName:       event.PodName,
+			PodID:         event.PodID,
+			ContainerName: event.ContainerName,
+			Path:          event.Path,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if s.cfg.Transport != dictionary.GELFTransportTCP {
+			if data, err = s.compress(data); err != nil {
+				return nil, err
+			}
+		}
+
+		messages = append(messages, data)
+	}
+
+	return messages, nil
+}
+
+func (s *GELF) compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	var w io.WriteCloser
+
+	switch s.cfg.Compression {
+	case dictionary.CompressionGzip:
+		w = gzip.NewWriter(&buf)
+	case dictionary.CompressionZlib:
+		w = zlib.NewWriter(&buf)
+	default:
+		return data, nil
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// sendUDP writes a datagram per message or per chunk of it, messages over GELFMaxChunks chunks are dropped.
+// It returns how many messages were written or dropped before a failure.
+func (s *GELF) sendUDP(messages [][]byte) (int, error) {
+	if err := s.connect(); err != nil {
+		return 0, err
+	}
+
+	for i, message := range messages {
+		datagrams, err := gelfChunks(message, s.cfg.ChunkSize)
+		if err != nil {
+			s.logger.Warn().Err(err).Int("size", len(message)).Msg("drop gelf message")
+
+			s.metrics.DroppedEvents.Inc()
+
+			continue
+		}
+
+		for _, datagram := range datagrams {
+			if _, err := s.conn.Write(datagram); err != nil {
+				return i, err
+			}
+		}
+	}
+
+	return len(messages), nil
+}
+
+func (s *GELF) sendTCP(messages [][]byte) error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	if err := s.conn.SetWriteDeadline(time.Now().Add(time.Duration(s.cfg.Timeout) * time.Millisecond)); err != nil {
+		return err
+	}
+
+	var body []byte
+
+	for _, message := range messages {
+		body = append(body, message...)
+		body = append(body, 0)
+	}
+
+	_, err := s.conn.Write(body)
+
+	return err
+}
+
+// sendHTTP posts messages one by one, it returns how many were accepted before a failure.
+func (s *GELF) sendHTTP(messages [][]byte) (int, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType("application/json")
+	req.SetRequestURI(s.cfg.URL)
+
+	switch s.cfg.Compression {
+	case dictionary.CompressionGzip:
+		req.Header.Set(fasthttp.HeaderContentEncoding, "gzip")
+	case dictionary.CompressionZlib:
+		req.Header.Set(fasthttp.HeaderContentEncoding, "deflate")
+	}
+
+	for i, message := range messages {
+		req.SetBody(message)
+
+		if err := s.httpCli.DoTimeout(req, resp, time.Duration(s.cfg.Timeout)*time.Millisecond); err != nil {
+			return i, err
+		}
+
+		if resp.StatusCode() < fasthttp.StatusOK || resp.StatusCode() >= fasthttp.StatusMultipleChoices {
+			return i, fmt.Errorf("%w: %d %s", dictionary.ErrBadStatusCode, resp.StatusCode(), resp.Body())
+		}
+	}
+
+	return len(messages), nil
+}
+
+func (s *GELF) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	dialer := &net.Dialer{Timeout: time.Duration(s.cfg.Timeout) * time.Millisecond}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	switch {
+	case s.cfg.Transport == dictionary.GELFTransportUDP:
+		conn, err = dialer.Dial("udp", s.cfg.Address)
+	case s.cfg.TLS:
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.cfg.Address, s.tlsConfig)
+	default:
+		conn, err = dialer.Dial("tcp", s.cfg.Address)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+
+	return nil
+}
+
+func (s *GELF) disconnect() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+
+	s.conn = nil
+
+	return err
+}
+
+// gelfChunks returns the message as is when it fits into a datagram of chunkSize bytes, otherwise chunks
+// sharing a random message id, each prefixed with the magic bytes, the id, its sequence number and the count.
+func gelfChunks(message []byte, chunkSize int) ([][]byte, error) {
+	if len(message) <= chunkSize {
+		return [][]byte{message}, nil
+	}
+
+	payloadSize := chunkSize - dictionary.GELFChunkHeaderSize
+	count := (len(message) + payloadSize - 1) / payloadSize
+
+	if count > dictionary.GELFMaxChunks {
+		return nil, fmt.Errorf("%w: %d chunks", dictionary.ErrGELFTooManyChunks, count)
+	}
+
+	id := make([]byte, 8)
+
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	chunks := make([][]byte, 0, count)
+
+	for i := 0; i < count; i++ {
+		payload := message[i*payloadSize : min((i+1)*payloadSize, len(message))]
+
+		chunk := make([]byte, 0, dictionary.GELFChunkHeaderSize+len(payload))
+		chunk = append(chunk, 0x1e, 0x0f)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, payload...)
+
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, nil
+}
@@ -0,0 +1,384 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/mailru/easyjson"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// fakeGraylog is a gelf input listening on the transport, it reassembles udp chunks, splits tcp streams
+// by null bytes and decompresses messages. Over http messages past a positive limit are answered with 503.
+type fakeGraylog struct {
+	address  string
+	mx       sync.Mutex
+	limit    int
+	chunked  int
+	messages []*entity.GELFMessage
+}
+
+func newFakeGraylog(t *testing.T, transport string, useTLS bool) *fakeGraylog {
+	t.Helper()
+
+	server := &fakeGraylog{}
+
+	switch transport {
+	case dictionary.GELFTransportUDP:
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+
+		t.Cleanup(func() { _ = conn.Close() })
+
+		server.address = conn.LocalAddr().String()
+
+		go server.serveUDP(t, conn)
+	case dictionary.GELFTransportTCP:
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+
+		if useTLS {
+			certServer := httptest.NewTLSServer(http.NotFoundHandler())
+			certServer.Close()
+
+			listener = tls.NewListener(listener, &tls.Config{Certificates: certServer.TLS.Certificates})
+		}
+
+		t.Cleanup(func() { _ = listener.Close() })
+
+		server.address = listener.Addr().String()
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+
+				go server.serveTCP(t, conn)
+			}
+		}()
+	default:
+		httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+
+			server.mx.Lock()
+			full := server.limit > 0 && len(server.messages) >= server.limit
+			server.mx.Unlock()
+
+			if full {
+				w.WriteHeader(http.StatusServiceUnavailable)
+
+				return
+			}
+
+			server.add(t, decompressGELF(t, body))
+
+			w.WriteHeader(http.StatusAccepted)
+		}))
+
+		t.Cleanup(httpServer.Close)
+
+		server.address = httpServer.URL + "/gelf"
+	}
+
+	return server
+}
+
+func (s *fakeGraylog) serveUDP(t *testing.T, conn net.PacketConn) {
+	chunks := make(map[string][][]byte)
+	buf := make([]byte, 65536)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		datagram := append([]byte(nil), buf[:n]...)
+
+		if !bytes.HasPrefix(datagram, []byte{0x1e, 0x0f}) {
+			s.add(t, decompressGELF(t, datagram))
+
+			continue
+		}
+
+		id, seq, count := string(datagram[2:10]), datagram[10], int(datagram[11])
+
+		if chunks[id] == nil {
+			chunks[id] = make([][]byte, count)
+		}
+
+		chunks[id][seq] = datagram[dictionary.GELFChunkHeaderSize:]
+
+		if received := len(chunks[id]) - countNil(chunks[id]); received == count {
+			s.mx.Lock()
+			s.chunked++
+			s.mx.Unlock()
+
+			s.add(t, decompressGELF(t, bytes.Join(chunks[id], nil)))
+
+			delete(chunks, id)
+		}
+	}
+}
+
+func (s *fakeGraylog) serveTCP(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		message, err := reader.ReadBytes(0)
+		if err != nil {
+			return
+		}
+
+		s.add(t, message[:len(message)-1])
+	}
+}
+
+func (s *fakeGraylog) add(t *testing.T, data []byte) {
+	message := &entity.GELFMessage{}
+
+	if err := easyjson.Unmarshal(data, message); err != nil {
+		t.Errorf("unmarshal message %s: %v", data, err)
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.messages = append(s.messages, message)
+}
+
+func (s *fakeGraylog) received() []*entity.GELFMessage {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return append([]*entity.GELFMessage(nil), s.messages...)
+}
+
+func decompressGELF(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var (
+		r   io.Reader
+		err error
+	)
+
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case data[0] == 0x78:
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return data
+	}
+
+	if err != nil {
+		t.Errorf("decompress: %v", err)
+
+		return nil
+	}
+
+	data, err = io.ReadAll(r)
+	if err != nil {
+		t.Errorf("decompress: %v", err)
+	}
+
+	return data
+}
+
+func countNil(chunks [][]byte) int {
+	n := 0
+
+	for _, chunk := range chunks {
+		if chunk == nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestGELF_SendEvents(t *testing.T) {
+	t.Parallel()
+
+	readAt := time.Date(2024, 1, 2, 3, 4, 5, 123000000, time.UTC)
+	long := strings.Repeat("0123456789abcdef", 400)
+
+	meta := &entity.Meta{
+		Path:          "/var/log/pods/default_api_abc/app/0.log",
+		Namespace:     "default",
+		PodName:       "api",
+		PodID:         "abc",
+		ContainerName: "app",
+	}
+
+	events := []*entity.Event{{Message: "first", Time: readAt, Meta: meta}, {Message: long, Time: readAt, Meta: meta}}
+
+	tests := []struct {
+		name        string
+		transport   string
+		compression string
+		tls         bool
+		chunkSize   int
+		chunked     int
+	}{
+		{name: "udp gzip", transport: dictionary.GELFTransportUDP, compression: dictionary.CompressionGzip, chunkSize: 1420},
+		{name: "udp chunked", transport: dictionary.GELFTransportUDP, compression: dictionary.CompressionNone, chunkSize: 1420, chunked: 1},
+		{name: "tcp", transport: dictionary.GELFTransportTCP, compression: dictionary.CompressionGzip, chunkSize: 1420},
+		{name: "tcp tls", transport: dictionary.GELFTransportTCP, tls: true, chunkSize: 1420},
+		{name: "http zlib", transport: dictionary.GELFTransportHTTP, compression: dictionary.CompressionZlib, chunkSize: 1420},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			server := newFakeGraylog(t, tt.transport, tt.tls)
+
+			gelf, err := NewGELF(conf.GELF{
+				Transport:          tt.transport,
+				Address:            server.address,
+				URL:                server.address,
+				Host:               "node-1",
+				Compression:        tt.compression,
+				ChunkSize:          tt.chunkSize,
+				TLS:                tt.tls,
+				InsecureSkipVerify: true,
+				Timeout:            1000,
+			}, NewMetrics().ForOutput("test"), &logger)
+			if err != nil {
+				t.Fatalf("NewGELF() error = %v", err)
+			}
+
+			defer gelf.Close()
+
+			if err := gelf.SendEvents(events); err != nil {
+				t.Fatalf("SendEvents() error = %v", err)
+			}
+
+			var messages []*entity.GELFMessage
+
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if messages = server.received(); len(messages) == len(events) {
+					break
+				}
+			}
+
+			want := make([]*entity.GELFMessage, 0, len(events))
+
+			for _, event := range events {
+				want = append(want, &entity.GELFMessage{
+					Version:       dictionary.GELFVersion,
+					Host:          "node-1",
+					ShortMessage:  event.Message,
+					Timestamp:     entity.EpochTime(readAt),
+					Level:         dictionary.GELFLevelInfo,
+					Namespace:     "default",
+					PodName:       "api",
+					PodID:         "abc",
+					ContainerName: "app",
+					Path:          "/var/log/pods/default_api_abc/app/0.log",
+				})
+			}
+
+			if !reflect.DeepEqual(messages, want) {
+				t.Errorf("received %d messages, want %d equal to %+v", len(messages), len(want), want[0])
+			}
+
+			server.mx.Lock()
+			defer server.mx.Unlock()
+
+			if server.chunked != tt.chunked {
+				t.Errorf("received %d chunked messages, want %d", server.chunked, tt.chunked)
+			}
+		})
+	}
+}
+
+func TestGELF_SendEvents_HTTPFailure(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	server := newFakeGraylog(t, dictionary.GELFTransportHTTP, false)
+	metrics := NewMetrics().ForOutput("test")
+
+	server.limit = 2
+
+	gelf, err := NewGELF(conf.GELF{
+		Transport:   dictionary.GELFTransportHTTP,
+		URL:         server.address,
+		Host:        "node-1",
+		Compression: dictionary.CompressionGzip,
+		Timeout:     1000,
+	}, metrics, &logger)
+	if err != nil {
+		t.Fatalf("NewGELF() error = %v", err)
+	}
+
+	defer gelf.Close()
+
+	events := make([]*entity.Event, 0, 5)
+
+	for _, message := range []string{"first", "second", "third", "fourth", "fifth"} {
+		events = append(events, &entity.Event{Message: message, Time: time.Now(), Meta: &entity.Meta{}})
+	}
+
+	if err := gelf.SendEvents(events); err == nil {
+		t.Fatal("SendEvents() error = nil, want bad status")
+	}
+
+	if got := len(server.received()); got != 2 {
+		t.Errorf("received %d messages, want 2", got)
+	}
+
+	if got := testutil.ToFloat64(metrics.DroppedEvents); got != 3 {
+		t.Errorf("dropped events = %v, want 3", got)
+	}
+}
+
+func TestGELFChunks(t *testing.T) {
+	t.Parallel()
+
+	chunks, err := gelfChunks(make([]byte, 100), 50)
+	if err != nil {
+		t.Fatalf("gelfChunks() error = %v", err)
+	}
+
+	if len(chunks) != 3 || len(chunks[2]) != dictionary.GELFChunkHeaderSize+24 || chunks[1][10] != 1 || chunks[1][11] != 3 {
+		t.Errorf("gelfChunks() = %d chunks, want 3 with sequence headers", len(chunks))
+	}
+
+	if !bytes.Equal(chunks[0][2:10], chunks[2][2:10]) {
+		t.Error("chunks have different message ids")
+	}
+
+	if _, err := gelfChunks(make([]byte, 129*38), 50); err == nil {
+		t.Error("gelfChunks() error = nil, want too many chunks")
+	}
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+// Heartbeat is updated by a pipeline goroutine on every loop iteration.
+type Heartbeat struct {
+	last atomic.Int64
+}
+
+func (b *Heartbeat) Beat() {
+	b.last.Store(time.Now().UnixNano())
+}
+
+// Health collects heartbeats of pipeline goroutines and readiness checks of outputs.
+type Health struct {
+	timeout time.Duration
+	mx      sync.RWMutex
+	beats   map[string]*Heartbeat
+	checks  map[string]func() error
+	synced  atomic.Bool
+}
+
+func NewHealth(cfg conf.Config) *Health {
+	return &Health{
+		timeout: time.Duration(cfg.Admin.HealthTimeout) * time.Millisecond,
+		beats:   make(map[string]*Heartbeat),
+		checks:  make(map[string]func() error),
+	}
+}
+
+// Heartbeat registers the component and returns its heartbeat.
+func (h *Health) Heartbeat(component string) *Heartbeat {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	beat, ok := h.beats[component]
+	if !ok {
+		beat = &Heartbeat{}
+		h.beats[component] = beat
+	}
+
+	beat.Beat()
+
+	return beat
+}
+
+func (h *Health) AddReadinessCheck(name string, check func() error) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	h.checks[name] = check
+}
+
+// SetSynced marks the initial listing of log files as completed.
+func (h *Health) SetSynced() {
+	h.synced.Store(true)
+}
+
+// Live returns an error when the watcher loop, the dispatcher or all senders did not beat within the timeout.
+func (h *Health) Live(now time.Time) error {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+
+	stuck := make([]string, 0)
+
+	senders, stuckSenders := 0, make([]string, 0)
+
+	for component, beat := range h.beats {
+		isStuck := now.Sub(time.Unix(0, beat.last.Load())) > h.timeout
+
+		if strings.HasPrefix(component, dictionary.ComponentSender) {
+			senders++
+
+			if isStuck {
+				stuckSenders = append(stuckSenders, component)
+			}
+
+			continue
+		}
+
+		if isStuck {
+			stuck = append(stuck, component)
+		}
+	}
+
+	if senders > 0 && len(stuckSenders) == senders {
+		stuck = append(stuck, stuckSenders...)
+	}
+
+	if len(stuck) == 0 {
+		return nil
+	}
+
+	sort.Strings(stuck)
+
+	return fmt.Errorf("%w: %s", dictionary.ErrComponentStuck, strings.Join(stuck, ", "))
+}
+
+// Ready returns an error until log files are synced and while any readiness check fails.
+func (h *Health) Ready() error {
+	if !h.synced.Load() {
+		return dictionary.ErrNotSynced
+	}
+
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+
+	for name, check := range h.checks {
+		if err := check(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+func TestHealth_Live(t *testing.T) {
+	t.Parallel()
+
+	health := NewHealth(conf.Config{Admin: conf.Admin{HealthTimeout: 1000}})
+
+	health.Heartbeat(dictionary.ComponentWatcher)
+	health.Heartbeat(dictionary.ComponentDispatcher)
+	sender0 := health.Heartbeat(dictionary.ComponentSender + "-0")
+	sender1 := health.Heartbeat(dictionary.ComponentSender + "-1")
+
+	if err := health.Live(time.Now()); err != nil {
+		t.Fatalf("Live() error = %v", err)
+	}
+
+	stale := time.Now().Add(-time.Minute).UnixNano()
+
+	sender0.last.Store(stale)
+
+	if err := health.Live(time.Now()); err != nil {
+		t.Fatalf("Live() with one stuck sender error = %v", err)
+	}
+
+	sender1.last.Store(stale)
+
+	if err := health.Live(time.Now()); !errors.Is(err, dictionary.ErrComponentStuck) {
+		t.Fatalf("Live() with all stuck senders error = %v, want %v", err, dictionary.ErrComponentStuck)
+	}
+
+	sender0.Beat()
+	health.beats[dictionary.ComponentWatcher].last.Store(stale)
+
+	if err := health.Live(time.Now()); !errors.Is(err, dictionary.ErrComponentStuck) {
+		t.Fatalf("Live() with stuck watcher error = %v, want %v", err, dictionary.ErrComponentStuck)
+	}
+}
+
+func TestHealth_Ready(t *testing.T) {
+	t.Parallel()
+
+	health := NewHealth(conf.Config{})
+
+	outputErr := errors.New("unreachable")
+
+	var failing bool
+
+	health.AddReadinessCheck("es", func() error {
+		if failing {
+			return outputErr
+		}
+
+		return nil
+	})
+
+	if err := health.Ready(); !errors.Is(err, dictionary.ErrNotSynced) {
+		t.Fatalf("Ready() before sync error = %v, want %v", err, dictionary.ErrNotSynced)
+	}
+
+	health.SetSynced()
+
+	if err := health.Ready(); err != nil {
+		t.Fatalf("Ready() error = %v", err)
+	}
+
+	failing = true
+
+	if err := health.Ready(); !errors.Is(err, outputErr) {
+		t.Fatalf("Ready() with failing output error = %v, want %v", err, outputErr)
+	}
+}
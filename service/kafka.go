@@ -0,0 +1,549 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// Kafka produces events as json documents to partitions of templated topics. Partition leaders are taken
+// from metadata of the brokers, the idempotent producer numbers batches of every partition so brokers
+// drop duplicates of resent batches.
+type Kafka struct {
+	cfg           conf.Kafka
+	acks          int16
+	mx            sync.Mutex
+	brokers       map[string]*kafkaBroker
+	nodes         map[int32]string
+	topics        map[string]*kafkaTopic
+	producerID    int64
+	producerEpoch int16
+	sequences     map[kafkaPartition]int32
+	next          int
+	stop          *outputStop
+	metrics       *OutputMetrics
+	logger        *zerolog.Logger
+}
+
+type kafkaTopic struct {
+	leaders   []int32
+	fetchedAt time.Time
+}
+
+type kafkaPartition struct {
+	topic     string
+	partition int32
+}
+
+type kafkaBatch struct {
+	kafkaPartition
+	records []*kafkaRecord
+	body    []byte
+}
+
+func NewKafka(cfg conf.Kafka, metrics *OutputMetrics, logger *zerolog.Logger) *Kafka {
+	var acks int16 = -1
+
+	if cfg.Acks != dictionary.KafkaAcksAll {
+		if v, err := strconv.ParseInt(cfg.Acks, 10, 16); err == nil {
+			acks = int16(v)
+		}
+	}
+
+	return &Kafka{
+		cfg:        cfg,
+		acks:       acks,
+		brokers:    make(map[string]*kafkaBroker),
+		nodes:      make(map[int32]string),
+		topics:     make(map[string]*kafkaTopic),
+		producerID: kafkaNoProducerID,
+		sequences:  make(map[kafkaPartition]int32),
+		stop:       newOutputStop(),
+		metrics:    metrics,
+		logger:     logger,
+	}
+}
+
+// Start waits for ctx, brokers are connected by the first batch. Once ctx is done batches are no longer retried.
+func (s *Kafka) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	s.stop.stop()
+
+	return nil
+}
+
+func (s *Kafka) Health() error {
+	return nil
+}
+
+// Probe requests metadata of no topics from the bootstrap brokers, topics are templated by events.
+func (s *Kafka) Probe() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	req := &kafkaEncoder{}
+
+	req.int32(0)
+
+	_, err := s.bootstrapRequest(kafkaMetadataKey, kafkaMetadataVersion, req.b)
+
+	return err
+}
+
+// Close closes connections to brokers.
+func (s *Kafka) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for _, broker := range s.brokers {
+		broker.close()
+	}
+
+	return nil
+}
+
+func (s *Kafka) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// SendEvents produces a record batch per partition, batches failed with retriable errors are resent
+// to the leaders of refreshed metadata up to KafkaRetries times.
+func (s *Kafka) SendEvents(events []*entity.Event) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err := s.sendEvents(events)
+	if err != nil {
+		s.logger.Err(err).Int("num", len(events)).Msg("produce to kafka")
+
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
+		// sequences of the failed batches are lost, a new producer id starts them over
+		s.producerID = kafkaNoProducerID
+
+		return err
+	}
+
+	s.metrics.BatchesSent.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+func (s *Kafka) sendEvents(events []*entity.Event) error {
+	batches, err := s.batches(events)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+
+		failed, err := s.produce(batches)
+
+		s.metrics.BulkDuration.Observe(time.Since(start).Seconds())
+
+		if err != nil && !errors.Is(err, dictionary.ErrKafkaRetriable) {
+			return err
+		}
+
+		if err == nil && len(failed) == 0 {
+			return nil
+		}
+
+		if err == nil {
+			err = fmt.Errorf("%w: %d partitions failed", dictionary.ErrKafkaRetriable, len(failed))
+		}
+
+		if attempt >= dictionary.KafkaRetries {
+			return err
+		}
+
+		s.metrics.Retries.Inc()
+
+		s.logger.Warn().Err(err).Int("attempt", attempt+1).Msg("produce to kafka, retrying")
+
+		if !s.stop.wait(dictionary.KafkaRetryBackoff << attempt) {
+			return err
+		}
+
+		for _, batch := range failed {
+			delete(s.topics, batch.topic)
+		}
+
+		batches = failed
+	}
+}
+
+// batches splits events by topic and partition and encodes a record batch per partition.
+func (s *Kafka) batches(events []*entity.Event) ([]*kafkaBatch, error) {
+	byPartition := make(map[kafkaPartition]*kafkaBatch)
+	batches := make([]*kafkaBatch, 0)
+
+	s.next++
+
+	for _, event := range events {
+		topic := expandTemplate(s.cfg.Topic, event.Meta)
+
+		leaders, err := s.leaders(topic)
+
+		// new topics may have no leaders while they are being created
+		for attempt := 0; errors.Is(err, dictionary.ErrKafkaRetriable) && attempt < dictionary.KafkaRetries; attempt++ {
+			if !s.stop.wait(dictionary.KafkaRetryBackoff << attempt) {
+				break
+			}
+
+			leaders, err = s.leaders(topic)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var key []byte
+
+		if s.cfg.PartitionKey != "" {
+			if k := expandTemplate(s.cfg.PartitionKey, event.Meta); k != "" {
+				key = []byte(k)
+			}
+		}
+
+		partition := kafkaPartition{topic: topic, partition: s.partition(key, len(leaders))}
+
+		value, err := easyjson.Marshal(entity.NewFieldsBody(event))
+		if err != nil {
+			return nil, err
+		}
+
+		batch, ok := byPartition[partition]
+		if !ok {
+			batch = &kafkaBatch{kafkaPartition: partition}
+			byPartition[partition] = batch
+
+			batches = append(batches, batch)
+		}
+
+		batch.records = append(batch.records, &kafkaRecord{key: key, value: value, timestamp: event.Time})
+	}
+
+	if s.cfg.Idempotent && s.producerID == kafkaNoProducerID {
+		if err := s.initProducer(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, batch := range batches {
+		sequence := kafkaNoSequence
+
+		if s.cfg.Idempotent {
+			sequence = s.sequences[batch.kafkaPartition]
+			s.sequences[batch.kafkaPartition] = sequence + int32(len(batch.records))
+		}
+
+		body, err := kafkaRecordBatch(batch.records, s.cfg.Compression, s.producerID, s.producerEpoch, sequence)
+		if err != nil {
+			return nil, err
+		}
+
+		batch.body = body
+	}
+
+	return batches, nil
+}
+
+// partition hashes the key like the java client does, events without a key go to the partition chosen
+// round robin for the whole batch.
+func (s *Kafka) partition(key []byte, num int) int32 {
+	if key == nil {
+		return int32(s.next % num)
+	}
+
+	return (kafkaMurmur2(key) & 0x7fffffff) % int32(num)
+}
+
+// produce sends batches to leaders of their partitions, returns batches failed with retriable errors.
+func (s *Kafka) produce(batches []*kafkaBatch) ([]*kafkaBatch, error) {
+	byLeader := make(map[int32][]*kafkaBatch)
+	failed := make([]*kafkaBatch, 0)
+
+	for _, batch := range batches {
+		leaders, err := s.leaders(batch.topic)
+		if err != nil {
+			return batches, err
+		}
+
+		if int(batch.partition) >= len(leaders) || leaders[batch.partition] < 0 {
+			failed = append(failed, batch)
+
+			continue
+		}
+
+		leader := leaders[batch.partition]
+		byLeader[leader] = append(byLeader[leader], batch)
+	}
+
+	var err error
+
+	for leader, leaderBatches := range byLeader {
+		leaderFailed, leaderErr := s.produceTo(leader, leaderBatches)
+
+		failed = append(failed, leaderFailed...)
+
+		if leaderErr != nil && (err == nil || !errors.Is(leaderErr, dictionary.ErrKafkaRetriable)) {
+			err = leaderErr
+		}
+	}
+
+	return failed, err
+}
+
+// produceTo sends batches to one broker, network errors fail all batches as retriable.
+func (s *Kafka) produceTo(leader int32, batches []*kafkaBatch) ([]*kafkaBatch, error) {
+	broker, ok := s.nodes[leader]
+	if !ok {
+		return batches, fmt.Errorf("%w: unknown leader %d", dictionary.ErrKafkaRetriable, leader)
+	}
+
+	byTopic := make(map[string][]*kafkaBatch)
+	topics := make([]string, 0)
+
+	for _, batch := range batches {
+		if _, ok := byTopic[batch.topic]; !ok {
+			topics = append(topics, batch.topic)
+		}
+
+		byTopic[batch.topic] = append(byTopic[batch.topic], batch)
+	}
+
+	sort.Strings(topics)
+
+	req := &kafkaEncoder{}
+
+	req.nullString()
+	req.int16(s.acks)
+	req.int32(int32(s.cfg.Timeout))
+	req.int32(int32(len(topics)))
+
+	for _, topic := range topics {
+		req.string(topic)
+		req.int32(int32(len(byTopic[topic])))
+
+		for _, batch := range byTopic[topic] {
+			req.int32(batch.partition)
+			req.bytes(batch.body)
+		}
+	}
+
+	resp, err := s.broker(broker).request(kafkaProduceKey, kafkaProduceVersion, req.b, s.acks != 0)
+	if err != nil {
+		s.broker(broker).close()
+
+		return batches, fmt.Errorf("%w: %s: %w", dictionary.ErrKafkaRetriable, broker, err)
+	}
+
+	if s.acks == 0 {
+		return nil, nil
+	}
+
+	return s.produceResponse(resp, batches)
+}
+
+func (s *Kafka) produceResponse(resp []byte, batches []*kafkaBatch) ([]*kafkaBatch, error) {
+	byPartition := make(map[kafkaPartition]*kafkaBatch, len(batches))
+
+	for _, batch := range batches {
+		byPartition[batch.kafkaPartition] = batch
+	}
+
+	failed := make([]*kafkaBatch, 0)
+
+	var err error
+
+	d := &kafkaDecoder{b: resp}
+
+	for topics := d.int32(); topics > 0 && d.err == nil; topics-- {
+		topic := d.string()
+
+		for partitions := d.int32(); partitions > 0 && d.err == nil; partitions-- {
+			partition := d.int32()
+			code := d.int16()
+
+			d.int64() // base offset
+			d.int64() // log append time
+			d.int64() // log start offset
+
+			batch, ok := byPartition[kafkaPartition{topic: topic, partition: partition}]
+
+			switch {
+			case !ok || code == 0 || code == kafkaErrDuplicateSequenceNumber:
+			case kafkaRetriable(code):
+				failed = append(failed, batch)
+			default:
+				err = fmt.Errorf("%w: %s[%d]: error code %d", dictionary.ErrKafkaProduce, topic, partition, code)
+			}
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return failed, err
+}
+
+// leaders returns leaders of partitions of the topic indexed by partition, metadata is requested when missing
+// or older than KafkaMetadataTTL.
+func (s *Kafka) leaders(topic string) ([]int32, error) {
+	if meta, ok := s.topics[topic]; ok && time.Since(meta.fetchedAt) < dictionary.KafkaMetadataTTL {
+		return meta.leaders, nil
+	}
+
+	req := &kafkaEncoder{}
+
+	req.int32(1)
+	req.string(topic)
+
+	resp, err := s.bootstrapRequest(kafkaMetadataKey, kafkaMetadataVersion, req.b)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &kafkaDecoder{b: resp}
+
+	for brokers := d.int32(); brokers > 0 && d.err == nil; brokers-- {
+		nodeID := d.int32()
+		host := d.string()
+		port := d.int32()
+
+		d.string() // rack
+
+		s.nodes[nodeID] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	d.int32() // controller id
+
+	var leaders []int32
+
+	for topics := d.int32(); topics > 0 && d.err == nil; topics-- {
+		code := d.int16()
+		name := d.string()
+
+		d.int8() // is internal
+
+		if kafkaRetriable(code) {
+			err = fmt.Errorf("%w: metadata of %s: error code %d", dictionary.ErrKafkaRetriable, name, code)
+		} else if code != 0 {
+			err = fmt.Errorf("%w: metadata of %s: error code %d", dictionary.ErrKafkaProduce, name, code)
+		}
+
+		for partitions := d.int32(); partitions > 0 && d.err == nil; partitions-- {
+			d.int16() // partition error code
+
+			index := d.int32()
+			leader := d.int32()
+
+			d.next(4 * int(d.int32())) // replicas
+			d.next(4 * int(d.int32())) // isr
+
+			for int(index) >= len(leaders) {
+				leaders = append(leaders, -1)
+			}
+
+			leaders[index] = leader
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(leaders) == 0 {
+		return nil, fmt.Errorf("%w: topic %s has no partitions", dictionary.ErrKafkaRetriable, topic)
+	}
+
+	s.topics[topic] = &kafkaTopic{leaders: leaders, fetchedAt: time.Now()}
+
+	return leaders, nil
+}
+
+// initProducer requests a producer id and epoch for the idempotent producer and starts sequences over.
+func (s *Kafka) initProducer() error {
+	req := &kafkaEncoder{}
+
+	req.nullString()
+	req.int32(kafkaTransactionTimeoutMs)
+
+	resp, err := s.bootstrapRequest(kafkaInitProducerKey, kafkaInitProducerVersion, req.b)
+	if err != nil {
+		return err
+	}
+
+	d := &kafkaDecoder{b: resp}
+
+	d.int32() // throttle time
+
+	code := d.int16()
+	producerID := d.int64()
+	producerEpoch := d.int16()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("%w: init producer id: error code %d", dictionary.ErrKafkaProduce, code)
+	}
+
+	s.producerID, s.producerEpoch = producerID, producerEpoch
+	s.sequences = make(map[kafkaPartition]int32)
+
+	s.logger.Info().Int64("producer id", producerID).Int16("epoch", producerEpoch).Msg("kafka producer initialized")
+
+	return nil
+}
+
+// bootstrapRequest sends the request to the first configured broker that answers.
+func (s *Kafka) bootstrapRequest(apiKey, version int16, body []byte) ([]byte, error) {
+	var err error
+
+	for _, addr := range s.cfg.Brokers {
+		var resp []byte
+
+		resp, err = s.broker(addr).request(apiKey, version, body, true)
+		if err == nil {
+			return resp, nil
+		}
+
+		s.broker(addr).close()
+
+		s.logger.Warn().Err(err).Str("broker", addr).Msg("kafka bootstrap broker request")
+	}
+
+	return nil, fmt.Errorf("%w: %w", dictionary.ErrKafkaRetriable, err)
+}
+
+func (s *Kafka) broker(addr string) *kafkaBroker {
+	broker, ok := s.brokers[addr]
+	if !ok {
+		broker = &kafkaBroker{addr: addr, clientID: s.cfg.ClientID}
+		s.brokers[addr] = broker
+	}
+
+	return broker
+}
@@ -0,0 +1,627 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// fakeKafka is a single broker leading every partition of every topic, it stores produced records
+// by partition and answers the first notLeader produce requests with NOT_LEADER_OR_FOLLOWER.
+type fakeKafka struct {
+	listener   net.Listener
+	partitions int32
+	mx         sync.Mutex
+	notLeader  int
+	records    map[kafkaPartition][]string
+	sequences  map[kafkaPartition][]int32
+	producers  []int64
+}
+
+func newFakeKafka(t *testing.T) *fakeKafka {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	broker := &fakeKafka{
+		listener:   listener,
+		partitions: 3,
+		records:    make(map[kafkaPartition][]string),
+		sequences:  make(map[kafkaPartition][]int32),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go broker.serve(t, conn)
+		}
+	}()
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	return broker
+}
+
+func (s *fakeKafka) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		size := make([]byte, 4)
+
+		if _, err := io.ReadFull(reader, size); err != nil {
+			return
+		}
+
+		frame := make([]byte, binary.BigEndian.Uint32(size))
+
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return
+		}
+
+		d := &kafkaDecoder{b: frame}
+
+		apiKey, _, correlationID := d.int16(), d.int16(), d.int32()
+
+		d.string() // client id
+
+		var resp *kafkaEncoder
+
+		switch apiKey {
+		case kafkaMetadataKey:
+			resp = s.metadata(d)
+		case kafkaInitProducerKey:
+			resp = &kafkaEncoder{}
+
+			resp.int32(0)
+			resp.int16(0)
+			resp.int64(42)
+			resp.int16(1)
+		case kafkaProduceKey:
+			resp = s.produce(t, d)
+		}
+
+		if d.err != nil {
+			t.Errorf("decode request %d: %v", apiKey, d.err)
+
+			return
+		}
+
+		if resp == nil {
+			continue
+		}
+
+		out := &kafkaEncoder{}
+
+		out.int32(int32(4 + len(resp.b)))
+		out.int32(correlationID)
+		out.b = append(out.b, resp.b...)
+
+		if _, err := conn.Write(out.b); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeKafka) metadata(d *kafkaDecoder) *kafkaEncoder {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	resp := &kafkaEncoder{}
+
+	resp.int32(1)
+	resp.int32(0)
+	resp.string(host)
+	resp.int32(int32(portNum))
+	resp.nullString()
+	resp.int32(0)
+
+	topics := d.int32()
+
+	resp.int32(topics)
+
+	for ; topics > 0; topics-- {
+		resp.int16(0)
+		resp.string(d.string())
+		resp.int8(0)
+		resp.int32(s.partitions)
+
+		for i := int32(0); i < s.partitions; i++ {
+			resp.int16(0)
+			resp.int32(i)
+			resp.int32(0)
+			resp.int32(1)
+			resp.int32(0)
+			resp.int32(1)
+			resp.int32(0)
+		}
+	}
+
+	return resp
+}
+
+func (s *fakeKafka) produce(t *testing.T, d *kafkaDecoder) *kafkaEncoder {
+	t.Helper()
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	code := int16(0)
+
+	if s.notLeader > 0 {
+		s.notLeader--
+
+		code = kafkaErrNotLeaderOrFollower
+	}
+
+	d.string() // transactional id
+
+	acks := d.int16()
+
+	d.int32() // timeout
+
+	resp := &kafkaEncoder{}
+
+	topics := d.int32()
+
+	resp.int32(topics)
+
+	for ; topics > 0; topics-- {
+		topic := d.string()
+		partitions := d.int32()
+
+		resp.string(topic)
+		resp.int32(partitions)
+
+		for ; partitions > 0; partitions-- {
+			partition := kafkaPartition{topic: topic, partition: d.int32()}
+			batch := d.bytes()
+
+			if code == 0 {
+				s.decodeBatch(t, partition, batch)
+			}
+
+			resp.int32(partition.partition)
+			resp.int16(code)
+			resp.int64(0)
+			resp.int64(-1)
+			resp.int64(0)
+		}
+	}
+
+	resp.int32(0)
+
+	if acks == 0 {
+		return nil
+	}
+
+	return resp
+}
+
+func (s *fakeKafka) decodeBatch(t *testing.T, partition kafkaPartition, batch []byte) {
+	t.Helper()
+
+	d := &kafkaDecoder{b: batch}
+
+	d.int64() // base offset
+	d.int32() // batch length
+	d.int32() // partition leader epoch
+
+	if magic := d.int8(); magic != kafkaRecordBatchMagic {
+		t.Errorf("magic = %d, want %d", magic, kafkaRecordBatchMagic)
+	}
+
+	if crc := uint32(d.int32()); crc != crc32.Checksum(d.b, kafkaCRCTable) {
+		t.Errorf("crc mismatch of %v", partition)
+	}
+
+	attributes := d.int16()
+
+	d.int32() // last offset delta
+	d.int64() // first timestamp
+	d.int64() // max timestamp
+
+	producerID := d.int64()
+
+	d.int16() // producer epoch
+
+	sequence := d.int32()
+	count := d.int32()
+
+	if producerID != kafkaNoProducerID {
+		s.producers = append(s.producers, producerID)
+		s.sequences[partition] = append(s.sequences[partition], sequence)
+	}
+
+	payload := d.b
+
+	switch attributes & 0x07 {
+	case kafkaCompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			t.Fatalf("gzip reader: %v", err)
+		}
+
+		payload, _ = io.ReadAll(r)
+	case kafkaCompressionZstd:
+		r, err := zstd.NewReader(nil)
+		if err != nil {
+			t.Fatalf("zstd reader: %v", err)
+		}
+
+		payload, err = r.DecodeAll(payload, nil)
+		if err != nil {
+			t.Errorf("decode zstd: %v", err)
+		}
+	}
+
+	records := &kafkaDecoder{b: payload}
+
+	for i := int32(0); i < count; i++ {
+		records.varint() // length
+		records.int8()   // attributes
+		records.varint() // timestamp delta
+		records.varint() // offset delta
+
+		key := records.varbytes()
+
+		value := &entity.FieldsBody{}
+		if err := value.UnmarshalJSON(records.varbytes()); err != nil {
+			t.Errorf("unmarshal value: %v", err)
+		}
+
+		records.varint() // headers
+
+		s.records[partition] = append(s.records[partition], string(key)+":"+value.Message)
+	}
+
+	if records.err != nil {
+		t.Errorf("decode records: %v", records.err)
+	}
+}
+
+func kafkaTestEvents() []*entity.Event {
+	now := time.Now()
+
+	return []*entity.Event{
+		{Message: "first", Time: now, Meta: &entity.Meta{Namespace: "default", PodName: "api", PodID: "abc"}},
+		{Message: "other", Time: now, Meta: &entity.Meta{Namespace: "kube-system", PodName: "dns", PodID: "def"}},
+		{Message: "second", Time: now.Add(time.Second), Meta: &entity.Meta{Namespace: "default", PodName: "api", PodID: "abc"}},
+	}
+}
+
+func TestKafka_SendEvents(t *testing.T) {
+	t.Parallel()
+
+	abc := kafkaPartition{topic: "logs-default", partition: (kafkaMurmur2([]byte("abc")) & 0x7fffffff) % 3}
+	def := kafkaPartition{topic: "logs-kube-system", partition: (kafkaMurmur2([]byte("def")) & 0x7fffffff) % 3}
+
+	tests := []struct {
+		name        string
+		compression string
+		idempotent  bool
+		acks        string
+		notLeader   int
+		sequences   map[kafkaPartition][]int32
+	}{
+		{name: "plain", compression: dictionary.CompressionNone, acks: dictionary.KafkaAcksLeader},
+		{name: "gzip without acks", compression: dictionary.CompressionGzip, acks: dictionary.KafkaAcksNone},
+		{
+			name:        "idempotent zstd",
+			compression: dictionary.CompressionZstd,
+			idempotent:  true,
+			acks:        dictionary.KafkaAcksAll,
+			sequences:   map[kafkaPartition][]int32{abc: {0, 2}, def: {0, 1}},
+		},
+		{
+			name:        "retry not leader",
+			compression: dictionary.CompressionNone,
+			idempotent:  true,
+			acks:        dictionary.KafkaAcksAll,
+			notLeader:   1,
+			sequences:   map[kafkaPartition][]int32{abc: {0, 2}, def: {0, 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			broker := newFakeKafka(t)
+
+			broker.notLeader = tt.notLeader
+
+			kafka := NewKafka(conf.Kafka{
+				Brokers:      []string{broker.listener.Addr().String()},
+				Topic:        "logs-{namespace}",
+				PartitionKey: "{pod_id}",
+				Acks:         tt.acks,
+				Compression:  tt.compression,
+				Idempotent:   tt.idempotent,
+				ClientID:     "logfowd",
+				Timeout:      1000,
+			}, NewMetrics().ForOutput("test"), &logger)
+
+			defer kafka.Close()
+
+			for i := 0; i < 2; i++ {
+				if err := kafka.SendEvents(kafkaTestEvents()); err != nil {
+					t.Fatalf("SendEvents() error = %v", err)
+				}
+			}
+
+			// records produced without acks may still be read by the broker
+			time.Sleep(50 * time.Millisecond)
+
+			broker.mx.Lock()
+			defer broker.mx.Unlock()
+
+			want := map[kafkaPartition][]string{
+				abc: {"abc:first", "abc:second", "abc:first", "abc:second"},
+				def: {"def:other", "def:other"},
+			}
+
+			if !reflect.DeepEqual(broker.records, want) {
+				t.Errorf("produced records = %v, want %v", broker.records, want)
+			}
+
+			if tt.sequences == nil {
+				tt.sequences = map[kafkaPartition][]int32{}
+			}
+
+			if !reflect.DeepEqual(broker.sequences, tt.sequences) {
+				t.Errorf("sequences = %v, want %v", broker.sequences, tt.sequences)
+			}
+		})
+	}
+}
+
+func TestKafkaMurmur2(t *testing.T) {
+	t.Parallel()
+
+	// hashes of the java client Utils.murmur2 tests
+	tests := []struct {
+		key  string
+		hash int32
+	}{
+		{key: "21", hash: -973932308},
+		{key: "foobar", hash: -790332482},
+		{key: "a-little-bit-long-string", hash: -985981536},
+		{key: "a-little-bit-longer-string", hash: -1486304829},
+		{key: "lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", hash: -58897971},
+		{key: "abc", hash: 479470107},
+	}
+
+	for _, tt := range tests {
+		if got := kafkaMurmur2([]byte(tt.key)); got != tt.hash {
+			t.Errorf("kafkaMurmur2(%q) = %d, want %d", tt.key, got, tt.hash)
+		}
+	}
+}
+
+func TestKafka_SendEvents_Stopped(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	broker := newFakeKafka(t)
+
+	broker.notLeader = 10
+
+	kafka := NewKafka(conf.Kafka{
+		Brokers:      []string{broker.listener.Addr().String()},
+		Topic:        "logs-{namespace}",
+		PartitionKey: "{pod_id}",
+		Acks:         dictionary.KafkaAcksLeader,
+		Compression:  dictionary.CompressionNone,
+		ClientID:     "logfowd",
+		Timeout:      1000,
+	}, NewMetrics().ForOutput("test"), &logger)
+
+	defer kafka.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_ = kafka.Start(ctx)
+
+	if err := kafka.SendEvents(kafkaTestEvents()); !errors.Is(err, dictionary.ErrKafkaRetriable) {
+		t.Errorf("SendEvents() error = %v, want %v", err, dictionary.ErrKafkaRetriable)
+	}
+
+	broker.mx.Lock()
+	defer broker.mx.Unlock()
+
+	if broker.notLeader != 9 {
+		t.Errorf("answered %d produce requests after stop, want 1", 10-broker.notLeader)
+	}
+}
+
+// fetch request of the consumer api, only the broker test reads records back.
+const (
+	kafkaFetchKey     int16 = 1
+	kafkaFetchVersion int16 = 4
+)
+
+// fetchKafka reads records of the partition from its leader into the collector, it checks batches
+// like the fake broker does.
+func fetchKafka(t *testing.T, kafka *Kafka, collector *fakeKafka, partition kafkaPartition, leader int32) {
+	t.Helper()
+
+	req := &kafkaEncoder{}
+
+	req.int32(-1)      // replica id
+	req.int32(1000)    // max wait
+	req.int32(1)       // min bytes
+	req.int32(1 << 20) // max bytes
+	req.int8(0)        // isolation level
+	req.int32(1)
+	req.string(partition.topic)
+	req.int32(1)
+	req.int32(partition.partition)
+	req.int64(0)       // fetch offset
+	req.int32(1 << 20) // partition max bytes
+
+	resp, err := kafka.broker(kafka.nodes[leader]).request(kafkaFetchKey, kafkaFetchVersion, req.b, true)
+	if err != nil {
+		t.Fatalf("fetch %v: %v", partition, err)
+	}
+
+	d := &kafkaDecoder{b: resp}
+
+	d.int32() // throttle time
+
+	for topics := d.int32(); topics > 0 && d.err == nil; topics-- {
+		d.string()
+
+		for partitions := d.int32(); partitions > 0 && d.err == nil; partitions-- {
+			d.int32() // partition
+
+			if code := d.int16(); code != 0 {
+				t.Fatalf("fetch %v: error code %d", partition, code)
+			}
+
+			d.int64() // high watermark
+			d.int64() // last stable offset
+			d.next(16 * max(int(d.int32()), 0))
+
+			records := &kafkaDecoder{b: d.bytes()}
+
+			for len(records.b) > 0 && records.err == nil {
+				header := records.next(12)
+				if records.err != nil {
+					break
+				}
+
+				batch := append(header, records.next(int(binary.BigEndian.Uint32(header[8:])))...)
+
+				collector.decodeBatch(t, partition, batch)
+			}
+
+			if records.err != nil {
+				t.Errorf("fetch %v: %v", partition, records.err)
+			}
+		}
+	}
+
+	if d.err != nil {
+		t.Fatalf("fetch %v: %v", partition, d.err)
+	}
+}
+
+// TestKafka_SendEvents_Broker produces to the brokers of LOGFOWD_KAFKA_BROKERS and reads records back,
+// topics are named by the test and have to be created automatically by the brokers.
+func TestKafka_SendEvents_Broker(t *testing.T) {
+	t.Parallel()
+
+	brokers := os.Getenv("LOGFOWD_KAFKA_BROKERS")
+	if brokers == "" {
+		t.Skip("LOGFOWD_KAFKA_BROKERS is not set")
+	}
+
+	tests := []struct {
+		name        string
+		compression string
+		idempotent  bool
+		acks        string
+	}{
+		{name: "plain", compression: dictionary.CompressionNone, acks: dictionary.KafkaAcksLeader},
+		{name: "gzip", compression: dictionary.CompressionGzip, acks: dictionary.KafkaAcksLeader},
+		{name: "idempotent zstd", compression: dictionary.CompressionZstd, idempotent: true, acks: dictionary.KafkaAcksAll},
+	}
+
+	for i, tt := range tests {
+		i, tt := i, tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			prefix := "logfowd-test-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.Itoa(i)
+
+			kafka := NewKafka(conf.Kafka{
+				Brokers:      strings.Split(brokers, ","),
+				Topic:        prefix + "-{namespace}",
+				PartitionKey: "{pod_id}",
+				Acks:         tt.acks,
+				Compression:  tt.compression,
+				Idempotent:   tt.idempotent,
+				ClientID:     "logfowd",
+				Timeout:      10000,
+			}, NewMetrics().ForOutput("test"), &logger)
+
+			defer kafka.Close()
+
+			for i := 0; i < 2; i++ {
+				if err := kafka.SendEvents(kafkaTestEvents()); err != nil {
+					t.Fatalf("SendEvents() error = %v", err)
+				}
+			}
+
+			collector := &fakeKafka{
+				records:   make(map[kafkaPartition][]string),
+				sequences: make(map[kafkaPartition][]int32),
+			}
+			want := make(map[kafkaPartition][]string)
+
+			for key, messages := range map[string][]string{
+				"default:abc":     {"abc:first", "abc:second", "abc:first", "abc:second"},
+				"kube-system:def": {"def:other", "def:other"},
+			} {
+				namespace, podID, _ := strings.Cut(key, ":")
+				topic := prefix + "-" + namespace
+
+				leaders, err := kafka.leaders(topic)
+				if err != nil {
+					t.Fatalf("leaders(%s) error = %v", topic, err)
+				}
+
+				partition := kafkaPartition{
+					topic:     topic,
+					partition: (kafkaMurmur2([]byte(podID)) & 0x7fffffff) % int32(len(leaders)),
+				}
+
+				want[partition] = messages
+
+				fetchKafka(t, kafka, collector, partition, leaders[partition.partition])
+			}
+
+			if !reflect.DeepEqual(collector.records, want) {
+				t.Errorf("fetched records = %v, want %v", collector.records, want)
+			}
+
+			if tt.idempotent && len(collector.producers) == 0 {
+				t.Error("fetched batches have no producer id, want the idempotent producer's")
+			}
+		})
+	}
+}
@@ -0,0 +1,430 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/soulgarden/logfowd/dictionary"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// kafka api keys and versions of the requests the producer sends.
+const (
+	kafkaProduceKey          int16 = 0
+	kafkaProduceVersion      int16 = 7
+	kafkaMetadataKey         int16 = 3
+	kafkaMetadataVersion     int16 = 1
+	kafkaInitProducerKey     int16 = 22
+	kafkaInitProducerVersion int16 = 0
+)
+
+// kafka error codes the producer handles, others fail the batch.
+const (
+	kafkaErrUnknownTopicOrPartition int16 = 3
+	kafkaErrLeaderNotAvailable      int16 = 5
+	kafkaErrNotLeaderOrFollower     int16 = 6
+	kafkaErrRequestTimedOut         int16 = 7
+	kafkaErrNotEnoughReplicas       int16 = 19
+	kafkaErrNotEnoughReplicasAppend int16 = 20
+	kafkaErrDuplicateSequenceNumber int16 = 46
+)
+
+const (
+	kafkaCompressionGzip int16 = 1
+	kafkaCompressionZstd int16 = 4
+)
+
+const (
+	kafkaRecordBatchMagic     int8  = 2
+	kafkaNoProducerID         int64 = -1
+	kafkaNoSequence           int32 = -1
+	kafkaTransactionTimeoutMs int32 = 60000
+)
+
+var kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaZstd is shared by all batches, EncodeAll is safe for concurrent use.
+var kafkaZstd = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil)
+})
+
+func kafkaRetriable(code int16) bool {
+	switch code {
+	case kafkaErrUnknownTopicOrPartition, kafkaErrLeaderNotAvailable, kafkaErrNotLeaderOrFollower,
+		kafkaErrRequestTimedOut, kafkaErrNotEnoughReplicas, kafkaErrNotEnoughReplicasAppend:
+		return true
+	default:
+		return false
+	}
+}
+
+// kafkaEncoder appends big endian primitives of the kafka protocol.
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.b = append(e.b, byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	e.b = binary.BigEndian.AppendUint16(e.b, uint16(v))
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	e.b = binary.BigEndian.AppendUint32(e.b, uint32(v))
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	e.b = binary.BigEndian.AppendUint64(e.b, uint64(v))
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *kafkaEncoder) nullString() {
+	e.int16(-1)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	e.b = protowire.AppendVarint(e.b, protowire.EncodeZigZag(v))
+}
+
+func (e *kafkaEncoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+
+		return
+	}
+
+	e.varint(int64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// kafkaDecoder reads big endian primitives of the kafka protocol, the first short read is kept in err
+// and following reads return zero values.
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n < 0 || len(d.b) < n {
+		d.err = fmt.Errorf("%w: need %d bytes, %d left", dictionary.ErrKafkaMalformed, n, len(d.b))
+
+		return nil
+	}
+
+	v := d.b[:n]
+	d.b = d.b[n:]
+
+	return v
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if v := d.next(1); v != nil {
+		return int8(v[0])
+	}
+
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if v := d.next(2); v != nil {
+		return int16(binary.BigEndian.Uint16(v))
+	}
+
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if v := d.next(4); v != nil {
+		return int32(binary.BigEndian.Uint32(v))
+	}
+
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if v := d.next(8); v != nil {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+
+	return d.next(int(n))
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := protowire.ConsumeVarint(d.b)
+	if n < 0 {
+		d.err = fmt.Errorf("%w: bad varint", dictionary.ErrKafkaMalformed)
+
+		return 0
+	}
+
+	d.b = d.b[n:]
+
+	return protowire.DecodeZigZag(v)
+}
+
+func (d *kafkaDecoder) varbytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+
+	return d.next(int(n))
+}
+
+// kafkaBroker is a connection to one broker, requests are sent one by one by the caller holding the producer lock.
+type kafkaBroker struct {
+	addr          string
+	clientID      string
+	conn          net.Conn
+	reader        *bufio.Reader
+	correlationID int32
+}
+
+// request sends the request and returns the response body after the header, requests without a response
+// like produce with acks 0 return nil.
+func (b *kafkaBroker) request(apiKey, version int16, body []byte, response bool) ([]byte, error) {
+	if b.conn == nil {
+		conn, err := net.DialTimeout("tcp", b.addr, dictionary.RequestTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		b.conn, b.reader = conn, bufio.NewReader(conn)
+	}
+
+	if err := b.conn.SetDeadline(time.Now().Add(dictionary.RequestTimeout)); err != nil {
+		return nil, err
+	}
+
+	b.correlationID++
+
+	header := &kafkaEncoder{}
+
+	header.int32(0)
+	header.int16(apiKey)
+	header.int16(version)
+	header.int32(b.correlationID)
+	header.string(b.clientID)
+
+	frame := append(header.b, body...)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+
+	if _, err := b.conn.Write(frame); err != nil {
+		return nil, err
+	}
+
+	if !response {
+		return nil, nil
+	}
+
+	size := make([]byte, 4)
+
+	if _, err := io.ReadFull(b.reader, size); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint32(size))
+
+	if _, err := io.ReadFull(b.reader, resp); err != nil {
+		return nil, err
+	}
+
+	d := &kafkaDecoder{b: resp}
+
+	if correlationID := d.int32(); d.err == nil && correlationID != b.correlationID {
+		return nil, fmt.Errorf(
+			"%w: correlation id %d, expected %d",
+			dictionary.ErrKafkaMalformed,
+			correlationID,
+			b.correlationID,
+		)
+	}
+
+	return d.b, d.err
+}
+
+func (b *kafkaBroker) close() {
+	if b.conn != nil {
+		_ = b.conn.Close()
+
+		b.conn, b.reader = nil, nil
+	}
+}
+
+// kafkaRecord is a record of a batch, a nil key is encoded as null.
+type kafkaRecord struct {
+	key       []byte
+	value     []byte
+	timestamp time.Time
+}
+
+// kafkaRecordBatch encodes records as a v2 record batch, the idempotent producer passes its id, epoch and
+// the sequence of the first record, others pass kafkaNoProducerID and kafkaNoSequence.
+func kafkaRecordBatch(
+	records []*kafkaRecord,
+	compression string,
+	producerID int64,
+	producerEpoch int16,
+	baseSequence int32,
+) ([]byte, error) {
+	first, maxTimestamp := records[0].timestamp.UnixMilli(), records[0].timestamp.UnixMilli()
+
+	encoded := &kafkaEncoder{}
+
+	for i, record := range records {
+		timestamp := record.timestamp.UnixMilli()
+		maxTimestamp = max(maxTimestamp, timestamp)
+
+		r := &kafkaEncoder{}
+
+		r.int8(0)
+		r.varint(timestamp - first)
+		r.varint(int64(i))
+		r.varbytes(record.key)
+		r.varbytes(record.value)
+		r.varint(0)
+
+		encoded.varint(int64(len(r.b)))
+		encoded.b = append(encoded.b, r.b...)
+	}
+
+	var attributes int16
+
+	payload := encoded.b
+
+	switch compression {
+	case dictionary.CompressionGzip:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		payload, attributes = buf.Bytes(), kafkaCompressionGzip
+	case dictionary.CompressionZstd:
+		w, err := kafkaZstd()
+		if err != nil {
+			return nil, err
+		}
+
+		payload, attributes = w.EncodeAll(payload, nil), kafkaCompressionZstd
+	}
+
+	afterCRC := &kafkaEncoder{}
+
+	afterCRC.int16(attributes)
+	afterCRC.int32(int32(len(records) - 1))
+	afterCRC.int64(first)
+	afterCRC.int64(maxTimestamp)
+	afterCRC.int64(producerID)
+	afterCRC.int16(producerEpoch)
+	afterCRC.int32(baseSequence)
+	afterCRC.int32(int32(len(records)))
+	afterCRC.b = append(afterCRC.b, payload...)
+
+	batch := &kafkaEncoder{}
+
+	batch.int64(0)
+	batch.int32(int32(4 + 1 + 4 + len(afterCRC.b)))
+	batch.int32(-1)
+	batch.int8(kafkaRecordBatchMagic)
+	batch.int32(int32(crc32.Checksum(afterCRC.b, kafkaCRCTable)))
+	batch.b = append(batch.b, afterCRC.b...)
+
+	return batch.b, nil
+}
+
+// kafkaMurmur2 is the murmur2 hash of the java client default partitioner, so keys land on the same partitions
+// as with other producers.
+func kafkaMurmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	length := len(data)
+	h := seed ^ uint32(length)
+
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length-length%4:]
+
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return int32(h)
+}
@@ -0,0 +1,382 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/mailru/easyjson"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"github.com/valyala/fasthttp"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// lokiIgnoredRegexp matches the number of rejected entries in a partially accepted push.
+var lokiIgnoredRegexp = regexp.MustCompile(`total ignored: (\d+) out of`)
+
+// Loki pushes events to the loki push api, events are grouped into streams by labels taken from meta
+// and entries of a stream are sorted by time.
+type Loki struct {
+	cfg     conf.Loki
+	httpCli *fasthttp.Client
+	mx      sync.Mutex
+	streams map[string]time.Time
+	stop    *outputStop
+	metrics *OutputMetrics
+	logger  *zerolog.Logger
+}
+
+type lokiStream struct {
+	key     string
+	labels  map[string]string
+	entries []*entity.Event
+}
+
+func NewLoki(cfg conf.Loki, metrics *OutputMetrics, logger *zerolog.Logger) *Loki {
+	return &Loki{
+		cfg:     cfg,
+		httpCli: &fasthttp.Client{},
+		streams: make(map[string]time.Time),
+		stop:    newOutputStop(),
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+// Start waits for ctx, loki has no background jobs. Once ctx is done pushes are no longer retried.
+func (s *Loki) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	s.stop.stop()
+
+	return nil
+}
+
+func (s *Loki) Health() error {
+	return nil
+}
+
+// Probe requests the readiness endpoint of loki.
+func (s *Loki) Probe() error {
+	return probeRequest(s.httpCli, fasthttp.MethodGet, strings.TrimRight(s.cfg.URL, "/")+dictionary.LokiReadyPath, nil, nil)
+}
+
+// Close closes idle connections to loki.
+func (s *Loki) Close() error {
+	s.httpCli.CloseIdleConnections()
+
+	return nil
+}
+
+func (s *Loki) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// SendEvents pushes events, entries rejected as out of order or too old are counted as dropped
+// instead of failing the batch.
+func (s *Loki) SendEvents(events []*entity.Event) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	streams := s.group(events, time.Now())
+
+	if s.cfg.Encoding == dictionary.LokiEncodingJSON {
+		body, err := easyjson.Marshal(lokiJSON(streams))
+		if err != nil {
+			s.metrics.BatchesSent.WithLabelValues("error").Inc()
+			s.metrics.DroppedEvents.Add(float64(len(events)))
+
+			return err
+		}
+
+		req.SetBody(body)
+		req.Header.SetContentType("application/json")
+	} else {
+		req.SetBody(snappy.Encode(nil, lokiProtobuf(streams)))
+		req.Header.SetContentType("application/x-protobuf")
+	}
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI(strings.TrimRight(s.cfg.URL, "/") + dictionary.LokiPushPath)
+
+	if s.cfg.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", s.cfg.TenantID)
+	}
+
+	if s.cfg.Username != "" {
+		req.Header.Set(
+			"Authorization",
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(s.cfg.Username+":"+s.cfg.Password)),
+		)
+	}
+
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+
+		err = s.httpCli.DoTimeout(req, resp, dictionary.RequestTimeout)
+
+		s.metrics.BulkDuration.Observe(time.Since(start).Seconds())
+
+		if !lokiRetryable(err, resp.StatusCode()) || attempt >= s.cfg.MaxRetries {
+			break
+		}
+
+		delay := min(time.Duration(s.cfg.RetryDelay)*time.Millisecond<<attempt, dictionary.LokiMaxRetryDelay)
+
+		s.logger.Warn().
+			Err(err).
+			Int("status", resp.StatusCode()).
+			Int("attempt", attempt+1).
+			Dur("delay", delay).
+			Msg("push to loki, retrying")
+
+		s.metrics.Retries.Inc()
+
+		if !s.stop.wait(delay) {
+			break
+		}
+	}
+
+	// a partially accepted push tells how many entries were ignored, other bad requests reject the whole batch
+	if err == nil && resp.StatusCode() == http.StatusBadRequest {
+		if ignored, ok := lokiIgnored(resp.Body()); ok {
+			s.countRejected(resp.Body(), ignored)
+
+			s.metrics.BatchesSent.WithLabelValues("success").Inc()
+
+			return nil
+		}
+	}
+
+	if err == nil && resp.StatusCode() >= http.StatusMultipleChoices {
+		err = fmt.Errorf("%w: %d %s", dictionary.ErrBadStatusCode, resp.StatusCode(), resp.Body())
+	}
+
+	if err != nil {
+		s.logger.Err(err).Int("num", len(events)).Msg("push to loki")
+
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
+		return err
+	}
+
+	s.metrics.BatchesSent.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+// countRejected counts entries loki refused to ingest, like out of order or too old ones.
+func (s *Loki) countRejected(body []byte, num int) {
+	s.metrics.ItemFailures.WithLabelValues(strconv.Itoa(http.StatusBadRequest)).Add(float64(num))
+	s.metrics.DroppedEvents.Add(float64(num))
+
+	s.logger.Warn().Int("num", num).Bytes("response body", body).Msg("loki rejected entries")
+}
+
+// lokiIgnored returns the number of entries ignored in a partially accepted push, false when the body
+// doesn't tell it.
+func lokiIgnored(body []byte) (int, bool) {
+	matches := lokiIgnoredRegexp.FindSubmatch(body)
+	if matches == nil {
+		return 0, false
+	}
+
+	ignored, err := strconv.Atoi(string(matches[1]))
+
+	return ignored, err == nil
+}
+
+// lokiRetryable reports whether the push may succeed when sent again: rate limited, server errors and
+// network errors.
+func lokiRetryable(err error, status int) bool {
+	return err != nil || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// group splits events into streams sorted by labels, entries of every stream are sorted by time.
+func (s *Loki) group(events []*entity.Event, now time.Time) []*lokiStream {
+	byKey := make(map[string]*lokiStream)
+
+	for _, event := range events {
+		labels := s.labels(event.Meta)
+		key := s.admit(labels, now)
+
+		stream, ok := byKey[key]
+		if !ok {
+			stream = &lokiStream{key: key, labels: labels}
+			byKey[key] = stream
+		}
+
+		stream.entries = append(stream.entries, event)
+	}
+
+	streams := make([]*lokiStream, 0, len(byKey))
+
+	for _, stream := range byKey {
+		sort.SliceStable(stream.entries, func(i, j int) bool {
+			return stream.entries[i].Time.Before(stream.entries[j].Time)
+		})
+
+		streams = append(streams, stream)
+	}
+
+	sort.Slice(streams, func(i, j int) bool { return streams[i].key < streams[j].key })
+
+	return streams
+}
+
+// labels returns static labels and configured meta labels, empty meta values are skipped.
+func (s *Loki) labels(meta *entity.Meta) map[string]string {
+	labels := make(map[string]string, len(s.cfg.StaticLabels)+len(s.cfg.Labels))
+
+	for name, value := range s.cfg.StaticLabels {
+		labels[name] = value
+	}
+
+	for _, name := range s.cfg.Labels {
+		var value string
+
+		switch name {
+		case dictionary.LokiLabelNamespace:
+			value = meta.Namespace
+		case dictionary.LokiLabelPod:
+			value = meta.PodName
+		case dictionary.LokiLabelPodID:
+			value = meta.PodID
+		case dictionary.LokiLabelContainer:
+			value = meta.ContainerName
+		}
+
+		if value != "" {
+			labels[name] = value
+		}
+	}
+
+	if len(labels) == 0 {
+		labels[dictionary.LokiJobLabel] = dictionary.LokiJob
+	}
+
+	return labels
+}
+
+// admit returns the key of the label set, label sets over the max streams limit are replaced in place
+// by static labels with the overflow label.
+func (s *Loki) admit(labels map[string]string, now time.Time) string {
+	key := lokiLabelsKey(labels)
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, ok := s.streams[key]; !ok && len(s.streams) >= s.cfg.MaxStreams {
+		for seen, last := range s.streams {
+			if now.Sub(last) > dictionary.LokiStreamTTL {
+				delete(s.streams, seen)
+			}
+		}
+
+		if len(s.streams) >= s.cfg.MaxStreams {
+			for name := range labels {
+				if _, ok := s.cfg.StaticLabels[name]; !ok {
+					delete(labels, name)
+				}
+			}
+
+			labels[dictionary.LokiOverflowLabel] = "true"
+
+			s.logger.Debug().Str("labels", key).Msg("loki max streams reached, event sent to overflow stream")
+
+			return lokiLabelsKey(labels)
+		}
+	}
+
+	s.streams[key] = now
+
+	return key
+}
+
+// lokiLabelsKey formats labels sorted by name like {container="app", namespace="default"}.
+func lokiLabelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+
+	for name := range labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+
+	for _, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(labels[name]))
+	}
+
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+func lokiJSON(streams []*lokiStream) *entity.LokiPushRequest {
+	push := &entity.LokiPushRequest{Streams: make([]*entity.LokiStream, 0, len(streams))}
+
+	for _, stream := range streams {
+		values := make([][2]string, 0, len(stream.entries))
+
+		for _, event := range stream.entries {
+			values = append(values, [2]string{strconv.FormatInt(event.Time.UnixNano(), 10), event.Message})
+		}
+
+		push.Streams = append(push.Streams, &entity.LokiStream{Stream: stream.labels, Values: values})
+	}
+
+	return push
+}
+
+// lokiProtobuf encodes streams as logproto.PushRequest, the message is small enough to be written by hand.
+func lokiProtobuf(streams []*lokiStream) []byte {
+	var push []byte
+
+	for _, stream := range streams {
+		var msg []byte
+
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendString(msg, stream.key)
+
+		for _, event := range stream.entries {
+			var timestamp []byte
+
+			timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(event.Time.Unix()))
+			timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(event.Time.Nanosecond()))
+
+			var entry []byte
+
+			entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, timestamp)
+			entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+			entry = protowire.AppendString(entry, event.Message)
+
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendBytes(msg, entry)
+		}
+
+		push = protowire.AppendTag(push, 1, protowire.BytesType)
+		push = protowire.AppendBytes(push, msg)
+	}
+
+	return push
+}
@@ -0,0 +1,300 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/mailru/easyjson"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fakeLoki decodes pushed streams into label sets and their lines, statuses of failures are answered
+// to the first requests, status to the next ones.
+type fakeLoki struct {
+	*httptest.Server
+	mx       sync.Mutex
+	status   int
+	body     string
+	failures []int
+	requests int
+	streams  map[string][]string
+}
+
+func newFakeLoki(t *testing.T) *fakeLoki {
+	t.Helper()
+
+	loki := &fakeLoki{status: http.StatusNoContent, streams: make(map[string][]string)}
+
+	loki.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loki.mx.Lock()
+		defer loki.mx.Unlock()
+
+		if r.URL.Path != dictionary.LokiPushPath || r.Header.Get("X-Scope-OrgID") != "tenant" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+
+		if r.Header.Get("Content-Type") == "application/json" {
+			push := &entity.LokiPushRequest{}
+			if err := easyjson.Unmarshal(body, push); err != nil {
+				t.Errorf("unmarshal push: %v", err)
+			}
+
+			for _, stream := range push.Streams {
+				key := lokiLabelsKey(stream.Stream)
+
+				for _, value := range stream.Values {
+					loki.streams[key] = append(loki.streams[key], value[1])
+				}
+			}
+		} else {
+			decoded, err := snappy.Decode(nil, body)
+			if err != nil {
+				t.Errorf("decode snappy: %v", err)
+			}
+
+			loki.decodeProtobuf(decoded)
+		}
+
+		loki.requests++
+
+		if len(loki.failures) > 0 {
+			w.WriteHeader(loki.failures[0])
+
+			loki.failures = loki.failures[1:]
+
+			return
+		}
+
+		w.WriteHeader(loki.status)
+		_, _ = w.Write([]byte(loki.body))
+	}))
+
+	t.Cleanup(loki.Close)
+
+	return loki
+}
+
+func (s *fakeLoki) decodeProtobuf(push []byte) {
+	for _, stream := range protoFields(push, 1) {
+		key := string(protoFields(stream, 1)[0])
+
+		for _, entry := range protoFields(stream, 2) {
+			s.streams[key] = append(s.streams[key], string(protoFields(entry, 2)[0]))
+		}
+	}
+}
+
+// protoFields returns values of length delimited fields with the number.
+func protoFields(msg []byte, num protowire.Number) [][]byte {
+	var values [][]byte
+
+	for len(msg) > 0 {
+		n, typ, tagLen := protowire.ConsumeTag(msg)
+		msg = msg[tagLen:]
+
+		if typ != protowire.BytesType {
+			msg = msg[protowire.ConsumeFieldValue(n, typ, msg):]
+
+			continue
+		}
+
+		value, valueLen := protowire.ConsumeBytes(msg)
+		msg = msg[valueLen:]
+
+		if n == num {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+func lokiTestEvents() []*entity.Event {
+	now := time.Now()
+
+	return []*entity.Event{
+		{Message: "second", Time: now.Add(time.Second), Meta: &entity.Meta{Namespace: "default", PodName: "api"}},
+		{Message: "first", Time: now, Meta: &entity.Meta{Namespace: "default", PodName: "api"}},
+		{Message: "other", Time: now, Meta: &entity.Meta{Namespace: "kube-system", PodName: "dns"}},
+		{Message: "node", Time: now, Meta: &entity.Meta{}},
+	}
+}
+
+func TestLoki_SendEvents(t *testing.T) {
+	t.Parallel()
+
+	for _, encoding := range []string{dictionary.LokiEncodingProtobuf, dictionary.LokiEncodingJSON} {
+		encoding := encoding
+
+		t.Run(encoding, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			server := newFakeLoki(t)
+
+			loki := NewLoki(conf.Loki{
+				URL:          server.URL,
+				Encoding:     encoding,
+				Labels:       []string{dictionary.LokiLabelNamespace, dictionary.LokiLabelPod},
+				StaticLabels: map[string]string{"cluster": "test"},
+				MaxStreams:   2,
+				TenantID:     "tenant",
+			}, NewMetrics().ForOutput("test"), &logger)
+
+			if err := loki.SendEvents(lokiTestEvents()); err != nil {
+				t.Fatalf("SendEvents() error = %v", err)
+			}
+
+			want := map[string][]string{
+				`{cluster="test", namespace="default", pod="api"}`:     {"first", "second"},
+				`{cluster="test", namespace="kube-system", pod="dns"}`: {"other"},
+				`{cluster="test", overflow="true"}`:                    {"node"},
+			}
+
+			if !reflect.DeepEqual(server.streams, want) {
+				t.Errorf("pushed streams = %v, want %v", server.streams, want)
+			}
+		})
+	}
+}
+
+func TestLoki_SendEvents_Rejected(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		status       int
+		body         string
+		failures     []int
+		wantErr      bool
+		wantDropped  float64
+		wantRetries  float64
+		wantRequests int
+	}{
+		{
+			name:         "partially accepted",
+			status:       http.StatusBadRequest,
+			body:         `entry with timestamp 2024-01-02 ignored, reason: 'entry out of order', total ignored: 3 out of 4`,
+			wantDropped:  3,
+			wantRequests: 1,
+		},
+		{
+			name:         "bad request",
+			status:       http.StatusBadRequest,
+			body:         `error parsing labels: unexpected end of input`,
+			wantErr:      true,
+			wantDropped:  4,
+			wantRequests: 1,
+		},
+		{
+			name:         "rate limited then accepted",
+			status:       http.StatusNoContent,
+			failures:     []int{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+			wantRetries:  2,
+			wantRequests: 3,
+		},
+		{
+			name:         "retries exhausted",
+			status:       http.StatusNoContent,
+			failures:     []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable},
+			wantErr:      true,
+			wantDropped:  4,
+			wantRetries:  2,
+			wantRequests: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			metrics := NewMetrics().ForOutput("test")
+			server := newFakeLoki(t)
+
+			server.status, server.body, server.failures = tt.status, tt.body, tt.failures
+
+			loki := NewLoki(conf.Loki{
+				URL:        server.URL,
+				Encoding:   dictionary.LokiEncodingProtobuf,
+				Labels:     []string{dictionary.LokiLabelNamespace},
+				MaxStreams: 10,
+				TenantID:   "tenant",
+				MaxRetries: 2,
+				RetryDelay: 1,
+			}, metrics, &logger)
+
+			if err := loki.SendEvents(lokiTestEvents()); (err != nil) != tt.wantErr {
+				t.Fatalf("SendEvents() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got := testutil.ToFloat64(metrics.DroppedEvents); got != tt.wantDropped {
+				t.Errorf("dropped = %v, want %v", got, tt.wantDropped)
+			}
+
+			if got := testutil.ToFloat64(metrics.Retries); got != tt.wantRetries {
+				t.Errorf("retries = %v, want %v", got, tt.wantRetries)
+			}
+
+			server.mx.Lock()
+			defer server.mx.Unlock()
+
+			if server.requests != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", server.requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestLoki_SendEvents_StopRetrying(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	server := newFakeLoki(t)
+
+	server.status = http.StatusTooManyRequests
+
+	loki := NewLoki(conf.Loki{
+		URL:        server.URL,
+		Encoding:   dictionary.LokiEncodingProtobuf,
+		Labels:     []string{dictionary.LokiLabelNamespace},
+		MaxStreams: 10,
+		TenantID:   "tenant",
+		MaxRetries: 5,
+		RetryDelay: 60000,
+	}, NewMetrics().ForOutput("test"), &logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() { _ = loki.Start(ctx) }()
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+
+	if err := loki.SendEvents(lokiTestEvents()); err == nil {
+		t.Error("SendEvents() error = nil, want rate limited")
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("SendEvents() took %v after the output was stopped", elapsed)
+	}
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/soulgarden/logfowd/storage"
+)
+
+const metricsNamespace = "logfowd"
+
+type Metrics struct {
+	Registry         *prometheus.Registry
+	LinesRead        *prometheus.CounterVec
+	BatchesSent      *prometheus.CounterVec
+	BulkDuration     *prometheus.HistogramVec
+	Retries          *prometheus.CounterVec
+	ItemFailures     *prometheus.CounterVec
+	DroppedEvents    *prometheus.CounterVec
+	ChannelOverflows *prometheus.CounterVec
+	TapDropped       prometheus.Counter
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		LinesRead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "lines_read_total",
+			Help:      "Number of lines read from log files.",
+		}, []string{"namespace", "container"}),
+		BatchesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "batches_sent_total",
+			Help:      "Number of batches sent to the output by result.",
+		}, []string{"output", "result"}),
+		BulkDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "bulk_duration_seconds",
+			Help:      "Latency of bulk requests including retries.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"output"}),
+		Retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_retries_total",
+			Help:      "Number of requests retried on another node or over a new connection.",
+		}, []string{"output"}),
+		ItemFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bulk_item_failures_total",
+			Help:      "Number of documents rejected in bulk responses by status code.",
+		}, []string{"output", "status"}),
+		DroppedEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "events_dropped_total",
+			Help:      "Number of events lost because of failed batches, rejected documents or buffer overflows.",
+		}, []string{"output"}),
+		ChannelOverflows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "event_channel_overflows_total",
+			Help:      "Number of events pushed to a full event buffer of the output, dropped or blocking readers by overflow.",
+		}, []string{"output"}),
+		TapDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tap_events_dropped_total",
+			Help:      "Number of events not delivered to slow tap subscribers.",
+		}),
+	}
+
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.LinesRead,
+		m.BatchesSent,
+		m.BulkDuration,
+		m.Retries,
+		m.ItemFailures,
+		m.DroppedEvents,
+		m.ChannelOverflows,
+		m.TapDropped,
+	)
+
+	return m
+}
+
+// OutputMetrics are metrics of a single output, labeled by its name.
+type OutputMetrics struct {
+	BatchesSent      *prometheus.CounterVec
+	BulkDuration     prometheus.Observer
+	Retries          prometheus.Counter
+	ItemFailures     *prometheus.CounterVec
+	DroppedEvents    prometheus.Counter
+	ChannelOverflows prometheus.Counter
+}
+
+// ForOutput returns metrics of the named output, result and status labels are left to the output.
+func (m *Metrics) ForOutput(name string) *OutputMetrics {
+	labels := prometheus.Labels{"output": name}
+
+	return &OutputMetrics{
+		BatchesSent:      m.BatchesSent.MustCurryWith(labels),
+		BulkDuration:     m.BulkDuration.With(labels),
+		Retries:          m.Retries.With(labels),
+		ItemFailures:     m.ItemFailures.MustCurryWith(labels),
+		DroppedEvents:    m.DroppedEvents.With(labels),
+		ChannelOverflows: m.ChannelOverflows.With(labels),
+	}
+}
+
+// registerWatcher exposes buffer lengths of output queues and per file state of the watcher.
+func (m *Metrics) registerWatcher(w *Watcher) {
+	for _, queue := range w.queues {
+		queue := queue
+
+		m.Registry.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace:   metricsNamespace,
+				Name:        "events_buffered",
+				Help:        "Number of events waiting in the event buffer of the output.",
+				ConstLabels: prometheus.Labels{"output": queue.name},
+			}, func() float64 { return float64(len(queue.event)) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace:   metricsNamespace,
+				Name:        "batches_buffered",
+				Help:        "Number of batches waiting for a free sender of the output.",
+				ConstLabels: prometheus.Labels{"output": queue.name},
+			}, func() float64 { return float64(len(queue.batches)) }),
+		)
+	}
+
+	m.Registry.MustRegister(newFilesCollector(w.state))
+}
+
+// filesCollector exports per file series of tracked files only, series of a file are gone once it is no longer
+// tracked, so their number is bounded by open files.
+type filesCollector struct {
+	state       *storage.State
+	openFiles   *prometheus.Desc
+	linesRead   *prometheus.Desc
+	bytesBehind *prometheus.Desc
+}
+
+func newFilesCollector(state *storage.State) *filesCollector {
+	return &filesCollector{
+		state: state,
+		openFiles: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "open_files"),
+			"Number of tracked log files.",
+			nil,
+			nil,
+		),
+		linesRead: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "file_lines_read_total"),
+			"Number of lines read from the log file since it is tracked.",
+			[]string{"path", "namespace", "pod", "container"},
+			nil,
+		),
+		bytesBehind: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "file_bytes_behind"),
+			"Difference between file size and read offset.",
+			[]string{"path", "namespace", "pod", "container"},
+			nil,
+		),
+	}
+}
+
+func (c *filesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.openFiles
+	ch <- c.linesRead
+	ch <- c.bytesBehind
+}
+
+func (c *filesCollector) Collect(ch chan<- prometheus.Metric) {
+	files := c.state.Files()
+
+	ch <- prometheus.MustNewConstMetric(c.openFiles, prometheus.GaugeValue, float64(len(files)))
+
+	// sizes are the ones seen by the reader on the last write event, files are not stated on every scrape
+	for _, f := range files {
+		snapshot := f.Snapshot()
+		labels := []string{snapshot.Path, snapshot.Meta.Namespace, snapshot.Meta.PodName, snapshot.Meta.ContainerName}
+
+		ch <- prometheus.MustNewConstMetric(c.linesRead, prometheus.CounterValue, float64(f.LinesRead()), labels...)
+
+		ch <- prometheus.MustNewConstMetric(
+			c.bytesBehind,
+			prometheus.GaugeValue,
+			float64(max(snapshot.Size-snapshot.Offset, 0)),
+			labels...,
+		)
+	}
+}
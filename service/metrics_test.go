@@ -0,0 +1,115 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/soulgarden/logfowd/entity"
+	"github.com/soulgarden/logfowd/service/file"
+	"github.com/soulgarden/logfowd/storage"
+)
+
+func TestMetrics_ForOutput(t *testing.T) {
+	t.Parallel()
+
+	metrics := NewMetrics()
+
+	es, loki := metrics.ForOutput("es"), metrics.ForOutput("loki")
+
+	es.BatchesSent.WithLabelValues("success").Inc()
+	loki.BatchesSent.WithLabelValues("error").Inc()
+	loki.DroppedEvents.Add(3)
+	loki.Retries.Inc()
+	es.ItemFailures.WithLabelValues("429").Inc()
+	loki.ChannelOverflows.Inc()
+
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{name: "es batches sent", got: testutil.ToFloat64(metrics.BatchesSent.WithLabelValues("es", "success")), want: 1},
+		{name: "es batches failed", got: testutil.ToFloat64(metrics.BatchesSent.WithLabelValues("es", "error")), want: 0},
+		{name: "loki batches failed", got: testutil.ToFloat64(metrics.BatchesSent.WithLabelValues("loki", "error")), want: 1},
+		{name: "es dropped", got: testutil.ToFloat64(metrics.DroppedEvents.WithLabelValues("es")), want: 0},
+		{name: "loki dropped", got: testutil.ToFloat64(metrics.DroppedEvents.WithLabelValues("loki")), want: 3},
+		{name: "loki retries", got: testutil.ToFloat64(metrics.Retries.WithLabelValues("loki")), want: 1},
+		{name: "es item failures", got: testutil.ToFloat64(metrics.ItemFailures.WithLabelValues("es", "429")), want: 1},
+		{name: "loki overflows", got: testutil.ToFloat64(metrics.ChannelOverflows.WithLabelValues("loki")), want: 1},
+		{name: "es overflows", got: testutil.ToFloat64(metrics.ChannelOverflows.WithLabelValues("es")), want: 0},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestFilesCollector(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "0.log")
+
+	if err := os.WriteFile(path, []byte("first\nsecond\nthird\n"), 0o644); err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+
+	f, err := file.NewFile(path)
+	if err != nil {
+		t.Fatalf("NewFile() error = %v", err)
+	}
+
+	defer f.Close()
+
+	f.EntityFile.Meta = &entity.Meta{Namespace: "default", PodName: "api-0", ContainerName: "api"}
+
+	if err := f.Read(); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	logFile, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+
+	if _, err := logFile.WriteString("unread\n"); err != nil {
+		t.Fatalf("append log: %v", err)
+	}
+
+	_ = logFile.Close()
+
+	if _, err := f.IsTruncated(); err != nil {
+		t.Fatalf("IsTruncated() error = %v", err)
+	}
+
+	state := storage.NewState()
+	state.SetFile(path, f)
+
+	labels := `{container="api",namespace="default",path="` + path + `",pod="api-0"}`
+
+	want := `
+# HELP logfowd_file_bytes_behind Difference between file size and read offset.
+# TYPE logfowd_file_bytes_behind gauge
+logfowd_file_bytes_behind` + labels + ` 7
+# HELP logfowd_file_lines_read_total Number of lines read from the log file since it is tracked.
+# TYPE logfowd_file_lines_read_total counter
+logfowd_file_lines_read_total` + labels + ` 3
+# HELP logfowd_open_files Number of tracked log files.
+# TYPE logfowd_open_files gauge
+logfowd_open_files 1
+`
+
+	if err := testutil.CollectAndCompare(newFilesCollector(state), strings.NewReader(want)); err != nil {
+		t.Errorf("collected metrics: %v", err)
+	}
+
+	state.DeleteFile(path)
+
+	if got := testutil.CollectAndCount(newFilesCollector(state)); got != 1 {
+		t.Errorf("collected %d metrics after the file is untracked, want only open files", got)
+	}
+}
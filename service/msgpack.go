@@ -0,0 +1,282 @@
+package service
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+// msgpackExt is a decoded extension value like the fluentd EventTime.
+type msgpackExt struct {
+	typ  int8
+	data []byte
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+
+	return append(b, s...)
+}
+
+func appendMsgpackBin(b []byte, data []byte) []byte {
+	switch n := len(data); {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc5), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(n))
+	}
+
+	return append(b, data...)
+}
+
+func appendMsgpackArray(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+func appendMsgpackMap(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+func appendMsgpackUint(b []byte, v uint64) []byte {
+	switch {
+	case v < 128:
+		return append(b, byte(v))
+	case v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(v))
+	case v <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(v))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), v)
+	}
+}
+
+// appendMsgpackEventTime appends the fluentd EventTime extension with nanosecond precision.
+func appendMsgpackEventTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xd7, 0x00)
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Unix()))
+
+	return binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+}
+
+// readMsgpack decodes the next value of the stream. Integers are decoded as int64 or uint64, maps as
+// map[string]interface{} with keys formatted by fmt, str and bin as string and []byte, ext as msgpackExt.
+// nolint: gocyclo, cyclop, funlen
+func readMsgpack(r *bufio.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return readMsgpackMap(r, int(c&0x0f))
+	case c&0xf0 == 0x90:
+		return readMsgpackArray(r, int(c&0x0f))
+	case c&0xe0 == 0xa0:
+		data, err := readMsgpackBytes(r, int(c&0x1f))
+
+		return string(data), err
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := readMsgpackLen(r, c-0xc4)
+		if err != nil {
+			return nil, err
+		}
+
+		return readMsgpackBytes(r, n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := readMsgpackLen(r, c-0xc7)
+		if err != nil {
+			return nil, err
+		}
+
+		return readMsgpackExt(r, n)
+	case 0xca:
+		v, err := readMsgpackBytes(r, 4)
+		if err != nil {
+			return nil, err
+		}
+
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(v))), nil
+	case 0xcb:
+		v, err := readMsgpackBytes(r, 8)
+		if err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(v)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := readMsgpackBytes(r, 1<<(c-0xcc))
+
+		return msgpackUint(v), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		v, err := readMsgpackBytes(r, 1<<(c-0xd0))
+		if err != nil {
+			return nil, err
+		}
+
+		u := msgpackUint(v)
+		shift := 64 - 8*len(v)
+
+		return int64(u<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return readMsgpackExt(r, 1<<(c-0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := readMsgpackLen(r, c-0xd9)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := readMsgpackBytes(r, n)
+
+		return string(data), err
+	case 0xdc, 0xdd:
+		n, err := readMsgpackLen(r, c-0xdc+1)
+		if err != nil {
+			return nil, err
+		}
+
+		return readMsgpackArray(r, n)
+	case 0xde, 0xdf:
+		n, err := readMsgpackLen(r, c-0xde+1)
+		if err != nil {
+			return nil, err
+		}
+
+		return readMsgpackMap(r, n)
+	}
+
+	return nil, fmt.Errorf("%w: unknown type 0x%x", dictionary.ErrMsgpack, c)
+}
+
+// readMsgpackLen reads a length of 1, 2 or 4 bytes for the size class 0, 1 or 2.
+func readMsgpackLen(r *bufio.Reader, class byte) (int, error) {
+	v, err := readMsgpackBytes(r, 1<<class)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(msgpackUint(v)), nil
+}
+
+func readMsgpackBytes(r *bufio.Reader, n int) ([]byte, error) {
+	data := make([]byte, n)
+
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func readMsgpackExt(r *bufio.Reader, n int) (interface{}, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readMsgpackBytes(r, n)
+
+	return msgpackExt{typ: int8(typ), data: data}, err
+}
+
+func readMsgpackArray(r *bufio.Reader, n int) (interface{}, error) {
+	values := make([]interface{}, 0, n)
+
+	for i := 0; i < n; i++ {
+		value, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+func readMsgpackMap(r *bufio.Reader, n int) (interface{}, error) {
+	values := make(map[string]interface{}, n)
+
+	for i := 0; i < n; i++ {
+		key, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+
+		values[fmt.Sprint(key)] = value
+	}
+
+	return values, nil
+}
+
+func msgpackUint(b []byte) uint64 {
+	var v uint64
+
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+
+	return v
+}
+
+// msgpackBytes returns str and bin values as bytes, fluentd sends nonces and salts as either.
+func msgpackBytes(v interface{}) []byte {
+	switch value := v.(type) {
+	case string:
+		return []byte(value)
+	case []byte:
+		return value
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,514 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/mailru/easyjson"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"github.com/valyala/fasthttp"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpLevelRegexp matches a level at the beginning of the message like "[ERROR] ..." or after a level key
+// like level=warn or "severity":"info".
+var otlpLevelRegexp = regexp.MustCompile(
+	`(?i)(?:^\W*|\b(?:level|lvl|severity)\W{1,3})(trace|debug|info|warn|warning|error|err|fatal|panic|crit|critical)\b`,
+)
+
+// otlpRejectedRegexp matches the number of rejected records in a json partial success response.
+var otlpRejectedRegexp = regexp.MustCompile(`"rejectedLogRecords"\s*:\s*"?(\d+)`)
+
+// OTLP exports events as OpenTelemetry logs over http, events are grouped into resources by meta.
+type OTLP struct {
+	cfg     conf.OTLP
+	httpCli *fasthttp.Client
+	stop    *outputStop
+	metrics *OutputMetrics
+	logger  *zerolog.Logger
+}
+
+type otlpResource struct {
+	attributes [][2]string
+	records    []*entity.Event
+}
+
+type otlpSeverity struct {
+	number int
+	text   string
+}
+
+func NewOTLP(cfg conf.OTLP, metrics *OutputMetrics, logger *zerolog.Logger) *OTLP {
+	return &OTLP{
+		cfg:     cfg,
+		httpCli: &fasthttp.Client{},
+		stop:    newOutputStop(),
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+// Start waits for ctx, otlp has no background jobs. Once ctx is done exports are no longer retried.
+func (s *OTLP) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	s.stop.stop()
+
+	return nil
+}
+
+func (s *OTLP) Health() error {
+	return nil
+}
+
+// Probe exports an empty json request with the configured headers, the collector accepts it without logs.
+func (s *OTLP) Probe() error {
+	headers := map[string]string{"Content-Type": "application/json"}
+
+	for name, value := range s.cfg.Headers {
+		headers[name] = value
+	}
+
+	return probeRequest(
+		s.httpCli,
+		fasthttp.MethodPost,
+		strings.TrimRight(s.cfg.URL, "/")+dictionary.OTLPLogsPath,
+		headers,
+		[]byte(`{}`),
+	)
+}
+
+// Close closes idle connections to the collector.
+func (s *OTLP) Close() error {
+	s.httpCli.CloseIdleConnections()
+
+	return nil
+}
+
+func (s *OTLP) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// SendEvents exports events, throttled, failed with 5xx and unsent requests are retried up to max_retries times.
+// Records rejected in a partial success are counted as dropped instead of failing the batch.
+func (s *OTLP) SendEvents(events []*entity.Event) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	if err := s.makeRequest(req, otlpGroup(events)); err != nil {
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
+		return err
+	}
+
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+
+		err = s.httpCli.DoTimeout(req, resp, dictionary.RequestTimeout)
+
+		s.metrics.BulkDuration.Observe(time.Since(start).Seconds())
+
+		if (err == nil && !otlpRetryable(resp.StatusCode())) || attempt >= s.cfg.MaxRetries {
+			break
+		}
+
+		var retryAfter string
+
+		if err == nil {
+			retryAfter = string(resp.Header.Peek("Retry-After"))
+		}
+
+		delay := s.retryDelay(attempt, retryAfter, time.Now())
+
+		s.logger.Warn().
+			Err(err).
+			Int("status", resp.StatusCode()).
+			Int("attempt", attempt+1).
+			Dur("delay", delay).
+			Msg("otlp export failed, retrying")
+
+		if !s.stop.wait(delay) {
+			break
+		}
+
+		s.metrics.Retries.Inc()
+	}
+
+	if err == nil && resp.StatusCode() >= http.StatusMultipleChoices {
+		err = fmt.Errorf("%w: %d %s", dictionary.ErrBadStatusCode, resp.StatusCode(), resp.Body())
+	}
+
+	if err != nil {
+		s.logger.Err(err).Int("num", len(events)).Msg("export to otlp")
+
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
+		return err
+	}
+
+	if rejected := s.partiallyRejected(resp.Body()); rejected > 0 {
+		s.countRejected(resp.Body(), rejected)
+	}
+
+	s.metrics.BatchesSent.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+func (s *OTLP) makeRequest(req *fasthttp.Request, resources []*otlpResource) error {
+	var body []byte
+
+	if s.cfg.Encoding == dictionary.OTLPEncodingJSON {
+		var err error
+
+		body, err = easyjson.Marshal(otlpJSON(resources))
+		if err != nil {
+			return err
+		}
+
+		req.Header.SetContentType("application/json")
+	} else {
+		body = otlpProtobuf(resources)
+
+		req.Header.SetContentType("application/x-protobuf")
+	}
+
+	if s.cfg.Compression == dictionary.CompressionGzip {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		body = buf.Bytes()
+
+		req.Header.Set("Content-Encoding", dictionary.CompressionGzip)
+	}
+
+	for name, value := range s.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+
+	req.SetBody(body)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI(strings.TrimRight(s.cfg.URL, "/") + dictionary.OTLPLogsPath)
+
+	return nil
+}
+
+// retryDelay returns the delay of Retry-After given in seconds or as a date, or the exponential backoff
+// starting at retry_delay when the header is missing. The delay is capped by OTLPMaxRetryDelay.
+func (s *OTLP) retryDelay(attempt int, retryAfter string, now time.Time) time.Duration {
+	delay := time.Duration(s.cfg.RetryDelay) * time.Millisecond << attempt
+	if delay <= 0 || delay > dictionary.OTLPMaxRetryDelay {
+		delay = dictionary.OTLPMaxRetryDelay
+	}
+
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		delay = min(time.Duration(seconds)*time.Second, dictionary.OTLPMaxRetryDelay)
+	} else if date, err := http.ParseTime(retryAfter); err == nil {
+		delay = min(max(date.Sub(now), 0), dictionary.OTLPMaxRetryDelay)
+	}
+
+	return delay
+}
+
+// partiallyRejected returns the number of records rejected in a partial success response.
+func (s *OTLP) partiallyRejected(body []byte) int {
+	if s.cfg.Encoding == dictionary.OTLPEncodingJSON {
+		if matches := otlpRejectedRegexp.FindSubmatch(body); matches != nil {
+			rejected, _ := strconv.Atoi(string(matches[1]))
+
+			return rejected
+		}
+
+		return 0
+	}
+
+	// ExportLogsServiceResponse.partial_success.rejected_log_records
+	for _, partial := range protoBytesFields(body, 1) {
+		for len(partial) > 0 {
+			num, typ, tagLen := protowire.ConsumeTag(partial)
+			if tagLen < 0 {
+				return 0
+			}
+
+			partial = partial[tagLen:]
+
+			if num == 1 && typ == protowire.VarintType {
+				rejected, _ := protowire.ConsumeVarint(partial)
+
+				return int(rejected)
+			}
+
+			valueLen := protowire.ConsumeFieldValue(num, typ, partial)
+			if valueLen < 0 {
+				return 0
+			}
+
+			partial = partial[valueLen:]
+		}
+	}
+
+	return 0
+}
+
+func (s *OTLP) countRejected(body []byte, num int) {
+	s.metrics.ItemFailures.WithLabelValues(strconv.Itoa(http.StatusBadRequest)).Add(float64(num))
+	s.metrics.DroppedEvents.Add(float64(num))
+
+	s.logger.Warn().Int("num", num).Bytes("response body", body).Msg("otlp collector rejected records")
+}
+
+func otlpRetryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// otlpGroup splits events into resources in order of appearance, a resource per pod container.
+func otlpGroup(events []*entity.Event) []*otlpResource {
+	resources := make([]*otlpResource, 0)
+	byMeta := make(map[entity.Meta]*otlpResource)
+
+	for _, event := range events {
+		// rotated files of a container belong to the same resource
+		key := *event.Meta
+		key.Path = ""
+
+		resource, ok := byMeta[key]
+		if !ok {
+			resource = &otlpResource{attributes: otlpAttributes(event.Meta)}
+			byMeta[key] = resource
+
+			resources = append(resources, resource)
+		}
+
+		resource.records = append(resource.records, event)
+	}
+
+	return resources
+}
+
+// otlpAttributes maps meta to kubernetes resource semantic conventions, empty values are skipped.
+func otlpAttributes(meta *entity.Meta) [][2]string {
+	attributes := make([][2]string, 0, 4)
+
+	for _, attribute := range [][2]string{
+		{dictionary.OTLPAttributeNamespace, meta.Namespace},
+		{dictionary.OTLPAttributePodName, meta.PodName},
+		{dictionary.OTLPAttributePodUID, meta.PodID},
+		{dictionary.OTLPAttributeContainerName, meta.ContainerName},
+	} {
+		if attribute[1] != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+
+	return attributes
+}
+
+// otlpSeverityOf detects the level of the message, messages without a level have unspecified severity.
+func otlpSeverityOf(message string) otlpSeverity {
+	matches := otlpLevelRegexp.FindStringSubmatch(message)
+	if matches == nil {
+		return otlpSeverity{}
+	}
+
+	switch strings.ToLower(matches[1]) {
+	case "trace":
+		return otlpSeverity{number: 1, text: "TRACE"}
+	case "debug":
+		return otlpSeverity{number: 5, text: "DEBUG"}
+	case "info":
+		return otlpSeverity{number: 9, text: "INFO"}
+	case "warn", "warning":
+		return otlpSeverity{number: 13, text: "WARN"}
+	case "error", "err":
+		return otlpSeverity{number: 17, text: "ERROR"}
+	default:
+		return otlpSeverity{number: 21, text: "FATAL"}
+	}
+}
+
+func otlpJSON(resources []*otlpResource) *entity.OTLPLogsRequest {
+	export := &entity.OTLPLogsRequest{ResourceLogs: make([]*entity.OTLPResourceLogs, 0, len(resources))}
+
+	for _, resource := range resources {
+		attributes := make([]*entity.OTLPKeyValue, 0, len(resource.attributes))
+
+		for _, attribute := range resource.attributes {
+			attributes = append(attributes, &entity.OTLPKeyValue{
+				Key:   attribute[0],
+				Value: &entity.OTLPAnyValue{StringValue: attribute[1]},
+			})
+		}
+
+		records := make([]*entity.OTLPLogRecord, 0, len(resource.records))
+
+		for _, event := range resource.records {
+			severity := otlpSeverityOf(event.Message)
+			timestamp := strconv.FormatInt(event.Time.UnixNano(), 10)
+
+			records = append(records, &entity.OTLPLogRecord{
+				TimeUnixNano:         timestamp,
+				ObservedTimeUnixNano: timestamp,
+				SeverityNumber:       severity.number,
+				SeverityText:         severity.text,
+				Body:                 &entity.OTLPAnyValue{StringValue: event.Message},
+			})
+		}
+
+		export.ResourceLogs = append(export.ResourceLogs, &entity.OTLPResourceLogs{
+			Resource: &entity.OTLPResource{Attributes: attributes},
+			ScopeLogs: []*entity.OTLPScopeLogs{{
+				Scope:      &entity.OTLPScope{Name: dictionary.OTLPScopeName},
+				LogRecords: records,
+			}},
+		})
+	}
+
+	return export
+}
+
+// otlpProtobuf encodes resources as ExportLogsServiceRequest, only the fields logfowd fills are written.
+func otlpProtobuf(resources []*otlpResource) []byte {
+	var export []byte
+
+	for _, resource := range resources {
+		var res []byte
+
+		for _, attribute := range resource.attributes {
+			res = protowire.AppendTag(res, 1, protowire.BytesType)
+			res = protowire.AppendBytes(res, otlpKeyValue(attribute[0], attribute[1]))
+		}
+
+		var scope []byte
+
+		scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+		scope = protowire.AppendString(scope, dictionary.OTLPScopeName)
+
+		var scopeLogs []byte
+
+		scopeLogs = protowire.AppendTag(scopeLogs, 1, protowire.BytesType)
+		scopeLogs = protowire.AppendBytes(scopeLogs, scope)
+
+		for _, event := range resource.records {
+			scopeLogs = protowire.AppendTag(scopeLogs, 2, protowire.BytesType)
+			scopeLogs = protowire.AppendBytes(scopeLogs, otlpLogRecord(event))
+		}
+
+		var resourceLogs []byte
+
+		resourceLogs = protowire.AppendTag(resourceLogs, 1, protowire.BytesType)
+		resourceLogs = protowire.AppendBytes(resourceLogs, res)
+		resourceLogs = protowire.AppendTag(resourceLogs, 2, protowire.BytesType)
+		resourceLogs = protowire.AppendBytes(resourceLogs, scopeLogs)
+
+		export = protowire.AppendTag(export, 1, protowire.BytesType)
+		export = protowire.AppendBytes(export, resourceLogs)
+	}
+
+	return export
+}
+
+func otlpLogRecord(event *entity.Event) []byte {
+	severity := otlpSeverityOf(event.Message)
+
+	var record []byte
+
+	record = protowire.AppendTag(record, 1, protowire.Fixed64Type)
+	record = protowire.AppendFixed64(record, uint64(event.Time.UnixNano()))
+
+	if severity.number != 0 {
+		record = protowire.AppendTag(record, 2, protowire.VarintType)
+		record = protowire.AppendVarint(record, uint64(severity.number))
+		record = protowire.AppendTag(record, 3, protowire.BytesType)
+		record = protowire.AppendString(record, severity.text)
+	}
+
+	record = protowire.AppendTag(record, 5, protowire.BytesType)
+	record = protowire.AppendBytes(record, otlpStringValue(event.Message))
+	record = protowire.AppendTag(record, 11, protowire.Fixed64Type)
+	record = protowire.AppendFixed64(record, uint64(event.Time.UnixNano()))
+
+	return record
+}
+
+func otlpKeyValue(key, value string) []byte {
+	var kv []byte
+
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, key)
+	kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+	kv = protowire.AppendBytes(kv, otlpStringValue(value))
+
+	return kv
+}
+
+func otlpStringValue(value string) []byte {
+	var anyValue []byte
+
+	anyValue = protowire.AppendTag(anyValue, 1, protowire.BytesType)
+	anyValue = protowire.AppendString(anyValue, value)
+
+	return anyValue
+}
+
+// protoBytesFields returns values of length delimited fields with the number, nil on malformed messages.
+func protoBytesFields(msg []byte, num protowire.Number) [][]byte {
+	var values [][]byte
+
+	for len(msg) > 0 {
+		n, typ, tagLen := protowire.ConsumeTag(msg)
+		if tagLen < 0 {
+			return nil
+		}
+
+		msg = msg[tagLen:]
+
+		if typ != protowire.BytesType {
+			valueLen := protowire.ConsumeFieldValue(n, typ, msg)
+			if valueLen < 0 {
+				return nil
+			}
+
+			msg = msg[valueLen:]
+
+			continue
+		}
+
+		value, valueLen := protowire.ConsumeBytes(msg)
+		if valueLen < 0 {
+			return nil
+		}
+
+		msg = msg[valueLen:]
+
+		if n == num {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
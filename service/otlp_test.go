@@ -0,0 +1,387 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/mailru/easyjson"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// fakeCollector decodes exported resources into their pod name and records formatted as "SEVERITY body".
+type fakeCollector struct {
+	*httptest.Server
+	mx        sync.Mutex
+	throttled int
+	failed    int
+	requests  int
+	status    int
+	body      []byte
+	resources map[string][]string
+}
+
+func newFakeCollector(t *testing.T) *fakeCollector {
+	t.Helper()
+
+	collector := &fakeCollector{status: http.StatusOK, resources: make(map[string][]string)}
+
+	collector.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		collector.mx.Lock()
+		defer collector.mx.Unlock()
+
+		if r.URL.Path != dictionary.OTLPLogsPath || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		collector.requests++
+
+		if collector.throttled > 0 {
+			collector.throttled--
+
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+
+			return
+		}
+
+		if collector.failed > 0 {
+			collector.failed--
+
+			w.WriteHeader(http.StatusBadGateway)
+
+			return
+		}
+
+		var reader io.Reader = r.Body
+
+		if r.Header.Get("Content-Encoding") == dictionary.CompressionGzip {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Errorf("decode gzip: %v", err)
+			}
+
+			reader = gz
+		}
+
+		body, _ := io.ReadAll(reader)
+
+		if r.Header.Get("Content-Type") == "application/json" {
+			collector.decodeJSON(t, body)
+		} else {
+			collector.decodeProtobuf(body)
+		}
+
+		w.WriteHeader(collector.status)
+		_, _ = w.Write(collector.body)
+	}))
+
+	t.Cleanup(collector.Close)
+
+	return collector
+}
+
+func (s *fakeCollector) decodeJSON(t *testing.T, body []byte) {
+	t.Helper()
+
+	export := &entity.OTLPLogsRequest{}
+	if err := easyjson.Unmarshal(body, export); err != nil {
+		t.Errorf("unmarshal export: %v", err)
+	}
+
+	for _, resourceLogs := range export.ResourceLogs {
+		var pod string
+
+		for _, attribute := range resourceLogs.Resource.Attributes {
+			if attribute.Key == dictionary.OTLPAttributePodName {
+				pod = attribute.Value.StringValue
+			}
+		}
+
+		for _, record := range resourceLogs.ScopeLogs[0].LogRecords {
+			s.resources[pod] = append(s.resources[pod], record.SeverityText+" "+record.Body.StringValue)
+		}
+	}
+}
+
+func (s *fakeCollector) decodeProtobuf(body []byte) {
+	for _, resourceLogs := range protoBytesFields(body, 1) {
+		var pod string
+
+		for _, resource := range protoBytesFields(resourceLogs, 1) {
+			for _, attribute := range protoBytesFields(resource, 1) {
+				if string(protoBytesFields(attribute, 1)[0]) == dictionary.OTLPAttributePodName {
+					pod = string(protoBytesFields(protoBytesFields(attribute, 2)[0], 1)[0])
+				}
+			}
+		}
+
+		for _, scopeLogs := range protoBytesFields(resourceLogs, 2) {
+			for _, record := range protoBytesFields(scopeLogs, 2) {
+				var severity string
+
+				if texts := protoBytesFields(record, 3); len(texts) > 0 {
+					severity = string(texts[0])
+				}
+
+				body := string(protoBytesFields(protoBytesFields(record, 5)[0], 1)[0])
+
+				s.resources[pod] = append(s.resources[pod], severity+" "+body)
+			}
+		}
+	}
+}
+
+func otlpTestEvents() []*entity.Event {
+	now := time.Now()
+
+	return []*entity.Event{
+		{Message: "[ERROR] failed", Time: now, Meta: &entity.Meta{Namespace: "default", PodName: "api"}},
+		{Message: `{"level":"warn","msg":"slow"}`, Time: now, Meta: &entity.Meta{Namespace: "kube-system", PodName: "dns"}},
+		{Message: "ts=1 level=info started", Time: now, Meta: &entity.Meta{Namespace: "default", PodName: "api"}},
+		{Message: "no level", Time: now, Meta: &entity.Meta{Namespace: "default", PodName: "api"}},
+	}
+}
+
+func TestOTLP_SendEvents(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		encoding    string
+		compression string
+	}{
+		{encoding: dictionary.OTLPEncodingProtobuf, compression: dictionary.CompressionGzip},
+		{encoding: dictionary.OTLPEncodingJSON, compression: dictionary.CompressionNone},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.encoding, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			metrics := NewMetrics().ForOutput("test")
+			server := newFakeCollector(t)
+
+			server.throttled = 2
+
+			otlp := NewOTLP(conf.OTLP{
+				URL:         server.URL,
+				Encoding:    tt.encoding,
+				Compression: tt.compression,
+				Headers:     map[string]string{"Authorization": "Bearer token"},
+				MaxRetries:  2,
+				RetryDelay:  1,
+			}, metrics, &logger)
+
+			if err := otlp.SendEvents(otlpTestEvents()); err != nil {
+				t.Fatalf("SendEvents() error = %v", err)
+			}
+
+			want := map[string][]string{
+				"api": {"ERROR [ERROR] failed", "INFO ts=1 level=info started", " no level"},
+				"dns": {`WARN {"level":"warn","msg":"slow"}`},
+			}
+
+			if !reflect.DeepEqual(server.resources, want) {
+				t.Errorf("exported resources = %q, want %q", server.resources, want)
+			}
+
+			if server.requests != 3 {
+				t.Errorf("requests = %d, want 3", server.requests)
+			}
+
+			if got := testutil.ToFloat64(metrics.Retries); got != 2 {
+				t.Errorf("retries = %v, want 2", got)
+			}
+		})
+	}
+}
+
+func TestOTLP_SendEvents_Failure(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		status       int
+		failed       int
+		unreachable  bool
+		wantErr      bool
+		wantRequests int
+		wantRetries  float64
+		wantDropped  float64
+	}{
+		{name: "server error retried", status: http.StatusOK, failed: 2, wantRequests: 3, wantRetries: 2},
+		{
+			name:         "server error over max retries",
+			status:       http.StatusOK,
+			failed:       3,
+			wantErr:      true,
+			wantRequests: 3,
+			wantRetries:  2,
+			wantDropped:  4,
+		},
+		{name: "bad request", status: http.StatusBadRequest, wantErr: true, wantRequests: 1, wantDropped: 4},
+		{name: "unreachable", unreachable: true, wantErr: true, wantRetries: 2, wantDropped: 4},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			metrics := NewMetrics().ForOutput("test")
+			server := newFakeCollector(t)
+
+			server.status, server.failed = tt.status, tt.failed
+
+			if tt.unreachable {
+				server.Close()
+			}
+
+			otlp := NewOTLP(conf.OTLP{
+				URL:         server.URL,
+				Encoding:    dictionary.OTLPEncodingJSON,
+				Compression: dictionary.CompressionNone,
+				Headers:     map[string]string{"Authorization": "Bearer token"},
+				MaxRetries:  2,
+				RetryDelay:  1,
+			}, metrics, &logger)
+
+			if err := otlp.SendEvents(otlpTestEvents()); (err != nil) != tt.wantErr {
+				t.Fatalf("SendEvents() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			server.mx.Lock()
+			defer server.mx.Unlock()
+
+			if server.requests != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", server.requests, tt.wantRequests)
+			}
+
+			if got := testutil.ToFloat64(metrics.Retries); got != tt.wantRetries {
+				t.Errorf("retries = %v, want %v", got, tt.wantRetries)
+			}
+
+			if got := testutil.ToFloat64(metrics.DroppedEvents); got != tt.wantDropped {
+				t.Errorf("dropped = %v, want %v", got, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestOTLP_SendEvents_Rejected(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	metrics := NewMetrics().ForOutput("test")
+	server := newFakeCollector(t)
+
+	server.body = []byte(`{"partialSuccess":{"rejectedLogRecords":"2","errorMessage":"too old"}}`)
+
+	otlp := NewOTLP(conf.OTLP{
+		URL:         server.URL,
+		Encoding:    dictionary.OTLPEncodingJSON,
+		Compression: dictionary.CompressionNone,
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		RetryDelay:  1,
+	}, metrics, &logger)
+
+	if err := otlp.SendEvents(otlpTestEvents()); err != nil {
+		t.Fatalf("SendEvents() error = %v", err)
+	}
+
+	if got := testutil.ToFloat64(metrics.DroppedEvents); got != 2 {
+		t.Errorf("dropped = %v, want 2", got)
+	}
+
+	server.throttled = 1
+
+	if err := otlp.SendEvents(otlpTestEvents()); err == nil {
+		t.Error("SendEvents() throttled without retries error = nil")
+	}
+}
+
+func TestOTLP_retryDelay(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		attempt    int
+		retryAfter string
+		delay      time.Duration
+	}{
+		{name: "backoff", attempt: 2, delay: 400 * time.Millisecond},
+		{name: "backoff cap", attempt: 20, delay: dictionary.OTLPMaxRetryDelay},
+		{name: "seconds", attempt: 2, retryAfter: "3", delay: 3 * time.Second},
+		{name: "date", retryAfter: "Tue, 02 Jan 2024 03:04:15 GMT", delay: 10 * time.Second},
+		{name: "past date", retryAfter: "Tue, 02 Jan 2024 03:04:00 GMT", delay: 0},
+		{name: "seconds cap", retryAfter: "3600", delay: dictionary.OTLPMaxRetryDelay},
+	}
+
+	logger := zerolog.Nop()
+	otlp := NewOTLP(conf.OTLP{RetryDelay: 100}, NewMetrics().ForOutput("test"), &logger)
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := otlp.retryDelay(tt.attempt, tt.retryAfter, now); got != tt.delay {
+				t.Errorf("retryDelay() = %v, want %v", got, tt.delay)
+			}
+		})
+	}
+}
+
+func TestOTLP_SendEvents_Stopped(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	server := newFakeCollector(t)
+
+	server.throttled = 10
+
+	otlp := NewOTLP(conf.OTLP{
+		URL:         server.URL,
+		Encoding:    dictionary.OTLPEncodingJSON,
+		Compression: dictionary.CompressionNone,
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		MaxRetries:  5,
+		RetryDelay:  60000,
+	}, NewMetrics().ForOutput("test"), &logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_ = otlp.Start(ctx)
+
+	if err := otlp.SendEvents(otlpTestEvents()); err == nil {
+		t.Error("SendEvents() throttled after stop error = nil")
+	}
+
+	server.mx.Lock()
+	defer server.mx.Unlock()
+
+	if server.throttled != 9 {
+		t.Errorf("sent %d requests after stop, want 1", 10-server.throttled)
+	}
+}
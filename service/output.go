@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// Output is a destination of event batches sent by workers of its queue.
+type Output interface {
+	// Start runs background jobs of the output, like node health checks, until ctx is done.
+	Start(ctx context.Context) error
+	// SendEvents sends the batch, events failed to be sent are counted as dropped by the output before
+	// the error is returned, the queue logs the error and goes on.
+	SendEvents(events []*entity.Event) error
+	// Health returns an error when the output can't accept events.
+	Health() error
+	// Close releases resources of the output, it is called when no batches are being sent.
+	Close() error
+	Capabilities() Capabilities
+}
+
+// Capabilities describe which features of the pipeline apply to an output.
+type Capabilities struct {
+	// Indices reports that documents are addressed to es indices, so retention and tap index names apply.
+	// It matches documentIndex, so tap and logfowd test show the same index.
+	Indices bool
+}
+
+// NewOutputs creates every configured output by name, outputs created before an error are closed.
+func NewOutputs(cfg conf.Config, metrics *Metrics, logger *zerolog.Logger) (map[string]Output, error) {
+	outputs := make(map[string]Output)
+
+	for _, outputCfg := range cfg.OutputConfigs() {
+		output, err := NewOutput(cfg, outputCfg, metrics, logger)
+		if err != nil {
+			closeOutputs(outputs, logger)
+
+			return nil, fmt.Errorf("%s: %w", outputCfg.Name, err)
+		}
+
+		outputs[outputCfg.Name] = output
+	}
+
+	return outputs, nil
+}
+
+// ReloadOutputs creates outputs of the next config, outputs with unchanged settings are kept, so their buffers and
+// background jobs go on. Outputs created before an error are closed, kept ones are left running.
+func ReloadOutputs(
+	cfg, next conf.Config,
+	outputs map[string]Output,
+	metrics *Metrics,
+	logger *zerolog.Logger,
+) (map[string]Output, error) {
+	prevCfgs := make(map[string]conf.Output)
+
+	for _, outputCfg := range cfg.OutputConfigs() {
+		prevCfgs[outputCfg.Name] = outputCfg
+	}
+
+	nextOutputs, created := make(map[string]Output), make(map[string]Output)
+
+	for _, outputCfg := range next.OutputConfigs() {
+		prevCfg, ok := prevCfgs[outputCfg.Name]
+		if output := outputs[outputCfg.Name]; ok && output != nil && sameOutput(cfg, next, prevCfg, outputCfg) {
+			nextOutputs[outputCfg.Name] = output
+
+			continue
+		}
+
+		output, err := NewOutput(next, outputCfg, metrics, logger)
+		if err != nil {
+			closeOutputs(created, logger)
+
+			return nil, fmt.Errorf("%s: %w", outputCfg.Name, err)
+		}
+
+		nextOutputs[outputCfg.Name], created[outputCfg.Name] = output, output
+	}
+
+	return nextOutputs, nil
+}
+
+// sameOutput reports whether the output is created the same way by both configs. Routes and flush intervals are
+// applied by the queue, es and stdout outputs also read the rest of the config besides the output sections.
+func sameOutput(cfg, next conf.Config, outputCfg, nextCfg conf.Output) bool {
+	clearQueue := func(outputCfg conf.Output) conf.Output {
+		outputCfg.Routes, outputCfg.FlushInterval, outputCfg.Storage.FlushInterval = nil, 0, 0
+
+		return outputCfg
+	}
+
+	if !reflect.DeepEqual(clearQueue(outputCfg), clearQueue(nextCfg)) {
+		return false
+	}
+
+	if outputCfg.Type != dictionary.OutputES && outputCfg.Type != dictionary.OutputStdout {
+		return true
+	}
+
+	clearOutputs := func(cfg conf.Config, outputCfg conf.Output) conf.Config {
+		cfg = cfg.ForOutput(clearQueue(outputCfg))
+		cfg.Outputs = nil
+
+		return cfg
+	}
+
+	return reflect.DeepEqual(clearOutputs(cfg, outputCfg), clearOutputs(next, nextCfg))
+}
+
+// NewOutput creates an output of the configured type, the es client detects the cluster version and bootstraps it.
+func NewOutput(cfg conf.Config, outputCfg conf.Output, metrics *Metrics, logger *zerolog.Logger) (Output, error) {
+	outputMetrics := metrics.ForOutput(outputCfg.Name)
+
+	switch outputCfg.Type {
+	case dictionary.OutputStdout:
+		return NewStdout(cfg.ForOutput(outputCfg), os.Stdout, outputMetrics, logger), nil
+	case dictionary.OutputLoki:
+		return NewLoki(outputCfg.Loki, outputMetrics, logger), nil
+	case dictionary.OutputOTLP:
+		return NewOTLP(outputCfg.OTLP, outputMetrics, logger), nil
+	case dictionary.OutputForward:
+		return NewForward(outputCfg.Forward, outputMetrics, logger), nil
+	case dictionary.OutputKafka:
+		return NewKafka(outputCfg.Kafka, outputMetrics, logger), nil
+	case dictionary.OutputSplunk:
+		splunk, err := NewSplunk(outputCfg.Splunk, outputMetrics, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return splunk, nil
+	case dictionary.OutputClickHouse:
+		return NewClickHouse(outputCfg.ClickHouse, outputMetrics, logger), nil
+	case dictionary.OutputGELF:
+		gelf, err := NewGELF(outputCfg.GELF, outputMetrics, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return gelf, nil
+	case dictionary.OutputSyslog:
+		syslog, err := NewSyslog(outputCfg.Syslog, outputMetrics, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return syslog, nil
+	case dictionary.OutputFile:
+		return NewFileArchive(outputCfg.File, outputMetrics, logger), nil
+	case dictionary.OutputS3:
+		s3, err := NewS3(outputCfg.S3, outputMetrics, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return s3, nil
+	case dictionary.OutputParquet:
+		parquet, err := NewParquet(outputCfg.Parquet, outputMetrics, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return parquet, nil
+	}
+
+	return NewESCli(cfg.ForOutput(outputCfg), outputMetrics, logger), nil
+}
+
+// outputStop is closed once background jobs of the output are stopped, retry delays end early on it, so batches
+// waiting for a retry don't hold the shutdown.
+type outputStop struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func newOutputStop() *outputStop {
+	return &outputStop{done: make(chan struct{})}
+}
+
+func (s *outputStop) stop() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// wait sleeps for the delay, it returns false when the output is stopped before the delay passes.
+func (s *outputStop) wait(delay time.Duration) bool {
+	// a zero delay makes both cases ready, select would pick either
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func closeOutputs(outputs map[string]Output, logger *zerolog.Logger) {
+	for name, output := range outputs {
+		if err := output.Close(); err != nil {
+			logger.Err(err).Str("output", name).Msg("close output")
+		}
+	}
+}
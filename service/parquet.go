@@ -0,0 +1,370 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog"
+	uuid "github.com/satori/go.uuid"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// Parquet writes events as rows of parquet files per expanded key for analytics engines like spark or duckdb.
+// Files are written with a .tmp extension until their footer is written, so readers of the dir only see
+// complete files. With s3 set closed files are uploaded under the same key and removed.
+type Parquet struct {
+	cfg      conf.Parquet
+	columns  []string
+	node     string
+	zstd     *zstd.Encoder
+	s3       *S3
+	mx       sync.Mutex
+	files    map[string]*parquetFile
+	uploadMx sync.Mutex
+	metrics  *OutputMetrics
+	logger   *zerolog.Logger
+}
+
+type parquetFile struct {
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	parquet *parquetWriter
+	created time.Time
+}
+
+func NewParquet(cfg conf.Parquet, metrics *OutputMetrics, logger *zerolog.Logger) (*Parquet, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Parquet{
+		cfg:     cfg,
+		columns: append(slices.Clone(dictionary.ParquetColumns), cfg.Fields...),
+		node:    nodeName(""),
+		zstd:    encoder,
+		files:   make(map[string]*parquetFile),
+		metrics: metrics,
+		logger:  logger,
+	}
+
+	if cfg.S3.Bucket != "" {
+		if p.s3, err = NewS3(cfg.S3, metrics, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Start creates the dir, checks that files can be created in it and removes files left incomplete by a previous
+// run, then closes files over max age and uploads closed files every ParquetCheckInterval until ctx is done. Once
+// ctx is done uploads are no longer retried.
+func (s *Parquet) Start(ctx context.Context) error {
+	if err := os.MkdirAll(s.cfg.Dir, 0o755); err != nil {
+		s.logger.Err(err).Str("dir", s.cfg.Dir).Msg("create parquet dir")
+	} else if err := writable(s.cfg.Dir); err != nil {
+		s.logger.Err(err).Str("dir", s.cfg.Dir).Msg("parquet dir is not writable")
+	}
+
+	s.recover()
+	s.uploadClosed()
+
+	ticker := time.NewTicker(dictionary.ParquetCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if s.s3 != nil {
+				s.s3.stop.stop()
+			}
+
+			return nil
+		case <-ticker.C:
+			s.closeExpired(time.Now())
+			s.uploadClosed()
+		}
+	}
+}
+
+// Health reports whether the dir exists, files are not created in it, that is checked once by Start.
+func (s *Parquet) Health() error {
+	return isDir(s.cfg.Dir)
+}
+
+// Probe checks that files can be created in the dir and, with s3 set, the bucket.
+func (s *Parquet) Probe() error {
+	if err := writableDir(s.cfg.Dir); err != nil {
+		return err
+	}
+
+	if s.s3 != nil {
+		return s.s3.Probe()
+	}
+
+	return nil
+}
+
+// Close closes open files and uploads closed ones.
+func (s *Parquet) Close() error {
+	s.mx.Lock()
+
+	var errs []error
+
+	for key, file := range s.files {
+		errs = append(errs, s.closeFile(file))
+
+		delete(s.files, key)
+	}
+
+	s.mx.Unlock()
+
+	s.uploadClosed()
+	s.zstd.Close()
+
+	return errors.Join(errs...)
+}
+
+func (s *Parquet) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// SendEvents adds rows to files of the events, writes row groups reaching row_group_size and closes files
+// reaching max_size after the batch.
+func (s *Parquet) SendEvents(events []*entity.Event) error {
+	start := time.Now()
+
+	err := s.write(events)
+
+	s.metrics.BulkDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		s.logger.Err(err).Int("num", len(events)).Msg("write to parquet")
+
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
+		return err
+	}
+
+	s.metrics.BatchesSent.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+func (s *Parquet) write(events []*entity.Event) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := time.Now()
+	written := make(map[string]*parquetFile)
+
+	for _, event := range events {
+		key := s.key(event)
+
+		file, err := s.file(key, now)
+		if err != nil {
+			return err
+		}
+
+		file.parquet.add(event)
+		written[key] = file
+	}
+
+	for key, file := range written {
+		if file.parquet.rowsSize >= s.cfg.RowGroupSize {
+			if err := file.parquet.flushRowGroup(); err != nil {
+				return err
+			}
+		}
+
+		if file.parquet.size() >= s.cfg.MaxSize || now.Sub(file.created) >= time.Duration(s.cfg.MaxAge)*time.Millisecond {
+			delete(s.files, key)
+
+			if err := s.closeFile(file); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// key expands the key template for the event, empty placeholders leave no empty dirs.
+func (s *Parquet) key(event *entity.Event) string {
+	key := strings.NewReplacer(
+		dictionary.TemplateDate, event.Time.UTC().Format(fileArchiveDay),
+		dictionary.TemplateNode, s.node,
+	).Replace(expandTemplate(s.cfg.Key, event.Meta))
+
+	return filepath.Clean("/" + key)[1:]
+}
+
+// file returns the open file of the key or creates one with a unique name.
+func (s *Parquet) file(key string, now time.Time) (*parquetFile, error) {
+	if file, ok := s.files[key]; ok {
+		return file, nil
+	}
+
+	dir := filepath.Join(s.cfg.Dir, key)
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, now.UTC().Format(dictionary.ParquetNameFormat)+"-"+uuid.NewV4().String()+dictionary.ParquetExt)
+
+	f, err := os.OpenFile(path+dictionary.ParquetTmpExt, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &parquetFile{path: path, file: f, writer: bufio.NewWriter(f), created: now}
+
+	if file.parquet, err = newParquetWriter(file.writer, s.columns, s.cfg.Compression, s.zstd); err != nil {
+		_ = f.Close()
+
+		return nil, err
+	}
+
+	s.files[key] = file
+
+	return file, nil
+}
+
+// closeExpired closes files older than max age.
+func (s *Parquet) closeExpired(now time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for key, file := range s.files {
+		if now.Sub(file.created) < time.Duration(s.cfg.MaxAge)*time.Millisecond {
+			continue
+		}
+
+		delete(s.files, key)
+
+		if err := s.closeFile(file); err != nil {
+			s.logger.Err(err).Str("path", file.path).Msg("close parquet file")
+		}
+	}
+}
+
+// closeFile writes the footer and renames the file to its final name.
+func (s *Parquet) closeFile(file *parquetFile) error {
+	err := file.parquet.close()
+
+	if err == nil {
+		err = file.writer.Flush()
+	}
+
+	if closeErr := file.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.path+dictionary.ParquetTmpExt, file.path)
+}
+
+// recover removes files left without a footer by a previous run, their rows can not be read.
+func (s *Parquet) recover() {
+	s.mx.Lock()
+
+	open := make(map[string]bool, len(s.files))
+
+	for _, file := range s.files {
+		open[file.path+dictionary.ParquetTmpExt] = true
+	}
+
+	s.mx.Unlock()
+
+	err := filepath.WalkDir(s.cfg.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(path, dictionary.ParquetExt+dictionary.ParquetTmpExt) ||
+			open[path] {
+			return err
+		}
+
+		s.logger.Warn().Str("path", path).Msg("incomplete parquet file removed")
+
+		return os.Remove(path)
+	})
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		s.logger.Err(err).Str("dir", s.cfg.Dir).Msg("recover parquet files")
+	}
+}
+
+// uploadClosed uploads closed files to s3 and removes them with dirs left empty, files failed to be uploaded
+// are kept for the next check.
+func (s *Parquet) uploadClosed() {
+	if s.s3 == nil {
+		return
+	}
+
+	s.uploadMx.Lock()
+	defer s.uploadMx.Unlock()
+
+	err := filepath.WalkDir(s.cfg.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(path, dictionary.ParquetExt) {
+			return err
+		}
+
+		if err := s.upload(path); err != nil {
+			s.logger.Err(err).Str("path", path).Msg("upload parquet file")
+		}
+
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		s.logger.Err(err).Str("dir", s.cfg.Dir).Msg("upload parquet files")
+	}
+}
+
+func (s *Parquet) upload(path string) error {
+	rel, err := filepath.Rel(s.cfg.Dir, path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := s.s3.putObject(filepath.ToSlash(rel), data); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	// dirs are created for new files under the lock
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for dir := filepath.Dir(path); dir != filepath.Clean(s.cfg.Dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+}
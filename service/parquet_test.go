@@ -0,0 +1,976 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// thriftReader decodes the thrift compact protocol into structs of values by field id, integers are int64.
+type thriftReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *thriftReader) varint() uint64 {
+	value, n := binary.Uvarint(r.data[r.pos:])
+	r.pos += n
+
+	return value
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case dictionary.ThriftTypeTrue:
+		return true
+	case dictionary.ThriftTypeFalse:
+		return false
+	case dictionary.ThriftTypeI32, dictionary.ThriftTypeI64:
+		value := r.varint()
+
+		return int64(value>>1) ^ -int64(value&1)
+	case dictionary.ThriftTypeBin:
+		n := int(r.varint())
+		r.pos += n
+
+		return r.data[r.pos-n : r.pos]
+	case dictionary.ThriftTypeList:
+		header := r.data[r.pos]
+		r.pos++
+
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.varint())
+		}
+
+		list := make([]any, size)
+
+		for i := range list {
+			list[i] = r.value(header & 0x0f)
+		}
+
+		return list
+	default:
+		return r.structValue()
+	}
+}
+
+func (r *thriftReader) structValue() map[int64]any {
+	fields := make(map[int64]any)
+
+	var id int64
+
+	for {
+		header := r.data[r.pos]
+		r.pos++
+
+		if header == dictionary.ThriftTypeStop {
+			return fields
+		}
+
+		if delta := int64(header >> 4); delta != 0 {
+			id += delta
+		} else {
+			value := r.varint()
+			id = int64(value>>1) ^ -int64(value&1)
+		}
+
+		fields[id] = r.value(header & 0x0f)
+	}
+}
+
+// compact protocol types of parquetThrift fields, bools are written as parquetCompactBool or the next type.
+const (
+	parquetCompactBool   = 1
+	parquetCompactI32    = 5
+	parquetCompactI64    = 6
+	parquetCompactBinary = 8
+	parquetCompactList   = 9
+	parquetCompactStruct = 12
+)
+
+// parquetThriftField is a field of a parquet.thrift struct, elem names the struct of struct fields and of struct
+// list elements.
+type parquetThriftField struct {
+	typ      byte
+	elemType byte
+	elem     string
+	required bool
+}
+
+// parquetThrift lists fields of parquet.thrift structs by id as the format spec defines them, it doesn't use
+// dictionary, so a wrong constant of the writer fails checkThrift instead of being read back the same way.
+var parquetThrift = map[string]map[int64]parquetThriftField{
+	"FileMetaData": {
+		1: {typ: parquetCompactI32, required: true},
+		2: {typ: parquetCompactList, elemType: parquetCompactStruct, elem: "SchemaElement", required: true},
+		3: {typ: parquetCompactI64, required: true},
+		4: {typ: parquetCompactList, elemType: parquetCompactStruct, elem: "RowGroup", required: true},
+		5: {typ: parquetCompactList, elemType: parquetCompactStruct, elem: "KeyValue"},
+		6: {typ: parquetCompactBinary},
+		7: {typ: parquetCompactList, elemType: parquetCompactStruct, elem: "ColumnOrder"},
+	},
+	"KeyValue": {
+		1: {typ: parquetCompactBinary, required: true},
+		2: {typ: parquetCompactBinary},
+	},
+	"SchemaElement": {
+		1:  {typ: parquetCompactI32},
+		2:  {typ: parquetCompactI32},
+		3:  {typ: parquetCompactI32},
+		4:  {typ: parquetCompactBinary, required: true},
+		5:  {typ: parquetCompactI32},
+		6:  {typ: parquetCompactI32},
+		7:  {typ: parquetCompactI32},
+		8:  {typ: parquetCompactI32},
+		9:  {typ: parquetCompactI32},
+		10: {typ: parquetCompactStruct, elem: "LogicalType"},
+	},
+	"LogicalType": {
+		1: {typ: parquetCompactStruct, elem: "StringType"},
+		8: {typ: parquetCompactStruct, elem: "TimestampType"},
+	},
+	"StringType": {},
+	"TimestampType": {
+		1: {typ: parquetCompactBool, required: true},
+		2: {typ: parquetCompactStruct, elem: "TimeUnit", required: true},
+	},
+	"TimeUnit": {
+		1: {typ: parquetCompactStruct, elem: "MilliSeconds"},
+		2: {typ: parquetCompactStruct, elem: "MicroSeconds"},
+		3: {typ: parquetCompactStruct, elem: "NanoSeconds"},
+	},
+	"MilliSeconds": {},
+	"MicroSeconds": {},
+	"NanoSeconds":  {},
+	"RowGroup": {
+		1: {typ: parquetCompactList, elemType: parquetCompactStruct, elem: "ColumnChunk", required: true},
+		2: {typ: parquetCompactI64, required: true},
+		3: {typ: parquetCompactI64, required: true},
+	},
+	"ColumnChunk": {
+		1: {typ: parquetCompactBinary},
+		2: {typ: parquetCompactI64, required: true},
+		3: {typ: parquetCompactStruct, elem: "ColumnMetaData"},
+	},
+	"ColumnMetaData": {
+		1:  {typ: parquetCompactI32, required: true},
+		2:  {typ: parquetCompactList, elemType: parquetCompactI32, required: true},
+		3:  {typ: parquetCompactList, elemType: parquetCompactBinary, required: true},
+		4:  {typ: parquetCompactI32, required: true},
+		5:  {typ: parquetCompactI64, required: true},
+		6:  {typ: parquetCompactI64, required: true},
+		7:  {typ: parquetCompactI64, required: true},
+		8:  {typ: parquetCompactList, elemType: parquetCompactStruct, elem: "KeyValue"},
+		9:  {typ: parquetCompactI64, required: true},
+		10: {typ: parquetCompactI64},
+		11: {typ: parquetCompactI64},
+		12: {typ: parquetCompactStruct, elem: "Statistics"},
+	},
+	"Statistics": {
+		1: {typ: parquetCompactBinary},
+		2: {typ: parquetCompactBinary},
+		3: {typ: parquetCompactI64},
+		4: {typ: parquetCompactI64},
+		5: {typ: parquetCompactBinary},
+		6: {typ: parquetCompactBinary},
+	},
+	"ColumnOrder": {
+		1: {typ: parquetCompactStruct, elem: "TypeDefinedOrder"},
+	},
+	"TypeDefinedOrder": {},
+	"PageHeader": {
+		1: {typ: parquetCompactI32, required: true},
+		2: {typ: parquetCompactI32, required: true},
+		3: {typ: parquetCompactI32, required: true},
+		4: {typ: parquetCompactI32},
+		5: {typ: parquetCompactStruct, elem: "DataPageHeader"},
+	},
+	"DataPageHeader": {
+		1: {typ: parquetCompactI32, required: true},
+		2: {typ: parquetCompactI32, required: true},
+		3: {typ: parquetCompactI32, required: true},
+		4: {typ: parquetCompactI32, required: true},
+		5: {typ: parquetCompactStruct, elem: "Statistics"},
+	},
+}
+
+var parquetThriftUnions = map[string]bool{"LogicalType": true, "TimeUnit": true, "ColumnOrder": true}
+
+// checkThrift walks the struct at the reader position by parquetThrift, it reports unknown and repeated fields,
+// fields of another type, missing required fields and unions without exactly one field.
+func checkThrift(t *testing.T, r *thriftReader, name string) {
+	t.Helper()
+
+	spec := parquetThrift[name]
+	seen := make(map[int64]bool)
+
+	var id int64
+
+	for {
+		header := r.data[r.pos]
+		r.pos++
+
+		if header == 0 {
+			break
+		}
+
+		if delta := int64(header >> 4); delta != 0 {
+			id += delta
+		} else {
+			value := r.varint()
+			id = int64(value>>1) ^ -int64(value&1)
+		}
+
+		typ := header & 0x0f
+		field, ok := spec[id]
+
+		if field.typ == parquetCompactBool && typ == parquetCompactBool+1 {
+			typ = parquetCompactBool
+		}
+
+		switch {
+		case !ok:
+			t.Errorf("%s has unknown field %d", name, id)
+		case seen[id]:
+			t.Errorf("%s has field %d twice", name, id)
+		case typ != field.typ:
+			t.Errorf("%s field %d has type %d, want %d", name, id, typ, field.typ)
+		}
+
+		seen[id] = true
+
+		switch {
+		case !ok || typ != field.typ:
+			r.value(header & 0x0f)
+		case typ == parquetCompactStruct:
+			checkThrift(t, r, field.elem)
+		case typ == parquetCompactList:
+			list := r.data[r.pos]
+			r.pos++
+
+			size := int(list >> 4)
+			if size == 15 {
+				size = int(r.varint())
+			}
+
+			if elemType := list & 0x0f; elemType != field.elemType {
+				t.Fatalf("%s field %d has elements of type %d, want %d", name, id, elemType, field.elemType)
+			}
+
+			for i := 0; i < size; i++ {
+				if field.elemType == parquetCompactStruct {
+					checkThrift(t, r, field.elem)
+				} else {
+					r.value(field.elemType)
+				}
+			}
+		default:
+			r.value(header & 0x0f)
+		}
+	}
+
+	for id, field := range spec {
+		if field.required && !seen[id] {
+			t.Errorf("%s misses required field %d", name, id)
+		}
+	}
+
+	if parquetThriftUnions[name] && len(seen) != 1 {
+		t.Errorf("union %s has %d fields, want 1", name, len(seen))
+	}
+}
+
+// readParquet returns values of every column by its name, timestamps formatted as rfc 3339, and the number
+// of row groups of the parquet file.
+func readParquet(t *testing.T, data []byte) (map[string][]string, int) {
+	t.Helper()
+
+	if !bytes.HasPrefix(data, []byte("PAR1")) || !bytes.HasSuffix(data, []byte("PAR1")) {
+		t.Fatalf("no parquet magic in %d bytes", len(data))
+	}
+
+	metaLen := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	meta := (&thriftReader{data: data, pos: len(data) - 8 - metaLen}).structValue()
+
+	schema := meta[2].([]any)
+	columns := make(map[string][]string)
+
+	for _, group := range meta[4].([]any) {
+		group := group.(map[int64]any)
+
+		for i, chunk := range group[1].([]any) {
+			columnMeta := chunk.(map[int64]any)[3].(map[int64]any)
+			name := string(schema[i+1].(map[int64]any)[4].([]byte))
+
+			if path := string(columnMeta[3].([]any)[0].([]byte)); path != name {
+				t.Errorf("path in schema %s of column %s", path, name)
+			}
+
+			r := &thriftReader{data: data, pos: int(columnMeta[9].(int64))}
+			header := r.structValue()
+			page := data[r.pos : r.pos+int(header[3].(int64))]
+
+			switch columnMeta[4].(int64) {
+			case dictionary.ParquetCodecZstd:
+				decoder, _ := zstd.NewReader(nil)
+				page, _ = decoder.DecodeAll(page, nil)
+
+				decoder.Close()
+			case dictionary.ParquetCodecGzip:
+				gz, _ := gzip.NewReader(bytes.NewReader(page))
+				page, _ = io.ReadAll(gz)
+			}
+
+			if int64(len(page)) != header[2].(int64) {
+				t.Fatalf("column %s page of %d bytes, want %d", name, len(page), header[2])
+			}
+
+			numValues := header[5].(map[int64]any)[1].(int64)
+
+			if numValues != group[3].(int64) || numValues != columnMeta[5].(int64) {
+				t.Errorf("column %s has %d values, want %d rows", name, numValues, group[3])
+			}
+
+			for j := int64(0); j < numValues; j++ {
+				if columnMeta[1].(int64) == dictionary.ParquetTypeInt64 {
+					micros := int64(binary.LittleEndian.Uint64(page))
+					page = page[8:]
+
+					columns[name] = append(columns[name], time.UnixMicro(micros).UTC().Format(time.RFC3339Nano))
+
+					continue
+				}
+
+				n := binary.LittleEndian.Uint32(page)
+				columns[name] = append(columns[name], string(page[4:4+n]))
+				page = page[4+n:]
+			}
+		}
+	}
+
+	if rows := int(meta[3].(int64)); rows != len(columns[dictionary.FieldMessage]) {
+		t.Errorf("file has %d rows, read %d", rows, len(columns[dictionary.FieldMessage]))
+	}
+
+	return columns, len(meta[4].([]any))
+}
+
+// parquetFiles returns paths of files in the dir relative to it.
+func parquetFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	var paths []string
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			paths = append(paths, rel)
+		}
+
+		return err
+	})
+	if err != nil {
+		t.Fatalf("walk dir: %v", err)
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+func parquetEvents() []*entity.Event {
+	day := time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)
+
+	return []*entity.Event{
+		{Message: "first", Time: day, Meta: &entity.Meta{Namespace: "default", PodName: "api", Path: "/var/log/a"}},
+		{Message: "system", Time: day, Meta: &entity.Meta{Namespace: "kube-system", PodName: "dns", Path: "/var/log/b"}},
+		{Message: "second", Time: day.Add(time.Second), Meta: &entity.Meta{Namespace: "default", PodName: "api"}},
+	}
+}
+
+// parquetEventColumns returns columns of parquetEvents written with the path field by dir of their key.
+func parquetEventColumns() map[string]map[string][]string {
+	return map[string]map[string][]string{
+		"default/2024-01-02": {
+			"message":        {"first", "second"},
+			"@timestamp":     {"2024-01-02T03:04:05.123456Z", "2024-01-02T03:04:06.123456Z"},
+			"pod_name":       {"api", "api"},
+			"namespace":      {"default", "default"},
+			"container_name": {"", ""},
+			"pod_id":         {"", ""},
+			"path":           {"/var/log/a", ""},
+		},
+		"kube-system/2024-01-02": {
+			"message":        {"system"},
+			"@timestamp":     {"2024-01-02T03:04:05.123456Z"},
+			"pod_name":       {"dns"},
+			"namespace":      {"kube-system"},
+			"container_name": {""},
+			"pod_id":         {""},
+			"path":           {"/var/log/b"},
+		},
+	}
+}
+
+func TestParquet_SendEvents(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		compression  string
+		rowGroupSize int64
+		maxSize      int64
+		files        int
+		rowGroups    int
+	}{
+		{name: "zstd", compression: dictionary.CompressionZstd, rowGroupSize: 1 << 20, maxSize: 1 << 20, files: 2, rowGroups: 1},
+		{name: "gzip", compression: dictionary.CompressionGzip, rowGroupSize: 1 << 20, maxSize: 1 << 20, files: 2, rowGroups: 1},
+		{name: "row group per batch", compression: dictionary.CompressionNone, rowGroupSize: 1, maxSize: 1 << 20, files: 2, rowGroups: 2},
+		{name: "roll by size", compression: dictionary.CompressionZstd, rowGroupSize: 1, maxSize: 1, files: 3, rowGroups: 1},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			dir := t.TempDir()
+
+			parquet, err := NewParquet(conf.Parquet{
+				Dir:          dir,
+				Key:          "{namespace}/{date}",
+				Fields:       []string{dictionary.FieldPath},
+				Compression:  tt.compression,
+				RowGroupSize: tt.rowGroupSize,
+				MaxSize:      tt.maxSize,
+				MaxAge:       3600000,
+			}, NewMetrics().ForOutput("test"), &logger)
+			if err != nil {
+				t.Fatalf("NewParquet() error = %v", err)
+			}
+
+			for _, events := range [][]*entity.Event{parquetEvents()[:2], parquetEvents()[2:]} {
+				if err := parquet.SendEvents(events); err != nil {
+					t.Fatalf("SendEvents() error = %v", err)
+				}
+			}
+
+			if err := parquet.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			paths := parquetFiles(t, dir)
+
+			if len(paths) != tt.files {
+				t.Fatalf("wrote files %v, want %d", paths, tt.files)
+			}
+
+			got := make(map[string]map[string][]string)
+
+			for _, path := range paths {
+				if !strings.HasSuffix(path, ".parquet") {
+					t.Errorf("file %s has no parquet extension", path)
+				}
+
+				data, err := os.ReadFile(filepath.Join(dir, path))
+				if err != nil {
+					t.Fatalf("read file: %v", err)
+				}
+
+				columns, rowGroups := readParquet(t, data)
+
+				if path := filepath.Dir(path); got[path] == nil {
+					got[path] = columns
+				} else {
+					for name, values := range columns {
+						got[path][name] = append(got[path][name], values...)
+					}
+				}
+
+				if strings.HasPrefix(path, "default") && rowGroups != tt.rowGroups {
+					t.Errorf("file %s has %d row groups, want %d", path, rowGroups, tt.rowGroups)
+				}
+			}
+
+			if want := parquetEventColumns(); !reflect.DeepEqual(got, want) {
+				t.Errorf("wrote %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestParquetWriter_Format checks the file against the format spec: the footer and page headers by
+// parquetThrift, the schema, offsets and sizes of column chunks, timestamp statistics and values of pages.
+func TestParquetWriter_Format(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		compression string
+		codec       int64
+	}{
+		{compression: dictionary.CompressionNone, codec: 0},
+		{compression: dictionary.CompressionGzip, codec: 2},
+		{compression: dictionary.CompressionZstd, codec: 6},
+	}
+
+	columns := append(append([]string(nil), dictionary.ParquetColumns...), dictionary.FieldPath)
+
+	events := parquetEvents()
+
+	// the first row group has timestamps out of order, statistics must not be taken from the first and last rows
+	groups := [][]*entity.Event{{events[2], events[0]}, {events[1]}}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.compression, func(t *testing.T) {
+			t.Parallel()
+
+			encoder, err := zstd.NewWriter(nil)
+			if err != nil {
+				t.Fatalf("zstd.NewWriter() error = %v", err)
+			}
+
+			defer encoder.Close()
+
+			var buf bytes.Buffer
+
+			w, err := newParquetWriter(&buf, columns, tt.compression, encoder)
+			if err != nil {
+				t.Fatalf("newParquetWriter() error = %v", err)
+			}
+
+			want := make(map[string][]string)
+
+			for _, group := range groups {
+				for _, event := range group {
+					w.add(event)
+
+					for _, column := range columns {
+						value := eventField(event, column)
+						if column == dictionary.FieldTimestamp {
+							value = event.Time.UTC().Format(time.RFC3339Nano)
+						}
+
+						want[column] = append(want[column], value)
+					}
+				}
+
+				if err := w.flushRowGroup(); err != nil {
+					t.Fatalf("flushRowGroup() error = %v", err)
+				}
+			}
+
+			if err := w.close(); err != nil {
+				t.Fatalf("close() error = %v", err)
+			}
+
+			data := buf.Bytes()
+			metaStart := len(data) - 8 - int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+
+			r := &thriftReader{data: data, pos: metaStart}
+			checkThrift(t, r, "FileMetaData")
+
+			if r.pos != len(data)-8 {
+				t.Errorf("footer metadata ends at %d, want %d", r.pos, len(data)-8)
+			}
+
+			meta := (&thriftReader{data: data, pos: metaStart}).structValue()
+			schema := meta[2].([]any)
+
+			if root := schema[0].(map[int64]any); root[5] != int64(len(columns)) {
+				t.Errorf("schema root has %v children, want %d", root[5], len(columns))
+			}
+
+			for i, column := range columns {
+				element := schema[i+1].(map[int64]any)
+
+				// BYTE_ARRAY of UTF8, INT64 of TIMESTAMP_MICROS, both REQUIRED
+				typ, converted := int64(6), int64(0)
+				if column == dictionary.FieldTimestamp {
+					typ, converted = 2, 10
+				}
+
+				if string(element[4].([]byte)) != column || element[1] != typ || element[3] != int64(0) ||
+					element[6] != converted {
+					t.Errorf("schema element %d = %v, want required %s of type %d", i+1, element, column, typ)
+				}
+			}
+
+			offset, rows := int64(len("PAR1")), int64(0)
+
+			for g, group := range meta[4].([]any) {
+				group := group.(map[int64]any)
+
+				var totalSize int64
+
+				for i, chunk := range group[1].([]any) {
+					chunk := chunk.(map[int64]any)
+					columnMeta := chunk[3].(map[int64]any)
+
+					if chunk[2] != offset || columnMeta[9] != offset {
+						t.Errorf("column %s chunk at %v, page at %v, want %d", columns[i], chunk[2], columnMeta[9], offset)
+					}
+
+					if columnMeta[4] != tt.codec || columnMeta[5] != group[3] {
+						t.Errorf("column %s codec %v of %v values, want %d of %v", columns[i], columnMeta[4],
+							columnMeta[5], tt.codec, group[3])
+					}
+
+					r := &thriftReader{data: data, pos: int(offset)}
+					checkThrift(t, r, "PageHeader")
+
+					headerSize := int64(r.pos) - offset
+					header := (&thriftReader{data: data, pos: int(offset)}).structValue()
+					dataPage := header[5].(map[int64]any)
+
+					// DATA_PAGE of PLAIN values, levels of required columns are empty RLE
+					if header[1] != int64(0) || dataPage[1] != group[3] || dataPage[2] != int64(0) ||
+						dataPage[3] != int64(3) || dataPage[4] != int64(3) {
+						t.Errorf("column %s page header = %v", columns[i], header)
+					}
+
+					if columnMeta[6] != headerSize+header[2].(int64) || columnMeta[7] != headerSize+header[3].(int64) {
+						t.Errorf("column %s sizes %v and %v, page of %d header bytes = %v", columns[i], columnMeta[6],
+							columnMeta[7], headerSize, header)
+					}
+
+					if columns[i] == dictionary.FieldTimestamp {
+						parquetCheckStatistics(t, columnMeta[12].(map[int64]any), groups[g])
+					}
+
+					totalSize += columnMeta[6].(int64)
+					offset += columnMeta[7].(int64)
+				}
+
+				if group[2] != totalSize {
+					t.Errorf("row group %d total size %v, want %d", g, group[2], totalSize)
+				}
+
+				rows += group[3].(int64)
+			}
+
+			if offset != int64(metaStart) || meta[3] != rows {
+				t.Errorf("chunks end at %d with %v rows, footer at %d with %d rows", offset, meta[3], metaStart, rows)
+			}
+
+			if got, _ := readParquet(t, data); !reflect.DeepEqual(got, want) {
+				t.Errorf("read %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// parquetCheckStatistics checks that statistics of the timestamp column are min and max of the row group.
+func parquetCheckStatistics(t *testing.T, stats map[int64]any, events []*entity.Event) {
+	t.Helper()
+
+	minValue, maxValue := events[0].Time.UnixMicro(), events[0].Time.UnixMicro()
+
+	for _, event := range events {
+		minValue = min(minValue, event.Time.UnixMicro())
+		maxValue = max(maxValue, event.Time.UnixMicro())
+	}
+
+	got := func(id int64) int64 {
+		return int64(binary.LittleEndian.Uint64(stats[id].([]byte)))
+	}
+
+	if got(1) != maxValue || got(5) != maxValue || got(2) != minValue || got(6) != minValue || stats[3] != int64(0) {
+		t.Errorf("statistics = %v, want min %d and max %d without nulls", stats, minValue, maxValue)
+	}
+}
+
+func TestParquet_CloseExpired(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	dir := t.TempDir()
+
+	parquet, err := NewParquet(conf.Parquet{
+		Dir:          dir,
+		Key:          "{namespace}",
+		Compression:  dictionary.CompressionZstd,
+		RowGroupSize: 1 << 20,
+		MaxSize:      1 << 20,
+		MaxAge:       60000,
+	}, NewMetrics().ForOutput("test"), &logger)
+	if err != nil {
+		t.Fatalf("NewParquet() error = %v", err)
+	}
+
+	if err := parquet.SendEvents(parquetEvents()[:1]); err != nil {
+		t.Fatalf("SendEvents() error = %v", err)
+	}
+
+	parquet.closeExpired(time.Now())
+
+	if paths := parquetFiles(t, dir); len(paths) != 1 || !strings.HasSuffix(paths[0], ".parquet.tmp") {
+		t.Fatalf("files %v before max age, want an open file", paths)
+	}
+
+	// the open file is kept
+	parquet.recover()
+	parquet.closeExpired(time.Now().Add(time.Minute))
+
+	if paths := parquetFiles(t, dir); len(paths) != 1 || !strings.HasSuffix(paths[0], ".parquet") {
+		t.Errorf("files %v after max age, want a closed file", paths)
+	}
+}
+
+func TestParquet_Recover(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	dir := t.TempDir()
+
+	files := []string{"default/20240102T030405.000000000Z-1.parquet", "default/20240102T030405.000000000Z-2.parquet.tmp"}
+
+	for _, path := range files {
+		path = filepath.Join(dir, path)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+
+		if err := os.WriteFile(path, []byte("PAR1"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+
+	parquet, err := NewParquet(conf.Parquet{Dir: dir, Compression: dictionary.CompressionZstd}, NewMetrics().ForOutput("test"), &logger)
+	if err != nil {
+		t.Fatalf("NewParquet() error = %v", err)
+	}
+
+	parquet.recover()
+
+	if paths, want := parquetFiles(t, dir), files[:1]; !reflect.DeepEqual(paths, want) {
+		t.Errorf("files %v after recover, want %v", paths, want)
+	}
+}
+
+func TestParquet_UploadClosed(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	dir := t.TempDir()
+	server := newFakeS3(t)
+
+	parquet, err := NewParquet(conf.Parquet{
+		Dir:          dir,
+		Key:          "logs/{namespace}/{date}",
+		Compression:  dictionary.CompressionZstd,
+		RowGroupSize: 1 << 20,
+		MaxSize:      1 << 20,
+		MaxAge:       3600000,
+		S3: conf.S3{
+			Endpoint:   server.URL,
+			Region:     "eu-west-1",
+			Bucket:     "logs",
+			AccessKey:  "access",
+			SecretKey:  "secret",
+			PathStyle:  true,
+			RetryDelay: 1,
+		},
+	}, NewMetrics().ForOutput("test"), &logger)
+	if err != nil {
+		t.Fatalf("NewParquet() error = %v", err)
+	}
+
+	if err := parquet.SendEvents(parquetEvents()); err != nil {
+		t.Fatalf("SendEvents() error = %v", err)
+	}
+
+	if err := parquet.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if paths := parquetFiles(t, dir); len(paths) != 0 {
+		t.Errorf("files %v left after upload", paths)
+	}
+
+	server.mx.Lock()
+	defer server.mx.Unlock()
+
+	messages := make(map[string][]string)
+
+	for key, data := range server.objects {
+		if !strings.HasSuffix(key, ".parquet") {
+			t.Errorf("object %s has no parquet extension", key)
+		}
+
+		columns, _ := readParquet(t, data)
+		messages[key[:strings.LastIndex(key, "/")]] = columns[dictionary.FieldMessage]
+	}
+
+	want := map[string][]string{
+		"logs/default/2024-01-02":     {"first", "second"},
+		"logs/kube-system/2024-01-02": {"system"},
+	}
+
+	if !reflect.DeepEqual(messages, want) {
+		t.Errorf("uploaded %v, want %v", messages, want)
+	}
+}
+
+func TestParquet_Health(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	dir := filepath.Join(t.TempDir(), "parquet")
+
+	parquet, err := NewParquet(conf.Parquet{Dir: dir}, NewMetrics().ForOutput("test"), &logger)
+	if err != nil {
+		t.Fatalf("NewParquet() error = %v", err)
+	}
+
+	if err := parquet.Health(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Health() before start error = %v, want %v", err, fs.ErrNotExist)
+	}
+
+	if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat dir after health error = %v, want %v", err, fs.ErrNotExist)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_ = parquet.Start(ctx)
+
+	if err := parquet.Health(); err != nil {
+		t.Errorf("Health() after start error = %v", err)
+	}
+
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("dir after health = %v, %v, want no files", entries, err)
+	}
+}
+
+// pyarrowRead prints columns of parquet files as json by the dir of every file, timestamps in rfc3339 with
+// microseconds, and row groups by file.
+const pyarrowRead = `
+import datetime, json, os, sys
+import pyarrow.parquet as pq
+
+columns, row_groups = {}, {}
+
+for path in sys.argv[2:]:
+    parquet = pq.ParquetFile(os.path.join(sys.argv[1], path))
+    row_groups[path] = parquet.metadata.num_row_groups
+
+    for name, values in parquet.read().to_pydict().items():
+        for value in values:
+            # timestamps not adjusted to utc are read naive and printed without the zone, so they don't match
+            if isinstance(value, datetime.datetime) and value.tzinfo is None:
+                value = value.strftime("%Y-%m-%dT%H:%M:%S.%f")
+            elif isinstance(value, datetime.datetime):
+                value = value.astimezone(datetime.timezone.utc).strftime("%Y-%m-%dT%H:%M:%S.%fZ")
+
+            columns.setdefault(os.path.dirname(path), {}).setdefault(name, []).append(value)
+
+json.dump({"columns": columns, "row_groups": row_groups}, sys.stdout)
+`
+
+// TestParquet_SendEvents_Pyarrow reads written files with pyarrow, the test is skipped when python3 can't
+// import it.
+func TestParquet_SendEvents_Pyarrow(t *testing.T) {
+	t.Parallel()
+
+	if err := exec.Command("python3", "-c", "import pyarrow.parquet").Run(); err != nil {
+		t.Skipf("pyarrow is not installed: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		compression  string
+		rowGroupSize int64
+		rowGroups    int
+	}{
+		{name: "zstd", compression: dictionary.CompressionZstd, rowGroupSize: 1 << 20, rowGroups: 1},
+		{name: "gzip", compression: dictionary.CompressionGzip, rowGroupSize: 1 << 20, rowGroups: 1},
+		{name: "row group per batch", compression: dictionary.CompressionNone, rowGroupSize: 1, rowGroups: 2},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			dir := t.TempDir()
+
+			parquet, err := NewParquet(conf.Parquet{
+				Dir:          dir,
+				Key:          "{namespace}/{date}",
+				Fields:       []string{dictionary.FieldPath},
+				Compression:  tt.compression,
+				RowGroupSize: tt.rowGroupSize,
+				MaxSize:      1 << 20,
+				MaxAge:       3600000,
+			}, NewMetrics().ForOutput("test"), &logger)
+			if err != nil {
+				t.Fatalf("NewParquet() error = %v", err)
+			}
+
+			for _, events := range [][]*entity.Event{parquetEvents()[:2], parquetEvents()[2:]} {
+				if err := parquet.SendEvents(events); err != nil {
+					t.Fatalf("SendEvents() error = %v", err)
+				}
+			}
+
+			if err := parquet.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			paths := parquetFiles(t, dir)
+
+			out, err := exec.Command("python3", append([]string{"-c", pyarrowRead, dir}, paths...)...).CombinedOutput()
+			if err != nil {
+				t.Fatalf("read with pyarrow: %v: %s", err, out)
+			}
+
+			var read struct {
+				Columns   map[string]map[string][]string `json:"columns"`
+				RowGroups map[string]int                 `json:"row_groups"`
+			}
+
+			if err := json.Unmarshal(out, &read); err != nil {
+				t.Fatalf("unmarshal pyarrow output %s: %v", out, err)
+			}
+
+			if want := parquetEventColumns(); !reflect.DeepEqual(read.Columns, want) {
+				t.Errorf("pyarrow read %v, want %v", read.Columns, want)
+			}
+
+			for path, rowGroups := range read.RowGroups {
+				if strings.HasPrefix(path, "default") && rowGroups != tt.rowGroups {
+					t.Errorf("pyarrow read %d row groups of %s, want %d", rowGroups, path, tt.rowGroups)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,416 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// parquetWriter writes events as rows of a parquet file with a required column per field, the timestamp is
+// an int64 of microseconds, other fields are utf8 strings. Rows are buffered until flushRowGroup writes them
+// as a row group with a plain encoded data page per column, close writes the footer.
+type parquetWriter struct {
+	w         io.Writer
+	offset    int64
+	columns   []string
+	codec     int32
+	zstd      *zstd.Encoder
+	rows      []*entity.Event
+	rowsSize  int64
+	numRows   int64
+	rowGroups []parquetRowGroup
+}
+
+type parquetRowGroup struct {
+	numRows int64
+	chunks  []parquetChunk
+}
+
+type parquetChunk struct {
+	offset           int64
+	uncompressedSize int64
+	compressedSize   int64
+	min, max         int64
+}
+
+// newParquetWriter writes the magic and returns the writer, the zstd encoder is used with the zstd codec only.
+func newParquetWriter(w io.Writer, columns []string, compression string, encoder *zstd.Encoder) (*parquetWriter, error) {
+	p := &parquetWriter{w: w, columns: columns, zstd: encoder}
+
+	switch compression {
+	case dictionary.CompressionZstd:
+		p.codec = dictionary.ParquetCodecZstd
+	case dictionary.CompressionGzip:
+		p.codec = dictionary.ParquetCodecGzip
+	default:
+		p.codec = dictionary.ParquetCodecNone
+	}
+
+	return p, p.write([]byte(dictionary.ParquetMagic))
+}
+
+// add buffers the event as a row of the next row group.
+func (p *parquetWriter) add(event *entity.Event) {
+	p.rows = append(p.rows, event)
+
+	for _, column := range p.columns {
+		if column == dictionary.FieldTimestamp {
+			p.rowsSize += 8
+		} else {
+			p.rowsSize += 4 + int64(len(eventField(event, column)))
+		}
+	}
+}
+
+// size returns the bytes written and the plain encoded size of buffered rows.
+func (p *parquetWriter) size() int64 {
+	return p.offset + p.rowsSize
+}
+
+// flushRowGroup writes buffered rows as a row group.
+func (p *parquetWriter) flushRowGroup() error {
+	if len(p.rows) == 0 {
+		return nil
+	}
+
+	group := parquetRowGroup{numRows: int64(len(p.rows))}
+
+	for _, column := range p.columns {
+		chunk, err := p.writeChunk(column)
+		if err != nil {
+			return err
+		}
+
+		group.chunks = append(group.chunks, chunk)
+	}
+
+	p.rowGroups = append(p.rowGroups, group)
+	p.numRows += group.numRows
+	p.rows = p.rows[:0]
+	p.rowsSize = 0
+
+	return nil
+}
+
+// writeChunk writes the column of buffered rows as a single data page.
+func (p *parquetWriter) writeChunk(column string) (parquetChunk, error) {
+	chunk := parquetChunk{offset: p.offset}
+
+	var page bytes.Buffer
+
+	for i, event := range p.rows {
+		if column == dictionary.FieldTimestamp {
+			micros := event.Time.UnixMicro()
+
+			if i == 0 || micros < chunk.min {
+				chunk.min = micros
+			}
+
+			if i == 0 || micros > chunk.max {
+				chunk.max = micros
+			}
+
+			page.Write(binary.LittleEndian.AppendUint64(nil, uint64(micros)))
+
+			continue
+		}
+
+		value := eventField(event, column)
+
+		page.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(value))))
+		page.WriteString(value)
+	}
+
+	data, err := p.compress(page.Bytes())
+	if err != nil {
+		return chunk, err
+	}
+
+	header := &thriftWriter{}
+
+	header.begin()
+	header.i32(1, dictionary.ParquetPageTypeData)
+	header.i32(2, int32(page.Len()))
+	header.i32(3, int32(len(data)))
+	header.structBegin(5)
+	header.i32(1, int32(len(p.rows)))
+	header.i32(2, dictionary.ParquetEncodingPlain)
+	header.i32(3, dictionary.ParquetEncodingRLE)
+	header.i32(4, dictionary.ParquetEncodingRLE)
+	header.end()
+	header.end()
+
+	chunk.uncompressedSize = int64(len(header.buf) + page.Len())
+	chunk.compressedSize = int64(len(header.buf) + len(data))
+
+	if err := p.write(header.buf); err != nil {
+		return chunk, err
+	}
+
+	return chunk, p.write(data)
+}
+
+func (p *parquetWriter) compress(data []byte) ([]byte, error) {
+	switch p.codec {
+	case dictionary.ParquetCodecZstd:
+		return p.zstd.EncodeAll(data, nil), nil
+	case dictionary.ParquetCodecGzip:
+		var buf bytes.Buffer
+
+		w := gzip.NewWriter(&buf)
+
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	default:
+		return data, nil
+	}
+}
+
+// close flushes buffered rows and writes the footer, the file metadata followed by its length and the magic.
+func (p *parquetWriter) close() error {
+	if err := p.flushRowGroup(); err != nil {
+		return err
+	}
+
+	meta := p.metadata()
+
+	if err := p.write(meta); err != nil {
+		return err
+	}
+
+	if err := p.write(binary.LittleEndian.AppendUint32(nil, uint32(len(meta)))); err != nil {
+		return err
+	}
+
+	return p.write([]byte(dictionary.ParquetMagic))
+}
+
+// metadata encodes the FileMetaData struct of the parquet format.
+func (p *parquetWriter) metadata() []byte {
+	meta := &thriftWriter{}
+
+	meta.begin()
+	meta.i32(1, 1)
+
+	meta.list(2, dictionary.ThriftTypeStruct, len(p.columns)+1)
+	meta.begin()
+	meta.binary(4, []byte("schema"))
+	meta.i32(5, int32(len(p.columns)))
+	meta.end()
+
+	for _, column := range p.columns {
+		meta.begin()
+
+		if column == dictionary.FieldTimestamp {
+			meta.i32(1, dictionary.ParquetTypeInt64)
+		} else {
+			meta.i32(1, dictionary.ParquetTypeByteArray)
+		}
+
+		meta.i32(3, dictionary.ParquetRepetitionRequired)
+		meta.binary(4, []byte(column))
+
+		// the converted type is kept for older readers, the logical type is a union of empty or small structs
+		if column == dictionary.FieldTimestamp {
+			meta.i32(6, dictionary.ParquetConvertedTimestampMicros)
+		} else {
+			meta.i32(6, dictionary.ParquetConvertedUTF8)
+		}
+
+		meta.structBegin(10)
+
+		if column == dictionary.FieldTimestamp {
+			meta.structBegin(8)
+			meta.bool(1, true)
+			meta.structBegin(2)
+			meta.structBegin(2)
+			meta.end()
+			meta.end()
+			meta.end()
+		} else {
+			meta.structBegin(1)
+			meta.end()
+		}
+
+		meta.end()
+		meta.end()
+	}
+
+	meta.i64(3, p.numRows)
+
+	meta.list(4, dictionary.ThriftTypeStruct, len(p.rowGroups))
+
+	for _, group := range p.rowGroups {
+		p.rowGroupMetadata(meta, group)
+	}
+
+	meta.binary(6, []byte(dictionary.ParquetCreatedBy))
+
+	// every column is ordered by its type, signed for int64 and unsigned bytes for strings
+	meta.list(7, dictionary.ThriftTypeStruct, len(p.columns))
+
+	for range p.columns {
+		meta.begin()
+		meta.structBegin(1)
+		meta.end()
+		meta.end()
+	}
+
+	meta.end()
+
+	return meta.buf
+}
+
+// rowGroupMetadata encodes the RowGroup struct with a ColumnChunk per column.
+func (p *parquetWriter) rowGroupMetadata(meta *thriftWriter, group parquetRowGroup) {
+	var totalSize int64
+
+	meta.begin()
+	meta.list(1, dictionary.ThriftTypeStruct, len(group.chunks))
+
+	for i, chunk := range group.chunks {
+		column := p.columns[i]
+		totalSize += chunk.uncompressedSize
+
+		meta.begin()
+		meta.i64(2, chunk.offset)
+		meta.structBegin(3)
+
+		if column == dictionary.FieldTimestamp {
+			meta.i32(1, dictionary.ParquetTypeInt64)
+		} else {
+			meta.i32(1, dictionary.ParquetTypeByteArray)
+		}
+
+		meta.list(2, dictionary.ThriftTypeI32, 1)
+		meta.varint(uint64(zigzag(dictionary.ParquetEncodingPlain)))
+		meta.list(3, dictionary.ThriftTypeBin, 1)
+		meta.varint(uint64(len(column)))
+		meta.buf = append(meta.buf, column...)
+		meta.i32(4, p.codec)
+		meta.i64(5, group.numRows)
+		meta.i64(6, chunk.uncompressedSize)
+		meta.i64(7, chunk.compressedSize)
+		meta.i64(9, chunk.offset)
+
+		// min and max of timestamps let readers skip row groups out of the queried time range
+		if column == dictionary.FieldTimestamp {
+			minValue := binary.LittleEndian.AppendUint64(nil, uint64(chunk.min))
+			maxValue := binary.LittleEndian.AppendUint64(nil, uint64(chunk.max))
+
+			meta.structBegin(12)
+			meta.binary(1, maxValue)
+			meta.binary(2, minValue)
+			meta.i64(3, 0)
+			meta.binary(5, maxValue)
+			meta.binary(6, minValue)
+			meta.end()
+		}
+
+		meta.end()
+		meta.end()
+	}
+
+	meta.i64(2, totalSize)
+	meta.i64(3, group.numRows)
+	meta.end()
+}
+
+func (p *parquetWriter) write(data []byte) error {
+	n, err := p.w.Write(data)
+
+	p.offset += int64(n)
+
+	return err
+}
+
+// thriftWriter encodes structs with the thrift compact protocol, begin and end enclose a struct, fields
+// are written in the order of their ids.
+type thriftWriter struct {
+	buf  []byte
+	last []int16
+}
+
+func (t *thriftWriter) begin() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) end() {
+	t.buf = append(t.buf, dictionary.ThriftTypeStop)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// field writes the header of the field, the id is a delta of the previous field id when it fits.
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.varint(uint64(zigzag(int64(id))))
+	}
+
+	*last = id
+}
+
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, dictionary.ThriftTypeStruct)
+	t.begin()
+}
+
+// list writes the header of the list field, elements are written next, struct elements between begin and end.
+func (t *thriftWriter) list(id int16, elemType byte, size int) {
+	t.field(id, dictionary.ThriftTypeList)
+
+	if size < 15 {
+		t.buf = append(t.buf, byte(size)<<4|elemType)
+	} else {
+		t.buf = append(t.buf, 0xf0|elemType)
+		t.varint(uint64(size))
+	}
+}
+
+func (t *thriftWriter) bool(id int16, value bool) {
+	if value {
+		t.field(id, dictionary.ThriftTypeTrue)
+	} else {
+		t.field(id, dictionary.ThriftTypeFalse)
+	}
+}
+
+func (t *thriftWriter) i32(id int16, value int32) {
+	t.field(id, dictionary.ThriftTypeI32)
+	t.varint(uint64(zigzag(int64(value))))
+}
+
+func (t *thriftWriter) i64(id int16, value int64) {
+	t.field(id, dictionary.ThriftTypeI64)
+	t.varint(uint64(zigzag(value)))
+}
+
+func (t *thriftWriter) binary(id int16, value []byte) {
+	t.field(id, dictionary.ThriftTypeBin)
+	t.varint(uint64(len(value)))
+	t.buf = append(t.buf, value...)
+}
+
+func (t *thriftWriter) varint(value uint64) {
+	t.buf = binary.AppendUvarint(t.buf, value)
+}
+
+func zigzag(value int64) int64 {
+	return (value << 1) ^ (value >> 63)
+}
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// Pipeline turns lines of log files into documents, it is shared by the watcher and the test command.
+type Pipeline struct {
+	outputs   []conf.Output
+	k8sRegexp *regexp.Regexp
+}
+
+func NewPipeline(cfg conf.Config) *Pipeline {
+	return &Pipeline{
+		outputs:   cfg.OutputConfigs(),
+		k8sRegexp: regexp.MustCompile(dictionary.K8sPodsRegexp),
+	}
+}
+
+// Meta parses k8s meta from the log file path, files outside of the pods dir get empty meta.
+func (s *Pipeline) Meta(path string) *entity.Meta {
+	matches := s.k8sRegexp.FindAllStringSubmatch(path, -1)
+
+	if matches == nil {
+		return &entity.Meta{Path: path}
+	}
+
+	return &entity.Meta{
+		Path:          path,
+		PodName:       matches[0][2],
+		Namespace:     matches[0][1],
+		ContainerName: matches[0][4],
+		PodID:         matches[0][3],
+	}
+}
+
+func (s *Pipeline) Event(line *entity.Line, meta *entity.Meta) *entity.Event {
+	return entity.NewEvent(line, meta)
+}
+
+// Routes returns positions of outputs the event with meta is sent to, in the order of OutputConfigs.
+func (s *Pipeline) Routes(meta *entity.Meta) []int {
+	routes := make([]int, 0, len(s.outputs))
+
+	for i, output := range s.outputs {
+		if matchRoutes(output.Routes, meta) {
+			routes = append(routes, i)
+		}
+	}
+
+	return routes
+}
+
+// Test runs lines of the case through the pipeline and returns differences from the expected documents,
+// a document is expected for every output the line is routed to.
+func (s *Pipeline) Test(c *entity.PipelineCase) []string {
+	meta := s.Meta(c.Path)
+
+	if c.Meta != nil {
+		overrideMeta(meta, c.Meta)
+	}
+
+	got := make([]*entity.TapEvent, 0, len(c.Lines))
+
+	for i, str := range c.Lines {
+		event := s.Event(&entity.Line{Pos: int64(i), Str: str, Time: c.Time}, meta)
+
+		for _, route := range s.Routes(meta) {
+			output := s.outputs[route]
+
+			got = append(got, &entity.TapEvent{
+				Output:   output.Name,
+				Index:    documentIndex(output, c.Time),
+				Document: entity.NewFieldsBody(event),
+			})
+		}
+	}
+
+	var diffs []string
+
+	if len(got) != len(c.Expected) {
+		diffs = append(diffs, fmt.Sprintf("expected %d documents, got %d", len(c.Expected), len(got)))
+	}
+
+	for i := 0; i < len(got) || i < len(c.Expected); i++ {
+		switch {
+		case i >= len(c.Expected):
+			diffs = append(diffs, fmt.Sprintf("document %d: unexpected message %s", i, tapEventFields(got[i])[2][1]))
+		case i >= len(got):
+			diffs = append(diffs, fmt.Sprintf("document %d: missing message %s", i, tapEventFields(c.Expected[i])[2][1]))
+		default:
+			diffs = append(diffs, diffTapEvents(i, c.Expected[i], got[i])...)
+		}
+	}
+
+	return diffs
+}
+
+func matchRoutes(routes []conf.Route, meta *entity.Meta) bool {
+	if len(routes) == 0 {
+		return true
+	}
+
+	for _, route := range routes {
+		if matchPattern(route.Namespace, meta.Namespace) &&
+			matchPattern(route.Pod, meta.PodName) &&
+			matchPattern(route.Container, meta.ContainerName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchPattern matches value against a shell pattern, patterns are validated with the config.
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	ok, _ := path.Match(pattern, value)
+
+	return ok
+}
+
+func overrideMeta(meta *entity.Meta, override *entity.CaseMeta) {
+	if override.Namespace != "" {
+		meta.Namespace = override.Namespace
+	}
+
+	if override.PodName != "" {
+		meta.PodName = override.PodName
+	}
+
+	if override.PodID != "" {
+		meta.PodID = override.PodID
+	}
+
+	if override.ContainerName != "" {
+		meta.ContainerName = override.ContainerName
+	}
+}
+
+func diffTapEvents(i int, expected, got *entity.TapEvent) []string {
+	want, have := tapEventFields(expected), tapEventFields(got)
+
+	var diffs []string
+
+	for j := range want {
+		if want[j][1] != have[j][1] {
+			diffs = append(
+				diffs,
+				fmt.Sprintf("document %d: %s: expected %s, got %s", i, want[j][0], want[j][1], have[j][1]),
+			)
+		}
+	}
+
+	return diffs
+}
+
+// tapEventFields returns quoted values of the document fields in the order they are compared.
+func tapEventFields(event *entity.TapEvent) [][2]string {
+	doc := event.Document
+	if doc == nil {
+		doc = &entity.FieldsBody{}
+	}
+
+	return [][2]string{
+		{"output", strconv.Quote(event.Output)},
+		{"_index", strconv.Quote(event.Index)},
+		{"message", strconv.Quote(doc.Message)},
+		{"@timestamp", strconv.Quote(doc.Timestamp.Format(time.RFC3339Nano))},
+		{"namespace", strconv.Quote(doc.Namespace)},
+		{"pod_name", strconv.Quote(doc.PodName)},
+		{"pod_id", strconv.Quote(doc.PodID)},
+		{"container_name", strconv.Quote(doc.ContainerName)},
+	}
+}
+
+// documentIndex returns the index documents of the output are written to, empty for outputs without indices
+// in their capabilities.
+func documentIndex(output conf.Output, t time.Time) string {
+	switch output.Type {
+	case dictionary.OutputES, dictionary.OutputStdout, "":
+		return indexName(output.Storage, t)
+	}
+
+	return ""
+}
+
+// indexName returns the data stream name or the daily index the document read at t is written to.
+func indexName(storage conf.Storage, t time.Time) string {
+	if storage.DataStream.Enabled() {
+		return storage.DataStream.Name
+	}
+
+	return storage.IndexName + "-" + t.Format(dictionary.IndexDateLayout)
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+func TestPipeline_Test(t *testing.T) {
+	t.Parallel()
+
+	cfg := conf.Config{Storage: conf.Storage{IndexName: "logfowd"}}
+
+	readAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	expected := func(message string) *entity.TapEvent {
+		return &entity.TapEvent{
+			Index: "logfowd-2024.01.02",
+			Document: &entity.FieldsBody{
+				Message:       message,
+				Timestamp:     readAt,
+				Namespace:     "default",
+				PodName:       "api",
+				PodID:         "abc-1",
+				ContainerName: "app",
+			},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		c     *entity.PipelineCase
+		diffs []string
+	}{
+		{
+			name: "matching documents",
+			c: &entity.PipelineCase{
+				Path:     "/var/log/pods/default_api_abc-1/app/0.log",
+				Time:     readAt,
+				Lines:    []string{"first", "second"},
+				Expected: []*entity.TapEvent{expected("first"), expected("second")},
+			},
+		},
+		{
+			name: "meta override",
+			c: &entity.PipelineCase{
+				Path:     "/tmp/app.log",
+				Meta:     &entity.CaseMeta{Namespace: "default", PodName: "api", PodID: "abc-1", ContainerName: "app"},
+				Time:     readAt,
+				Lines:    []string{"first"},
+				Expected: []*entity.TapEvent{expected("first")},
+			},
+		},
+		{
+			name: "different fields",
+			c: &entity.PipelineCase{
+				Path:     "/var/log/pods/default_api_abc-1/app/0.log",
+				Time:     readAt.AddDate(0, 0, 1),
+				Lines:    []string{"first"},
+				Expected: []*entity.TapEvent{expected("other")},
+			},
+			diffs: []string{
+				`document 0: _index: expected "logfowd-2024.01.02", got "logfowd-2024.01.03"`,
+				`document 0: message: expected "other", got "first"`,
+				`document 0: @timestamp: expected "2024-01-02T03:04:05Z", got "2024-01-03T03:04:05Z"`,
+			},
+		},
+		{
+			name: "missing and unexpected documents",
+			c: &entity.PipelineCase{
+				Path:     "/var/log/pods/default_api_abc-1/app/0.log",
+				Time:     readAt,
+				Lines:    []string{"first", "second"},
+				Expected: []*entity.TapEvent{expected("first")},
+			},
+			diffs: []string{
+				"expected 1 documents, got 2",
+				`document 1: unexpected message "second"`,
+			},
+		},
+	}
+
+	pipeline := NewPipeline(cfg)
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := pipeline.Test(tt.c); !reflect.DeepEqual(got, tt.diffs) {
+				t.Errorf("Test() = %q, want %q", got, tt.diffs)
+			}
+		})
+	}
+}
+
+func TestPipeline_Routes(t *testing.T) {
+	t.Parallel()
+
+	cfg := conf.Config{
+		Outputs: []conf.Output{
+			{Name: "all"},
+			{Name: "system", Routes: []conf.Route{{Namespace: "kube-*"}, {Namespace: "default", Container: "proxy"}}},
+			{Name: "none", Routes: []conf.Route{{Pod: "missing"}}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		meta   *entity.Meta
+		routes []int
+	}{
+		{
+			name:   "pattern",
+			meta:   &entity.Meta{Namespace: "kube-system", PodName: "dns", ContainerName: "dns"},
+			routes: []int{0, 1},
+		},
+		{
+			name:   "all fields of a route",
+			meta:   &entity.Meta{Namespace: "default", PodName: "api", ContainerName: "proxy"},
+			routes: []int{0, 1},
+		},
+		{
+			name:   "no matching routes",
+			meta:   &entity.Meta{Namespace: "default", PodName: "api", ContainerName: "app"},
+			routes: []int{0},
+		},
+	}
+
+	pipeline := NewPipeline(cfg)
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := pipeline.Routes(tt.meta); !reflect.DeepEqual(got, tt.routes) {
+				t.Errorf("Routes() = %v, want %v", got, tt.routes)
+			}
+		})
+	}
+}
+
+func TestDocumentIndex_Capabilities(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	metrics := NewMetrics()
+	cfg := conf.Config{Storage: conf.Storage{IndexName: "logfowd"}}
+
+	// es outputs detect the cluster on creation, its client is checked without it
+	outputs := map[string]Output{
+		dictionary.OutputES: NewESCli(cfg, metrics.ForOutput(dictionary.OutputES), &logger),
+	}
+
+	for _, typ := range []string{
+		dictionary.OutputStdout, dictionary.OutputLoki, dictionary.OutputOTLP, dictionary.OutputForward,
+		dictionary.OutputKafka, dictionary.OutputSplunk, dictionary.OutputClickHouse, dictionary.OutputGELF,
+		dictionary.OutputSyslog, dictionary.OutputFile, dictionary.OutputS3, dictionary.OutputParquet,
+	} {
+		output, err := NewOutput(cfg, conf.Output{Name: typ, Type: typ, Storage: cfg.Storage}, metrics, &logger)
+		if err != nil {
+			t.Fatalf("NewOutput(%s) error = %v", typ, err)
+		}
+
+		outputs[typ] = output
+	}
+
+	for typ, output := range outputs {
+		index := documentIndex(conf.Output{Type: typ, Storage: cfg.Storage}, time.Now())
+
+		if (index != "") != output.Capabilities().Indices {
+			t.Errorf("%s: documentIndex() = %q, capabilities indices %v", typ, index, output.Capabilities().Indices)
+		}
+	}
+}
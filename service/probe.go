@@ -0,0 +1,126 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/valyala/fasthttp"
+)
+
+// Prober is implemented by outputs able to check that their destination is reachable without sending events,
+// validate --connect probes every output implementing it.
+type Prober interface {
+	Probe() error
+}
+
+// probeRequest sends the request with the client, network errors and non 2xx responses are problems.
+func probeRequest(httpCli *fasthttp.Client, method, uri string, headers map[string]string, body []byte) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	req.SetBody(body)
+
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	if err := httpCli.DoTimeout(req, resp, dictionary.RequestTimeout); err != nil {
+		return err
+	}
+
+	if resp.StatusCode() < http.StatusOK || resp.StatusCode() >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %d %s", dictionary.ErrBadStatusCode, resp.StatusCode(), resp.Body())
+	}
+
+	return nil
+}
+
+// probeDial opens and closes a tcp connection to host and port of the url, the port defaults by scheme.
+func probeDial(uri string) error {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	addr := parsed.Host
+
+	if parsed.Port() == "" {
+		port := "80"
+		if strings.EqualFold(parsed.Scheme, "https") {
+			port = "443"
+		}
+
+		addr = net.JoinHostPort(parsed.Hostname(), port)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, dictionary.RequestTimeout)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// writableDir checks that the dir or, when it does not exist yet, its closest existing parent is a dir
+// files can be created in.
+func writableDir(dir string) error {
+	for {
+		_, err := os.Stat(dir)
+		if errors.Is(err, fs.ErrNotExist) && filepath.Dir(dir) != dir {
+			dir = filepath.Dir(dir)
+
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return writable(dir)
+	}
+}
+
+// writable checks that the dir exists and files can be created in it.
+func writable(dir string) error {
+	if err := isDir(dir); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, ".logfowd-probe-*")
+	if err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(file.Name())
+}
+
+// isDir checks that the dir exists without creating files in it, for checks repeated as often as health.
+func isDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%w: %s", dictionary.ErrNotDir, dir)
+	}
+
+	return nil
+}
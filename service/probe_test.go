@@ -0,0 +1,179 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+func TestOutputs_Probe(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	metrics := NewMetrics().ForOutput("test")
+
+	ready := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case dictionary.LokiReadyPath, dictionary.ClickHousePingPath, dictionary.OTLPLogsPath:
+			_, _ = w.Write([]byte("ok"))
+		case dictionary.SplunkHealthPath:
+			if r.Header.Get("Authorization") != "Splunk token" {
+				w.WriteHeader(http.StatusForbidden)
+
+				return
+			}
+
+			_, _ = w.Write([]byte(`{"text":"HEC is healthy","code":17}`))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(ready.Close)
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(unavailable.Close)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	closedAddr := closed.Addr().String()
+	_ = closed.Close()
+
+	s3 := newFakeS3(t)
+
+	s3Cfg := conf.S3{
+		Endpoint:   s3.URL,
+		Region:     "eu-west-1",
+		Bucket:     "logs",
+		AccessKey:  "access",
+		SecretKey:  "secret",
+		PathStyle:  true,
+		RetryDelay: 1,
+	}
+
+	s3Output, err := NewS3(s3Cfg, metrics, &logger)
+	if err != nil {
+		t.Fatalf("NewS3() error = %v", err)
+	}
+
+	s3Cfg.Bucket = "missing"
+
+	missingBucket, err := NewS3(s3Cfg, metrics, &logger)
+	if err != nil {
+		t.Fatalf("NewS3() error = %v", err)
+	}
+
+	splunk, err := NewSplunk(conf.Splunk{URL: ready.URL, Token: "token"}, metrics, &logger)
+	if err != nil {
+		t.Fatalf("NewSplunk() error = %v", err)
+	}
+
+	splunkInvalidToken, err := NewSplunk(conf.Splunk{URL: ready.URL, Token: "other"}, metrics, &logger)
+	if err != nil {
+		t.Fatalf("NewSplunk() error = %v", err)
+	}
+
+	gelf, err := NewGELF(conf.GELF{Transport: dictionary.GELFTransportHTTP, URL: ready.URL}, metrics, &logger)
+	if err != nil {
+		t.Fatalf("NewGELF() error = %v", err)
+	}
+
+	syslog, err := NewSyslog(conf.Syslog{
+		Transport: dictionary.SyslogTransportTCP,
+		Address:   listener.Addr().String(),
+		Timeout:   1000,
+	}, metrics, &logger)
+	if err != nil {
+		t.Fatalf("NewSyslog() error = %v", err)
+	}
+
+	syslogRefused, err := NewSyslog(conf.Syslog{
+		Transport: dictionary.SyslogTransportTCP,
+		Address:   closedAddr,
+		Timeout:   1000,
+	}, metrics, &logger)
+	if err != nil {
+		t.Fatalf("NewSyslog() error = %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		prober  Prober
+		wantErr bool
+	}{
+		{name: "loki", prober: NewLoki(conf.Loki{URL: ready.URL}, metrics, &logger)},
+		{name: "loki not ready", prober: NewLoki(conf.Loki{URL: unavailable.URL}, metrics, &logger), wantErr: true},
+		{name: "otlp", prober: NewOTLP(conf.OTLP{URL: ready.URL}, metrics, &logger)},
+		{name: "splunk", prober: splunk},
+		{name: "splunk invalid token", prober: splunkInvalidToken, wantErr: true},
+		{name: "clickhouse", prober: NewClickHouse(conf.ClickHouse{URL: ready.URL}, metrics, &logger)},
+		{name: "gelf http", prober: gelf},
+		{name: "syslog tcp", prober: syslog},
+		{name: "syslog tcp refused", prober: syslogRefused, wantErr: true},
+		{name: "s3", prober: s3Output},
+		{name: "s3 missing bucket", prober: missingBucket, wantErr: true},
+		{name: "file dir to be created", prober: NewFileArchive(conf.FileArchive{Dir: filepath.Join(t.TempDir(), "a", "b")}, metrics, &logger)},
+		{name: "file dir is a file", prober: NewFileArchive(conf.FileArchive{Dir: file}, metrics, &logger), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := tt.prober.Probe(); (err != nil) != tt.wantErr {
+				t.Errorf("Probe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWritableDir(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	if err := writableDir(filepath.Join(dir, "not", "created")); err != nil {
+		t.Errorf("writableDir() error = %v", err)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("dir has %d entries after probe, want none", len(entries))
+	}
+
+	file := filepath.Join(dir, "file")
+
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	if err := writableDir(file); !errors.Is(err, dictionary.ErrNotDir) {
+		t.Errorf("writableDir() error = %v, want %v", err, dictionary.ErrNotDir)
+	}
+}
@@ -0,0 +1,308 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"golang.org/x/sync/errgroup"
+)
+
+// Queue buffers events of one output, batches them and sends batches by its own workers, so a slow output
+// doesn't delay others. When the buffer is full events are dropped or readers are blocked depending on overflow.
+type Queue struct {
+	name          string
+	overflow      string
+	workers       int
+	event         chan *entity.Event
+	batches       chan []*entity.Event
+	hasEvent      chan struct{}
+	flushInterval atomic.Int64
+	mx            sync.RWMutex
+	cfg           conf.Output
+	output        Output
+	stopOutput    context.CancelFunc
+	health        *Health
+	tap           *Tap
+	metrics       *OutputMetrics
+	logger        *zerolog.Logger
+}
+
+func NewQueue(
+	cfg conf.Output,
+	output Output,
+	metrics *Metrics,
+	health *Health,
+	tap *Tap,
+	logger *zerolog.Logger,
+) *Queue {
+	queueLogger := logger.With().Str("output", cfg.Name).Logger()
+
+	q := &Queue{
+		name:     cfg.Name,
+		overflow: cfg.Overflow,
+		workers:  cfg.Workers,
+		event:    make(chan *entity.Event, cfg.Workers*dictionary.SendBatchesNum*dictionary.FlushLogsNumber),
+		batches:  make(chan []*entity.Event, cfg.Workers*dictionary.SendBatchesNum),
+		hasEvent: make(chan struct{}, cfg.Workers*dictionary.SendBatchesNum*dictionary.FlushLogsNumber),
+		cfg:      cfg,
+		output:   output,
+		health:   health,
+		tap:      tap,
+		metrics:  metrics.ForOutput(cfg.Name),
+		logger:   &queueLogger,
+	}
+
+	q.flushInterval.Store(int64(cfg.FlushInterval))
+
+	return q
+}
+
+// Start runs background jobs of the output, the dispatcher and workers of the queue in the group.
+func (s *Queue) Start(ctx context.Context, g *errgroup.Group) {
+	s.startOutput(ctx, s.cfg, s.getOutput())
+
+	g.Go(func() error {
+		return s.dispatcher(ctx)
+	})
+
+	for i := 0; i < s.workers; i++ {
+		i := i
+
+		g.Go(func() error {
+			return s.sender(ctx, i)
+		})
+	}
+}
+
+// Reload switches workers to the new output and applies the new flush interval. Batches being sent
+// are finished by the previous output, which is closed after them, the same output is kept running.
+func (s *Queue) Reload(ctx context.Context, cfg conf.Output, output Output) {
+	s.flushInterval.Store(int64(cfg.FlushInterval))
+
+	s.startOutput(ctx, cfg, output)
+}
+
+// Close closes the current output, it is called after workers are stopped.
+func (s *Queue) Close() error {
+	return s.getOutput().Close()
+}
+
+// Push adds the event to the buffer, on overflow it is dropped or the caller is blocked until there is room.
+func (s *Queue) Push(event *entity.Event) {
+	if len(s.event) == cap(s.event) {
+		s.metrics.ChannelOverflows.Inc()
+
+		if s.overflow == dictionary.OverflowDrop {
+			select {
+			case s.event <- event:
+			default:
+				s.metrics.DroppedEvents.Inc()
+
+				s.logger.Debug().Msg("logs channel overflowed, event dropped")
+
+				return
+			}
+		} else {
+			s.logger.
+				Err(dictionary.ErrChannelOverflowed).
+				Msg("logs channel overflowed, consider increasing workers")
+
+			s.event <- event
+		}
+	} else {
+		s.event <- event
+	}
+
+	if len(s.hasEvent) != cap(s.hasEvent) {
+		s.hasEvent <- struct{}{}
+	}
+}
+
+// startOutput runs background jobs of the output, stops jobs of the previous one and closes it. A running output
+// passed again keeps its jobs, stopping them would end retries of outputs flushing buffers on Close.
+func (s *Queue) startOutput(ctx context.Context, cfg conf.Output, output Output) {
+	// workers hold the read lock while sending, so the previous output is idle once the lock is taken
+	s.mx.Lock()
+
+	prev, stopPrev := s.output, s.stopOutput
+
+	if prev == output && stopPrev != nil {
+		s.cfg = cfg
+
+		s.mx.Unlock()
+
+		return
+	}
+
+	outputCtx, cancel := context.WithCancel(ctx)
+
+	s.cfg, s.output, s.stopOutput = cfg, output, cancel
+
+	s.mx.Unlock()
+
+	if stopPrev != nil {
+		stopPrev()
+	}
+
+	if prev != output {
+		if err := prev.Close(); err != nil {
+			s.logger.Err(err).Msg("close previous output")
+		}
+	}
+
+	go func() {
+		if err := output.Start(outputCtx); err != nil {
+			s.logger.Err(err).Msg("output background jobs")
+		}
+	}()
+}
+
+func (s *Queue) getOutput() Output {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return s.output
+}
+
+func (s *Queue) dispatcher(ctx context.Context) error {
+	s.logger.Debug().Msg("start send dispatcher")
+
+	defer s.logger.Debug().Msg("stop send dispatcher")
+
+	beat := s.health.Heartbeat(dictionary.ComponentDispatcher + "-" + s.name)
+
+	for {
+		beat.Beat()
+
+		select {
+		case <-time.After(time.Duration(s.flushInterval.Load()) * time.Millisecond):
+			s.sendByTimer()
+		case <-s.hasEvent:
+			s.sendByLimit()
+		case <-ctx.Done():
+			s.sendRemainingEvents()
+
+			return nil
+		}
+	}
+}
+
+func (s *Queue) sender(ctx context.Context, i int) error {
+	s.logger.Debug().Int("worker", i).Msgf("start sender %d", i)
+
+	defer s.logger.Debug().Int("worker", i).Msgf("stop sender %d", i)
+
+	beat := s.health.Heartbeat(dictionary.ComponentSender + "-" + s.name + "-" + strconv.Itoa(i))
+
+	heartbeat := time.NewTicker(dictionary.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		beat.Beat()
+
+		select {
+		case <-heartbeat.C:
+		case events := <-s.batches:
+			// a failed batch is counted as dropped by the output, the worker goes on with the next one,
+			// so a failing output doesn't stop others
+			err := s.send(events)
+
+			s.logger.Err(err).
+				Int("worker", i).
+				Int("num", len(events)).
+				Msg("send events")
+		case <-ctx.Done():
+			for len(s.batches) > 0 {
+				events := <-s.batches
+
+				err := s.send(events)
+
+				s.logger.Err(err).
+					Int("worker", i).
+					Int("num", len(events)).
+					Msg("send remaining event before shutting down")
+			}
+
+			return nil
+		}
+	}
+}
+
+// send publishes the batch to the tap and sends it to the output under the read lock.
+func (s *Queue) send(events []*entity.Event) error {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	var index string
+
+	if s.output.Capabilities().Indices {
+		index = indexName(s.cfg.Storage, time.Now())
+	}
+
+	s.tap.Publish(s.name, index, events)
+
+	return s.output.SendEvents(events)
+}
+
+func (s *Queue) sendByLimit() {
+	if len(s.event) < dictionary.FlushLogsNumber {
+		return
+	}
+
+	events := make([]*entity.Event, dictionary.FlushLogsNumber)
+
+	for i := 0; i < dictionary.FlushLogsNumber; i++ {
+		events[i] = <-s.event
+	}
+
+	s.batches <- events
+
+	s.logger.Debug().
+		Int("num", len(events)).
+		Int("num remaining", len(s.event)).
+		Msg("flushed event to senders by event number limit")
+}
+
+func (s *Queue) sendByTimer() {
+	num := len(s.event)
+
+	if num == 0 {
+		return
+	}
+
+	events := make([]*entity.Event, num)
+
+	for i := 0; i < num; i++ {
+		events[i] = <-s.event
+	}
+
+	s.batches <- events
+
+	s.logger.Info().
+		Int("num", len(events)).
+		Int("num remaining", len(s.event)).
+		Msg("flushed event to senders by timer")
+}
+
+func (s *Queue) sendRemainingEvents() {
+	if len(s.event) == 0 {
+		return
+	}
+
+	events := make([]*entity.Event, 0)
+
+	for len(s.event) > 0 {
+		events = append(events, <-s.event)
+	}
+
+	s.batches <- events
+
+	s.logger.Warn().Int("num", len(events)).Msg("send remaining event to senders before shutting down")
+}
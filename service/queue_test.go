@@ -0,0 +1,228 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestQueue_Push_Drop(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	metrics := NewMetrics()
+
+	cfg := conf.Output{Name: "slow", Workers: 1, FlushInterval: 1000, Overflow: dictionary.OverflowDrop}
+
+	queue := NewQueue(cfg, NewESCli(conf.Config{}, metrics.ForOutput("slow"), &logger), metrics, NewHealth(conf.Config{}), NewTap(metrics, &logger), &logger)
+
+	size := cap(queue.event)
+
+	// nobody reads the queue, pushing over the capacity must not block
+	for i := 0; i < size+10; i++ {
+		queue.Push(testEvents()[0])
+	}
+
+	if got := len(queue.event); got != size {
+		t.Errorf("buffered %d events, want %d", got, size)
+	}
+
+	if got := testutil.ToFloat64(metrics.DroppedEvents.WithLabelValues("slow")); got != 10 {
+		t.Errorf("dropped = %v, want 10", got)
+	}
+
+	if got := testutil.ToFloat64(metrics.ChannelOverflows.WithLabelValues("slow")); got != 10 {
+		t.Errorf("overflows = %v, want 10", got)
+	}
+}
+
+// fakeOutput records sent events, starts and closes, batches fail with err when it is set.
+type fakeOutput struct {
+	mx      sync.Mutex
+	err     error
+	sent    int
+	failed  int
+	started int
+	stopped int
+	closed  int
+}
+
+func (o *fakeOutput) Start(ctx context.Context) error {
+	o.mx.Lock()
+	o.started++
+	o.mx.Unlock()
+
+	<-ctx.Done()
+
+	o.mx.Lock()
+	o.stopped++
+	o.mx.Unlock()
+
+	return nil
+}
+
+func (o *fakeOutput) SendEvents(events []*entity.Event) error {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	if o.err != nil {
+		o.failed += len(events)
+
+		return o.err
+	}
+
+	o.sent += len(events)
+
+	return nil
+}
+
+func (o *fakeOutput) Health() error { return nil }
+
+func (o *fakeOutput) Close() error {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	o.closed++
+
+	return nil
+}
+
+func (o *fakeOutput) Capabilities() Capabilities { return Capabilities{} }
+
+func (o *fakeOutput) counts() (int, int) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	return o.sent, o.failed
+}
+
+// lifecycle returns how many times the output was started, stopped and closed.
+func (o *fakeOutput) lifecycle() (int, int, int) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	return o.started, o.stopped, o.closed
+}
+
+func TestQueue_Reload(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	metrics := NewMetrics()
+
+	cfg := conf.Output{Name: "reloaded", Workers: 1, FlushInterval: 1000, Overflow: dictionary.OverflowBlock}
+	output, next := &fakeOutput{}, &fakeOutput{}
+
+	queue := NewQueue(cfg, output, metrics, NewHealth(conf.Config{}), NewTap(metrics, &logger), &logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	waitLifecycle := func(output *fakeOutput, started, stopped, closed int) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+
+		for {
+			gotStarted, gotStopped, gotClosed := output.lifecycle()
+			if gotStarted == started && gotStopped == stopped && gotClosed == closed {
+				return
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("output started %d, stopped %d, closed %d times, want %d, %d, %d",
+					gotStarted, gotStopped, gotClosed, started, stopped, closed)
+			}
+
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	queue.startOutput(ctx, cfg, output)
+	waitLifecycle(output, 1, 0, 0)
+
+	// the same output keeps its background jobs and isn't closed
+	cfg.FlushInterval = 250
+	queue.Reload(ctx, cfg, output)
+
+	if got := queue.flushInterval.Load(); got != 250 {
+		t.Errorf("flush interval = %d, want 250", got)
+	}
+
+	waitLifecycle(output, 1, 0, 0)
+
+	queue.Reload(ctx, cfg, next)
+	waitLifecycle(output, 1, 1, 1)
+	waitLifecycle(next, 1, 0, 0)
+}
+
+func TestQueue_Start_FailingOutput(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	metrics := NewMetrics()
+	health := NewHealth(conf.Config{})
+	tap := NewTap(metrics, &logger)
+
+	failing := &fakeOutput{err: dictionary.ErrBadStatusCode}
+	working := &fakeOutput{}
+
+	newQueue := func(name string, output Output) *Queue {
+		cfg := conf.Output{Name: name, Workers: 1, FlushInterval: 10, Overflow: dictionary.OverflowBlock}
+
+		return NewQueue(cfg, output, metrics, health, tap, &logger)
+	}
+
+	queues := []*Queue{newQueue("failing", failing), newQueue("working", working)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, gCtx := errgroup.WithContext(ctx)
+
+	for _, queue := range queues {
+		queue.Start(gCtx, g)
+	}
+
+	// batches are sent by the flush timer, every round fails on one output and succeeds on the other
+	for round := 1; round <= 3; round++ {
+		for _, queue := range queues {
+			queue.Push(testEvents()[0])
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+
+		for {
+			sent, _ := working.counts()
+			_, failed := failing.counts()
+
+			if sent == round && failed == round {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("round %d: sent %d and failed %d events, want %d", round, sent, failed, round)
+			}
+
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	if err := gCtx.Err(); err != nil {
+		t.Errorf("group context error = %v, a failing output must not stop others", err)
+	}
+
+	cancel()
+
+	if err := g.Wait(); err != nil {
+		t.Errorf("Wait() error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+)
+
+// Reloader loads the config file on SIGHUP or file change and applies it to the running pipeline.
+// Invalid configs are rejected and the previous config keeps running.
+type Reloader struct {
+	path          string
+	cfg           conf.Config
+	outputs       map[string]Output
+	watcher       *Watcher
+	metrics       *Metrics
+	health        *Health
+	mx            sync.Mutex
+	stopRetention context.CancelFunc
+	logger        *zerolog.Logger
+}
+
+func NewReloader(
+	path string,
+	cfg conf.Config,
+	outputs map[string]Output,
+	watcher *Watcher,
+	metrics *Metrics,
+	health *Health,
+	logger *zerolog.Logger,
+) *Reloader {
+	return &Reloader{
+		path:    path,
+		cfg:     cfg,
+		outputs: outputs,
+		watcher: watcher,
+		metrics: metrics,
+		health:  health,
+		logger:  logger,
+	}
+}
+
+// Start runs the retention job of the current config and applies config changes until ctx is done.
+func (s *Reloader) Start(ctx context.Context) error {
+	s.logger.Debug().Str("path", s.path).Msg("start config reloader")
+
+	defer s.logger.Debug().Str("path", s.path).Msg("stop config reloader")
+
+	s.startRetention(ctx, s.cfg, s.outputs)
+
+	hup := make(chan os.Signal, 1)
+
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+	)
+
+	if s.cfg.Reload.Watch {
+		fileWatcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			s.logger.Err(err).Msg("new config watcher")
+
+			return err
+		}
+
+		defer fileWatcher.Close()
+
+		// configmaps are updated by swapping a symlink, so the directory is watched instead of the file
+		if err := fileWatcher.Add(filepath.Dir(s.path)); err != nil {
+			s.logger.Err(err).Str("path", s.path).Msg("add config dir to watcher")
+
+			return err
+		}
+
+		events, errs = fileWatcher.Events, fileWatcher.Errors
+	}
+
+	debounce := time.NewTimer(0)
+	<-debounce.C
+
+	for {
+		select {
+		case <-hup:
+			s.logger.Info().Msg("sighup received, reload config")
+
+			s.apply(ctx)
+		case <-events:
+			debounce.Reset(time.Duration(s.cfg.Reload.Debounce) * time.Millisecond)
+		case <-debounce.C:
+			s.apply(ctx)
+		case err := <-errs:
+			s.logger.Err(err).Msg("config watcher received error")
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *Reloader) apply(ctx context.Context) {
+	if err := s.Reload(ctx); err != nil {
+		s.logger.Err(err).Str("path", s.path).Msg("reload config, previous config is kept")
+	}
+}
+
+// Reload loads and validates the config file, then switches the watcher to outputs of the new config, outputs with
+// unchanged settings are kept. Fields that can't be changed at runtime keep their current values.
+func (s *Reloader) Reload(ctx context.Context) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	next, err := conf.Load(s.path)
+	if err != nil {
+		return err
+	}
+
+	if err := next.Validate(); err != nil {
+		return err
+	}
+
+	if fields := s.cfg.RestartRequired(next); len(fields) > 0 {
+		s.logger.Warn().Strs("fields", fields).Msg("config fields changed, restart to apply them")
+
+		next.LogsPath, next.Output, next.Storage.Workers, next.Admin, next.Reload =
+			s.cfg.LogsPath, s.cfg.Output, s.cfg.Storage.Workers, s.cfg.Admin, s.cfg.Reload
+
+		// routes and output sections are applied only while queues stay the same
+		if slices.Contains(fields, "outputs") {
+			next.Outputs = s.cfg.Outputs
+		}
+	}
+
+	if reflect.DeepEqual(s.cfg, next) {
+		s.logger.Debug().Msg("config not changed")
+
+		return nil
+	}
+
+	outputs, err := ReloadOutputs(s.cfg, next, s.outputs, s.metrics, s.logger)
+	if err != nil {
+		return err
+	}
+
+	if next.DebugMode {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	}
+
+	s.watcher.Reload(ctx, next, outputs)
+
+	for name, output := range outputs {
+		s.health.AddReadinessCheck(name, output.Health)
+	}
+
+	s.startRetention(ctx, next, outputs)
+
+	s.cfg, s.outputs = next, outputs
+
+	s.logger.Info().Str("path", s.path).Msg("config reloaded")
+
+	return nil
+}
+
+// startRetention stops retention jobs of the previous config and starts jobs of outputs writing to es indices
+// with retention enabled.
+func (s *Reloader) startRetention(ctx context.Context, cfg conf.Config, outputs map[string]Output) {
+	if s.stopRetention != nil {
+		s.stopRetention()
+		s.stopRetention = nil
+	}
+
+	retentionCtx, cancel := context.WithCancel(ctx)
+
+	s.stopRetention = cancel
+
+	for _, outputCfg := range cfg.OutputConfigs() {
+		esCli, ok := outputs[outputCfg.Name].(*Cli)
+
+		if !ok || !outputCfg.Storage.Retention.Enabled {
+			continue
+		}
+
+		logger := s.logger.With().Str("output", outputCfg.Name).Logger()
+
+		go NewRetention(cfg.ForOutput(outputCfg), esCli, &logger).Start(retentionCtx)
+	}
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+func writeReloaderConfig(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+}
+
+func TestReloader_Reload(t *testing.T) {
+	t.Parallel()
+
+	es := newFakeES(t)
+	logger := zerolog.Nop()
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	writeReloaderConfig(t, path, `{"storage":{"hosts":["`+es.URL+`"],"api_prefix":"/","workers":2}}`)
+
+	cfg, err := conf.Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	metrics := NewMetrics()
+	health := NewHealth(cfg)
+	esCli := NewESCli(cfg, metrics.ForOutput(dictionary.OutputES), &logger)
+	outputs := map[string]Output{dictionary.OutputES: esCli}
+	watcher := NewWatcher(cfg, outputs, metrics, health, NewTap(metrics, &logger), &logger)
+	reloader := NewReloader(path, cfg, outputs, watcher, metrics, health, &logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writeReloaderConfig(t, path, `{"storage":{"hosts":["`+es.URL+`"],"api_prefix":"/","workers":2,"workers_typo":1}}`)
+
+	if err := reloader.Reload(ctx); err == nil {
+		t.Fatal("Reload() with unknown key error = nil")
+	}
+
+	writeReloaderConfig(t, path, `{"storage":{"hosts":["`+es.URL+`"],"api_prefix":"/","workers":2,"balancer":"random"}}`)
+
+	if err := reloader.Reload(ctx); err == nil {
+		t.Fatal("Reload() with invalid balancer error = nil")
+	}
+
+	if watcher.queues[0].getOutput() != esCli {
+		t.Fatal("es client replaced by invalid config")
+	}
+
+	writeReloaderConfig(
+		t,
+		path,
+		`{"logs_path":["/tmp"],"storage":{"hosts":["`+es.URL+`"],"api_prefix":"/","workers":5,`+
+			`"index_name":"reloaded","flush_interval":250}}`,
+	)
+
+	if err := reloader.Reload(ctx); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	if watcher.queues[0].getOutput() == esCli {
+		t.Fatal("es client not replaced")
+	}
+
+	if got := watcher.queues[0].getOutput().(*Cli).getIndexName(); !strings.HasPrefix(got, "reloaded-") {
+		t.Errorf("index name = %s, want reloaded-*", got)
+	}
+
+	if got := watcher.queues[0].flushInterval.Load(); got != 250 {
+		t.Errorf("flush interval = %d, want 250", got)
+	}
+
+	if reloader.cfg.Storage.Workers != 2 || len(reloader.cfg.LogsPath) != 1 || reloader.cfg.LogsPath[0] != "/var/log/pods" {
+		t.Errorf("restart required fields changed: workers %d, logs path %v", reloader.cfg.Storage.Workers, reloader.cfg.LogsPath)
+	}
+}
+
+func TestReloader_Reload_KeepsOutputs(t *testing.T) {
+	t.Parallel()
+
+	es := newFakeES(t)
+	logger := zerolog.Nop()
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	config := func(indexName string, sample, flushInterval int) string {
+		return `{"outputs":[` +
+			`{"name":"es","storage":{"hosts":["` + es.URL + `"],"api_prefix":"/","index_name":"` + indexName + `"}},` +
+			`{"name":"debug","type":"stdout","flush_interval":` + strconv.Itoa(flushInterval) +
+			`,"routes":[{"namespace":"default"}],"stdout":{"sample":` + strconv.Itoa(sample) + `}}]}`
+	}
+
+	writeReloaderConfig(t, path, config("logs", 1, 1000))
+
+	cfg, err := conf.Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	metrics := NewMetrics()
+	health := NewHealth(cfg)
+
+	outputs, err := NewOutputs(cfg, metrics, &logger)
+	if err != nil {
+		t.Fatalf("NewOutputs() error = %v", err)
+	}
+
+	watcher := NewWatcher(cfg, outputs, metrics, health, NewTap(metrics, &logger), &logger)
+	reloader := NewReloader(path, cfg, outputs, watcher, metrics, health, &logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// only queue settings of stdout change, the es section of the other output isn't read by it
+	writeReloaderConfig(t, path, config("reloaded", 1, 250))
+
+	if err := reloader.Reload(ctx); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	if watcher.queues[0].getOutput() == outputs["es"] {
+		t.Error("es client with a new index name not replaced")
+	}
+
+	if watcher.queues[1].getOutput() != outputs["debug"] {
+		t.Error("stdout with unchanged settings replaced")
+	}
+
+	if got := watcher.queues[1].flushInterval.Load(); got != 250 {
+		t.Errorf("stdout flush interval = %d, want 250", got)
+	}
+
+	writeReloaderConfig(t, path, config("reloaded", 2, 250))
+
+	if err := reloader.Reload(ctx); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	if watcher.queues[1].getOutput() == outputs["debug"] {
+		t.Error("stdout with a new sample not replaced")
+	}
+}
@@ -0,0 +1,269 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"github.com/valyala/fasthttp"
+)
+
+type Retention struct {
+	cfg    conf.Config
+	esCli  *Cli
+	holder string
+	logger *zerolog.Logger
+}
+
+func NewRetention(cfg conf.Config, esCli *Cli, logger *zerolog.Logger) *Retention {
+	holder, err := os.Hostname()
+	if err != nil {
+		holder = strconv.Itoa(os.Getpid())
+	}
+
+	return &Retention{
+		cfg:    cfg,
+		esCli:  esCli,
+		holder: holder,
+		logger: logger,
+	}
+}
+
+// Start applies retention policies on every interval until ctx is done, errors are logged and retried later.
+func (s *Retention) Start(ctx context.Context) {
+	s.logger.Debug().Msg("start retention job")
+
+	defer s.logger.Debug().Msg("stop retention job")
+
+	interval := time.Duration(s.cfg.Storage.Retention.Interval) * time.Millisecond
+
+	for {
+		if err := s.Run(time.Now()); err != nil {
+			s.logger.Err(err).Msg("apply retention policies")
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Retention) Run(now time.Time) error {
+	if s.cfg.Storage.Retention.LeaderElection {
+		leader, err := s.acquireLease(now)
+		if err != nil {
+			return err
+		}
+
+		if !leader {
+			s.logger.Debug().Str("holder", s.holder).Msg("retention lease is held by another instance")
+
+			return nil
+		}
+	}
+
+	for _, policy := range s.cfg.Storage.Retention.Policies {
+		if err := s.apply(policy, now); err != nil {
+			s.logger.Err(err).Str("pattern", policy.Pattern).Msg("apply retention policy")
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Retention) apply(policy conf.RetentionPolicy, now time.Time) error {
+	if policy.Pattern == "" || policy.MaxAgeDays < 1 {
+		return fmt.Errorf(
+			"%w: pattern %q, max age days %d",
+			dictionary.ErrInvalidRetentionPolicy,
+			policy.Pattern,
+			policy.MaxAgeDays,
+		)
+	}
+
+	if policy.GetAction() != dictionary.RetentionActionDelete && policy.GetAction() != dictionary.RetentionActionClose {
+		return fmt.Errorf("%w: unknown action %q", dictionary.ErrInvalidRetentionPolicy, policy.GetAction())
+	}
+
+	indices, err := s.listIndices(policy.Pattern)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range expiredIndices(indices, policy, now) {
+		if policy.GetAction() == dictionary.RetentionActionClose && index.Status == "close" {
+			continue
+		}
+
+		event := s.logger.Info().
+			Str("index", index.Index).
+			Str("action", policy.GetAction()).
+			Int("max age days", policy.MaxAgeDays)
+
+		if s.cfg.Storage.Retention.DryRun {
+			event.Msg("dry run, index retention action skipped")
+
+			continue
+		}
+
+		if err := s.applyAction(policy.GetAction(), index.Index); err != nil {
+			return err
+		}
+
+		event.Msg("index retention action applied")
+	}
+
+	return nil
+}
+
+func (s *Retention) listIndices(pattern string) (entity.CatIndices, error) {
+	status, body, err := s.esCli.request(
+		fasthttp.MethodGet,
+		"_cat/indices/"+pattern+"-*?format=json&h=index,status&expand_wildcards=open,closed",
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%w: list indices %s: %d", dictionary.ErrBadStatusCode, pattern, status)
+	}
+
+	indices := entity.CatIndices{}
+
+	if err := easyjson.Unmarshal(body, &indices); err != nil {
+		return nil, err
+	}
+
+	return indices, nil
+}
+
+func (s *Retention) applyAction(action, index string) error {
+	method, path := fasthttp.MethodDelete, index
+
+	if action == dictionary.RetentionActionClose {
+		method, path = fasthttp.MethodPost, index+"/_close"
+	}
+
+	status, body, err := s.esCli.request(method, path, nil)
+	if err != nil {
+		return err
+	}
+
+	if status != http.StatusOK {
+		return fmt.Errorf("%w: %s %s: %d %s", dictionary.ErrBadStatusCode, action, index, status, body)
+	}
+
+	return nil
+}
+
+// acquireLease takes or renews the lease document with optimistic concurrency control,
+// so only one instance applies policies at a time.
+func (s *Retention) acquireLease(now time.Time) (bool, error) {
+	lease := &entity.Lease{
+		Holder:    s.holder,
+		ExpiresAt: now.Add(2 * time.Duration(s.cfg.Storage.Retention.Interval) * time.Millisecond),
+	}
+
+	body, err := easyjson.Marshal(lease)
+	if err != nil {
+		return false, err
+	}
+
+	docPath := s.cfg.Storage.Retention.LockIndex + "/_doc/" + dictionary.RetentionLeaseID
+
+	status, _, err := s.esCli.request(fasthttp.MethodPut, docPath+"?op_type=create&refresh=true", body)
+	if err != nil {
+		return false, err
+	}
+
+	switch status {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+	default:
+		return false, fmt.Errorf("%w: create lease: %d", dictionary.ErrBadStatusCode, status)
+	}
+
+	status, respBody, err := s.esCli.request(fasthttp.MethodGet, docPath, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if status != http.StatusOK {
+		return false, fmt.Errorf("%w: get lease: %d", dictionary.ErrBadStatusCode, status)
+	}
+
+	current := &entity.LeaseResponse{}
+
+	if err := easyjson.Unmarshal(respBody, current); err != nil {
+		return false, err
+	}
+
+	if current.Source != nil && current.Source.Holder != s.holder && current.Source.ExpiresAt.After(now) {
+		return false, nil
+	}
+
+	status, _, err = s.esCli.request(
+		fasthttp.MethodPut,
+		docPath+"?refresh=true&if_seq_no="+strconv.FormatInt(current.SeqNo, 10)+
+			"&if_primary_term="+strconv.FormatInt(current.PrimaryTerm, 10),
+		body,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	switch status {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("%w: renew lease: %d", dictionary.ErrBadStatusCode, status)
+}
+
+// expiredIndices returns indices named exactly <pattern>-YYYY.MM.DD with the date older than policy max age.
+func expiredIndices(indices entity.CatIndices, policy conf.RetentionPolicy, now time.Time) entity.CatIndices {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	cutoff := today.AddDate(0, 0, -policy.MaxAgeDays)
+
+	expired := entity.CatIndices{}
+
+	for _, index := range indices {
+		suffix, ok := strings.CutPrefix(index.Index, policy.Pattern+"-")
+		if !ok || len(suffix) != len(dictionary.IndexDateLayout) {
+			continue
+		}
+
+		date, err := time.ParseInLocation(dictionary.IndexDateLayout, suffix, now.Location())
+		if err != nil {
+			continue
+		}
+
+		if date.Before(cutoff) {
+			expired = append(expired, index)
+		}
+	}
+
+	return expired
+}
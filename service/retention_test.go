@@ -0,0 +1,317 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+func Test_expiredIndices(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 3, 10, 15, 0, 0, 0, time.UTC)
+
+	indices := entity.CatIndices{
+		{Index: "logfowd-2024.03.10"},
+		{Index: "logfowd-2024.03.03"},
+		{Index: "logfowd-2024.03.02"},
+		{Index: "logfowd-2023.12.31", Status: "close"},
+		{Index: "logfowd-lock"},
+		{Index: "logfowd-audit-2024.01.01"},
+		{Index: "logfowd-2024.01.01-restored"},
+		{Index: "logfowdx-2024.01.01"},
+		{Index: "other-2024.01.01"},
+	}
+
+	got := expiredIndices(indices, conf.RetentionPolicy{Pattern: "logfowd", MaxAgeDays: 7}, now)
+
+	want := entity.CatIndices{
+		{Index: "logfowd-2024.03.02"},
+		{Index: "logfowd-2023.12.31", Status: "close"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expiredIndices() = %v, want %v", got, want)
+	}
+}
+
+// fakeRetentionES serves _cat/indices from indices, records delete and close requests and keeps the lease
+// document with seq_no based optimistic concurrency control like es does.
+type fakeRetentionES struct {
+	*httptest.Server
+	mx      sync.Mutex
+	indices entity.CatIndices
+	actions []string
+	lease   *entity.Lease
+	seqNo   int64
+	// raceOnGet changes the lease after it is read, like a concurrent renew by another instance
+	raceOnGet bool
+}
+
+func newFakeRetentionES(t *testing.T) *fakeRetentionES {
+	t.Helper()
+
+	es := &fakeRetentionES{}
+
+	es.Server = httptest.NewServer(http.HandlerFunc(es.serve))
+
+	t.Cleanup(es.Close)
+
+	return es
+}
+
+func (es *fakeRetentionES) serve(w http.ResponseWriter, r *http.Request) {
+	es.mx.Lock()
+	defer es.mx.Unlock()
+
+	query := r.URL.Query()
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/_cat/indices/"):
+		body, _ := easyjson.Marshal(es.indices)
+
+		_, _ = w.Write(body)
+	case r.URL.Path == "/logfowd-lock/_doc/"+dictionary.RetentionLeaseID:
+		es.serveLease(w, r, query)
+	case r.Method == http.MethodDelete:
+		es.actions = append(es.actions, "delete "+strings.TrimPrefix(r.URL.Path, "/"))
+
+		_, _ = w.Write([]byte(`{"acknowledged":true}`))
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/_close"):
+		es.actions = append(es.actions, "close "+strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/_close"))
+
+		_, _ = w.Write([]byte(`{"acknowledged":true}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (es *fakeRetentionES) serveLease(w http.ResponseWriter, r *http.Request, query url.Values) {
+	switch r.Method {
+	case http.MethodGet:
+		if es.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		body, _ := easyjson.Marshal(&entity.LeaseResponse{Found: true, SeqNo: es.seqNo, PrimaryTerm: 1, Source: es.lease})
+
+		_, _ = w.Write(body)
+
+		if es.raceOnGet {
+			es.seqNo++
+		}
+	case http.MethodPut:
+		lease := &entity.Lease{}
+		body, _ := io.ReadAll(r.Body)
+		_ = easyjson.Unmarshal(body, lease)
+
+		switch {
+		case query.Get("op_type") == "create" && es.lease != nil:
+			w.WriteHeader(http.StatusConflict)
+		case query.Has("if_seq_no") && query.Get("if_seq_no") != strconv.FormatInt(es.seqNo, 10):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			es.lease = lease
+			es.seqNo++
+
+			w.WriteHeader(http.StatusCreated)
+		}
+	}
+}
+
+func newRetentionTestCli(es *fakeRetentionES, retention conf.Retention, holder string) *Retention {
+	logger := zerolog.Nop()
+
+	cfg := conf.Config{
+		Storage: conf.Storage{
+			Hosts:     []string{es.URL},
+			IndexName: "logfowd",
+			APIPrefix: "/",
+			Retention: retention,
+		},
+	}
+
+	s := NewRetention(cfg, NewESCli(cfg, NewMetrics().ForOutput("test"), &logger), &logger)
+	s.holder = holder
+
+	return s
+}
+
+func TestRetention_Run(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 3, 10, 15, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		dryRun bool
+		action string
+		want   []string
+	}{
+		{
+			name:   "delete",
+			action: dictionary.RetentionActionDelete,
+			want:   []string{"delete logfowd-2024.03.02", "delete logfowd-2023.12.31"},
+		},
+		{
+			name:   "close skips closed indices",
+			action: dictionary.RetentionActionClose,
+			want:   []string{"close logfowd-2024.03.02"},
+		},
+		{
+			name:   "dry run",
+			dryRun: true,
+			action: dictionary.RetentionActionDelete,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			es := newFakeRetentionES(t)
+
+			es.indices = entity.CatIndices{
+				{Index: "logfowd-2024.03.10", Status: "open"},
+				{Index: "logfowd-2024.03.02", Status: "open"},
+				{Index: "logfowd-2023.12.31", Status: "close"},
+			}
+
+			s := newRetentionTestCli(es, conf.Retention{
+				Interval:  3600000,
+				DryRun:    tt.dryRun,
+				LockIndex: "logfowd-lock",
+				Policies:  []conf.RetentionPolicy{{Pattern: "logfowd", MaxAgeDays: 7, Action: tt.action}},
+			}, "node-1")
+
+			if err := s.Run(now); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			es.mx.Lock()
+			defer es.mx.Unlock()
+
+			if !reflect.DeepEqual(es.actions, tt.want) {
+				t.Errorf("actions = %v, want %v", es.actions, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetention_acquireLease(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 3, 10, 15, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		lease      *entity.Lease
+		raceOnGet  bool
+		wantLeader bool
+		wantHolder string
+	}{
+		{name: "no lease", wantLeader: true, wantHolder: "node-1"},
+		{
+			name:       "held by another instance",
+			lease:      &entity.Lease{Holder: "node-2", ExpiresAt: now.Add(time.Minute)},
+			wantLeader: false,
+			wantHolder: "node-2",
+		},
+		{
+			name:       "expired lease of another instance",
+			lease:      &entity.Lease{Holder: "node-2", ExpiresAt: now.Add(-time.Minute)},
+			wantLeader: true,
+			wantHolder: "node-1",
+		},
+		{
+			name:       "own lease is renewed",
+			lease:      &entity.Lease{Holder: "node-1", ExpiresAt: now.Add(time.Minute)},
+			wantLeader: true,
+			wantHolder: "node-1",
+		},
+		{
+			name:       "renewed concurrently",
+			lease:      &entity.Lease{Holder: "node-2", ExpiresAt: now.Add(-time.Minute)},
+			raceOnGet:  true,
+			wantLeader: false,
+			wantHolder: "node-2",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			es := newFakeRetentionES(t)
+
+			es.lease = tt.lease
+			es.raceOnGet = tt.raceOnGet
+
+			s := newRetentionTestCli(es, conf.Retention{Interval: 60000, LockIndex: "logfowd-lock"}, "node-1")
+
+			leader, err := s.acquireLease(now)
+			if err != nil {
+				t.Fatalf("acquireLease() error = %v", err)
+			}
+
+			es.mx.Lock()
+			defer es.mx.Unlock()
+
+			if leader != tt.wantLeader || es.lease.Holder != tt.wantHolder {
+				t.Errorf("leader = %v with holder %s, want %v with %s", leader, es.lease.Holder, tt.wantLeader, tt.wantHolder)
+			}
+
+			if leader && !es.lease.ExpiresAt.Equal(now.Add(2*time.Minute)) {
+				t.Errorf("lease expires at %s, want two intervals later", es.lease.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestRetention_Run_SingleLeader(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 3, 10, 15, 0, 0, 0, time.UTC)
+	es := newFakeRetentionES(t)
+
+	es.indices = entity.CatIndices{{Index: "logfowd-2024.03.02", Status: "open"}}
+
+	retention := conf.Retention{
+		Interval:       60000,
+		LeaderElection: true,
+		LockIndex:      "logfowd-lock",
+		Policies:       []conf.RetentionPolicy{{Pattern: "logfowd", MaxAgeDays: 7}},
+	}
+
+	for _, holder := range []string{"node-1", "node-2", "node-3"} {
+		if err := newRetentionTestCli(es, retention, holder).Run(now); err != nil {
+			t.Fatalf("Run() of %s error = %v", holder, err)
+		}
+	}
+
+	es.mx.Lock()
+	defer es.mx.Unlock()
+
+	if want := []string{"delete logfowd-2024.03.02"}; !reflect.DeepEqual(es.actions, want) || es.lease.Holder != "node-1" {
+		t.Errorf("actions = %v with holder %s, want %v by node-1", es.actions, es.lease.Holder, want)
+	}
+}
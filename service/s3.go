@@ -0,0 +1,530 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/mailru/easyjson"
+	"github.com/rs/zerolog"
+	uuid "github.com/satori/go.uuid"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"github.com/valyala/fasthttp"
+)
+
+// S3 archives events to s3 compatible storage. Documents are compressed into a buffer per object key, buffers
+// over part_size are uploaded as parts of a multipart upload, so memory stays bounded for large objects.
+// Buffers failed to be uploaded are kept as pending and retried every S3CheckInterval.
+type S3 struct {
+	cfg      conf.S3
+	endpoint *url.URL
+	signer   *s3Signer
+	node     string
+	mx       sync.Mutex
+	buffers  map[string]*s3Buffer
+	pending  []*s3Buffer
+	httpCli  *fasthttp.Client
+	stop     *outputStop
+	metrics  *OutputMetrics
+	logger   *zerolog.Logger
+}
+
+type s3Buffer struct {
+	key      string
+	buf      bytes.Buffer
+	writer   io.WriteCloser
+	closed   bool
+	size     int64
+	events   int
+	created  time.Time
+	uploadID string
+	parts    []entity.S3CompletedPart
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func NewS3(cfg conf.S3, metrics *OutputMetrics, logger *zerolog.Logger) (*S3, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	accessKey, secretKey := cfg.AccessKey, cfg.SecretKey
+	if accessKey == "" {
+		accessKey, secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	return &S3{
+		cfg:      cfg,
+		endpoint: endpoint,
+		signer:   &s3Signer{accessKey: accessKey, secretKey: secretKey, region: cfg.Region},
+		node:     nodeName(cfg.Node),
+		buffers:  make(map[string]*s3Buffer),
+		httpCli:  &fasthttp.Client{},
+		stop:     newOutputStop(),
+		metrics:  metrics,
+		logger:   logger,
+	}, nil
+}
+
+// nodeName returns the configured node or the one from S3NodeEnv, the hostname when both are empty.
+func nodeName(node string) string {
+	if node == "" {
+		node = os.Getenv(dictionary.S3NodeEnv)
+	}
+
+	if node == "" {
+		node, _ = os.Hostname()
+	}
+
+	return node
+}
+
+// Start uploads pending buffers and buffers older than buffer_interval every S3CheckInterval until ctx is done.
+// Once ctx is done requests are no longer retried.
+func (s *S3) Start(ctx context.Context) error {
+	ticker := time.NewTicker(dictionary.S3CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.stop.stop()
+
+			return nil
+		case <-ticker.C:
+			s.flushExpired(time.Now())
+		}
+	}
+}
+
+func (s *S3) Health() error {
+	return nil
+}
+
+// Probe requests the bucket, it fails on unreachable endpoints, missing buckets and invalid keys.
+func (s *S3) Probe() error {
+	_, err := s.request(http.MethodHead, "", nil, nil)
+
+	return err
+}
+
+// Close uploads pending and all other buffers, events of buffers failed to be uploaded are dropped.
+func (s *S3) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for prefix, buffer := range s.buffers {
+		delete(s.buffers, prefix)
+
+		s.pending = append(s.pending, buffer)
+	}
+
+	var errs []error
+
+	for _, buffer := range s.pending {
+		if err := s.upload(buffer); err != nil {
+			s.drop(buffer, err)
+
+			errs = append(errs, err)
+		}
+	}
+
+	s.pending = nil
+
+	s.httpCli.CloseIdleConnections()
+
+	return errors.Join(errs...)
+}
+
+func (s *S3) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// SendEvents appends documents to buffers of their keys, uploads parts of buffers over part_size and objects
+// of buffers over buffer_size. A failed part stays in its buffer and is uploaded with the next one, a failed
+// object is kept as pending, so events are dropped only over max_pending_size.
+func (s *S3) SendEvents(events []*entity.Event) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := time.Now()
+	written := make(map[string]*s3Buffer)
+
+	var errs []error
+
+	for _, event := range events {
+		prefix := s.prefix(event)
+
+		buffer, err := s.write(prefix, event, now)
+		if err != nil {
+			s.metrics.DroppedEvents.Inc()
+
+			errs = append(errs, err)
+
+			continue
+		}
+
+		written[prefix] = buffer
+	}
+
+	for prefix, buffer := range written {
+		switch {
+		case buffer.size+int64(buffer.buf.Len()) >= s.cfg.BufferSize:
+			delete(s.buffers, prefix)
+
+			errs = append(errs, s.complete(buffer))
+		case int64(buffer.buf.Len()) >= s.cfg.PartSize:
+			if err := s.uploadPart(buffer); err != nil {
+				s.logger.Warn().Err(err).Str("key", buffer.key).Msg("upload s3 part, keeping it buffered")
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// write appends the document of the event to the buffer of the prefix.
+func (s *S3) write(prefix string, event *entity.Event, now time.Time) (*s3Buffer, error) {
+	data, err := easyjson.Marshal(entity.NewFieldsBody(event))
+	if err != nil {
+		return nil, err
+	}
+
+	buffer, err := s.buffer(prefix, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := buffer.writer.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+
+	buffer.events++
+
+	return buffer, nil
+}
+
+// prefix expands the key template for the event.
+func (s *S3) prefix(event *entity.Event) string {
+	return strings.NewReplacer(
+		dictionary.TemplateDate, event.Time.UTC().Format(fileArchiveDay),
+		dictionary.TemplateNode, s.node,
+	).Replace(expandTemplate(s.cfg.Key, event.Meta))
+}
+
+// buffer returns the buffer of the prefix or creates one with a unique object key under it.
+func (s *S3) buffer(prefix string, now time.Time) (*s3Buffer, error) {
+	if buffer, ok := s.buffers[prefix]; ok {
+		return buffer, nil
+	}
+
+	name := now.UTC().Format(dictionary.S3DateFormat) + "-" + uuid.NewV4().String() + dictionary.FileArchiveExt
+
+	buffer := &s3Buffer{key: strings.Trim(prefix+"/"+name, "/"), created: now}
+
+	switch s.cfg.Compression {
+	case dictionary.CompressionGzip:
+		buffer.key += ".gz"
+		buffer.writer = gzip.NewWriter(&buffer.buf)
+	case dictionary.CompressionZstd:
+		writer, err := zstd.NewWriter(&buffer.buf)
+		if err != nil {
+			return nil, err
+		}
+
+		buffer.key += ".zst"
+		buffer.writer = writer
+	default:
+		buffer.writer = nopWriteCloser{&buffer.buf}
+	}
+
+	s.buffers[prefix] = buffer
+
+	return buffer, nil
+}
+
+// flushExpired uploads pending buffers, then buffers created buffer_interval ago.
+func (s *S3) flushExpired(now time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.retryPending()
+
+	for prefix, buffer := range s.buffers {
+		if now.Sub(buffer.created) < time.Duration(s.cfg.BufferInterval)*time.Millisecond {
+			continue
+		}
+
+		delete(s.buffers, prefix)
+
+		_ = s.complete(buffer)
+	}
+}
+
+// complete uploads the buffer, a buffer failed to be uploaded is kept as pending. It returns an error
+// when pending buffers over max_pending_size are dropped.
+func (s *S3) complete(buffer *s3Buffer) error {
+	err := s.upload(buffer)
+	if err == nil {
+		return nil
+	}
+
+	s.logger.Warn().Err(err).Str("key", buffer.key).Int("num", buffer.events).Msg("upload to s3, keeping it to retry")
+
+	s.pending = append(s.pending, buffer)
+
+	return s.limitPending()
+}
+
+// retryPending uploads pending buffers oldest first, it stops at the first failure.
+func (s *S3) retryPending() {
+	for len(s.pending) > 0 {
+		if err := s.upload(s.pending[0]); err != nil {
+			s.logger.Warn().Err(err).Str("key", s.pending[0].key).Int("pending", len(s.pending)).Msg("retry s3 upload")
+
+			return
+		}
+
+		s.pending = s.pending[1:]
+	}
+}
+
+// limitPending drops the oldest pending buffers while they hold more than max_pending_size bytes.
+func (s *S3) limitPending() error {
+	var size int64
+
+	for _, buffer := range s.pending {
+		size += int64(buffer.buf.Len())
+	}
+
+	var errs []error
+
+	for size > s.cfg.MaxPendingSize && len(s.pending) > 0 {
+		buffer := s.pending[0]
+
+		s.pending = s.pending[1:]
+		size -= int64(buffer.buf.Len())
+
+		err := fmt.Errorf("%w: %s over max pending size", dictionary.ErrS3Upload, buffer.key)
+
+		s.drop(buffer, err)
+
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// upload closes the compressed stream and uploads the buffer as an object, or as the last part
+// when parts are uploaded already.
+func (s *S3) upload(buffer *s3Buffer) error {
+	start := time.Now()
+
+	err := s.uploadBuffer(buffer)
+
+	s.metrics.BulkDuration.Observe(time.Since(start).Seconds())
+
+	if err == nil {
+		s.metrics.BatchesSent.WithLabelValues("success").Inc()
+	}
+
+	return err
+}
+
+func (s *S3) uploadBuffer(buffer *s3Buffer) error {
+	if !buffer.closed {
+		if err := buffer.writer.Close(); err != nil {
+			return err
+		}
+
+		buffer.closed = true
+	}
+
+	if buffer.uploadID == "" {
+		return s.putObject(buffer.key, buffer.buf.Bytes())
+	}
+
+	if buffer.buf.Len() > 0 {
+		if err := s.uploadPart(buffer); err != nil {
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(&entity.S3CompleteMultipartUpload{Parts: buffer.parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.request(fasthttp.MethodPost, buffer.key, url.Values{"uploadId": {buffer.uploadID}}, body)
+	if err != nil {
+		return err
+	}
+
+	// completion may fail after the 200 status is sent
+	s3Err := &entity.S3Error{}
+	if xml.Unmarshal(resp.body, s3Err) == nil {
+		return fmt.Errorf("%w: %s %s", dictionary.ErrS3Upload, s3Err.Code, s3Err.Message)
+	}
+
+	return nil
+}
+
+// putObject uploads data as a single object.
+func (s *S3) putObject(key string, data []byte) error {
+	_, err := s.request(fasthttp.MethodPut, key, nil, data)
+
+	return err
+}
+
+// uploadPart starts the multipart upload of the buffer if needed and uploads its data as the next part.
+func (s *S3) uploadPart(buffer *s3Buffer) error {
+	if buffer.uploadID == "" {
+		resp, err := s.request(fasthttp.MethodPost, buffer.key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+
+		result := &entity.S3InitiateMultipartUploadResult{}
+		if err := xml.Unmarshal(resp.body, result); err != nil {
+			return err
+		}
+
+		buffer.uploadID = result.UploadID
+	}
+
+	number := len(buffer.parts) + 1
+
+	resp, err := s.request(fasthttp.MethodPut, buffer.key, url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {buffer.uploadID},
+	}, buffer.buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	buffer.parts = append(buffer.parts, entity.S3CompletedPart{PartNumber: number, ETag: resp.etag})
+	buffer.size += int64(buffer.buf.Len())
+	buffer.buf.Reset()
+
+	return nil
+}
+
+// drop aborts the multipart upload of the buffer and counts its events as dropped.
+func (s *S3) drop(buffer *s3Buffer, err error) {
+	s.logger.Err(err).Str("key", buffer.key).Int("num", buffer.events).Msg("upload to s3")
+
+	s.metrics.BatchesSent.WithLabelValues("error").Inc()
+	s.metrics.DroppedEvents.Add(float64(buffer.events))
+
+	if buffer.uploadID == "" {
+		return
+	}
+
+	if _, err := s.request(fasthttp.MethodDelete, buffer.key, url.Values{"uploadId": {buffer.uploadID}}, nil); err != nil {
+		s.logger.Err(err).Str("key", buffer.key).Msg("abort s3 multipart upload")
+	}
+}
+
+type s3Response struct {
+	etag string
+	body []byte
+}
+
+// request sends a signed request to the object, network errors, 429 and 5xx responses are retried
+// with the exponential backoff starting at retry_delay.
+func (s *S3) request(method, key string, query url.Values, body []byte) (*s3Response, error) {
+	host, path := s.endpoint.Host, "/"+s.cfg.Bucket+"/"+key
+	if !s.cfg.PathStyle {
+		host, path = s.cfg.Bucket+"."+s.endpoint.Host, "/"+key
+	}
+
+	uri := s.endpoint.Scheme + "://" + host + s3EscapePath(path)
+	if len(query) > 0 {
+		uri += "?" + s3CanonicalQuery(query)
+	}
+
+	payloadHash := sha256Hex(body)
+
+	for attempt := 0; ; attempt++ {
+		now := time.Now()
+
+		headers := map[string]string{
+			"host":                 host,
+			"x-amz-content-sha256": payloadHash,
+			"x-amz-date":           now.UTC().Format(dictionary.S3DateFormat),
+		}
+
+		resp, status, err := s.do(method, uri, headers, s.signer.authorization(method, path, query, headers, payloadHash, now), body)
+
+		retriable := err != nil || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+
+		if err == nil && status >= http.StatusMultipleChoices {
+			err = fmt.Errorf("%w: %d %s", dictionary.ErrBadStatusCode, status, resp.body)
+		}
+
+		if err == nil || !retriable || attempt >= s.cfg.MaxRetries {
+			return resp, err
+		}
+
+		s.metrics.Retries.Inc()
+
+		delay := min(time.Duration(s.cfg.RetryDelay)*time.Millisecond<<attempt, dictionary.S3MaxRetryDelay)
+
+		s.logger.Warn().Err(err).Str("key", key).Int("attempt", attempt+1).Dur("delay", delay).Msg("s3 request, retrying")
+
+		if !s.stop.wait(delay) {
+			return resp, err
+		}
+	}
+}
+
+func (s *S3) do(method, uri string, headers map[string]string, authorization string, body []byte) (*s3Response, int, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.URI().DisablePathNormalizing = true
+	req.SetRequestURI(uri)
+	req.Header.SetMethod(method)
+
+	for name, value := range headers {
+		if name != "host" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	req.Header.Set("Authorization", authorization)
+	req.SetBody(body)
+
+	if err := s.httpCli.DoTimeout(req, resp, dictionary.RequestTimeout); err != nil {
+		return nil, 0, err
+	}
+
+	return &s3Response{
+		etag: string(resp.Header.Peek("ETag")),
+		body: append([]byte(nil), resp.Body()...),
+	}, resp.StatusCode(), nil
+}
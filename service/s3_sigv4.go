@@ -0,0 +1,134 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+// s3Signer signs requests with aws signature version 4, the payload hash is sent as x-amz-content-sha256.
+type s3Signer struct {
+	accessKey string
+	secretKey string
+	region    string
+}
+
+// authorization returns the Authorization header of the request, headers are lowercase names with values
+// that are signed, they must include host, x-amz-date and x-amz-content-sha256.
+func (s *s3Signer) authorization(
+	method, path string,
+	query url.Values,
+	headers map[string]string,
+	payloadHash string,
+	now time.Time,
+) string {
+	names := make([]string, 0, len(headers))
+
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		s3EscapePath(path),
+		s3CanonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := now.UTC().Format(dictionary.S3ScopeFormat) + "/" + s.region + "/" + dictionary.S3Service + "/aws4_request"
+
+	stringToSign := strings.Join([]string{
+		dictionary.S3Algorithm,
+		now.UTC().Format(dictionary.S3DateFormat),
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.UTC().Format(dictionary.S3ScopeFormat))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, dictionary.S3Service)
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return dictionary.S3Algorithm + " Credential=" + s.accessKey + "/" + scope +
+		", SignedHeaders=" + signedHeaders + ", Signature=" + signature
+}
+
+// s3CanonicalQuery sorts params by name and escapes names and values, params without a value keep the =.
+func s3CanonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name)+"="+s3Escape(value))
+		}
+	}
+
+	sort.Strings(params)
+
+	return strings.Join(params, "&")
+}
+
+// s3EscapePath escapes every segment of the path.
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// s3Escape escapes everything but unreserved characters of rfc 3986.
+func s3Escape(value string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+
+			continue
+		}
+
+		b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+	}
+
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
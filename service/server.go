@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+// Server serves admin endpoints: metrics, health probes, tracked files and live tap.
+type Server struct {
+	cfg     conf.Config
+	metrics *Metrics
+	health  *Health
+	watcher *Watcher
+	tap     *Tap
+	logger  *zerolog.Logger
+}
+
+func NewServer(
+	cfg conf.Config,
+	metrics *Metrics,
+	health *Health,
+	watcher *Watcher,
+	tap *Tap,
+	logger *zerolog.Logger,
+) *Server {
+	return &Server{
+		cfg:     cfg,
+		metrics: metrics,
+		health:  health,
+		watcher: watcher,
+		tap:     tap,
+		logger:  logger,
+	}
+}
+
+func (s *Server) Start(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              s.cfg.Admin.Listen,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: dictionary.RequestTimeout,
+		// streaming handlers stop on shutdown
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), dictionary.ShutDownDuration)
+		defer cancel()
+
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			s.logger.Err(err).Msg("shutdown admin server")
+		}
+	}()
+
+	s.logger.Info().Str("listen", s.cfg.Admin.Listen).Msg("start admin server")
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Err(err).Msg("admin server")
+
+		return err
+	}
+
+	return nil
+}
+
+// handler routes admin endpoints, /tap is served only when enabled.
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", promhttp.HandlerFor(s.metrics.Registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		s.writeProbe(w, s.health.Live(time.Now()))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		s.writeProbe(w, s.health.Ready())
+	})
+	mux.HandleFunc("/files", s.authorized(s.files))
+
+	if s.cfg.Admin.Tap {
+		mux.HandleFunc("/tap", s.authorized(s.tapEvents))
+	}
+
+	return mux
+}
+
+// authorized requires the admin token as a bearer token when it is set, endpoints exposing pods and their log
+// lines are wrapped with it.
+func (s *Server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	if s.cfg.Admin.Token == "" {
+		return handler
+	}
+
+	want := []byte("Bearer " + s.cfg.Admin.Token)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func (s *Server) files(w http.ResponseWriter, r *http.Request) {
+	statuses := s.watcher.Files(r.URL.Query().Get("namespace"), r.URL.Query().Get("pod"))
+
+	marshalled, err := easyjson.Marshal(statuses)
+	if err != nil {
+		s.logger.Err(err).Msg("marshal files")
+
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, _ = w.Write(marshalled)
+}
+
+// tapEvents streams processed documents as chunked ndjson until the client disconnects.
+func (s *Server) tapEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	query := r.URL.Query()
+
+	subscriber := s.tap.Subscribe(TapFilter{
+		Namespace: query.Get("namespace"),
+		Pod:       query.Get("pod"),
+		Container: query.Get("container"),
+	})
+	defer s.tap.Unsubscribe(subscriber)
+
+	s.logger.Info().Str("query", r.URL.RawQuery).Msg("tap started")
+
+	defer s.logger.Info().Str("query", r.URL.RawQuery).Msg("tap stopped")
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case event := <-subscriber.Events():
+			if _, err := w.Write(append(event, '\n')); err != nil {
+				return
+			}
+
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) writeProbe(w http.ResponseWriter, err error) {
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+
+		_, _ = w.Write([]byte(err.Error()))
+
+		return
+	}
+
+	_, _ = w.Write([]byte("ok"))
+}
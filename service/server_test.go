@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+)
+
+func TestServer_handler(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		admin  conf.Admin
+		path   string
+		token  string
+		status int
+	}{
+		{name: "tap disabled by default", path: "/tap", status: http.StatusNotFound},
+		{name: "tap enabled", admin: conf.Admin{Tap: true}, path: "/tap", status: http.StatusOK},
+		{
+			name:   "tap without token",
+			admin:  conf.Admin{Tap: true, Token: "secret"},
+			path:   "/tap",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "tap with wrong token",
+			admin:  conf.Admin{Tap: true, Token: "secret"},
+			path:   "/tap",
+			token:  "other",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "tap with token",
+			admin:  conf.Admin{Tap: true, Token: "secret"},
+			path:   "/tap",
+			token:  "secret",
+			status: http.StatusOK,
+		},
+		{name: "files without token", admin: conf.Admin{Token: "secret"}, path: "/files", status: http.StatusUnauthorized},
+		{name: "metrics without token", admin: conf.Admin{Token: "secret"}, path: "/metrics", status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			metrics := NewMetrics()
+			cfg := conf.Config{Admin: tt.admin}
+
+			server := NewServer(cfg, metrics, NewHealth(cfg), nil, NewTap(metrics, &logger), &logger)
+
+			// the tap streams until the client is gone, a done context stops it after the header is written
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil).WithContext(ctx)
+
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			recorder := httptest.NewRecorder()
+
+			server.handler().ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.status {
+				t.Errorf("%s status = %d, want %d", tt.path, recorder.Code, tt.status)
+			}
+		})
+	}
+}
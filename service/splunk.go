@@ -0,0 +1,238 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/rs/zerolog"
+	uuid "github.com/satori/go.uuid"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+	"github.com/valyala/fasthttp"
+)
+
+// Splunk sends batches to the http event collector. With indexer acknowledgement the ack of every batch
+// is polled on the channel of the output and batches not acknowledged in time are resent.
+type Splunk struct {
+	cfg     conf.Splunk
+	channel string
+	httpCli *fasthttp.Client
+	stop    *outputStop
+	metrics *OutputMetrics
+	logger  *zerolog.Logger
+}
+
+func NewSplunk(cfg conf.Splunk, metrics *OutputMetrics, logger *zerolog.Logger) (*Splunk, error) {
+	tlsConfig, err := newTLSConfig(cfg.InsecureSkipVerify, cfg.CAFile, cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Splunk{
+		cfg:     cfg,
+		channel: uuid.NewV4().String(),
+		httpCli: &fasthttp.Client{TLSConfig: tlsConfig},
+		stop:    newOutputStop(),
+		metrics: metrics,
+		logger:  logger,
+	}, nil
+}
+
+// Start waits for ctx, splunk has no background jobs. Once ctx is done acks are no longer polled.
+func (s *Splunk) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	s.stop.stop()
+
+	return nil
+}
+
+func (s *Splunk) Health() error {
+	return nil
+}
+
+// Probe requests the health endpoint of the collector with the token.
+func (s *Splunk) Probe() error {
+	return probeRequest(
+		s.httpCli,
+		fasthttp.MethodGet,
+		strings.TrimRight(s.cfg.URL, "/")+dictionary.SplunkHealthPath,
+		map[string]string{"Authorization": "Splunk " + s.cfg.Token},
+		nil,
+	)
+}
+
+// Close closes idle connections to the collector.
+func (s *Splunk) Close() error {
+	s.httpCli.CloseIdleConnections()
+
+	return nil
+}
+
+func (s *Splunk) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// SendEvents sends events in one request, with ack it waits until the batch is acknowledged and resends it
+// up to SplunkRetries times when the ack timeout passes.
+func (s *Splunk) SendEvents(events []*entity.Event) error {
+	body, err := s.makeBody(events)
+	if err != nil {
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+
+		var ackID *int64
+
+		ackID, err = s.send(body)
+
+		s.metrics.BulkDuration.Observe(time.Since(start).Seconds())
+
+		if err == nil && s.cfg.Ack {
+			if ackID == nil {
+				err = dictionary.ErrSplunkNoAckID
+			} else {
+				err = s.waitAck(*ackID)
+			}
+		}
+
+		if err == nil || attempt >= dictionary.SplunkRetries || !errors.Is(err, dictionary.ErrSplunkAckTimeout) {
+			break
+		}
+
+		s.metrics.Retries.Inc()
+
+		s.logger.Warn().Err(err).Int("attempt", attempt+1).Msg("splunk batch not acknowledged, resending")
+	}
+
+	if err != nil {
+		s.logger.Err(err).Int("num", len(events)).Msg("send to splunk")
+
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
+		return err
+	}
+
+	s.metrics.BatchesSent.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+// makeBody concatenates events as the hec batch format expects.
+func (s *Splunk) makeBody(events []*entity.Event) ([]byte, error) {
+	var body []byte
+
+	for _, event := range events {
+		data, err := easyjson.Marshal(&entity.SplunkEvent{
+			Time:       entity.EpochTime(event.Time),
+			Host:       expandTemplate(s.cfg.Host, event.Meta),
+			Source:     expandTemplate(s.cfg.Source, event.Meta),
+			Sourcetype: expandTemplate(s.cfg.Sourcetype, event.Meta),
+			Index:      expandTemplate(s.cfg.Index, event.Meta),
+			Event:      event.Message,
+			Fields: map[string]string{
+				"namespace":      event.Namespace,
+				"pod_name":       event.PodName,
+				"pod_id":         event.PodID,
+				"container_name": event.ContainerName,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		body = append(body, data...)
+		body = append(body, '\n')
+	}
+
+	return body, nil
+}
+
+// send posts the batch and returns its ack id when indexer acknowledgement is enabled for the token.
+func (s *Splunk) send(body []byte) (*int64, error) {
+	respBody, err := s.request(dictionary.SplunkEventPath, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &entity.SplunkResponse{}
+
+	if err := easyjson.Unmarshal(respBody, resp); err != nil {
+		return nil, err
+	}
+
+	return resp.AckID, nil
+}
+
+// waitAck polls the ack of the batch every ack_poll_interval until it is acknowledged or ack_timeout passes.
+func (s *Splunk) waitAck(ackID int64) error {
+	body, err := easyjson.Marshal(&entity.SplunkAckRequest{Acks: []int64{ackID}})
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(time.Duration(s.cfg.AckTimeout) * time.Millisecond)
+
+	for {
+		if !s.stop.wait(time.Duration(s.cfg.AckPollInterval) * time.Millisecond) {
+			return dictionary.ErrOutputStopped
+		}
+
+		respBody, err := s.request(dictionary.SplunkAckPath, body)
+		if err != nil {
+			return err
+		}
+
+		resp := &entity.SplunkAckResponse{}
+
+		if err := easyjson.Unmarshal(respBody, resp); err != nil {
+			return err
+		}
+
+		if resp.Acks[strconv.FormatInt(ackID, 10)] {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: ack %d", dictionary.ErrSplunkAckTimeout, ackID)
+		}
+	}
+}
+
+func (s *Splunk) request(path string, body []byte) ([]byte, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetBody(body)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType("application/json")
+	req.Header.Set("Authorization", "Splunk "+s.cfg.Token)
+	req.Header.Set("X-Splunk-Request-Channel", s.channel)
+	req.SetRequestURI(strings.TrimRight(s.cfg.URL, "/") + path)
+
+	if err := s.httpCli.DoTimeout(req, resp, dictionary.RequestTimeout); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("%w: %d %s", dictionary.ErrBadStatusCode, resp.StatusCode(), resp.Body())
+	}
+
+	return append([]byte(nil), resp.Body()...), nil
+}
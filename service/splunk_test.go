@@ -0,0 +1,229 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// fakeHEC stores received events by ack id, acks are acknowledged on the second poll except lost ones.
+type fakeHEC struct {
+	*httptest.Server
+	mx     sync.Mutex
+	ack    bool
+	lost   map[int64]bool
+	polls  map[int64]int
+	events map[int64][]*entity.SplunkEvent
+}
+
+func newFakeHEC(t *testing.T, ack bool) *fakeHEC {
+	t.Helper()
+
+	hec := &fakeHEC{
+		ack:    ack,
+		lost:   make(map[int64]bool),
+		polls:  make(map[int64]int),
+		events: make(map[int64][]*entity.SplunkEvent),
+	}
+
+	hec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hec.mx.Lock()
+		defer hec.mx.Unlock()
+
+		if r.Header.Get("Authorization") != "Splunk token" || r.Header.Get("X-Splunk-Request-Channel") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+
+		switch r.URL.Path {
+		case dictionary.SplunkEventPath:
+			ackID := int64(len(hec.events))
+
+			for _, line := range bytes.Split(bytes.TrimSpace(body), []byte("\n")) {
+				event := &entity.SplunkEvent{}
+				if err := easyjson.Unmarshal(line, event); err != nil {
+					t.Errorf("unmarshal event: %v", err)
+				}
+
+				hec.events[ackID] = append(hec.events[ackID], event)
+			}
+
+			resp := &entity.SplunkResponse{Text: "Success"}
+			if hec.ack {
+				resp.AckID = &ackID
+			}
+
+			_, _ = easyjson.MarshalToWriter(resp, w)
+		case dictionary.SplunkAckPath:
+			req := &entity.SplunkAckRequest{}
+			if err := easyjson.Unmarshal(body, req); err != nil {
+				t.Errorf("unmarshal ack request: %v", err)
+			}
+
+			resp := &entity.SplunkAckResponse{Acks: make(map[string]bool)}
+
+			for _, id := range req.Acks {
+				hec.polls[id]++
+				resp.Acks[strconv.FormatInt(id, 10)] = hec.polls[id] > 1 && !hec.lost[id]
+			}
+
+			_, _ = easyjson.MarshalToWriter(resp, w)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	t.Cleanup(hec.Close)
+
+	return hec
+}
+
+func TestSplunk_SendEvents(t *testing.T) {
+	t.Parallel()
+
+	readAt := time.Date(2024, 1, 2, 3, 4, 5, 123000000, time.UTC)
+
+	events := []*entity.Event{{
+		Message: "first",
+		Time:    readAt,
+		Meta: &entity.Meta{
+			Path:          "/var/log/pods/default_api_abc/app/0.log",
+			Namespace:     "default",
+			PodName:       "api",
+			PodID:         "abc",
+			ContainerName: "app",
+		},
+	}}
+
+	tests := []struct {
+		name    string
+		ack     bool
+		lost    map[int64]bool
+		batches int
+	}{
+		{name: "without ack", batches: 1},
+		{name: "ack", ack: true, batches: 1},
+		{name: "resend lost batch", ack: true, lost: map[int64]bool{0: true}, batches: 2},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			server := newFakeHEC(t, tt.ack)
+
+			if tt.lost != nil {
+				server.lost = tt.lost
+			}
+
+			splunk, err := NewSplunk(conf.Splunk{
+				URL:             server.URL,
+				Token:           "token",
+				Source:          "{path}",
+				Sourcetype:      "kube:container:{container}",
+				Index:           "k8s-{namespace}",
+				Ack:             tt.ack,
+				AckPollInterval: 1,
+				AckTimeout:      5,
+			}, NewMetrics().ForOutput("test"), &logger)
+			if err != nil {
+				t.Fatalf("NewSplunk() error = %v", err)
+			}
+
+			if err := splunk.SendEvents(events); err != nil {
+				t.Fatalf("SendEvents() error = %v", err)
+			}
+
+			server.mx.Lock()
+			defer server.mx.Unlock()
+
+			if len(server.events) != tt.batches {
+				t.Fatalf("received %d batches, want %d", len(server.events), tt.batches)
+			}
+
+			last := int64(tt.batches - 1)
+
+			want := []*entity.SplunkEvent{{
+				Time:       entity.EpochTime(readAt),
+				Source:     "/var/log/pods/default_api_abc/app/0.log",
+				Sourcetype: "kube:container:app",
+				Index:      "k8s-default",
+				Event:      "first",
+				Fields: map[string]string{
+					"namespace":      "default",
+					"pod_name":       "api",
+					"pod_id":         "abc",
+					"container_name": "app",
+				},
+			}}
+
+			if !reflect.DeepEqual(server.events[last], want) {
+				t.Errorf("received events = %+v, want %+v", server.events[last][0], want[0])
+			}
+
+			if tt.ack && server.polls[last] != 2 {
+				t.Errorf("ack %d polled %d times, want 2", last, server.polls[last])
+			}
+		})
+	}
+}
+
+func TestEpochTime_MarshalEasyJSON(t *testing.T) {
+	t.Parallel()
+
+	data, err := easyjson.Marshal(&entity.SplunkEvent{Time: entity.EpochTime(time.UnixMilli(1704164645007))})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	if want := `{"time":1704164645.007,"event":""}`; string(data) != want {
+		t.Errorf("Marshal() = %s, want %s", data, want)
+	}
+}
+
+func TestSplunk_SendEvents_Stopped(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	server := newFakeHEC(t, true)
+
+	splunk, err := NewSplunk(conf.Splunk{
+		URL:             server.URL,
+		Token:           "token",
+		Ack:             true,
+		AckPollInterval: 60000,
+		AckTimeout:      120000,
+	}, NewMetrics().ForOutput("test"), &logger)
+	if err != nil {
+		t.Fatalf("NewSplunk() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_ = splunk.Start(ctx)
+
+	if err := splunk.SendEvents(testEvents()); !errors.Is(err, dictionary.ErrOutputStopped) {
+		t.Errorf("SendEvents() error = %v, want %v", err, dictionary.ErrOutputStopped)
+	}
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// Stdout prints the bulk bodies the es client would send, or pretty documents, instead of sending them.
+type Stdout struct {
+	cfg     conf.Config
+	esCli   *Cli
+	out     io.Writer
+	mx      sync.Mutex
+	seen    int
+	metrics *OutputMetrics
+	logger  *zerolog.Logger
+}
+
+func NewStdout(cfg conf.Config, out io.Writer, metrics *OutputMetrics, logger *zerolog.Logger) *Stdout {
+	return &Stdout{
+		cfg:     cfg,
+		esCli:   NewESCli(cfg, metrics, logger),
+		out:     out,
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+// Start waits for ctx, stdout has no background jobs.
+func (s *Stdout) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	return nil
+}
+
+func (s *Stdout) Health() error {
+	return nil
+}
+
+func (s *Stdout) Close() error {
+	return nil
+}
+
+// Capabilities reports indices, printed bulk bodies and documents carry the index the es client would write to.
+func (s *Stdout) Capabilities() Capabilities {
+	return Capabilities{Indices: true}
+}
+
+func (s *Stdout) SendEvents(events []*entity.Event) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	events = s.sample(events)
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	var err error
+
+	if s.cfg.Stdout.Format == dictionary.StdoutFormatPretty {
+		err = s.writePretty(events)
+	} else {
+		err = s.writeBulk(events)
+	}
+
+	if err != nil {
+		s.metrics.BatchesSent.WithLabelValues("error").Inc()
+		s.metrics.DroppedEvents.Add(float64(len(events)))
+
+		return err
+	}
+
+	s.metrics.BatchesSent.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+// sample keeps every sample-th event counting across batches.
+func (s *Stdout) sample(events []*entity.Event) []*entity.Event {
+	if s.cfg.Stdout.Sample <= 1 {
+		return events
+	}
+
+	sampled := make([]*entity.Event, 0, len(events)/s.cfg.Stdout.Sample+1)
+
+	for _, event := range events {
+		if s.seen%s.cfg.Stdout.Sample == 0 {
+			sampled = append(sampled, event)
+		}
+
+		s.seen++
+	}
+
+	return sampled
+}
+
+func (s *Stdout) writeBulk(events []*entity.Event) error {
+	buf, err := s.esCli.makeBody(events)
+	if err != nil {
+		s.logger.Err(err).Msg("make body")
+
+		return err
+	}
+
+	_, err = s.out.Write(buf.Bytes())
+
+	buf.Reset()
+	s.esCli.buffers.Put(buf)
+
+	return err
+}
+
+func (s *Stdout) writePretty(events []*entity.Event) error {
+	index := indexName(s.cfg.Storage, time.Now())
+
+	for _, event := range events {
+		marshalled, err := json.MarshalIndent(&entity.TapEvent{Index: index, Document: entity.NewFieldsBody(event)}, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if _, err := s.out.Write(append(marshalled, '\n')); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+func TestStdout_SendEvents(t *testing.T) {
+	t.Parallel()
+
+	events := make([]*entity.Event, 0, 5)
+
+	for i := 0; i < 5; i++ {
+		events = append(events, &entity.Event{
+			Message: "testlog" + string(rune('0'+i)),
+			Time:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Meta:    &entity.Meta{Namespace: "test", PodName: "test", PodID: "test", ContainerName: "test"},
+		})
+	}
+
+	tests := []struct {
+		name     string
+		stdout   conf.Stdout
+		lines    int
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "bulk",
+			stdout:   conf.Stdout{Format: dictionary.StdoutFormatBulk, Sample: 1},
+			lines:    10,
+			contains: []string{`{"index":{"_index":"logfowd-`, `"message":"testlog4"`},
+		},
+		{
+			name:     "sampled bulk",
+			stdout:   conf.Stdout{Format: dictionary.StdoutFormatBulk, Sample: 2},
+			lines:    6,
+			contains: []string{`"message":"testlog0"`, `"message":"testlog2"`, `"message":"testlog4"`},
+			excludes: []string{`"message":"testlog1"`, `"message":"testlog3"`},
+		},
+		{
+			name:     "pretty",
+			stdout:   conf.Stdout{Format: dictionary.StdoutFormatPretty, Sample: 5},
+			lines:    11,
+			contains: []string{`  "_index": "logfowd-`, `    "message": "testlog0"`},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			out := &bytes.Buffer{}
+
+			cfg := conf.Config{Output: dictionary.OutputStdout, Stdout: tt.stdout, Storage: conf.Storage{IndexName: "logfowd"}}
+
+			stdout := NewStdout(cfg, out, NewMetrics().ForOutput("test"), &logger)
+
+			if err := stdout.SendEvents(events); err != nil {
+				t.Fatalf("SendEvents() error = %v", err)
+			}
+
+			got := out.String()
+
+			if lines := strings.Count(got, "\n"); lines != tt.lines {
+				t.Errorf("printed %d lines, want %d:\n%s", lines, tt.lines, got)
+			}
+
+			for _, s := range tt.contains {
+				if !strings.Contains(got, s) {
+					t.Errorf("output does not contain %s:\n%s", s, got)
+				}
+			}
+
+			for _, s := range tt.excludes {
+				if strings.Contains(got, s) {
+					t.Errorf("output contains %s:\n%s", s, got)
+				}
+			}
+		})
+	}
+}
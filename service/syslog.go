@@ -0,0 +1,365 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+const syslogRFC5424Time = "2006-01-02T15:04:05.000000Z07:00"
+
+// Syslog sends events to a syslog server over udp, tcp or tcp with tls. A tcp connection closed by the server
+// is noticed before the next batch and reopened, batches failed to be written are resent over a new connection.
+type Syslog struct {
+	cfg       conf.Syslog
+	hostname  string
+	tlsConfig *tls.Config
+	mx        sync.Mutex
+	conn      net.Conn
+	metrics   *OutputMetrics
+	logger    *zerolog.Logger
+}
+
+func NewSyslog(cfg conf.Syslog, metrics *OutputMetrics, logger *zerolog.Logger) (*Syslog, error) {
+	tlsConfig, err := newTLSConfig(cfg.InsecureSkipVerify, cfg.CAFile, cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+
+	return &Syslog{
+		cfg:       cfg,
+		hostname:  hostname,
+		tlsConfig: tlsConfig,
+		metrics:   metrics,
+		logger:    logger,
+	}, nil
+}
+
+// Start waits for ctx, the connection is opened by the first batch.
+func (s *Syslog) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	return nil
+}
+
+func (s *Syslog) Health() error {
+	return nil
+}
+
+// Probe connects to the syslog server, udp addresses are only resolved.
+func (s *Syslog) Probe() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	return s.disconnect()
+}
+
+// Close closes the connection to the syslog server.
+func (s *Syslog) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.disconnect()
+}
+
+func (s *Syslog) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// SendEvents writes a message per event, tcp batches failed to be written are resent over a new connection
+// up to SyslogRetries times.
+func (s *Syslog) SendEvents(events []*entity.Event) error {
+	messages := make([][]byte, 0, len(events))
+
+	for _, event := range events {
+		messages = append(messages, s.frame(s.message(event)))
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+
+		err = s.send(messages)
+
+		s.metrics.BulkDuration.Observe(time.Since(start).Seconds())
+
+		if err == nil {
+			break
+		}
+
+		if closeErr := s.disconnect(); closeErr != nil {
+			s.logger.Err(closeErr).Msg("close syslog connection")
+		}
+
+		if attempt >= dictionary.SyslogRetries || s.cfg.Transport != dictionary.SyslogTransportTCP {
+			s.logger.Err(err).Int("num", len(events)).Msg("send to syslog")
+
+			s.metrics.BatchesSent.WithLabelValues("error").Inc()
+			s.metrics.DroppedEvents.Add(float64(len(events)))
+
+			return err
+		}
+
+		s.metrics.Retries.Inc()
+
+		s.logger.Warn().Err(err).Int("attempt", attempt+1).Msg("send to syslog, resending over a new connection")
+	}
+
+	s.metrics.BatchesSent.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+// message formats the event as an rfc5424 message with meta in the structured data or as an rfc3164 one.
+func (s *Syslog) message(event *entity.Event) []byte {
+	pri := s.cfg.Facility*8 + s.cfg.Severity
+
+	hostname := expandTemplate(s.cfg.Hostname, event.Meta)
+	if hostname == "" {
+		hostname = s.hostname
+	}
+
+	appName := expandTemplate(s.cfg.AppName, event.Meta)
+
+	b := make([]byte, 0, len(event.Message)+256)
+
+	b = append(b, '<')
+	b = strconv.AppendInt(b, int64(pri), 10)
+	b = append(b, '>')
+
+	if s.cfg.Format == dictionary.SyslogFormatRFC3164 {
+		b = event.Time.AppendFormat(b, time.Stamp)
+		b = append(b, ' ')
+		b = append(b, syslogHeaderField(hostname, dictionary.SyslogMaxHostname)...)
+		b = append(b, ' ')
+		b = append(b, syslogTag(appName)...)
+		b = append(b, ": "...)
+
+		return append(b, event.Message...)
+	}
+
+	b = append(b, "1 "...)
+	b = event.Time.UTC().AppendFormat(b, syslogRFC5424Time)
+	b = append(b, ' ')
+	b = append(b, syslogHeaderField(hostname, dictionary.SyslogMaxHostname)...)
+	b = append(b, ' ')
+	b = append(b, syslogHeaderField(appName, dictionary.SyslogMaxAppName)...)
+	b = append(b, " - - "...)
+	b = s.appendStructuredData(b, event.Meta)
+	b = append(b, ' ')
+
+	return append(b, event.Message...)
+}
+
+// appendStructuredData appends an element with non-empty meta fields as params, the nil value without them.
+func (s *Syslog) appendStructuredData(b []byte, meta *entity.Meta) []byte {
+	params := [][2]string{
+		{dictionary.FieldNamespace, meta.Namespace},
+		{dictionary.FieldPodName, meta.PodName},
+		{dictionary.FieldPodID, meta.PodID},
+		{dictionary.FieldContainerName, meta.ContainerName},
+		{dictionary.FieldPath, meta.Path},
+	}
+
+	start := len(b)
+
+	b = append(b, '[')
+	b = append(b, s.cfg.SDID...)
+
+	empty := true
+
+	for _, param := range params {
+		if param[1] == "" {
+			continue
+		}
+
+		empty = false
+
+		b = append(b, ' ')
+		b = append(b, param[0]...)
+		b = append(b, `="`...)
+
+		for i := 0; i < len(param[1]); i++ {
+			if c := param[1][i]; c == '"' || c == '\\' || c == ']' {
+				b = append(b, '\\')
+			}
+
+			b = append(b, param[1][i])
+		}
+
+		b = append(b, '"')
+	}
+
+	if empty {
+		return append(b[:start], dictionary.SyslogNilValue...)
+	}
+
+	return append(b, ']')
+}
+
+// frame prefixes tcp messages with their length or terminates them with a newline.
+func (s *Syslog) frame(message []byte) []byte {
+	if s.cfg.Transport != dictionary.SyslogTransportTCP {
+		return message
+	}
+
+	if s.cfg.Framing == dictionary.SyslogFramingNewline {
+		return append(message, '\n')
+	}
+
+	b := make([]byte, 0, len(message)+8)
+
+	b = strconv.AppendInt(b, int64(len(message)), 10)
+	b = append(b, ' ')
+
+	return append(b, message...)
+}
+
+// send writes a datagram per message over udp and the whole batch over tcp.
+func (s *Syslog) send(messages [][]byte) error {
+	if s.conn != nil && s.cfg.Transport == dictionary.SyslogTransportTCP && !s.alive() {
+		s.logger.Info().Str("address", s.cfg.Address).Msg("syslog connection closed by server, reconnecting")
+
+		if err := s.disconnect(); err != nil {
+			s.logger.Err(err).Msg("close syslog connection")
+		}
+	}
+
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	if err := s.conn.SetWriteDeadline(time.Now().Add(time.Duration(s.cfg.Timeout) * time.Millisecond)); err != nil {
+		return err
+	}
+
+	if s.cfg.Transport != dictionary.SyslogTransportTCP {
+		for _, message := range messages {
+			if _, err := s.conn.Write(message); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	var body []byte
+
+	for _, message := range messages {
+		body = append(body, message...)
+	}
+
+	_, err := s.conn.Write(body)
+
+	return err
+}
+
+// alive reads the connection for a millisecond, servers never write to it, so anything but a timeout means
+// the connection is closed or broken. A deadline in the past would time out without reading.
+func (s *Syslog) alive() bool {
+	if err := s.conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+
+	var buf [1]byte
+
+	_, err := s.conn.Read(buf[:])
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (s *Syslog) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	dialer := &net.Dialer{Timeout: time.Duration(s.cfg.Timeout) * time.Millisecond}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	switch {
+	case s.cfg.Transport == dictionary.SyslogTransportUDP:
+		conn, err = dialer.Dial("udp", s.cfg.Address)
+	case s.cfg.TLS:
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.cfg.Address, s.tlsConfig)
+	default:
+		conn, err = dialer.Dial("tcp", s.cfg.Address)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+
+	return nil
+}
+
+func (s *Syslog) disconnect() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+
+	s.conn = nil
+
+	return err
+}
+
+// syslogHeaderField replaces characters outside printable ascii with underscores and truncates the value,
+// empty values are the nil value.
+func syslogHeaderField(value string, maxLen int) string {
+	if value == "" {
+		return dictionary.SyslogNilValue
+	}
+
+	b := []byte(value[:min(len(value), maxLen)])
+
+	for i, c := range b {
+		if c < '!' || c > '~' {
+			b[i] = '_'
+		}
+	}
+
+	return string(b)
+}
+
+// syslogTag keeps alphanumeric characters of the rfc3164 tag up to its max length.
+func syslogTag(appName string) string {
+	tag := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+
+		return -1
+	}, appName)
+
+	return tag[:min(len(tag), dictionary.SyslogMaxTag)]
+}
@@ -0,0 +1,307 @@
+package service
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/conf"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// fakeSyslog receives messages over the transport and splits tcp streams by the framing. With closeAfter
+// it closes every tcp connection after reading that many messages.
+type fakeSyslog struct {
+	address    string
+	framing    string
+	closeAfter int
+	mx         sync.Mutex
+	conns      int
+	messages   []string
+}
+
+func newFakeSyslog(t *testing.T, transport, framing string, useTLS bool, closeAfter int) *fakeSyslog {
+	t.Helper()
+
+	server := &fakeSyslog{framing: framing, closeAfter: closeAfter}
+
+	if transport == dictionary.SyslogTransportUDP {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+
+		t.Cleanup(func() { _ = conn.Close() })
+
+		server.address = conn.LocalAddr().String()
+
+		go func() {
+			buf := make([]byte, 65536)
+
+			for {
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+
+				server.add(string(buf[:n]))
+			}
+		}()
+
+		return server
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	if useTLS {
+		certServer := httptest.NewTLSServer(http.NotFoundHandler())
+		certServer.Close()
+
+		listener = tls.NewListener(listener, &tls.Config{Certificates: certServer.TLS.Certificates})
+	}
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	server.address = listener.Addr().String()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			server.mx.Lock()
+			server.conns++
+			server.mx.Unlock()
+
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s *fakeSyslog) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	for read := 0; s.closeAfter == 0 || read < s.closeAfter; read++ {
+		var message string
+
+		if s.framing == dictionary.SyslogFramingNewline {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			message = strings.TrimSuffix(line, "\n")
+		} else {
+			size, err := reader.ReadString(' ')
+			if err != nil {
+				return
+			}
+
+			n, _ := strconv.Atoi(strings.TrimSuffix(size, " "))
+			buf := make([]byte, n)
+
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				return
+			}
+
+			message = string(buf)
+		}
+
+		s.add(message)
+	}
+}
+
+func (s *fakeSyslog) add(message string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.messages = append(s.messages, message)
+}
+
+func (s *fakeSyslog) received(n int) []string {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.mx.Lock()
+		done := len(s.messages) >= n
+		s.mx.Unlock()
+
+		if done {
+			break
+		}
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return append([]string(nil), s.messages...)
+}
+
+func TestSyslog_SendEvents(t *testing.T) {
+	t.Parallel()
+
+	readAt := time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC)
+
+	events := []*entity.Event{
+		{
+			Message: "audit: user \"admin\" logged in",
+			Time:    readAt,
+			Meta: &entity.Meta{
+				Path:          "/var/log/pods/auth_api-0_abc/app/0.log",
+				Namespace:     "auth",
+				PodName:       "api-0",
+				PodID:         "abc",
+				ContainerName: "app",
+			},
+		},
+		{Message: "no meta", Time: readAt, Meta: &entity.Meta{}},
+	}
+
+	rfc5424 := []string{
+		`<86>1 2024-01-02T03:04:05.123456Z api-0 app - - [meta@32473 namespace="auth" pod_name="api-0" ` +
+			`pod_id="abc" container_name="app" path="/var/log/pods/auth_api-0_abc/app/0.log"] audit: user "admin" logged in`,
+		`<86>1 2024-01-02T03:04:05.123456Z node-1 - - - - no meta`,
+	}
+
+	tests := []struct {
+		name      string
+		transport string
+		format    string
+		framing   string
+		tls       bool
+		want      []string
+	}{
+		{
+			name:      "udp",
+			transport: dictionary.SyslogTransportUDP,
+			format:    dictionary.SyslogFormatRFC5424,
+			framing:   dictionary.SyslogFramingOctetCounting,
+			want:      rfc5424,
+		},
+		{
+			name:      "tcp octet counting",
+			transport: dictionary.SyslogTransportTCP,
+			format:    dictionary.SyslogFormatRFC5424,
+			framing:   dictionary.SyslogFramingOctetCounting,
+			want:      rfc5424,
+		},
+		{
+			name:      "tls newline rfc3164",
+			transport: dictionary.SyslogTransportTCP,
+			format:    dictionary.SyslogFormatRFC3164,
+			framing:   dictionary.SyslogFramingNewline,
+			tls:       true,
+			want: []string{
+				`<86>Jan  2 03:04:05 api-0 app: audit: user "admin" logged in`,
+				`<86>Jan  2 03:04:05 node-1 : no meta`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger := zerolog.Nop()
+			server := newFakeSyslog(t, tt.transport, tt.framing, tt.tls, 0)
+
+			syslog, err := NewSyslog(conf.Syslog{
+				Transport:          tt.transport,
+				Address:            server.address,
+				Format:             tt.format,
+				Framing:            tt.framing,
+				Facility:           10,
+				Severity:           6,
+				AppName:            "{container}",
+				Hostname:           "{pod}",
+				SDID:               "meta@32473",
+				TLS:                tt.tls,
+				InsecureSkipVerify: true,
+				Timeout:            1000,
+			}, NewMetrics().ForOutput("test"), &logger)
+			if err != nil {
+				t.Fatalf("NewSyslog() error = %v", err)
+			}
+
+			syslog.hostname = "node-1"
+
+			defer syslog.Close()
+
+			if err := syslog.SendEvents(events); err != nil {
+				t.Fatalf("SendEvents() error = %v", err)
+			}
+
+			if got := server.received(len(tt.want)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("received %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyslog_SendEvents_Reconnect(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	server := newFakeSyslog(t, dictionary.SyslogTransportTCP, dictionary.SyslogFramingOctetCounting, false, 1)
+
+	syslog, err := NewSyslog(conf.Syslog{
+		Transport: dictionary.SyslogTransportTCP,
+		Address:   server.address,
+		Format:    dictionary.SyslogFormatRFC5424,
+		Framing:   dictionary.SyslogFramingOctetCounting,
+		Facility:  1,
+		Severity:  6,
+		SDID:      "meta@32473",
+		Timeout:   1000,
+	}, NewMetrics().ForOutput("test"), &logger)
+	if err != nil {
+		t.Fatalf("NewSyslog() error = %v", err)
+	}
+
+	defer syslog.Close()
+
+	for i := 0; i < 3; i++ {
+		event := &entity.Event{Message: strconv.Itoa(i), Time: time.Now(), Meta: &entity.Meta{}}
+
+		if err := syslog.SendEvents([]*entity.Event{event}); err != nil {
+			t.Fatalf("SendEvents() error = %v", err)
+		}
+
+		// the server closes the connection after the message
+		server.received(i + 1)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	got := server.received(3)
+
+	if len(got) != 3 {
+		t.Fatalf("received %d messages, want 3", len(got))
+	}
+
+	server.mx.Lock()
+	defer server.mx.Unlock()
+
+	if server.conns != 3 {
+		t.Errorf("server accepted %d connections, want 3", server.conns)
+	}
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/mailru/easyjson"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+type TapFilter struct {
+	Namespace string
+	Pod       string
+	Container string
+}
+
+func (f TapFilter) match(meta *entity.Meta) bool {
+	return (f.Namespace == "" || f.Namespace == meta.Namespace) &&
+		(f.Pod == "" || f.Pod == meta.PodName) &&
+		(f.Container == "" || f.Container == meta.ContainerName)
+}
+
+type TapSubscriber struct {
+	filter TapFilter
+	events chan []byte
+}
+
+func (s *TapSubscriber) Events() <-chan []byte {
+	return s.events
+}
+
+// Tap streams documents leaving the pipeline to subscribers, slow subscribers lose events
+// instead of blocking senders.
+type Tap struct {
+	mx          sync.RWMutex
+	subscribers map[*TapSubscriber]struct{}
+	active      atomic.Int32
+	metrics     *Metrics
+	logger      *zerolog.Logger
+}
+
+func NewTap(metrics *Metrics, logger *zerolog.Logger) *Tap {
+	return &Tap{
+		subscribers: make(map[*TapSubscriber]struct{}),
+		metrics:     metrics,
+		logger:      logger,
+	}
+}
+
+func (s *Tap) Subscribe(filter TapFilter) *TapSubscriber {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	subscriber := &TapSubscriber{
+		filter: filter,
+		events: make(chan []byte, dictionary.TapBufferSize),
+	}
+
+	s.subscribers[subscriber] = struct{}{}
+	s.active.Add(1)
+
+	return subscriber
+}
+
+func (s *Tap) Unsubscribe(subscriber *TapSubscriber) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, ok := s.subscribers[subscriber]; ok {
+		delete(s.subscribers, subscriber)
+		s.active.Add(-1)
+	}
+}
+
+// Publish sends documents of the output to matching subscribers, it costs nothing while nobody is tapping.
+func (s *Tap) Publish(output, index string, events []*entity.Event) {
+	if s.active.Load() == 0 {
+		return
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	for _, event := range events {
+		var marshalled []byte
+
+		for subscriber := range s.subscribers {
+			if !subscriber.filter.match(event.Meta) {
+				continue
+			}
+
+			if marshalled == nil {
+				var err error
+
+				marshalled, err = easyjson.Marshal(&entity.TapEvent{
+					Output:   output,
+					Index:    index,
+					Document: entity.NewFieldsBody(event),
+				})
+				if err != nil {
+					s.logger.Err(err).Msg("marshal tap event")
+
+					return
+				}
+			}
+
+			select {
+			case subscriber.events <- marshalled:
+			default:
+				s.metrics.TapDropped.Inc()
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+func TestTap_Publish(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.Nop()
+	metrics := NewMetrics()
+	tap := NewTap(metrics, &logger)
+
+	matching := tap.Subscribe(TapFilter{Namespace: "test"})
+	other := tap.Subscribe(TapFilter{Namespace: "other"})
+
+	events := testEvents()
+
+	// slow subscriber never reads, publishing must not block
+	for i := 0; i < dictionary.TapBufferSize+10; i++ {
+		tap.Publish(dictionary.OutputES, "logfowd", events)
+	}
+
+	if got := len(matching.Events()); got != dictionary.TapBufferSize {
+		t.Errorf("matching subscriber got %d events, want %d", got, dictionary.TapBufferSize)
+	}
+
+	if got := len(other.Events()); got != 0 {
+		t.Errorf("filtered subscriber got %d events, want 0", got)
+	}
+
+	if got := testutil.ToFloat64(metrics.TapDropped); got != 10 {
+		t.Errorf("dropped = %v, want 10", got)
+	}
+
+	tap.Unsubscribe(matching)
+	tap.Unsubscribe(other)
+
+	if tap.active.Load() != 0 {
+		t.Error("tap is still active after unsubscribe")
+	}
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"github.com/soulgarden/logfowd/dictionary"
+	"github.com/soulgarden/logfowd/entity"
+)
+
+// expandTemplate replaces meta placeholders like {namespace} or {path} of the template with values of the event meta.
+func expandTemplate(template string, meta *entity.Meta) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+
+	return strings.NewReplacer(
+		dictionary.TemplateNamespace, meta.Namespace,
+		dictionary.TemplatePod, meta.PodName,
+		dictionary.TemplatePodID, meta.PodID,
+		dictionary.TemplateContainer, meta.ContainerName,
+		dictionary.TemplatePath, meta.Path,
+	).Replace(template)
+}
+
+// eventField returns the value of the event field named like fields of es documents, the timestamp is formatted
+// as RFC 3339 with nanoseconds.
+func eventField(event *entity.Event, field string) string {
+	switch field {
+	case dictionary.FieldMessage:
+		return event.Message
+	case dictionary.FieldTimestamp:
+		return event.Time.Format(time.RFC3339Nano)
+	case dictionary.FieldNamespace:
+		return event.Namespace
+	case dictionary.FieldPodName:
+		return event.PodName
+	case dictionary.FieldPodID:
+		return event.PodID
+	case dictionary.FieldContainerName:
+		return event.ContainerName
+	case dictionary.FieldPath:
+		return event.Path
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+// newTLSConfig verifies servers against system roots or, with caFile, against its pem certificates, with certFile
+// and keyFile the client presents their pem key pair.
+func newTLSConfig(insecureSkipVerify bool, caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: insecureSkipVerify} // nolint: gosec
+
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%w: %s", dictionary.ErrNoCertificates, caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/soulgarden/logfowd/dictionary"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	certServer.Close()
+
+	key, err := x509.MarshalPKCS8PrivateKey(certServer.TLS.Certificates[0].PrivateKey)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+
+	files := map[string][]byte{
+		"cert.pem":    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certServer.Certificate().Raw}),
+		"key.pem":     pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}),
+		"invalid.pem": []byte("not pem"),
+	}
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certServer.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				_ = tlsConn.Handshake()
+			}
+
+			_ = conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name          string
+		caFile        string
+		certFile      string
+		keyFile       string
+		wantErr       error
+		wantVerified  bool
+		wantClientKey bool
+	}{
+		{name: "system roots"},
+		{name: "ca file", caFile: "cert.pem", wantVerified: true},
+		{name: "missing ca file", caFile: "missing.pem", wantErr: fs.ErrNotExist},
+		{name: "ca file without certificates", caFile: "invalid.pem", wantErr: dictionary.ErrNoCertificates},
+		{name: "client certificate", certFile: "cert.pem", keyFile: "key.pem", wantClientKey: true},
+		{name: "missing key file", certFile: "cert.pem", keyFile: "missing.pem", wantErr: fs.ErrNotExist},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := func(name string) string {
+				if name == "" {
+					return ""
+				}
+
+				return filepath.Join(dir, name)
+			}
+
+			cfg, err := newTLSConfig(false, path(tt.caFile), path(tt.certFile), path(tt.keyFile))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("newTLSConfig() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			if got := len(cfg.Certificates) > 0; got != tt.wantClientKey {
+				t.Errorf("client certificate = %v, want %v", got, tt.wantClientKey)
+			}
+
+			conn, err := tls.Dial("tcp", listener.Addr().String(), cfg)
+			if err == nil {
+				_ = conn.Close()
+			}
+
+			if (err == nil) != tt.wantVerified {
+				t.Errorf("dial server with a self-signed certificate error = %v, want verified %v", err, tt.wantVerified)
+			}
+		})
+	}
+}
@@ -5,7 +5,8 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
-	"regexp"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/soulgarden/logfowd/service/file"
@@ -23,50 +24,59 @@ import (
 )
 
 type Watcher struct {
-	cfg       conf.Config
-	event     chan *entity.Event
-	esEvents  chan []*entity.Event
-	hasEvent  chan struct{}
-	esCli     *Cli
-	k8sRegexp *regexp.Regexp
-	state     *storage.State
-	logger    *zerolog.Logger
+	cfg      conf.Config
+	queues   []*Queue
+	pipeline atomic.Pointer[Pipeline]
+	state    *storage.State
+	metrics  *Metrics
+	health   *Health
+	logger   *zerolog.Logger
 }
 
-func NewWatcher(cfg conf.Config, esCli *Cli, logger *zerolog.Logger) *Watcher {
-	return &Watcher{
-		cfg:       cfg,
-		event:     make(chan *entity.Event, cfg.Storage.Workers*dictionary.SendBatchesNum*dictionary.FlushLogsNumber),
-		esEvents:  make(chan []*entity.Event, cfg.Storage.Workers*dictionary.SendBatchesNum),
-		hasEvent:  make(chan struct{}, cfg.Storage.Workers*dictionary.SendBatchesNum*dictionary.FlushLogsNumber),
-		esCli:     esCli,
-		k8sRegexp: regexp.MustCompile(dictionary.K8sPodsRegexp),
-		state:     storage.NewState(),
-		logger:    logger,
+func NewWatcher(
+	cfg conf.Config,
+	outputs map[string]Output,
+	metrics *Metrics,
+	health *Health,
+	tap *Tap,
+	logger *zerolog.Logger,
+) *Watcher {
+	w := &Watcher{
+		cfg:     cfg,
+		state:   storage.NewState(),
+		metrics: metrics,
+		health:  health,
+		logger:  logger,
 	}
+
+	for _, outputCfg := range cfg.OutputConfigs() {
+		w.queues = append(w.queues, NewQueue(outputCfg, outputs[outputCfg.Name], metrics, health, tap, logger))
+	}
+
+	w.pipeline.Store(NewPipeline(cfg))
+
+	metrics.registerWatcher(w)
+
+	return w
 }
 
 func (s *Watcher) Start(ctx context.Context) {
 	g, ctx := errgroup.WithContext(ctx)
 
-	g.Go(func() error {
-		return s.esSendDispatcher(ctx)
-	})
-
-	for i := 0; i < s.cfg.Storage.Workers; i++ {
-		i := i
-
-		g.Go(func() error {
-			return s.esSender(ctx, i)
-		})
+	for _, queue := range s.queues {
+		queue.Start(ctx, g)
 	}
 
+	defer s.closeOutputs()
+
 	if err := s.syncFiles(ctx, g); err != nil {
 		s.logger.Err(err).Msg("sync files")
 
 		return
 	}
 
+	s.health.SetSynced()
+
 	g.Go(func() error {
 		return s.watch(ctx, g)
 	})
@@ -76,6 +86,25 @@ func (s *Watcher) Start(ctx context.Context) {
 	s.logger.Err(err).Msg("wait goroutines")
 }
 
+// Reload applies routes and settings of outputs and switches queues to the new outputs. Buffered events
+// and file offsets are kept.
+func (s *Watcher) Reload(ctx context.Context, cfg conf.Config, outputs map[string]Output) {
+	s.pipeline.Store(NewPipeline(cfg))
+
+	for i, outputCfg := range cfg.OutputConfigs() {
+		s.queues[i].Reload(ctx, outputCfg, outputs[outputCfg.Name])
+	}
+}
+
+// closeOutputs closes outputs of all queues once senders are stopped.
+func (s *Watcher) closeOutputs() {
+	for _, queue := range s.queues {
+		if err := queue.Close(); err != nil {
+			s.logger.Err(err).Str("output", queue.name).Msg("close output")
+		}
+	}
+}
+
 // nolint: funlen, gocognit, cyclop
 func (s *Watcher) watch(ctx context.Context, g *errgroup.Group) error {
 	s.logger.Debug().Msg("start log files watcher")
@@ -99,8 +128,15 @@ func (s *Watcher) watch(ctx context.Context, g *errgroup.Group) error {
 
 	var oldRenamedPath string
 
+	beat := s.health.Heartbeat(dictionary.ComponentWatcher)
+
+	heartbeat := time.NewTicker(dictionary.HeartbeatInterval)
+	defer heartbeat.Stop()
+
 	for {
 		select {
+		case <-heartbeat.C:
+			beat.Beat()
 		case event, ok := <-watcher.Events:
 			if !ok {
 				s.logger.Err(dictionary.ErrChannelClosed).Msg("watcher events channel closed")
@@ -368,7 +404,7 @@ func (s *Watcher) addFile(path string) (*file.File, error) {
 		return nil, err
 	}
 
-	f.EntityFile.Meta = s.parseK8sMeta(path)
+	f.EntityFile.Meta = s.pipeline.Load().Meta(path)
 
 	s.state.SetFile(path, f)
 
@@ -443,116 +479,6 @@ func (s *Watcher) list(ctx context.Context, g *errgroup.Group, logPath string) e
 	return err
 }
 
-func (s *Watcher) esSendDispatcher(ctx context.Context) error {
-	s.logger.Debug().Msg("start es send dispatcher")
-
-	defer s.logger.Debug().Msg("stop es send dispatcher")
-
-	for {
-		select {
-		case <-time.After(time.Duration(s.cfg.Storage.FlushInterval) * time.Millisecond):
-			s.sendToESByTimer()
-		case <-s.hasEvent:
-			s.sendToESByLimit()
-		case <-ctx.Done():
-			s.sendToESRemainingEvents()
-
-			return nil
-		}
-	}
-}
-
-func (s *Watcher) esSender(ctx context.Context, i int) error {
-	s.logger.Debug().Int("worker", i).Msgf("start es sender %d", i)
-
-	defer s.logger.Debug().Int("worker", i).Msgf("stop es sender %d", i)
-
-	for {
-		select {
-		case events := <-s.esEvents:
-			err := s.esCli.SendEvents(events)
-
-			s.logger.Err(err).
-				Int("worker", i).
-				Int("num", len(events)).
-				Msg("send events to es")
-
-			if err != nil {
-				return err
-			}
-		case <-ctx.Done():
-			for len(s.esEvents) > 0 {
-				events := <-s.esEvents
-
-				err := s.esCli.SendEvents(events)
-
-				s.logger.Err(err).
-					Int("worker", i).
-					Int("num", len(events)).
-					Msg("send remaining event to es before shutting down")
-			}
-
-			return nil
-		}
-	}
-}
-
-func (s *Watcher) sendToESByLimit() {
-	if len(s.event) < dictionary.FlushLogsNumber {
-		return
-	}
-
-	events := make([]*entity.Event, dictionary.FlushLogsNumber)
-
-	for i := 0; i < dictionary.FlushLogsNumber; i++ {
-		events[i] = <-s.event
-	}
-
-	s.esEvents <- events
-
-	s.logger.Debug().
-		Int("num", len(events)).
-		Int("num remaining", len(s.event)).
-		Msg("flushed event to es senders by event number limit")
-}
-
-func (s *Watcher) sendToESByTimer() {
-	num := len(s.event)
-
-	if num == 0 {
-		return
-	}
-
-	events := make([]*entity.Event, num)
-
-	for i := 0; i < num; i++ {
-		events[i] = <-s.event
-	}
-
-	s.esEvents <- events
-
-	s.logger.Info().
-		Int("num", len(events)).
-		Int("num remaining", len(s.event)).
-		Msg("flushed event to es senders by timer")
-}
-
-func (s *Watcher) sendToESRemainingEvents() {
-	if len(s.event) == 0 {
-		return
-	}
-
-	events := make([]*entity.Event, 0)
-
-	for len(s.event) > 0 {
-		events = append(events, <-s.event)
-	}
-
-	s.esEvents <- events
-
-	s.logger.Warn().Int("num", len(events)).Msg("send remaining event to es senders before shutting down")
-}
-
 func (s *Watcher) listenLine(ctx context.Context, f *file.File) error {
 	s.logger.Debug().Str("path", f.EntityFile.Path).Msg("start listen new lines")
 
@@ -560,6 +486,11 @@ func (s *Watcher) listenLine(ctx context.Context, f *file.File) error {
 
 	fileState := s.state.GetFile(f.EntityFile.Path)
 
+	linesRead := s.metrics.LinesRead.WithLabelValues(
+		fileState.EntityFile.Meta.Namespace,
+		fileState.EntityFile.Meta.ContainerName,
+	)
+
 	for {
 		select {
 		case line, ok := <-f.ListenLine():
@@ -569,14 +500,16 @@ func (s *Watcher) listenLine(ctx context.Context, f *file.File) error {
 				return nil
 			}
 
-			s.addLogToBuffer(entity.NewEvent(line, fileState.EntityFile.Meta))
+			linesRead.Inc()
+			s.route(line, fileState.EntityFile.Meta)
 			s.state.SetFile(f.EntityFile.Path, f)
 
 		case <-ctx.Done():
 			for len(f.ListenLine()) > 0 {
 				line := <-f.ListenLine()
 
-				s.addLogToBuffer(entity.NewEvent(line, fileState.EntityFile.Meta))
+				linesRead.Inc()
+				s.route(line, fileState.EntityFile.Meta)
 				s.state.SetFile(f.EntityFile.Path, f)
 			}
 
@@ -585,33 +518,57 @@ func (s *Watcher) listenLine(ctx context.Context, f *file.File) error {
 	}
 }
 
-func (s *Watcher) addLogToBuffer(event *entity.Event) {
-	if len(s.event) == cap(s.event) {
-		s.logger.
-			Err(dictionary.ErrChannelOverflowed).
-			Msg("logs channel overflowed, consider increasing es workers")
-	}
+// route turns the line into an event and pushes it to queues of outputs it is routed to.
+func (s *Watcher) route(line *entity.Line, meta *entity.Meta) {
+	pipeline := s.pipeline.Load()
 
-	s.event <- event
+	event := pipeline.Event(line, meta)
 
-	if len(s.hasEvent) != cap(s.hasEvent) {
-		s.hasEvent <- struct{}{}
+	for _, i := range pipeline.Routes(event.Meta) {
+		s.queues[i].Push(event)
 	}
 }
 
-func (s *Watcher) parseK8sMeta(path string) *entity.Meta {
-	matches := s.k8sRegexp.FindAllStringSubmatch(path, -1)
+// Files returns status of tracked files sorted by path, empty namespace or pod matches any.
+func (s *Watcher) Files(namespace, pod string) entity.FileStatuses {
+	files := s.state.Files()
 
-	if matches == nil {
-		return &entity.Meta{}
-	}
+	statuses := make(entity.FileStatuses, 0, len(files))
+
+	for _, f := range files {
+		snapshot := f.Snapshot()
+		meta := snapshot.Meta
+
+		if (namespace != "" && meta.Namespace != namespace) || (pod != "" && meta.PodName != pod) {
+			continue
+		}
+
+		status := &entity.FileStatus{
+			Path:          snapshot.Path,
+			Inode:         snapshot.Inode,
+			Namespace:     meta.Namespace,
+			PodName:       meta.PodName,
+			PodID:         meta.PodID,
+			ContainerName: meta.ContainerName,
+			Offset:        snapshot.Offset,
+			Size:          snapshot.Size,
+			ReadAt:        snapshot.ReadAt,
+		}
 
-	return &entity.Meta{
-		PodName:       matches[0][2],
-		Namespace:     matches[0][1],
-		ContainerName: matches[0][4],
-		PodID:         matches[0][3],
+		if info, err := os.Stat(status.Path); err == nil {
+			status.Size = info.Size()
+		}
+
+		if status.Size > status.Offset {
+			status.BytesBehind = status.Size - status.Offset
+		}
+
+		statuses = append(statuses, status)
 	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Path < statuses[j].Path })
+
+	return statuses
 }
 
 func (s *Watcher) isLogFile(path string) bool {
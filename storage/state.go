@@ -31,7 +31,7 @@ func (s *State) RenameFile(oldPath, newPath string) {
 	f := s.files[oldPath]
 	delete(s.files, oldPath)
 
-	f.EntityFile.Path = newPath
+	f.SetPath(newPath)
 
 	s.files[newPath] = f
 }
@@ -60,3 +60,16 @@ func (s *State) IsFileExists(path string) bool {
 
 	return false
 }
+
+func (s *State) Files() []*file.File {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	files := make([]*file.File, 0, len(s.files))
+
+	for _, f := range s.files {
+		files = append(files, f)
+	}
+
+	return files
+}